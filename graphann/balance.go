@@ -0,0 +1,243 @@
+package graphann
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// in-degree balancing
+// the second pass of the construction keeps the reverse edges at random and fills the short rows with random
+// vertices, so some vertices end up with few or no in-edges and are hard to reach. BalanceInDegree repairs them
+// deterministically: a vertex below the target is added to the rows of its nearest vertices, where the alpha rule of
+// robustPrune does not occlude it, in place of a random fill edge or of a neighbor that has in-edges to spare.
+// The neighbors the new edge occludes are pruned as robustPrune would do, and their slots filled with random vertices.
+
+type InDegreeStats struct {
+	Min        int
+	Mean       float64
+	Max        int
+	RandomFill int // the random fill edges in the graph
+	Repaired   int // the edges added by the balancing
+	Pruned     int // the neighbors pruned because a repaired edge occludes them
+	Below      int // the vertices still below the target
+}
+
+func (s InDegreeStats) String() string {
+	return fmt.Sprintf("in-degree min/mean/max: %d/%.2f/%d, random fill edges: %d, repaired edges: %d, pruned edges: %d, vertices below the target: %d",
+		s.Min, s.Mean, s.Max, s.RandomFill, s.Repaired, s.Pruned, s.Below)
+}
+
+func inDegrees(graph [][]int) []int {
+	in := make([]int, len(graph))
+	for _, row := range graph {
+		for _, v := range row {
+			in[v]++
+		}
+	}
+	return in
+}
+
+func inDegreeStats(in []int, fill []int) InDegreeStats {
+	s := InDegreeStats{Min: len(in)}
+	sum := 0
+	for _, d := range in {
+		s.Min = min(s.Min, d)
+		s.Max = max(s.Max, d)
+		sum += d
+	}
+	s.Mean = float64(sum) / float64(max(len(in), 1))
+	for _, f := range fill {
+		s.RandomFill += f
+	}
+	return s
+}
+
+// the vertices that could point to v, nearest first: its neighbors and their neighbors. The random fill edges
+// of v are skipped, they say nothing about its neighborhood
+func repairCandidates(vectors [][]float32, graph [][]int, fill []int, v int, limit int) []int {
+	seen := map[int]bool{v: true}
+	candidates := make([]IdWithDist, 0)
+	add := func(u int) {
+		if !seen[u] {
+			seen[u] = true
+			candidates = append(candidates, IdWithDist{id: u, dist: L2Dist(vectors[u], vectors[v])})
+		}
+	}
+	near := graph[v][:len(graph[v])-fill[v]]
+	if len(near) == 0 {
+		near = graph[v]
+	}
+	for _, u := range near {
+		add(u)
+	}
+	for _, u := range near {
+		for _, w := range graph[u][:len(graph[u])-fill[u]] {
+			add(w)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist != candidates[j].dist {
+			return candidates[i].dist < candidates[j].dist
+		}
+		return candidates[i].id < candidates[j].id
+	})
+	ret := make([]int, 0, limit)
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		ret = append(ret, candidates[i].id)
+	}
+	return ret
+}
+
+// the position in the row of u that v can take, or -1, and the positions of the other neighbors that have to leave
+// the row. v must not be occluded by a nearer neighbor of u under the alpha rule, and every neighbor v occludes is
+// pruned, so it must have in-edges to spare. v takes the place of the farthest neighbor it occludes, otherwise of the
+// random fill edge to the vertex with the most in-edges, otherwise of the farthest neighbor farther than v. Only
+// vertices above the target lose an in-edge
+func repairSlot(vectors [][]float32, labels [][]uint32, row []int, fill int, u int, v int, in []int, minIn int, alpha float32) (int, []int) {
+	dist_uv := L2Dist(vectors[u], vectors[v])
+	kept := len(row) - fill
+	occluded := make([]int, 0)
+	occludedDist := make([]float32, 0)
+	for i, w := range row[:kept] {
+		if w == v {
+			return -1, nil
+		}
+		dist_uw := L2Dist(vectors[u], vectors[w])
+		if dist_uw < dist_uv && L2Dist(vectors[w], vectors[v])*alpha < dist_uv && labelsCover(labels, w, u, v) {
+			return -1, nil
+		}
+		if dist_uw > dist_uv && L2Dist(vectors[v], vectors[w])*alpha < dist_uw && labelsCover(labels, v, u, w) {
+			if in[w] <= minIn {
+				return -1, nil
+			}
+			occluded = append(occluded, i)
+			occludedDist = append(occludedDist, dist_uw)
+		}
+	}
+	for _, w := range row[kept:] {
+		if w == v {
+			return -1, nil
+		}
+	}
+
+	if len(occluded) > 0 {
+		farthest := 0
+		for i := range occluded {
+			if occludedDist[i] > occludedDist[farthest] {
+				farthest = i
+			}
+		}
+		slot := occluded[farthest]
+		return slot, append(occluded[:farthest], occluded[farthest+1:]...)
+	}
+
+	best := -1
+	for i := kept; i < len(row); i++ {
+		if in[row[i]] > minIn && (best < 0 || in[row[i]] > in[row[best]]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return best, nil
+	}
+
+	farthest := -1
+	farthestDist := dist_uv
+	for i, w := range row[:kept] {
+		if in[w] <= minIn {
+			continue
+		}
+		if dist_uw := L2Dist(vectors[u], vectors[w]); dist_uw > farthestDist {
+			farthest, farthestDist = i, dist_uw
+		}
+	}
+	return farthest, nil
+}
+
+// remove the neighbors at the given positions of the pruned part of the row of u, and fill the row back to its length
+// with random vertices, at the end of the row like the fill of the second pass. It returns the new row
+func pruneAndFill(row []int, fill int, u int, positions []int, in []int, r *rand.Rand) []int {
+	kept := len(row) - fill
+	drop := make(map[int]bool, len(positions))
+	for _, i := range positions {
+		drop[i] = true
+	}
+	ret := make([]int, 0, len(row))
+	for i, w := range row[:kept] {
+		if drop[i] {
+			in[w]--
+			continue
+		}
+		ret = append(ret, w)
+	}
+	for len(ret) < kept {
+		v := r.Intn(len(in))
+		if v == u || contains(ret, v) || contains(row[kept:], v) {
+			continue
+		}
+		in[v]++
+		ret = append(ret, v)
+	}
+	return append(ret, row[kept:]...)
+}
+
+// raise the in-degree of every vertex to minIn where the alpha rule allows it, in place. fill[u] is the number of
+// random fill edges at the end of the row of u (nil: none), and is updated. The vertices with the fewest in-edges
+// are repaired first, in a fixed order, and the random fill of the pruned slots comes from GraphBuildSeed, so the
+// result does not depend on the threads
+func BalanceInDegree(vectors [][]float32, labels [][]uint32, graph [][]int, fill []int, minIn int, alpha float32) InDegreeStats {
+	n := len(graph)
+	if fill == nil {
+		fill = make([]int, n)
+	}
+	in := inDegrees(graph)
+
+	low := make([]int, 0)
+	for v := 0; v < n; v++ {
+		if in[v] < minIn {
+			low = append(low, v)
+		}
+	}
+	sort.SliceStable(low, func(i, j int) bool { return in[low[i]] < in[low[j]] })
+
+	r := rand.New(rand.NewSource(GraphBuildSeed()))
+	repaired, pruned := 0, 0
+	for _, v := range low {
+		for _, u := range repairCandidates(vectors, graph, fill, v, max(4*minIn, 2*len(graph[v]))) {
+			if in[v] >= minIn {
+				break
+			}
+			slot, evicted := repairSlot(vectors, labels, graph[u], fill[u], u, v, in, minIn, alpha)
+			if slot < 0 {
+				continue
+			}
+			kept := len(graph[u]) - fill[u]
+			if slot >= kept {
+				// the fill edges stay at the end of the row
+				graph[u][slot], graph[u][kept] = graph[u][kept], graph[u][slot]
+				slot = kept
+				fill[u]--
+			}
+			in[graph[u][slot]]--
+			graph[u][slot] = v
+			in[v]++
+			repaired++
+			if len(evicted) > 0 {
+				graph[u] = pruneAndFill(graph[u], fill[u], u, evicted, in, r)
+				fill[u] += len(evicted)
+				pruned += len(evicted)
+			}
+		}
+	}
+
+	s := inDegreeStats(in, fill)
+	s.Repaired = repaired
+	s.Pruned = pruned
+	for _, d := range in {
+		if d < minIn {
+			s.Below++
+		}
+	}
+	return s
+}
@@ -0,0 +1,115 @@
+package graphann
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBalanceInDegree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	n, m, minIn := 300, 8, 3
+	vectors := genTestVectors(r, n, 8)
+	graph, fill := genTestGraph(r, vectors, m, m-2)
+
+	copyGraph := func() [][]int {
+		ret := make([][]int, n)
+		for i := range graph {
+			ret[i] = append([]int(nil), graph[i]...)
+		}
+		return ret
+	}
+	balanced := copyGraph()
+	balancedFill := append([]int(nil), fill...)
+	before := inDegreeStats(inDegrees(graph), fill)
+	s := BalanceInDegree(vectors, nil, balanced, balancedFill, minIn, DefaultPruneAlpha)
+
+	below := 0
+	for _, d := range inDegrees(graph) {
+		if d < minIn {
+			below++
+		}
+	}
+	if below == 0 {
+		t.Fatalf("the test graph should have vertices below the target")
+	}
+	if s.Repaired == 0 || s.Below >= below {
+		t.Fatalf("the balancing should repair vertices, %d below before, got %v", below, s)
+	}
+	if s.Min < before.Min || s.RandomFill >= before.RandomFill {
+		t.Fatalf("the balancing should replace random fill edges, before %v, after %v", before, s)
+	}
+	for u, row := range balanced {
+		if len(row) != m {
+			t.Fatalf("row %d has %d neighbors, expected %d", u, len(row), m)
+		}
+		for j, v := range row {
+			if v == u || contains(row[:j], v) {
+				t.Fatalf("row %d has a self or duplicate edge: %v", u, row)
+			}
+		}
+	}
+
+	// the repaired edges respect the alpha rule in both directions: no nearer kept neighbor occludes them, and they
+	// occlude no farther kept neighbor
+	occludes := func(vectors [][]float32, u, w, v int) bool {
+		return L2Dist(vectors[u], vectors[w]) < L2Dist(vectors[u], vectors[v]) &&
+			L2Dist(vectors[w], vectors[v])*DefaultPruneAlpha < L2Dist(vectors[u], vectors[v])
+	}
+	for u, row := range balanced {
+		kept := row[:m-balancedFill[u]]
+		for _, v := range kept {
+			if contains(graph[u], v) {
+				continue
+			}
+			for _, w := range kept {
+				if w != v && (occludes(vectors, u, w, v) || occludes(vectors, u, v, w)) {
+					t.Fatalf("the repaired edge %d -> %d and the kept edge %d -> %d break the alpha rule", u, v, u, w)
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, f := range balancedFill {
+		total += f
+	}
+	if total != s.RandomFill {
+		t.Fatalf("the fill counts say %d random edges, the stats %d", total, s.RandomFill)
+	}
+
+	// deterministic
+	again := copyGraph()
+	BalanceInDegree(vectors, nil, again, append([]int(nil), fill...), minIn, DefaultPruneAlpha)
+	for u := range again {
+		for j := range again[u] {
+			if again[u][j] != balanced[u][j] {
+				t.Fatalf("two runs differ at row %d: %v and %v", u, again[u], balanced[u])
+			}
+		}
+	}
+
+	// v occludes the two farther neighbors 2 and 3 of u: it takes the place of the farthest one, the other is pruned
+	// and replaced by a random fill edge. The nearer neighbor 4 does not occlude v and stays
+	point := func(x, y float32) []float32 { return []float32{x, y, 0, 0, 0, 0, 0, 0} }
+	small := [][]float32{point(0, 0), point(1, 0), point(2, 0), point(2, 0.1), point(0, -0.9), point(-3, 0), point(0, 3)}
+	u, v := 0, 1
+	in := []int{5, 0, 5, 5, 5, 5, 5}
+	row := []int{4, 2, 3, 5}
+	slot, evicted := repairSlot(small, nil, row, 1, u, v, in, minIn, DefaultPruneAlpha)
+	if slot != 2 || len(evicted) != 1 || evicted[0] != 1 {
+		t.Fatalf("expected v in slot 2 and the neighbor at 1 pruned, got slot %d, pruned %v", slot, evicted)
+	}
+	row[slot] = v
+	row = pruneAndFill(row, 1, u, evicted, in, rand.New(rand.NewSource(1)))
+	if len(row) != 4 || row[0] != 4 || row[1] != v || row[3] != 5 || contains([]int{u, v, 4, 5}, row[2]) || in[2] != 4 {
+		t.Fatalf("expected the row [4 1 x 5] with x a random fill edge, got %v", row)
+	}
+	for _, w := range row[:2] {
+		if w != v && (occludes(small, u, w, v) || occludes(small, u, v, w)) {
+			t.Fatalf("the repaired row %v breaks the alpha rule at %d", row, w)
+		}
+	}
+	if slot, _ := repairSlot(small, nil, []int{4, 2, 3, 5}, 1, u, v, []int{5, 0, minIn, 5, 5, 5, 5}, minIn, DefaultPruneAlpha); slot >= 0 {
+		t.Fatalf("v must not prune a neighbor at the target in-degree, got slot %d", slot)
+	}
+}
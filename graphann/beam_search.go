@@ -0,0 +1,282 @@
+package graphann
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+)
+
+// beam search (a.k.a. L-bounded greedy search in DiskANN)
+// compared to SearchKNN, the client only keeps the best L candidates,
+// and remembers the fetched vertices in a bitset instead of a map
+
+type beamCandidate struct {
+	id        int
+	dist      float32
+	step      int       // the round in which the vertex was fetched
+	neighbors []int     // only kept until the vertex is expanded
+	vector    []float32 // only kept with ReturnVectors
+	expanded  bool
+}
+
+// a sorted candidate list with a fixed capacity
+type beamList struct {
+	items []beamCandidate
+	size  int
+}
+
+func newBeamList(L int) *beamList {
+	return &beamList{items: make([]beamCandidate, L)}
+}
+
+// insert c into the list, return the position it was inserted at (-1 if it was not)
+func (l *beamList) insert(c beamCandidate) int {
+	L := len(l.items)
+	if L == 0 || (l.size == L && c.dist >= l.items[L-1].dist) {
+		return -1
+	}
+	pos := sort.Search(l.size, func(i int) bool { return l.items[i].dist > c.dist })
+	if l.size < L {
+		l.size++
+	}
+	copy(l.items[pos+1:l.size], l.items[pos:l.size-1])
+	l.items[pos] = c
+	return pos
+}
+
+// return the positions of the best (at most) num unexpanded candidates
+func (l *beamList) nextToExpand(num int) []int {
+	ret := make([]int, 0, num)
+	for i := 0; i < l.size && len(ret) < num; i++ {
+		if !l.items[i].expanded {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) get(i int) bool {
+	return b[i/64]&(1<<(uint(i)%64)) != 0
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (uint(i) % 64)
+}
+
+// return the found k nearest neighbors and the step to reach them.
+// L is the size of the candidate list (at least k). In each round, the parallel best unexpanded candidates
+// are expanded, and their unseen neighbors are fetched in one fixed-size batch of parallel * m ids.
+func (g GraphANNFrontend) SearchKNNBeam(queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]int, []int, SearchStats) {
+	results, stats := mustSearch(g.searchKNNBeam(context.Background(), queryVector, k, L, maxStep, parallel, benchmarking))
+	ret, stepRet := padResults(results, k)
+	return ret, stepRet, stats
+}
+
+// same as SearchKNNBeam, but return the found results with their distances instead of padded ids
+func (g GraphANNFrontend) SearchKNNBeamResults(queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats) {
+	return mustSearch(g.searchKNNBeam(context.Background(), queryVector, k, L, maxStep, parallel, benchmarking))
+}
+
+// the context-aware form of SearchKNNBeamResults, see SearchKNNContext
+func (g GraphANNFrontend) SearchKNNBeamContext(ctx context.Context, queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	return g.searchKNNBeam(ctx, queryVector, k, L, maxStep, parallel, benchmarking)
+}
+
+// the traversal behind SearchKNNBeam. It returns the (at most) k closest found vertices
+func (g GraphANNFrontend) searchKNNBeam(ctx context.Context, queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	n, _, m := g.GetMetadata()
+	L = max(L, k)
+
+	stats := SearchStats{ConvergedRound: -1}
+	list := newBeamList(L)
+	// with a filter, the list is only used for navigation and the results are kept separately
+	results := list
+	if g.Filter != nil {
+		results = newBeamList(k)
+	}
+	fetched := newBitset(n)   // the vertices we already know the vector and neighbors of
+	requested := newBitset(n) // the vertices already requested in the current round
+	converged := false
+	unchangedRounds := 0
+
+	if !benchmarking {
+		for _, v := range g.StartVertices {
+			if fetched.get(v.Id) {
+				continue
+			}
+			fetched.set(v.Id)
+			c := beamCandidate{
+				id:        v.Id,
+				dist:      L2Dist(v.Vector, queryVector),
+				step:      0,
+				neighbors: v.Neighbors,
+			}
+			if g.ReturnVectors {
+				c.vector = v.Vector
+			}
+			list.insert(c)
+			if results != list && g.matches(v) {
+				results.insert(beamCandidate{id: c.id, dist: c.dist, step: c.step, vector: c.vector})
+			}
+		}
+	}
+
+	batchSize := m * parallel
+	var round RoundTrace
+	// the per-round records of TrackRounds and Trace
+	record := func() {
+		g.recordRound(&stats, results.ids(k, g))
+		if g.Trace {
+			if results.size > 0 {
+				round.BestDist = results.items[0].dist
+			}
+			if results.size >= k {
+				round.KthDist = results.items[k-1].dist
+			}
+			stats.Trace = append(stats.Trace, round)
+		}
+	}
+	for step := 0; step < maxStep; step++ {
+
+		if converged && g.SkipDummyRounds {
+			break
+		}
+		if err := checkRound(ctx, step); err != nil {
+			return beamResults(results, k, g), stats, err
+		}
+
+		batchQ := make([]int, 0, batchSize)
+		if g.Trace {
+			round = newRoundTrace(step)
+			round.Dummy = converged
+		}
+		if !converged && !benchmarking {
+			for _, pos := range list.nextToExpand(parallel) {
+				c := &list.items[pos]
+				c.expanded = true
+				if g.Trace {
+					round.Expanded = append(round.Expanded, c.id)
+				}
+				for _, v := range c.neighbors {
+					if len(batchQ) < batchSize && !fetched.get(v) && !requested.get(v) {
+						requested.set(v)
+						batchQ = append(batchQ, v)
+					}
+				}
+				c.neighbors = nil
+			}
+		}
+		realNum := len(batchQ)
+		if g.Trace {
+			round.Fetched = append(round.Fetched, batchQ...)
+		}
+		// the batch always has the same size, so we fill it with random vertices
+		for len(batchQ) < batchSize {
+			batchQ = append(batchQ, rand.Intn(n))
+		}
+
+		queryResults, err := g.Graph.GetVertexInfo(batchQ)
+		if err != nil {
+			return beamResults(results, k, g), stats, &RoundError{Round: step, Err: err}
+		}
+		stats.IssuedRounds++
+
+		for _, v := range batchQ {
+			requested[v/64] = 0
+		}
+
+		if converged || benchmarking {
+			if converged {
+				stats.DummyRounds++
+			}
+			record()
+			continue
+		}
+
+		changed := false
+		for i, v := range queryResults {
+			if fetched.get(v.Id) {
+				continue
+			}
+			// if the neighbor list is all zeroes, the PIR failed and we may retry this vertex later
+			if lookupFailed(v) {
+				if g.Trace && i < realNum {
+					round.Failed = append(round.Failed, v.Id)
+				}
+				continue
+			}
+			fetched.set(v.Id)
+			c := beamCandidate{
+				id:        v.Id,
+				dist:      L2Dist(v.Vector, queryVector),
+				step:      step,
+				neighbors: v.Neighbors,
+			}
+			if g.ReturnVectors {
+				c.vector = v.Vector
+			}
+			pos := list.insert(c)
+			if results != list {
+				pos = -1
+				if g.matches(v) {
+					pos = results.insert(beamCandidate{id: c.id, dist: c.dist, step: c.step, vector: c.vector})
+				}
+			}
+			if pos >= 0 && pos < k {
+				changed = true
+			}
+		}
+
+		if changed {
+			stats.StableRound = step + 1
+			unchangedRounds = 0
+		} else {
+			unchangedRounds++
+		}
+
+		// the beam has converged when every candidate in the list has been expanded
+		if g.EarlyStop && ((g.Patience > 0 && unchangedRounds >= g.Patience) || len(list.nextToExpand(1)) == 0) {
+			converged = true
+			stats.ConvergedRound = step + 1
+		}
+		record()
+	}
+
+	return beamResults(results, k, g), stats, nil
+}
+
+// the ids of the (at most) k closest vertices in the list
+func (l *beamList) ids(k int, g GraphANNFrontend) []int {
+	ids := make([]int, 0, k)
+	for i := 0; i < k && i < l.size && g.inRange(l.items[i].dist); i++ {
+		ids = append(ids, l.items[i].id)
+	}
+	return ids
+}
+
+// the (at most) k closest vertices in the list
+func beamResults(results *beamList, k int, g GraphANNFrontend) []SearchResult {
+	found := make([]SearchResult, 0, k)
+	for i := 0; i < k && i < results.size && g.inRange(results.items[i].dist); i++ {
+		c := results.items[i]
+		found = append(found, SearchResult{Id: c.id, Dist: c.dist, Step: c.step, Vector: c.vector})
+	}
+	return found
+}
+
+func (g *GraphANNFrontend) SearchKNNBeamBatch(queryVectors [][]float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([][]int, [][]int) {
+	ret := make([][]int, len(queryVectors))
+	stepRet := make([][]int, len(queryVectors))
+	for i, queryVector := range queryVectors {
+		r, s, _ := g.SearchKNNBeam(queryVector, k, L, maxStep, parallel, benchmarking)
+		ret[i] = r
+		stepRet[i] = s
+	}
+	return ret, stepRet
+}
@@ -0,0 +1,316 @@
+package graphann
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// the binary formats of big-ann-benchmarks (BIGANN, DEEP, MSSPACEV, Text2Image)
+// .fbin/.u8bin/.i8bin/.ibin: a header of two little-endian uint32 (rows, columns), then the rows
+// of float32/uint8/int8/int32 values.
+// The kNN ground truth (.ibin, also called .bin) has the same header (queries, k), the ids and then the
+// float32 distances. The range search ground truth has a header (queries, total results), the number
+// of results of every query, the ids and the distances.
+
+// the size in bytes of one value of the format
+func binElemSize(ext string) (int, error) {
+	switch ext {
+	case ".fbin", ".ibin":
+		return 4, nil
+	case ".u8bin", ".i8bin":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("unknown binary file extension: %s", ext)
+	}
+}
+
+func readBinHeader(r io.Reader) (int, int, error) {
+	var header [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return 0, 0, fmt.Errorf("reading the header: %w", err)
+	}
+	return int(header[0]), int(header[1]), nil
+}
+
+// read the first n rows of a .fbin/.u8bin/.i8bin/.ibin file as float32. Only those rows are read.
+// n <= 0 reads all rows, dim <= 0 accepts any dimension
+func LoadBinFile(filename string, n int, dim int) ([][]float32, error) {
+	ext := filepath.Ext(filename)
+	elemSize, err := binElemSize(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows, cols, err := readBinHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if n <= 0 {
+		n = rows
+	}
+	if n > rows || (dim > 0 && dim != cols) {
+		return nil, fmt.Errorf("%s: invalid shape (%d, %d), expected at least (%d, %d)", filename, rows, cols, n, dim)
+	}
+
+	// one block of memory for all rows, like LoadBvecsFile
+	memSpace := make([]float32, n*cols)
+	ret := make([][]float32, n)
+	r := bufio.NewReaderSize(file, 1<<20)
+	buf := make([]byte, cols*elemSize)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("%s: reading row %d: %w", filename, i, err)
+		}
+		ret[i] = memSpace[i*cols : (i+1)*cols]
+		for j := range ret[i] {
+			switch ext {
+			case ".fbin":
+				ret[i][j] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*j:]))
+			case ".ibin":
+				ret[i][j] = float32(int32(binary.LittleEndian.Uint32(buf[4*j:])))
+			case ".u8bin":
+				ret[i][j] = float32(buf[j])
+			case ".i8bin":
+				ret[i][j] = float32(int8(buf[j]))
+			}
+		}
+	}
+	return ret, nil
+}
+
+func LoadFloat32MatrixFromBin(filename string, n int, dim int) ([][]float32, error) {
+	return LoadBinFile(filename, n, dim)
+}
+
+// read the first n rows of an .ibin file, e.g. a graph or the ids of a kNN ground truth file.
+// n <= 0 reads all rows, m <= 0 accepts any number of columns. As for .ivecs, all columns are returned
+func LoadIbinFile(filename string, n int, m int) ([][]int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows, cols, err := readBinHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if n <= 0 {
+		n = rows
+	}
+	if n > rows || cols < m {
+		return nil, fmt.Errorf("%s: invalid shape (%d, %d), expected at least (%d, %d)", filename, rows, cols, n, m)
+	}
+
+	ret := make([][]int, n)
+	r := bufio.NewReaderSize(file, 1<<20)
+	buf := make([]byte, cols*4)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("%s: reading row %d: %w", filename, i, err)
+		}
+		ret[i] = make([]int, cols)
+		for j := range ret[i] {
+			ret[i][j] = int(int32(binary.LittleEndian.Uint32(buf[4*j:])))
+		}
+	}
+	return ret, nil
+}
+
+// write the rows in the format of the extension (.fbin, .u8bin or .i8bin). The values are converted
+// without clamping, so they have to fit the format
+func SaveBinFile(filename string, matrix [][]float32) error {
+	ext := filepath.Ext(filename)
+	elemSize, err := binElemSize(ext)
+	if err != nil {
+		return err
+	}
+	if ext == ".ibin" {
+		return fmt.Errorf("use SaveIbinFile to write integer matrices")
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cols := 0
+	if len(matrix) > 0 {
+		cols = len(matrix[0])
+	}
+	w := bufio.NewWriterSize(file, 1<<20)
+	if err := binary.Write(w, binary.LittleEndian, [2]uint32{uint32(len(matrix)), uint32(cols)}); err != nil {
+		return err
+	}
+	buf := make([]byte, cols*elemSize)
+	for i, row := range matrix {
+		if len(row) != cols {
+			return fmt.Errorf("row %d has %d values, expected %d", i, len(row), cols)
+		}
+		for j, v := range row {
+			switch ext {
+			case ".fbin":
+				binary.LittleEndian.PutUint32(buf[4*j:], math.Float32bits(v))
+			case ".u8bin":
+				buf[j] = uint8(v)
+			case ".i8bin":
+				buf[j] = uint8(int8(v))
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func SaveIbinFile(filename string, matrix [][]int) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cols := 0
+	if len(matrix) > 0 {
+		cols = len(matrix[0])
+	}
+	w := bufio.NewWriterSize(file, 1<<20)
+	if err := binary.Write(w, binary.LittleEndian, [2]uint32{uint32(len(matrix)), uint32(cols)}); err != nil {
+		return err
+	}
+	buf := make([]byte, cols*4)
+	for i, row := range matrix {
+		if len(row) != cols {
+			return fmt.Errorf("row %d has %d values, expected %d", i, len(row), cols)
+		}
+		for j, v := range row {
+			binary.LittleEndian.PutUint32(buf[4*j:], uint32(int32(v)))
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// read a big-ann-benchmarks ground truth file with its distances. Both the kNN layout (every query has k results)
+// and the range search layout (every query has its own number of results) are recognized by the file size
+func LoadBinGroundTruth(filename string) (GroundTruth, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return GroundTruth{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return GroundTruth{}, err
+	}
+
+	queries, second, err := readBinHeader(file)
+	if err != nil {
+		return GroundTruth{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	r := bufio.NewReaderSize(file, 1<<20)
+	size := info.Size()
+
+	// the number of results of every query
+	counts := make([]int, queries)
+	switch {
+	case size == 8+int64(queries)*int64(second)*8:
+		for i := range counts {
+			counts[i] = second
+		}
+	case size == 8+int64(queries)*4+int64(second)*8:
+		raw := make([]int32, queries)
+		if err := binary.Read(r, binary.LittleEndian, raw); err != nil {
+			return GroundTruth{}, fmt.Errorf("%s: reading the result counts: %w", filename, err)
+		}
+		total := 0
+		for i, c := range raw {
+			counts[i] = int(c)
+			total += int(c)
+		}
+		if total != second {
+			return GroundTruth{}, fmt.Errorf("%s: the result counts add up to %d, the header says %d", filename, total, second)
+		}
+	default:
+		return GroundTruth{}, fmt.Errorf("%s: the size %d matches neither a kNN nor a range ground truth of %d queries", filename, size, queries)
+	}
+
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	ids := make([]int32, total)
+	dists := make([]float32, total)
+	if err := binary.Read(r, binary.LittleEndian, ids); err != nil {
+		return GroundTruth{}, fmt.Errorf("%s: reading the ids: %w", filename, err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, dists); err != nil {
+		return GroundTruth{}, fmt.Errorf("%s: reading the distances: %w", filename, err)
+	}
+
+	gt := GroundTruth{Ids: make([][]int, queries), Dists: make([][]float32, queries)}
+	pos := 0
+	for i, c := range counts {
+		gt.Ids[i] = make([]int, c)
+		for j := 0; j < c; j++ {
+			gt.Ids[i][j] = int(ids[pos+j])
+		}
+		gt.Dists[i] = dists[pos : pos+c]
+		pos += c
+	}
+	return gt, nil
+}
+
+// write the ground truth in the kNN layout. Every query needs the same number of results
+func SaveBinGroundTruth(filename string, gt GroundTruth) error {
+	k := 0
+	if len(gt.Ids) > 0 {
+		k = len(gt.Ids[0])
+	}
+	for i := range gt.Ids {
+		if len(gt.Ids[i]) != k || len(gt.Dists[i]) != k {
+			return fmt.Errorf("query %d has %d results, expected %d", i, len(gt.Ids[i]), k)
+		}
+	}
+	if err := SaveIbinFile(filename, gt.Ids); err != nil {
+		return err
+	}
+
+	// the distances follow the ids
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	for _, row := range gt.Dists {
+		if err := binary.Write(w, binary.LittleEndian, row); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -95,13 +95,26 @@ func main() {
 */
 
 func BuildGraph(n int, dim int, m int, vectors [][]float32, savepath string, dataset string) [][]int {
+	return BuildGraphWithLabels(n, dim, m, vectors, nil, savepath, dataset)
+}
+
+// same as BuildGraph, but the pruning keeps the edges needed by label-filtered queries.
+// labels[i] is the label set of vertex i. nil means no labels.
+func BuildGraphWithLabels(n int, dim int, m int, vectors [][]float32, labels [][]uint32, savepath string, dataset string) [][]int {
+	graph, _ := BuildGraphWithOptions(n, dim, m, vectors, labels, savepath, dataset, GraphBuildOptions{})
+	return graph
+}
+
+// same as BuildGraphWithLabels, with the knobs of the construction. It also returns the options as applied,
+// see CreateGraphBasedOnNGTWithOptions
+func BuildGraphWithOptions(n int, dim int, m int, vectors [][]float32, labels [][]uint32, savepath string, dataset string, opts GraphBuildOptions) ([][]int, GraphBuildOptions) {
 	// First create a HNSW index
 	// we first strip the file extension from input file name
 	ngtFileName := savepath + "/" + dataset + ".ngt"
 	fmt.Println("NGT index file name: ", ngtFileName)
-	graph := CreateGraphBasedOnNGT(vectors, ngtFileName, m)
+	graph, opts := CreateGraphBasedOnNGTWithOptions(vectors, labels, ngtFileName, m, opts)
 	EvaluateGraphQuality(vectors, graph)
-	return graph
+	return graph, opts
 }
 
 func graphBuildThreads(defaultThreads int) int {
@@ -116,6 +129,34 @@ func graphBuildThreads(defaultThreads int) int {
 	return threads
 }
 
+// the alpha of robustPrune in the graph construction
+const DefaultPruneAlpha float32 = 1.2
+
+// the knobs of the graph construction, the zero value builds the graph as before
+type GraphBuildOptions struct {
+	MinInDegree int // the in-degree every vertex is repaired up to, 0 = no balancing, see BalanceInDegree
+
+	// the fraction of every row reserved for long-range edges, 0 = none, see addLongRangeEdges
+	LongRangeFraction float64
+	// if set, LongRangeFraction is ignored: the graph is built with each of these fractions and the one with the
+	// fewest average steps is kept, see tuneLongRange
+	TuneLongRange []float64
+}
+
+// the seed of the random choices of the graph construction, 0 unless PACMANN_GRAPH_SEED is set.
+// The threads derive their own seeds from it, so a build with the same seed and threads is reproducible
+func GraphBuildSeed() int64 {
+	value := os.Getenv("PACMANN_GRAPH_SEED")
+	if value == "" {
+		return 0
+	}
+	seed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("PACMANN_GRAPH_SEED must be an integer, got %q", value))
+	}
+	return seed
+}
+
 func L2Dist(v1, v2 []float32) float32 {
 	dim := len(v1)
 	remainder := dim & 7 // len(v1) % 8
@@ -167,6 +208,12 @@ type IdWithDist struct {
 // for the vertex u, we prune the candidates to only m
 // it's the same as the prune function in the diskann paper
 func robustPrune(vectors [][]float32, u int, candidates []int, m int, alpha float32) []int {
+	return robustPruneWithLabels(vectors, nil, u, candidates, m, alpha)
+}
+
+// the filtered-diskann version of robust prune:
+// an accepted vertex only occludes a candidate if it carries all the labels shared by u and the candidate
+func robustPruneWithLabels(vectors [][]float32, labels [][]uint32, u int, candidates []int, m int, alpha float32) []int {
 	if len(candidates) <= m {
 		return candidates
 	}
@@ -192,7 +239,7 @@ func robustPrune(vectors [][]float32, u int, candidates []int, m int, alpha floa
 		ok := true
 		// now we check the triangle condition:
 		for j := 0; j < len(accept); j++ {
-			if L2Dist(vectors[accept[j].id], vectors[v])*alpha < dist_uv {
+			if L2Dist(vectors[accept[j].id], vectors[v])*alpha < dist_uv && labelsCover(labels, accept[j].id, u, v) {
 				ok = false
 				break
 			}
@@ -312,6 +359,16 @@ func robustPruneWithOneExtra(vectors [][]float32, u int, neighbors []int, v int,
 }
 
 func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
+	return CreateGraphBasedOnNGTWithLabels(vectors, nil, ngtFile, m)
+}
+
+func CreateGraphBasedOnNGTWithLabels(vectors [][]float32, labels [][]uint32, ngtFile string, m int) [][]int {
+	graph, _ := CreateGraphBasedOnNGTWithOptions(vectors, labels, ngtFile, m, GraphBuildOptions{})
+	return graph
+}
+
+// it also returns the options as applied, with the chosen fraction if the long-range edges were tuned
+func CreateGraphBasedOnNGTWithOptions(vectors [][]float32, labels [][]uint32, ngtFile string, m int, opts GraphBuildOptions) ([][]int, GraphBuildOptions) {
 
 	n := len(vectors)
 	dim := len(vectors[0])
@@ -367,7 +424,7 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 	}
 	defer ngt.Close()
 
-	alpha := float32(1.2) // the alpha parameter in the robust prune function
+	alpha := DefaultPruneAlpha // the alpha parameter in the robust prune function
 
 	graph := make([][]int, n)
 
@@ -411,7 +468,7 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 				//candidates = append(candidates, graph[u]...)
 
 				// we prune the neighbors to m
-				candidates = robustPrune(vectors, u, candidates, m, alpha)
+				candidates = robustPruneWithLabels(vectors, labels, u, candidates, m, alpha)
 				graph[u] = candidates
 			}
 
@@ -423,13 +480,42 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 
 	fmt.Printf("First pass done\n")
 
+	if len(opts.TuneLongRange) > 0 {
+		var trials []LongRangeTrial
+		graph, opts.LongRangeFraction, trials = tuneLongRange(vectors, labels, graph, m, alpha, opts)
+		for _, t := range trials {
+			fmt.Printf("Tried the %v\n", t)
+		}
+		fmt.Printf("Chose the long-range fraction %g\n", opts.LongRangeFraction)
+	} else {
+		graph = finishGraph(vectors, labels, graph, m, alpha, opts)
+	}
+	opts.TuneLongRange = nil
+
+	end := time.Now()
+	fmt.Println("Graph built, time = ", end.Sub(start))
+
+	return graph, opts
+}
+
+// the second pass of the construction over the pruned neighbors of the first pass: add the reverse edges, keep them
+// at random, prune and fill the rows. Then balance the in-degrees and add the long-range edges, see GraphBuildOptions
+func finishGraph(vectors [][]float32, labels [][]uint32, firstPass [][]int, m int, alpha float32, opts GraphBuildOptions) [][]int {
+	n := len(vectors)
+	maxThread := graphBuildThreads(16)
+	perThreadVertices := (n + maxThread - 1) / maxThread
+
+	// the local neighbors take the rest of the row
+	local := m - longRangeSlots(m, opts.LongRangeFraction)
+	graph := make([][]int, n)
+
 	// we now add the bi-directional edges
 	biGraph := make([][]int, n)
 	for u := 0; u < n; u++ {
 		biGraph[u] = make([]int, 0)
 	}
 	for u := 0; u < n; u++ {
-		for _, v := range graph[u] {
+		for _, v := range firstPass[u] {
 			biGraph[u] = append(biGraph[u], v)
 			biGraph[v] = append(biGraph[v], u)
 		}
@@ -447,12 +533,15 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 	var wg2 sync.WaitGroup
 	wg2.Add(maxThread)
 
+	// the number of random fill edges at the end of every row
+	fill := make([]int, n)
+
 	for t := 0; t < maxThread; t++ {
 		start := t * perThreadVertices
 		end := min((t+1)*perThreadVertices, n)
 
 		go func(start, end int) {
-			r := rand.New(rand.NewSource(int64(start)))
+			r := rand.New(rand.NewSource(GraphBuildSeed() + int64(start)))
 			for u := start; u < end; u++ {
 				connection := make([]int, 0)
 				for _, v := range biGraph[u] {
@@ -462,12 +551,13 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 					}
 				}
 
-				if len(connection) > m {
-					connection = robustPrune(vectors, u, connection, m, alpha)
+				if len(connection) > local {
+					connection = robustPruneWithLabels(vectors, labels, u, connection, local, alpha)
 				}
 
 				// we fill the connection by random neighbors
-				for len(connection) < m {
+				fill[u] = max(local-len(connection), 0)
+				for len(connection) < local {
 					// we add a random vertex to the outbounds
 					// make sure it's not i and not already in the outbounds
 					v := r.Intn(n)
@@ -495,29 +585,18 @@ func CreateGraphBasedOnNGT(vectors [][]float32, ngtFile string, m int) [][]int {
 
 	wg2.Wait()
 
-	inbounds = make([]int, n)
-	for i := 0; i < n; i++ {
-		for j := 0; j < len(graph[i]); j++ {
-			inbounds[graph[i][j]]++
-		}
-	}
+	// now we check the inbounds
+	fmt.Printf("Second pass done, %v\n", inDegreeStats(inDegrees(graph), fill))
 
-	// now we check the min and the max inbounds
-	minInbound := n
-	maxInbound := 0
-	for i := 0; i < n; i++ {
-		if inbounds[i] < minInbound {
-			minInbound = inbounds[i]
-		}
-		if inbounds[i] > maxInbound {
-			maxInbound = inbounds[i]
-		}
+	if opts.MinInDegree > 0 {
+		stats := BalanceInDegree(vectors, labels, graph, fill, opts.MinInDegree, alpha)
+		fmt.Printf("Balanced to in-degree %d, %v\n", opts.MinInDegree, stats)
 	}
 
-	fmt.Printf("Min inbound: %d, Max inbound: %d\n", minInbound, maxInbound)
-
-	end := time.Now()
-	fmt.Println("Graph built, time = ", end.Sub(start))
+	if local < m {
+		stats := addLongRangeEdges(vectors, graph, m, GraphBuildSeed())
+		fmt.Printf("Long-range edges added, %v\n", stats)
+	}
 
 	return graph
 }
@@ -527,7 +606,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 	start := time.Now()
 
 	n := len(vectors)
-	alpha := float32(1.2) // the alpha parameter in the robust prune function
+	alpha := DefaultPruneAlpha // the alpha parameter in the robust prune function
 
 	// we enumerate all vertices in a random order
 	perm := rand.Perm(n)
@@ -671,7 +750,7 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 	start := time.Now()
 
 	n := len(vectors)
-	alpha := float32(1.2) // the alpha parameter in the robust prune function
+	alpha := DefaultPruneAlpha // the alpha parameter in the robust prune function
 
 	// we enumerate all vertices in a random order
 	perm := rand.Perm(n)
@@ -775,6 +854,24 @@ func CreateGraphBasedOnHNSW(vectors [][]float32, hnsw *hnswgo.HNSW, m int) [][]i
 
 func EvaluateGraphQuality(vectors [][]float32, graph [][]int) {
 	n := len(vectors)
+
+	// we evaluate the quality of the graph by
+	// do search query for random vertices in the graph
+	// and report the average steps to reach the target
+
+	numQueries := 100
+	targets := make([]int, numQueries)
+	for i := range targets {
+		targets[i] = rand.Intn(n)
+	}
+	hitRate, avgSteps := MeasureGraphQuality(vectors, graph, targets)
+	fmt.Print("Hit rate: ", hitRate, " Average steps: ", avgSteps, "\n")
+}
+
+// search for the vectors of the targets, and return the fraction found as the top-1 and the average steps
+// to find them. The steps are +Inf when no target is found
+func MeasureGraphQuality(vectors [][]float32, graph [][]int, targets []int) (float64, float64) {
+	n := len(vectors)
 	dim := len(vectors[0])
 	m := len(graph[0])
 
@@ -792,28 +889,22 @@ func EvaluateGraphQuality(vectors [][]float32, graph [][]int) {
 
 	frontend.Preprocess()
 
-	// we evaluate the quality of the graph by
-	// do search query for random vertices in the graph
-	// and report the average steps to reach the target
-
-	numQueries := 100
 	hit := 0
 	avgSteps := 0.0
 
-	for i := 0; i < numQueries; i++ {
-		target := rand.Intn(n)
-		//fmt.Println("Query ", i, " target: ", target)
+	for _, target := range targets {
 		knn, steps := frontend.SearchKNN(vectors[target], 20, 20, 2, false)
 		if knn[0] == target {
 			hit++
 			avgSteps += float64(steps[0])
 		}
-
-		//fmt.Printf("Query %d: steps = %d\n", i, steps)
 	}
 
+	if hit == 0 {
+		return 0, math.Inf(1)
+	}
 	avgSteps /= float64(hit)
-	fmt.Print("Hit rate: ", float64(hit)/float64(numQueries), " Average steps: ", avgSteps, "\n")
+	return float64(hit) / float64(len(targets)), avgSteps
 }
 
 // compute the recall for a batch of queries @ k
@@ -861,3 +952,17 @@ func ComputeRecall(gnd [][]int, response [][]int, k int) float32 {
 
 	return recall
 }
+
+// the mean reciprocal rank of the true nearest neighbor gnd[i][0] in the responses (0 if it is missing)
+func ComputeMRR(gnd [][]int, response [][]int) float32 {
+	mrr := float32(0)
+	for i := range response {
+		for j, id := range response[i] {
+			if id == gnd[i][0] {
+				mrr += 1 / float32(j+1)
+				break
+			}
+		}
+	}
+	return mrr / float32(len(response))
+}
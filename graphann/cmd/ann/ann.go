@@ -13,8 +13,8 @@ import (
 
 func main() {
 	// Parameters
-	// "-n": number of vectors
-	// "-d": dimension of the vectors
+	// "-n": number of vectors, default to all rows of the input file
+	// "-d": dimension of the vectors, default to the dimension of the input file
 	// "-m": number of neighbors
 	// "-q": number of queries
 	// "-k": top K output
@@ -22,11 +22,11 @@ func main() {
 	// "-output": output file name, default to null
 	// "--parallel": how many parallel vertices are accessed in the same round, default to 1
 
-	numVectors := flag.Int("n", 100000, "number of vectors")
-	dimVectors := flag.Int("d", 128, "dimension of the vectors")
+	numVectors := flag.Int("n", 0, "number of vectors (0 = all rows of the input file)")
+	dimVectors := flag.Int("d", 0, "dimension of the vectors (0 = the dimension of the input file)")
 	neighborNum := flag.Int("m", 32, "number of neighbors")
 	outputNum := flag.Int("k", 100, "top K output")
-	queryNum := flag.Int("q", 100, "number of queries")
+	queryNum := flag.Int("q", 100, "number of queries (0 = all rows of the query file)")
 	inputFile := flag.String("input", "", "input file name")
 	queryFile := flag.String("query", "", "file name")
 	outputFile := flag.String("output", "", "output file name")
@@ -53,11 +53,14 @@ func main() {
 	var vectors [][]float32
 	if _, err := os.Stat(*inputFile); err == nil {
 		fmt.Println("Loading vectors from file")
-		vectors, err = graphann.LoadFloat32Matrix(*inputFile, n, d)
+		var info graphann.MatrixInfo
+		vectors, info, err = graphann.LoadFloat32MatrixWithInfo(*inputFile, n, d)
 		if err != nil {
 			fmt.Println("Error loading vectors from file: ", err)
 			return
 		}
+		n, d = len(vectors), info.Dim
+		fmt.Printf("Loaded %d of %d vectors with dimension %d\n", n, info.Rows, d)
 	} else {
 		fmt.Printf("Error: Loading files %e", err)
 		return
@@ -100,11 +103,17 @@ func main() {
 
 	if _, err := os.Stat(*queryFile); err == nil {
 		fmt.Println("Loading query vectors from file")
-		queryVectors, err = graphann.LoadFloat32Matrix(*queryFile, q, d)
+		var info graphann.MatrixInfo
+		queryVectors, info, err = graphann.LoadFloat32MatrixWithInfo(*queryFile, q, 0)
 		if err != nil {
 			fmt.Println("Error loading query vectors from file: ", err)
 			return
 		}
+		if info.Dim != d {
+			fmt.Printf("The queries have dimension %d, but the vectors have dimension %d\n", info.Dim, d)
+			return
+		}
+		q = len(queryVectors)
 	} else {
 		fmt.Printf("Error: Loading files %e", err)
 		return
@@ -154,7 +163,7 @@ func main() {
 	fmt.Println("Output written to file: ", output)
 
 	if *gndFile != "" {
-		gnd, err := graphann.LoadGraphFromFile(*gndFile, q, k) // it's just the same as loading the graph
+		gnd, err := graphann.LoadGroundTruthIds(*gndFile, q, k)
 		if err != nil {
 			fmt.Println("Error loading ground truth file: ", err)
 			return
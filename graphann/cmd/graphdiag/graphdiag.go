@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"example.com/graphann"
+)
+
+// connectivity and navigability diagnostics of an index graph, written as JSON.
+// The exit status is 1 if the graph is not strongly connected or some vertices cannot be reached from the
+// start set, so the tool can guard graph builds in scripts
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+func main() {
+	// Parameters
+	// "-graph": the graph file (.npy, .txt, .ivecs, .ibin, .graph)
+	// "-input": the vectors of the graph (optional), to check a .graph file and estimate the random fill
+	// "-n", "-m": the number of rows and neighbors to read (0 = all)
+	// "-sample": the number of vertices the random fill is estimated on
+	// "-seed": the seed of the start vertices (except for a .graph file, which records them) and of the sample
+	// "-output": the JSON file (default: stdout)
+
+	graphFile := flag.String("graph", "", "graph file name")
+	inputFile := flag.String("input", "", "vector file name (optional)")
+	numRows := flag.Int("n", 0, "number of vertices (0 = all rows of the graph file)")
+	numNeighbors := flag.Int("m", 0, "number of neighbors (0 = all columns of the graph file)")
+	sampleNum := flag.Int("sample", 10000, "number of vertices to estimate the random fill on")
+	seed := flag.Int64("seed", 0, "seed of the start vertices and of the sample")
+	outputFile := flag.String("output", "", "JSON output file (default: stdout)")
+	flag.Parse()
+
+	if *graphFile == "" {
+		fail("Please specify the graph file with -graph")
+	}
+
+	var graph [][]int
+	var start []int
+	var meta *graphann.GraphMeta
+	if filepath.Ext(*graphFile) == ".graph" {
+		g, m, err := graphann.LoadGraphWithMeta(*graphFile)
+		if err != nil {
+			fail("Error reading the graph: %v", err)
+		}
+		graph, start, meta = g, m.StartVertices, &m
+	} else {
+		g, _, err := graphann.LoadIntMatrixWithInfo(*graphFile, *numRows, *numNeighbors)
+		if err != nil {
+			fail("Error reading the graph: %v", err)
+		}
+		graph = g
+	}
+	if start == nil {
+		start = graphann.DefaultStartVertices(len(graph), *seed)
+	}
+
+	var vectors [][]float32
+	if *inputFile != "" {
+		v, _, err := graphann.LoadFloat32MatrixWithInfo(*inputFile, len(graph), 0)
+		if err != nil {
+			fail("Error reading the vectors: %v", err)
+		}
+		if meta != nil {
+			if err := meta.Validate(v); err != nil {
+				fail("%s does not match %s: %v", *graphFile, *inputFile, err)
+			}
+		}
+		vectors = v
+	}
+
+	d := graphann.DiagnoseGraph(graph, start, vectors, *sampleNum, *seed)
+
+	out := os.Stdout
+	if *outputFile != "" {
+		file, err := os.Create(*outputFile)
+		if err != nil {
+			fail("Error creating the output file: %v", err)
+		}
+		out = file
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		fail("Error writing the diagnostics: %v", err)
+	}
+	if out != os.Stdout {
+		out.Close()
+	}
+
+	fmt.Fprintf(os.Stderr, "%d vertices, %d neighbors, %d strongly connected components (largest %d), %d of %d unreachable from %d start vertices\n",
+		d.N, d.M, d.Components, d.LargestComponent, d.Unreachable, d.N, d.StartVertices)
+	fmt.Fprintf(os.Stderr, "hops: mean %.2f, max %d; in-degree: min %d, mean %.1f, max %d\n",
+		d.MeanHops, d.MaxHops, d.InDegree.Min, d.InDegree.Mean, d.InDegree.Max)
+	if vectors != nil {
+		fmt.Fprintf(os.Stderr, "estimated random fill: %.1f%% of the edges\n", d.RandomEdgeFraction*100)
+	}
+	if !d.Connected() {
+		fmt.Fprintln(os.Stderr, "The graph is disconnected")
+		os.Exit(1)
+	}
+}
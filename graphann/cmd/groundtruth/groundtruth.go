@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"example.com/graphann"
+)
+
+// compute the exact ground truth of the queries by brute force, e.g. for -gnd of private-search.
+// The ids go to -output (.ivecs, .npy or .ibin), the distances next to it (gnd_dist.fvecs or gnd_dist.npy),
+// or into the same file for the big-ann-benchmarks .ibin format
+
+func main() {
+	// Parameters
+	// "-input": the base vectors (any format of graphann.LoadFloat32Matrix, .fvecs and .bvecs are streamed)
+	// "-query": the query vectors
+	// "-output": the ground truth file (.ivecs, .npy or .ibin)
+	// "-n", "-d", "-q": number of base vectors, dimension and number of queries
+	// "-k": number of neighbors per query
+	// "-metric": l2, ip (maximum inner product) or cosine
+	// "-threads": number of threads (0 = all CPUs)
+	// "-block": number of base vectors scanned at once
+
+	inputFile := flag.String("input", "", "base vectors file name")
+	queryFile := flag.String("query", "", "query vectors file name")
+	outputFile := flag.String("output", "", "ground truth file name (.ivecs, .npy or .ibin)")
+	numVectors := flag.Int("n", 100000, "number of base vectors")
+	dimVectors := flag.Int("d", 128, "dimension of the vectors")
+	queryNum := flag.Int("q", 100, "number of queries")
+	outputNum := flag.Int("k", 100, "number of neighbors per query")
+	metricName := flag.String("metric", "l2", "distance metric: l2, ip or cosine")
+	threads := flag.Int("threads", 0, "number of threads (0 = all CPUs)")
+	blockSize := flag.Int("block", 100000, "number of base vectors scanned at once")
+	flag.Parse()
+
+	if *inputFile == "" || *queryFile == "" || *outputFile == "" {
+		fmt.Println("Please specify the base vectors, the queries and the output file")
+		return
+	}
+	metric, err := graphann.ParseMetric(*metricName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	queries, err := graphann.LoadFloat32Matrix(*queryFile, *queryNum, *dimVectors)
+	if err != nil {
+		fmt.Println("Error loading the queries: ", err)
+		return
+	}
+	r, err := graphann.OpenBlockReader(*inputFile, *numVectors, *dimVectors, *blockSize)
+	if err != nil {
+		fmt.Println("Error opening the base vectors: ", err)
+		return
+	}
+	defer r.Close()
+
+	start := time.Now()
+	gt, err := graphann.ComputeGroundTruthFromReader(r, queries, *outputNum, metric, *threads)
+	if err != nil {
+		fmt.Println("Error computing the ground truth: ", err)
+		return
+	}
+	fmt.Printf("Ground truth of %d queries (%s, k = %d) computed in %v\n", len(queries), metric, *outputNum, time.Since(start))
+
+	if err := graphann.SaveGroundTruth(*outputFile, gt); err != nil {
+		fmt.Println("Error saving the ground truth: ", err)
+		return
+	}
+	fmt.Printf("Saved the ids to %s and the distances to %s\n", *outputFile, graphann.GroundTruthDistFile(*outputFile))
+}
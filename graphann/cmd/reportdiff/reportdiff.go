@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"example.com/graphann"
+)
+
+// compare two JSON reports written by private-search and flag the regressions in recall, latency or communication.
+// The exit status is 1 if there is a regression, so the tool can guard benchmark runs in scripts
+
+func loadReport(filename string) (graphann.Report, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return graphann.Report{}, err
+	}
+	defer file.Close()
+	return graphann.ReadReport(file)
+}
+
+func main() {
+	// Parameters
+	// "-base": the report of the reference run
+	// "-new": the report of the run to check
+	// "-recall": the tolerated recall (and MRR) loss, in absolute terms
+	// "-latency": the tolerated relative increase of the computation, total and preparation times
+	// "-comm": the tolerated relative increase of the communication and the storage
+
+	baseFile := flag.String("base", "", "report of the reference run")
+	newFile := flag.String("new", "", "report of the run to check")
+	recallTol := flag.Float64("recall", 0.01, "tolerated recall loss (absolute)")
+	latencyTol := flag.Float64("latency", 0.1, "tolerated relative increase of the times")
+	commTol := flag.Float64("comm", 0.05, "tolerated relative increase of the communication and the storage")
+	flag.Parse()
+
+	if *baseFile == "" || *newFile == "" {
+		fmt.Println("Please specify the two reports with -base and -new")
+		os.Exit(2)
+	}
+	base, err := loadReport(*baseFile)
+	if err != nil {
+		fmt.Println("Error reading the base report: ", err)
+		os.Exit(2)
+	}
+	current, err := loadReport(*newFile)
+	if err != nil {
+		fmt.Println("Error reading the new report: ", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("Base: %s (%s)\n", base.Environment.GitRevision, base.Environment.Time)
+	fmt.Printf("New:  %s (%s)\n", current.Environment.GitRevision, current.Environment.Time)
+
+	changes, settings := graphann.DiffReports(base, current, graphann.DiffTolerance{
+		Recall:  *recallTol,
+		Latency: *latencyTol,
+		Comm:    *commTol,
+	})
+	if len(settings) > 0 {
+		fmt.Println("Changed settings:")
+		for _, s := range settings {
+			fmt.Println("  ", s)
+		}
+	}
+
+	regressions := 0
+	fmt.Printf("%-22s %14s %14s %10s\n", "metric", "base", "new", "change")
+	for _, c := range changes {
+		change := "-"
+		if c.Base != 0 {
+			change = fmt.Sprintf("%+.1f%%", (c.New-c.Base)/c.Base*100)
+		}
+		flagged := ""
+		if c.Regression {
+			flagged = "  REGRESSION"
+			regressions++
+		}
+		fmt.Printf("%-22s %14.6f %14.6f %10s%s\n", c.Metric, c.Base, c.New, change, flagged)
+	}
+
+	if regressions > 0 {
+		fmt.Printf("%d regressions\n", regressions)
+		os.Exit(1)
+	}
+	fmt.Println("No regressions")
+}
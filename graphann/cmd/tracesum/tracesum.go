@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"example.com/graphann"
+)
+
+// summarize a trace file written by private-search -trace (one JSON line per query)
+// and flag the queries whose traversal went wrong
+
+// the problems found in one query trace
+type queryIssues struct {
+	trace   graphann.QueryTrace
+	reasons []string
+}
+
+// the number of real rounds at the end of the traversal in which the k-th distance did not change.
+// The search did not converge in them, so it was stuck in a local minimum (or the frontier was too small)
+func plateauRounds(rounds []graphann.RoundTrace) int {
+	nonDummy := make([]graphann.RoundTrace, 0, len(rounds))
+	for _, r := range rounds {
+		if !r.Dummy {
+			nonDummy = append(nonDummy, r)
+		}
+	}
+	plateau := 0
+	for i := len(nonDummy) - 1; i > 0 && nonDummy[i].KthDist == nonDummy[i-1].KthDist; i-- {
+		plateau++
+	}
+	return plateau
+}
+
+func main() {
+	// Parameters
+	// "-input": the trace file
+	// "-stuck": number of final rounds without top-k change to flag a traversal as stuck
+	// "-minrecall": only flag the stuck traversals with a lower recall (ignored without ground truth)
+	// "-maxfail": flag the traversals with a larger fraction of failed lookups
+
+	inputFile := flag.String("input", "", "trace file (JSON lines)")
+	stuckRounds := flag.Int("stuck", 5, "final rounds without top-k change to flag a traversal as stuck")
+	minRecall := flag.Float64("minrecall", 0.9, "only flag the stuck traversals with a lower recall")
+	maxFail := flag.Float64("maxfail", 0.1, "flag the traversals with a larger fraction of failed lookups")
+	flag.Parse()
+
+	if *inputFile == "" {
+		fmt.Println("Please specify the trace file")
+		return
+	}
+	file, err := os.Open(*inputFile)
+	if err != nil {
+		fmt.Println("Error opening the trace file: ", err)
+		return
+	}
+	defer file.Close()
+	traces, err := graphann.ReadQueryTraces(file)
+	if err != nil {
+		fmt.Println("Error reading the trace file: ", err)
+		return
+	}
+	if len(traces) == 0 {
+		fmt.Println("The trace file is empty")
+		return
+	}
+
+	recallSum, recallNum := float64(0), 0
+	stableSum, convergedNum := 0, 0
+	fetchedSum, failedSum, realSum := 0, 0, 0
+	stableHist := make(map[int]int)
+	flagged := make([]queryIssues, 0)
+
+	for _, t := range traces {
+		if t.Recall >= 0 {
+			recallSum += float64(t.Recall)
+			recallNum++
+		}
+		stableSum += t.StableRound
+		stableHist[t.StableRound]++
+		if t.ConvergedRound >= 0 {
+			convergedNum++
+		}
+
+		fetched, failed, realRounds := 0, 0, 0
+		exhausted := -1
+		for _, r := range t.Rounds {
+			if r.Dummy {
+				continue
+			}
+			realRounds++
+			fetched += len(r.Fetched)
+			failed += len(r.Failed)
+			if len(r.Expanded) == 0 && exhausted < 0 {
+				exhausted = r.Round
+			}
+		}
+		fetchedSum += fetched
+		failedSum += failed
+		realSum += realRounds
+
+		issues := queryIssues{trace: t}
+		lowRecall := t.Recall < 0 || float64(t.Recall) < *minRecall
+		if plateau := plateauRounds(t.Rounds); plateau >= *stuckRounds && t.ConvergedRound < 0 && lowRecall {
+			issues.reasons = append(issues.reasons, fmt.Sprintf("stuck: the top-k did not change in the last %d rounds", plateau))
+		}
+		if t.ConvergedRound < 0 && realRounds > 0 && t.StableRound == realRounds {
+			issues.reasons = append(issues.reasons, "truncated: the top-k still changed in the last round")
+		}
+		if exhausted >= 0 {
+			issues.reasons = append(issues.reasons, fmt.Sprintf("exhausted: no vertex left to expand in round %d", exhausted))
+		}
+		if fetched > 0 && float64(failed)/float64(fetched) > *maxFail {
+			issues.reasons = append(issues.reasons, fmt.Sprintf("failures: %d of %d lookups failed", failed, fetched))
+		}
+		if len(issues.reasons) > 0 {
+			flagged = append(flagged, issues)
+		}
+	}
+
+	q := len(traces)
+	fmt.Println("Queries: ", q)
+	if recallNum > 0 {
+		fmt.Printf("Average recall: %f\n", recallSum/float64(recallNum))
+	}
+	fmt.Printf("Average stable round: %f\n", float64(stableSum)/float64(q))
+	fmt.Printf("Converged queries: %d / %d\n", convergedNum, q)
+	fmt.Printf("Average real rounds: %f\n", float64(realSum)/float64(q))
+	fmt.Printf("Average fetched ids: %f, failed lookups: %f\n", float64(fetchedSum)/float64(q), float64(failedSum)/float64(q))
+
+	fmt.Println("Stable round histogram:")
+	rounds := make([]int, 0, len(stableHist))
+	for r := range stableHist {
+		rounds = append(rounds, r)
+	}
+	sort.Ints(rounds)
+	for _, r := range rounds {
+		fmt.Printf("  %3d: %5d %s\n", r, stableHist[r], strings.Repeat("#", stableHist[r]*50/q))
+	}
+
+	// the worst queries first
+	sort.SliceStable(flagged, func(i, j int) bool { return flagged[i].trace.Recall < flagged[j].trace.Recall })
+	fmt.Printf("Flagged queries: %d\n", len(flagged))
+	for _, f := range flagged {
+		fmt.Printf("  query %d (recall %f, stable round %d): %s\n", f.trace.Query, f.trace.Recall, f.trace.StableRound, strings.Join(f.reasons, "; "))
+	}
+}
@@ -0,0 +1,289 @@
+package graphann
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// graph diagnostics
+// the properties of an index graph that decide whether the private traversal can reach the answers within its
+// rounds: strong connectivity, reachability and hop distances from the start set, degrees and malformed edges.
+// Used by graphann/cmd/graphdiag.
+
+type HistogramBin struct {
+	Value int `json:"value"`
+	Count int `json:"count"`
+}
+
+type DegreeStats struct {
+	Min       int            `json:"min"`
+	Mean      float64        `json:"mean"`
+	Max       int            `json:"max"`
+	Histogram []HistogramBin `json:"histogram"`
+}
+
+type GraphDiagnostics struct {
+	N int `json:"n"`
+	M int `json:"m"`
+
+	// strongly connected components
+	Components        int  `json:"components"`
+	LargestComponent  int  `json:"largest_component"`
+	SingletonCount    int  `json:"singleton_components"`
+	StronglyConnected bool `json:"strongly_connected"`
+
+	// breadth-first search from the start vertices
+	StartVertices int            `json:"start_vertices"`
+	Reachable     int            `json:"reachable"`
+	Unreachable   int            `json:"unreachable"`
+	MaxHops       int            `json:"max_hops"`
+	MeanHops      float64        `json:"mean_hops"`
+	Hops          []HistogramBin `json:"hops"` // the number of vertices at each hop distance
+
+	InDegree  DegreeStats `json:"in_degree"`
+	OutDegree DegreeStats `json:"out_degree"` // distinct valid neighbors, without self edges
+
+	SelfEdges      int `json:"self_edges"`
+	DuplicateEdges int `json:"duplicate_edges"`
+	InvalidEdges   int `json:"invalid_edges"` // ids outside [0, n)
+
+	// only with the vectors, see estimateRandomEdges
+	RandomEdgeFraction float64 `json:"random_edge_fraction,omitempty"`
+	SampledVertices    int     `json:"sampled_vertices,omitempty"`
+}
+
+// the graph is usable from every start vertex
+func (d GraphDiagnostics) Connected() bool {
+	return d.StronglyConnected && d.Unreachable == 0
+}
+
+// the distinct valid neighbors of every vertex, and the malformed edges
+func cleanRows(graph [][]int) ([][]int, int, int, int) {
+	n := len(graph)
+	rows := make([][]int, n)
+	self, duplicate, invalid := 0, 0, 0
+	for u, row := range graph {
+		rows[u] = make([]int, 0, len(row))
+		for j, v := range row {
+			switch {
+			case v < 0 || v >= n:
+				invalid++
+			case v == u:
+				self++
+			case contains(row[:j], v):
+				duplicate++
+			default:
+				rows[u] = append(rows[u], v)
+			}
+		}
+	}
+	return rows, self, duplicate, invalid
+}
+
+func degreeStats(degrees []int) DegreeStats {
+	if len(degrees) == 0 {
+		return DegreeStats{}
+	}
+	s := DegreeStats{Min: math.MaxInt, Histogram: histogram(degrees)}
+	sum := 0
+	for _, d := range degrees {
+		s.Min = min(s.Min, d)
+		s.Max = max(s.Max, d)
+		sum += d
+	}
+	s.Mean = float64(sum) / float64(len(degrees))
+	return s
+}
+
+// the bins of the values that occur, in increasing order
+func histogram(values []int) []HistogramBin {
+	counts := make(map[int]int)
+	for _, v := range values {
+		counts[v]++
+	}
+	bins := make([]HistogramBin, 0, len(counts))
+	for v, c := range counts {
+		bins = append(bins, HistogramBin{Value: v, Count: c})
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i].Value < bins[j].Value })
+	return bins
+}
+
+// the sizes of the strongly connected components, by an iterative Tarjan so deep graphs do not overflow the stack
+func stronglyConnectedComponents(rows [][]int) []int {
+	n := len(rows)
+	index := make([]int, n)
+	low := make([]int, n)
+	onStack := make([]bool, n)
+	for i := range index {
+		index[i] = -1
+	}
+	stack := make([]int, 0)
+	sizes := make([]int, 0)
+	next := 0
+
+	type frame struct{ u, edge int }
+	for root := 0; root < n; root++ {
+		if index[root] >= 0 {
+			continue
+		}
+		calls := []frame{{root, 0}}
+		index[root], low[root] = next, next
+		next++
+		stack = append(stack, root)
+		onStack[root] = true
+
+		for len(calls) > 0 {
+			f := &calls[len(calls)-1]
+			u := f.u
+			if f.edge < len(rows[u]) {
+				v := rows[u][f.edge]
+				f.edge++
+				if index[v] < 0 {
+					index[v], low[v] = next, next
+					next++
+					stack = append(stack, v)
+					onStack[v] = true
+					calls = append(calls, frame{v, 0})
+				} else if onStack[v] {
+					low[u] = min(low[u], index[v])
+				}
+				continue
+			}
+
+			// all edges of u are done
+			calls = calls[:len(calls)-1]
+			if len(calls) > 0 {
+				parent := calls[len(calls)-1].u
+				low[parent] = min(low[parent], low[u])
+			}
+			if low[u] == index[u] {
+				size := 0
+				for {
+					v := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[v] = false
+					size++
+					if v == u {
+						break
+					}
+				}
+				sizes = append(sizes, size)
+			}
+		}
+	}
+	return sizes
+}
+
+// the hop distance of every vertex from the start set, -1 if unreachable
+func hopDistances(rows [][]int, start []int) []int {
+	dist := make([]int, len(rows))
+	for i := range dist {
+		dist[i] = -1
+	}
+	frontier := make([]int, 0, len(start))
+	for _, s := range start {
+		if s >= 0 && s < len(rows) && dist[s] < 0 {
+			dist[s] = 0
+			frontier = append(frontier, s)
+		}
+	}
+	for hop := 1; len(frontier) > 0; hop++ {
+		next := make([]int, 0)
+		for _, u := range frontier {
+			for _, v := range rows[u] {
+				if dist[v] < 0 {
+					dist[v] = hop
+					next = append(next, v)
+				}
+			}
+		}
+		frontier = next
+	}
+	return dist
+}
+
+// the fraction of the edges that look like random fill rather than pruned neighbors. For sampled vertices u, an edge
+// u -> v is long if v is farther from u than the median distance from u to 32 random vertices. A uniformly random
+// neighbor is long half of the time and a pruned one almost never, so the fraction is estimated as twice the long edges
+func estimateRandomEdges(rows [][]int, vectors [][]float32, sampleNum int, r *rand.Rand) (float64, int) {
+	n := len(rows)
+	sampleNum = min(sampleNum, n)
+	long, total := 0, 0
+	dists := make([]float32, 32)
+	for _, u := range r.Perm(n)[:sampleNum] {
+		for i := range dists {
+			dists[i] = MetricL2.Dist(vectors[u], vectors[r.Intn(n)])
+		}
+		sort.Slice(dists, func(i, j int) bool { return dists[i] < dists[j] })
+		median := dists[len(dists)/2]
+		for _, v := range rows[u] {
+			if MetricL2.Dist(vectors[u], vectors[v]) > median {
+				long++
+			}
+			total++
+		}
+	}
+	if total == 0 {
+		return 0, sampleNum
+	}
+	return min(2*float64(long)/float64(total), 1), sampleNum
+}
+
+// diagnose the graph from the start vertices. With the vectors (nil: skipped), the random fill is estimated
+// over sampleNum vertices
+func DiagnoseGraph(graph [][]int, start []int, vectors [][]float32, sampleNum int, seed int64) GraphDiagnostics {
+	n := len(graph)
+	d := GraphDiagnostics{N: n, StartVertices: len(start)}
+	if n == 0 {
+		return d
+	}
+	d.M = len(graph[0])
+
+	rows, self, duplicate, invalid := cleanRows(graph)
+	d.SelfEdges, d.DuplicateEdges, d.InvalidEdges = self, duplicate, invalid
+
+	outDegrees := make([]int, n)
+	inDegrees := make([]int, n)
+	for u, row := range rows {
+		outDegrees[u] = len(row)
+		for _, v := range row {
+			inDegrees[v]++
+		}
+	}
+	d.InDegree = degreeStats(inDegrees)
+	d.OutDegree = degreeStats(outDegrees)
+
+	sizes := stronglyConnectedComponents(rows)
+	d.Components = len(sizes)
+	for _, s := range sizes {
+		d.LargestComponent = max(d.LargestComponent, s)
+		if s == 1 {
+			d.SingletonCount++
+		}
+	}
+	d.StronglyConnected = d.Components == 1
+
+	hops := make([]int, 0, n)
+	sum := 0
+	for _, h := range hopDistances(rows, start) {
+		if h < 0 {
+			d.Unreachable++
+			continue
+		}
+		hops = append(hops, h)
+		d.MaxHops = max(d.MaxHops, h)
+		sum += h
+	}
+	d.Reachable = len(hops)
+	if d.Reachable > 0 {
+		d.MeanHops = float64(sum) / float64(d.Reachable)
+	}
+	d.Hops = histogram(hops)
+
+	if vectors != nil && sampleNum > 0 {
+		d.RandomEdgeFraction, d.SampledVertices = estimateRandomEdges(rows, vectors, sampleNum, rand.New(rand.NewSource(seed)))
+	}
+	return d
+}
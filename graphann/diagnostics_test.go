@@ -0,0 +1,59 @@
+package graphann
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDiagnoseGraph(t *testing.T) {
+	// a ring with chords is strongly connected
+	n := 64
+	ring := make([][]int, n)
+	for i := range ring {
+		ring[i] = []int{(i + 1) % n, (i + 8) % n}
+	}
+	d := DiagnoseGraph(ring, []int{0}, nil, 0, 0)
+	if !d.Connected() || d.Components != 1 || d.Unreachable != 0 {
+		t.Fatalf("the ring should be connected: %+v", d)
+	}
+	if d.InDegree.Min != 2 || d.InDegree.Max != 2 || d.OutDegree.Mean != 2 {
+		t.Fatalf("unexpected degrees %+v %+v", d.InDegree, d.OutDegree)
+	}
+	// 0 reaches i in i/8 + i%8 hops
+	if d.MaxHops != 7+7 || len(d.Hops) != d.MaxHops+1 || d.Hops[0].Count != 1 {
+		t.Fatalf("unexpected hops %d %v", d.MaxHops, d.Hops)
+	}
+
+	// vertex n-1 only points to itself and nobody points to it. The malformed edges are counted
+	broken := make([][]int, n)
+	for i := range broken {
+		broken[i] = []int{(i + 1) % (n - 1), (i + 1) % (n - 1)}
+	}
+	broken[n-1] = []int{n - 1, n}
+	d = DiagnoseGraph(broken, []int{0}, nil, 0, 0)
+	if d.Connected() || d.Components != 2 || d.SingletonCount != 1 || d.LargestComponent != n-1 || d.Unreachable != 1 {
+		t.Fatalf("the isolated vertex should disconnect the graph: %+v", d)
+	}
+	if d.SelfEdges != 1 || d.DuplicateEdges != n-1 || d.InvalidEdges != 1 || d.InDegree.Min != 0 {
+		t.Fatalf("unexpected edge counts %+v", d)
+	}
+
+	// points on a line: the two nearest neighbors, or two random vertices
+	vectors := make([][]float32, 1000)
+	for i := range vectors {
+		vectors[i] = []float32{float32(i), 0}
+	}
+	near := make([][]int, len(vectors))
+	random := make([][]int, len(vectors))
+	r := rand.New(rand.NewSource(1))
+	for i := range near {
+		near[i] = []int{max(i-1, 1-i), min(i+1, 2*len(vectors)-i-3)}
+		random[i] = []int{r.Intn(len(vectors)), r.Intn(len(vectors))}
+	}
+	if f := DiagnoseGraph(near, []int{0}, vectors, 500, 0).RandomEdgeFraction; f > 0.05 {
+		t.Fatalf("the nearest neighbors look random: %f", f)
+	}
+	if f := DiagnoseGraph(random, []int{0}, vectors, 500, 0).RandomEdgeFraction; f < 0.8 {
+		t.Fatalf("the random neighbors were not detected: %f", f)
+	}
+}
@@ -0,0 +1,150 @@
+package graphann
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filtered search
+// every vertex may carry a small list of uint32 attributes (e.g. a category or a date).
+// The attributes are fetched together with the vector and the neighbors,
+// and the predicate is evaluated on the client, so the server learns nothing about the filter.
+
+// a predicate on the attributes of a vertex
+type VertexFilter func(attrs []uint32) bool
+
+func AttrEquals(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] == value
+	}
+}
+
+func AttrNotEquals(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] != value
+	}
+}
+
+func AttrGreater(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] > value
+	}
+}
+
+func AttrGreaterOrEqual(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] >= value
+	}
+}
+
+func AttrLess(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] < value
+	}
+}
+
+func AttrLessOrEqual(col int, value uint32) VertexFilter {
+	return func(attrs []uint32) bool {
+		return col < len(attrs) && attrs[col] <= value
+	}
+}
+
+// all the filters have to match
+func AllOf(filters ...VertexFilter) VertexFilter {
+	return func(attrs []uint32) bool {
+		for _, f := range filters {
+			if !f(attrs) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ParseFilter parses expressions like "0=3", "1>1700000000" or "0=3,1<=20" (comma means and).
+// The left side is the attribute column, the right side an unsigned integer.
+func ParseFilter(expr string) (VertexFilter, error) {
+	// longer operators first, so that ">=" is not parsed as ">"
+	operators := []struct {
+		op  string
+		new func(int, uint32) VertexFilter
+	}{
+		{">=", AttrGreaterOrEqual},
+		{"<=", AttrLessOrEqual},
+		{"!=", AttrNotEquals},
+		{"=", AttrEquals},
+		{">", AttrGreater},
+		{"<", AttrLess},
+	}
+
+	filters := make([]VertexFilter, 0)
+	for _, clause := range strings.Split(expr, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		parsed := false
+		for _, o := range operators {
+			idx := strings.Index(clause, o.op)
+			if idx < 0 {
+				continue
+			}
+			col, err := strconv.Atoi(strings.TrimSpace(clause[:idx]))
+			if err != nil || col < 0 {
+				return nil, fmt.Errorf("invalid attribute column in %q", clause)
+			}
+			value, err := strconv.ParseUint(strings.TrimSpace(clause[idx+len(o.op):]), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in %q: %v", clause, err)
+			}
+			filters = append(filters, o.new(col, uint32(value)))
+			parsed = true
+			break
+		}
+		if !parsed {
+			return nil, fmt.Errorf("no operator in filter clause %q", clause)
+		}
+	}
+
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("empty filter %q", expr)
+	}
+	return AllOf(filters...), nil
+}
+
+// Filtered-Vamana style occlusion rule:
+// p may prune v from u's neighbors only if p carries every label shared by u and v.
+// Otherwise the pruned edge could be the only way to reach v for queries filtered on that label.
+func labelsCover(labels [][]uint32, p int, u int, v int) bool {
+	if labels == nil {
+		return true
+	}
+	for _, l := range labels[v] {
+		if !containsLabel(labels[u], l) {
+			continue
+		}
+		if !containsLabel(labels[p], l) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsLabel(labels []uint32, l uint32) bool {
+	for _, x := range labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+// use one attribute column as the (single) label of each vertex
+func LabelsFromAttrs(attrs [][]uint32, col int) [][]uint32 {
+	labels := make([][]uint32, len(attrs))
+	for i := range attrs {
+		labels[i] = []uint32{attrs[i][col]}
+	}
+	return labels
+}
@@ -5,6 +5,9 @@ go 1.22.1
 require (
 	github.com/evan176/hnswgo v0.0.0-20220622031020-39253a76f9e4
 	github.com/kshard/fvecs v0.0.1
-	github.com/kshedden/gonpy v0.0.0-20210519231815-fa3c8dd8e59b
 	github.com/yahoojapan/gongt v0.0.0-20190517050727-966dcc7aa5e8
 )
+
+require example.com/pianopir v0.0.0-00010101000000-000000000000
+
+replace example.com/pianopir => ../pianopir
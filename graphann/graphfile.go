@@ -0,0 +1,238 @@
+package graphann
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+)
+
+// the .graph container
+// a graph file that describes itself: the magic "PACGRAPH", a little-endian uint32 version and header length,
+// the GraphMeta as JSON, then the n*m neighbor ids as little-endian uint32. The header records how the graph
+// was built and a checksum of the vectors it was built for, so a graph is not silently used with another
+// vector file or another n, as a bare _graph.npy would be.
+
+const graphFileMagic = "PACGRAPH"
+const graphFileVersion = 1
+
+type GraphMeta struct {
+	Version           int     `json:"version"`
+	N                 int     `json:"n"`
+	M                 int     `json:"m"`
+	Dim               int     `json:"dim"`
+	Metric            string  `json:"metric"`
+	Builder           string  `json:"builder"` // "ngt", "hnsw", "random", ... or empty if unknown
+	Alpha             float32 `json:"alpha"`
+	Seed              int64   `json:"seed"`
+	MinInDegree       int     `json:"min_in_degree,omitempty"`       // see GraphBuildOptions
+	LongRangeFraction float64 `json:"long_range_fraction,omitempty"` // the chosen one if it was tuned
+	VectorFile        string  `json:"vector_file,omitempty"`         // informational only, the checksum identifies the vectors
+	VectorChecksum    string  `json:"vector_checksum,omitempty"`     // see VectorChecksum
+	StartVertices     []int   `json:"start_vertices,omitempty"`
+	GraphChecksum     string  `json:"graph_checksum"` // CRC-32C of the ids as stored
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+// a CRC-64 of the float32 values of the vectors, so the same vectors loaded from .fvecs or .npy match
+func VectorChecksum(vectors [][]float32) string {
+	h := crc64.New(crc64Table)
+	w := bufio.NewWriterSize(h, 1<<16)
+	buf := make([]byte, 4)
+	for _, v := range vectors {
+		for _, x := range v {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(x))
+			w.Write(buf)
+		}
+	}
+	w.Flush()
+	return fmt.Sprintf("crc64:%016x", h.Sum64())
+}
+
+// sqrt(n) distinct random vertices, drawn from seed
+func DefaultStartVertices(n int, seed int64) []int {
+	r := rand.New(rand.NewSource(seed))
+	num := int(math.Sqrt(float64(n)))
+	return r.Perm(n)[:num]
+}
+
+// the metadata of a graph built over the vectors with the default alpha and seed of the construction
+func NewGraphMeta(vectors [][]float32, graph [][]int, builder string) GraphMeta {
+	meta := GraphMeta{
+		Version:        graphFileVersion,
+		N:              len(graph),
+		Metric:         MetricL2.String(),
+		Builder:        builder,
+		Alpha:          DefaultPruneAlpha,
+		Seed:           GraphBuildSeed(),
+		VectorChecksum: VectorChecksum(vectors),
+	}
+	if len(graph) > 0 {
+		meta.M = len(graph[0])
+	}
+	if len(vectors) > 0 {
+		meta.Dim = len(vectors[0])
+	}
+	meta.StartVertices = DefaultStartVertices(meta.N, meta.Seed)
+	return meta
+}
+
+// check that the graph was built for these vectors
+func (meta GraphMeta) Validate(vectors [][]float32) error {
+	if meta.N != len(vectors) {
+		return fmt.Errorf("the graph was built for n = %d, got %d vectors", meta.N, len(vectors))
+	}
+	if meta.Dim > 0 && len(vectors) > 0 && meta.Dim != len(vectors[0]) {
+		return fmt.Errorf("the graph was built for dimension %d, got dimension %d", meta.Dim, len(vectors[0]))
+	}
+	if meta.VectorChecksum != "" {
+		if sum := VectorChecksum(vectors); sum != meta.VectorChecksum {
+			return fmt.Errorf("the graph was built for other vectors (checksum %s, got %s)", meta.VectorChecksum, sum)
+		}
+	}
+	return nil
+}
+
+// the ids of the rows as stored
+func encodeGraphRows(graph [][]int, m int) ([]byte, error) {
+	data := make([]byte, 4*m*len(graph))
+	for i, row := range graph {
+		if len(row) != m {
+			return nil, fmt.Errorf("row %d has %d neighbors, expected %d", i, len(row), m)
+		}
+		for j, v := range row {
+			if v < 0 || v > math.MaxUint32 {
+				return nil, fmt.Errorf("row %d: id %d does not fit in uint32", i, v)
+			}
+			binary.LittleEndian.PutUint32(data[4*(i*m+j):], uint32(v))
+		}
+	}
+	return data, nil
+}
+
+// write the graph with its metadata. N, M, the version and the graph checksum are set from the graph
+func SaveGraphWithMeta(filename string, graph [][]int, meta GraphMeta) error {
+	meta.Version = graphFileVersion
+	meta.N = len(graph)
+	meta.M = 0
+	if len(graph) > 0 {
+		meta.M = len(graph[0])
+	}
+	data, err := encodeGraphRows(graph, meta.M)
+	if err != nil {
+		return err
+	}
+	meta.GraphChecksum = fmt.Sprintf("crc32c:%08x", crc32.Checksum(data, crc32Table))
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+	w.WriteString(graphFileMagic)
+	binary.Write(w, binary.LittleEndian, [2]uint32{graphFileVersion, uint32(len(header))})
+	w.Write(header)
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func readGraphMeta(r io.Reader) (GraphMeta, error) {
+	magic := make([]byte, len(graphFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != graphFileMagic {
+		return GraphMeta{}, fmt.Errorf("not a .graph file (wrong magic number)")
+	}
+	var prefix [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &prefix); err != nil {
+		return GraphMeta{}, fmt.Errorf("reading the header length: %w", err)
+	}
+	if prefix[0] != graphFileVersion {
+		return GraphMeta{}, fmt.Errorf("unknown .graph version %d", prefix[0])
+	}
+	header := make([]byte, prefix[1])
+	if _, err := io.ReadFull(r, header); err != nil {
+		return GraphMeta{}, fmt.Errorf("reading the header: %w", err)
+	}
+	var meta GraphMeta
+	if err := json.Unmarshal(header, &meta); err != nil {
+		return GraphMeta{}, fmt.Errorf("parsing the header: %w", err)
+	}
+	return meta, nil
+}
+
+// only the metadata of a .graph file
+func ReadGraphMeta(filename string) (GraphMeta, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return GraphMeta{}, err
+	}
+	defer file.Close()
+	meta, err := readGraphMeta(bufio.NewReader(file))
+	if err != nil {
+		return GraphMeta{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return meta, nil
+}
+
+// read a .graph file and verify its checksum
+func LoadGraphWithMeta(filename string) ([][]int, GraphMeta, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, GraphMeta{}, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, 1<<20)
+	meta, err := readGraphMeta(r)
+	if err != nil {
+		return nil, meta, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	data := make([]byte, 4*meta.N*meta.M)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, meta, fmt.Errorf("%s: reading the rows: %w", filename, err)
+	}
+	if sum := fmt.Sprintf("crc32c:%08x", crc32.Checksum(data, crc32Table)); sum != meta.GraphChecksum {
+		return nil, meta, fmt.Errorf("%s: checksum mismatch (%s, expected %s), the file is corrupted", filename, sum, meta.GraphChecksum)
+	}
+
+	// one block of memory for all rows
+	memSpace := make([]int, meta.N*meta.M)
+	graph := make([][]int, meta.N)
+	for i := range graph {
+		graph[i] = memSpace[i*meta.M : (i+1)*meta.M]
+		for j := range graph[i] {
+			graph[i][j] = int(binary.LittleEndian.Uint32(data[4*(i*meta.M+j):]))
+		}
+	}
+	return graph, meta, nil
+}
+
+// read a .graph file built for exactly n vertices (n <= 0: any) of degree m (m <= 0: any)
+func LoadGraphContainer(filename string, n int, m int) ([][]int, error) {
+	graph, meta, err := LoadGraphWithMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 && meta.N != n {
+		return nil, fmt.Errorf("%s: the graph was built for n = %d, expected %d", filename, meta.N, n)
+	}
+	if m > 0 && meta.M != m {
+		return nil, fmt.Errorf("%s: the graph has degree %d, expected %d", filename, meta.M, m)
+	}
+	return graph, nil
+}
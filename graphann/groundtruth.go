@@ -0,0 +1,352 @@
+package graphann
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/kshard/fvecs"
+)
+
+// exact ground truth
+// a brute-force kNN over the base set, streamed in blocks so the base does not have to fit in memory
+// next to the queries. The queries are split over the threads, and every thread keeps the top-k of its
+// queries across the blocks.
+
+type Metric int
+
+const (
+	MetricL2           Metric = iota // squared L2 distance, as used by the search
+	MetricInnerProduct               // maximum inner product, the distance is the negated inner product
+	MetricCosine                     // the distance is 1 - cosine similarity
+)
+
+func ParseMetric(s string) (Metric, error) {
+	switch strings.ToLower(s) {
+	case "l2", "euclidean":
+		return MetricL2, nil
+	case "ip", "mips", "innerproduct":
+		return MetricInnerProduct, nil
+	case "cosine", "angular":
+		return MetricCosine, nil
+	default:
+		return MetricL2, fmt.Errorf("unknown metric %q, expected l2, ip or cosine", s)
+	}
+}
+
+func (m Metric) String() string {
+	switch m {
+	case MetricInnerProduct:
+		return "ip"
+	case MetricCosine:
+		return "cosine"
+	default:
+		return "l2"
+	}
+}
+
+// the distance of v1 and v2, smaller is closer.
+// For the cosine metric, the vectors have to be normalized (see prepare)
+func (m Metric) Dist(v1, v2 []float32) float32 {
+	switch m {
+	case MetricInnerProduct, MetricCosine:
+		d := float32(0)
+		if m == MetricCosine {
+			d = 1
+		}
+		return d - dot(v1, v2)
+	default:
+		if len(v1) < 8 {
+			// L2Dist needs at least one full SIMD block
+			d := float32(0)
+			for i := range v1 {
+				d += (v1[i] - v2[i]) * (v1[i] - v2[i])
+			}
+			return d
+		}
+		return L2Dist(v1, v2)
+	}
+}
+
+// normalized copies of the vectors for the cosine metric, the vectors themselves otherwise
+func (m Metric) prepare(vectors [][]float32) [][]float32 {
+	if m != MetricCosine {
+		return vectors
+	}
+	ret := make([][]float32, len(vectors))
+	for i, v := range vectors {
+		norm := math.Sqrt(float64(dot(v, v)))
+		ret[i] = make([]float32, len(v))
+		if norm == 0 {
+			continue
+		}
+		for j := range v {
+			ret[i][j] = float32(float64(v[j]) / norm)
+		}
+	}
+	return ret
+}
+
+// four accumulators, so the additions do not wait on each other
+func dot(v1, v2 []float32) float32 {
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(v1); i += 4 {
+		s0 += v1[i] * v2[i]
+		s1 += v1[i+1] * v2[i+1]
+		s2 += v1[i+2] * v2[i+2]
+		s3 += v1[i+3] * v2[i+3]
+	}
+	for ; i < len(v1); i++ {
+		s0 += v1[i] * v2[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+// the base vectors in blocks
+type BlockReader interface {
+	// the next block of at most the block size vectors, io.EOF after the last one
+	Next() ([][]float32, error)
+	Close() error
+}
+
+// the blocks of an in-memory matrix
+type sliceBlockReader struct {
+	vectors   [][]float32
+	blockSize int
+	pos       int
+}
+
+func (r *sliceBlockReader) Next() ([][]float32, error) {
+	if r.pos >= len(r.vectors) {
+		return nil, io.EOF
+	}
+	end := min(r.pos+r.blockSize, len(r.vectors))
+	block := r.vectors[r.pos:end]
+	r.pos = end
+	return block, nil
+}
+
+func (r *sliceBlockReader) Close() error {
+	return nil
+}
+
+func NewSliceBlockReader(vectors [][]float32, blockSize int) BlockReader {
+	return &sliceBlockReader{vectors: vectors, blockSize: max(blockSize, 1)}
+}
+
+// read the first n vectors of the file in blocks of blockSize. The formats of OpenVectorReader are streamed,
+// the other formats of LoadFloat32Matrix are loaded at once
+func OpenBlockReader(filename string, n int, dim int, blockSize int) (BlockReader, error) {
+	r, err := OpenVectorReader(filename)
+	if errors.Is(err, ErrUnsupportedFormat) {
+		vectors, err := LoadFloat32Matrix(filename, n, dim)
+		if err != nil {
+			return nil, err
+		}
+		return NewSliceBlockReader(vectors, blockSize), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dim > 0 && r.Dim() != dim {
+		r.Close()
+		return nil, fmt.Errorf("%s: dimension %d requested, the file has dimension %d", filename, dim, r.Dim())
+	}
+	return NewVectorBlockReader(r, n, blockSize), nil
+}
+
+// the exact k nearest neighbors of every query, closest first
+type GroundTruth struct {
+	Ids   [][]int
+	Dists [][]float32
+}
+
+// the sorted top-k of one query, like topKList. The base ids arrive in increasing order,
+// so among equal distances the smaller id is kept first
+type exactTopK struct {
+	k     int
+	items []IdWithDist
+}
+
+func (l *exactTopK) insert(id int, dist float32) {
+	if len(l.items) == l.k && dist >= l.items[l.k-1].dist {
+		return
+	}
+	pos := len(l.items)
+	for pos > 0 && l.items[pos-1].dist > dist {
+		pos--
+	}
+	if len(l.items) < l.k {
+		l.items = append(l.items, IdWithDist{})
+	}
+	copy(l.items[pos+1:], l.items[pos:len(l.items)-1])
+	l.items[pos] = IdWithDist{id: id, dist: dist}
+}
+
+// the exact k nearest neighbors of the queries over the base vectors of r, using threads goroutines
+// (0 = all CPUs). If the base has less than k vectors, the lists are shorter
+func ComputeGroundTruthFromReader(r BlockReader, queries [][]float32, k int, metric Metric, threads int) (GroundTruth, error) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	threads = max(min(threads, len(queries)), 1)
+	queries = metric.prepare(queries)
+
+	lists := make([]exactTopK, len(queries))
+	for i := range lists {
+		lists[i] = exactTopK{k: k, items: make([]IdWithDist, 0, k)}
+	}
+
+	offset := 0
+	for {
+		block, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return GroundTruth{}, err
+		}
+		block = metric.prepare(block)
+
+		// every thread scans the block for its share of the queries
+		var wg sync.WaitGroup
+		for t := 0; t < threads; t++ {
+			wg.Add(1)
+			go func(t int) {
+				defer wg.Done()
+				for i := t; i < len(queries); i += threads {
+					for j, v := range block {
+						lists[i].insert(offset+j, metric.Dist(queries[i], v))
+					}
+				}
+			}(t)
+		}
+		wg.Wait()
+		offset += len(block)
+	}
+
+	gt := GroundTruth{Ids: make([][]int, len(queries)), Dists: make([][]float32, len(queries))}
+	for i, l := range lists {
+		gt.Ids[i] = make([]int, len(l.items))
+		gt.Dists[i] = make([]float32, len(l.items))
+		for j, item := range l.items {
+			gt.Ids[i][j] = item.id
+			gt.Dists[i][j] = item.dist
+		}
+	}
+	return gt, nil
+}
+
+// the exact k nearest neighbors of the queries over in-memory base vectors, e.g. in tests
+func ComputeGroundTruth(base [][]float32, queries [][]float32, k int, metric Metric, threads int) GroundTruth {
+	gt, _ := ComputeGroundTruthFromReader(NewSliceBlockReader(base, 65536), queries, k, metric, threads)
+	return gt
+}
+
+// the file of the distances next to the ids file, e.g. gnd_dist.fvecs for gnd.ivecs.
+// An .ibin ground truth holds its distances itself
+func GroundTruthDistFile(filename string) string {
+	ext := filepath.Ext(filename)
+	if ext == ".ibin" {
+		return filename
+	}
+	distExt := ext
+	if ext == ".ivecs" {
+		distExt = ".fvecs"
+	}
+	return strings.TrimSuffix(filename, ext) + "_dist" + distExt
+}
+
+// write the ids to filename (.ivecs, .npy or .ibin) and the distances to GroundTruthDistFile(filename)
+func SaveGroundTruth(filename string, gt GroundTruth) error {
+	switch filepath.Ext(filename) {
+	case ".ibin":
+		return SaveBinGroundTruth(filename, gt)
+	case ".ivecs":
+		if err := SaveIvecsFile(filename, gt.Ids); err != nil {
+			return err
+		}
+		return SaveFvecsFile(GroundTruthDistFile(filename), gt.Dists)
+	case ".npy":
+		if err := SaveGraphToNpyFile(filename, gt.Ids); err != nil {
+			return err
+		}
+		return SaveFloat32MatrixToNpyFile(GroundTruthDistFile(filename), gt.Dists)
+	default:
+		return fmt.Errorf("unknown ground truth file extension: %s", filepath.Ext(filename))
+	}
+}
+
+// the first k ids of the first q queries (q <= 0: all) of a ground truth file. An .ibin file is read with
+// LoadBinGroundTruth, which tells the kNN layout from the range search layout; a query with fewer than k
+// results, e.g. in a range search ground truth, is an error
+func LoadGroundTruthIds(filename string, q int, k int) ([][]int, error) {
+	if filepath.Ext(filename) != ".ibin" {
+		return LoadIntMatrixFromFile(filename, q, k)
+	}
+	gt, err := LoadBinGroundTruth(filename)
+	if err != nil {
+		return nil, err
+	}
+	if q <= 0 {
+		q = len(gt.Ids)
+	}
+	if q > len(gt.Ids) {
+		return nil, fmt.Errorf("%s: %d queries requested, the ground truth has %d", filename, q, len(gt.Ids))
+	}
+	ids := make([][]int, q)
+	for i := range ids {
+		if len(gt.Ids[i]) < k {
+			return nil, fmt.Errorf("%s: query %d has %d results, fewer than k = %d (a range search ground truth?)", filename, i, len(gt.Ids[i]), k)
+		}
+		ids[i] = gt.Ids[i][:k]
+	}
+	return ids, nil
+}
+
+func SaveIvecsFile(filename string, matrix [][]int) error {
+	w, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	e := fvecs.NewEncoder[uint32](w)
+	for _, row := range matrix {
+		v := make([]uint32, len(row))
+		for j, val := range row {
+			v[j] = uint32(val)
+		}
+		if err := e.Write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SaveFvecsFile(filename string, matrix [][]float32) error {
+	w, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	e := fvecs.NewEncoder[float32](w)
+	for _, row := range matrix {
+		if err := e.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SaveFloat32MatrixToNpyFile(filename string, matrix [][]float32) error {
+	return SaveFloat32MatrixToNpy(filename, matrix, "float32")
+}
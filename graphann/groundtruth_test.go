@@ -0,0 +1,94 @@
+package graphann
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// the exact top-k by sorting all distances
+func naiveGroundTruth(base [][]float32, query []float32, k int, metric Metric) []int {
+	prepared := metric.prepare(base)
+	q := metric.prepare([][]float32{query})[0]
+	ids := make([]int, len(base))
+	for i := range ids {
+		ids[i] = i
+	}
+	sort.SliceStable(ids, func(a, b int) bool {
+		return metric.Dist(q, prepared[ids[a]]) < metric.Dist(q, prepared[ids[b]])
+	})
+	return ids[:min(k, len(ids))]
+}
+
+func TestGroundTruth(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	n, dim, k := 1000, 20, 10
+	base := genTestVectors(rng, n, dim)
+	queries := genTestVectors(rng, 30, dim)
+
+	for _, metric := range []Metric{MetricL2, MetricInnerProduct, MetricCosine} {
+		want := make([][]int, len(queries))
+		for i, query := range queries {
+			want[i] = naiveGroundTruth(base, query, k, metric)
+		}
+
+		// the result does not depend on the blocks or the threads
+		for _, blockSize := range []int{1, 7, 1000, 5000} {
+			for _, threads := range []int{1, 4} {
+				gt, err := ComputeGroundTruthFromReader(NewSliceBlockReader(base, blockSize), queries, k, metric, threads)
+				if err != nil {
+					t.Fatalf("%v: %v", metric, err)
+				}
+				for i := range queries {
+					for j := 0; j < k; j++ {
+						if gt.Ids[i][j] != want[i][j] {
+							t.Fatalf("%v, block size %d, %d threads: query %d got %v, want %v", metric, blockSize, threads, i, gt.Ids[i], want[i])
+						}
+						if j > 0 && gt.Dists[i][j] < gt.Dists[i][j-1] {
+							t.Fatalf("%v: the distances of query %d are not sorted: %v", metric, i, gt.Dists[i])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// fewer base vectors than k
+	gt := ComputeGroundTruth(base[:3], queries, k, MetricL2, 2)
+	if len(gt.Ids[0]) != 3 {
+		t.Fatalf("expected 3 results from a base of 3 vectors, got %d", len(gt.Ids[0]))
+	}
+
+	// the ivecs/fvecs files stream back to the same ground truth
+	dir := t.TempDir()
+	baseFile := filepath.Join(dir, "base.fvecs")
+	if err := SaveFvecsFile(baseFile, base); err != nil {
+		t.Fatalf("SaveFvecsFile: %v", err)
+	}
+	r, err := OpenBlockReader(baseFile, n, dim, 128)
+	if err != nil {
+		t.Fatalf("OpenBlockReader: %v", err)
+	}
+	defer r.Close()
+	streamed, err := ComputeGroundTruthFromReader(r, queries, k, MetricL2, 0)
+	if err != nil {
+		t.Fatalf("streamed ground truth: %v", err)
+	}
+	gndFile := filepath.Join(dir, "gnd.ivecs")
+	if err := SaveGroundTruth(gndFile, streamed); err != nil {
+		t.Fatalf("SaveGroundTruth: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gnd_dist.fvecs")); err != nil {
+		t.Fatalf("the distances were not written: %v", err)
+	}
+	loaded, err := LoadIntMatrixFromFile(gndFile, len(queries), k)
+	if err != nil {
+		t.Fatalf("LoadIntMatrixFromFile: %v", err)
+	}
+	want := ComputeGroundTruth(base, queries, k, MetricL2, 1)
+	if recall := ComputeRecall(want.Ids, loaded, k); recall != 1 {
+		t.Fatalf("the saved ground truth has recall %f against the in-memory one", recall)
+	}
+}
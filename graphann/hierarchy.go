@@ -0,0 +1,272 @@
+package graphann
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hierarchical search
+// the coarse level is a small graph over a random sample of the vertices, served by its own PIR DB.
+// Its entries are much cheaper to fetch, so the first rounds navigate it to get close to the query.
+// Each coarse entry also stores the neighbors of the vertex in the full graph (its links),
+// so the best coarse vertices can be expanded in the full graph right away.
+
+type CoarseLevel struct {
+	Ids           []int        // the full-graph id of each coarse vertex
+	Graph         GetGraphInfo // the coarse graph over local ids 0..len(Ids)-1, with Links set
+	StartVertices []Vertex
+}
+
+func (c *CoarseLevel) Preprocess() {
+	if err := c.PreprocessContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// same as Preprocess, but return the error of the coarse graph instead of panicking
+func (c *CoarseLevel) PreprocessContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.Graph.Preprocess(); err != nil {
+		return fmt.Errorf("graphann: preprocessing the coarse graph: %w", err)
+	}
+	v, err := c.Graph.GetStartVertex()
+	if err != nil {
+		return fmt.Errorf("graphann: fetching the coarse start vertices: %w", err)
+	}
+	c.StartVertices = v
+	return nil
+}
+
+// remembers the vertices fetched during one coarse search
+type vertexCache struct {
+	GetGraphInfo
+	vertices map[int]Vertex
+}
+
+func (c *vertexCache) GetVertexInfo(ids []int) ([]Vertex, error) {
+	vertices, err := c.GetGraphInfo.GetVertexInfo(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vertices {
+		c.vertices[v.Id] = v
+	}
+	return vertices, nil
+}
+
+// run CoarseSteps rounds on the coarse level, and return the best vertices as full-graph start vertices
+func (g GraphANNFrontend) searchCoarse(ctx context.Context, queryVector []float32, parallel int, benchmarking bool) ([]Vertex, SearchStats, error) {
+	cache := &vertexCache{GetGraphInfo: g.Coarse.Graph, vertices: map[int]Vertex{}}
+	for _, v := range g.Coarse.StartVertices {
+		cache.vertices[v.Id] = v
+	}
+	coarse := GraphANNFrontend{
+		Graph:           cache,
+		EarlyStop:       g.EarlyStop,
+		Patience:        g.Patience,
+		SkipDummyRounds: g.SkipDummyRounds,
+		TrackRounds:     g.TrackRounds,
+		Trace:           g.Trace,
+	}
+	// a few more than parallel, in case some of them are already known
+	results, stats, err := coarse.searchKNNFrom(ctx, g.Coarse.StartVertices, queryVector, 2*parallel, g.CoarseSteps, parallel, benchmarking)
+	if err != nil {
+		return nil, stats, fmt.Errorf("coarse level: %w", err)
+	}
+
+	// the snapshots and traces of the coarse rounds, in full-graph ids
+	toGlobal := func(ids []int) {
+		for i, id := range ids {
+			ids[i] = g.Coarse.Ids[id]
+		}
+	}
+	for _, ids := range stats.RoundTopK {
+		toGlobal(ids)
+	}
+	for _, round := range stats.Trace {
+		toGlobal(round.Expanded)
+		toGlobal(round.Fetched)
+		toGlobal(round.Failed)
+	}
+
+	start := make([]Vertex, 0, len(results))
+	for _, r := range results {
+		v := cache.vertices[r.Id]
+		start = append(start, Vertex{Id: g.Coarse.Ids[r.Id], Vector: v.Vector, Neighbors: v.Links, Attrs: v.Attrs})
+	}
+	return start, stats, nil
+}
+
+// the statistics of the whole search. The fine rounds come after coarseSteps coarse rounds
+func mergeLevelStats(coarse SearchStats, fine SearchStats, coarseSteps int) SearchStats {
+	stats := SearchStats{
+		IssuedRounds:   coarse.IssuedRounds + fine.IssuedRounds,
+		DummyRounds:    coarse.DummyRounds + fine.DummyRounds,
+		ConvergedRound: -1,
+		StableRound:    coarse.StableRound,
+		SpecHits:       fine.SpecHits,
+		RoundTopK:      append(coarse.RoundTopK, fine.RoundTopK...),
+		Trace:          coarse.Trace,
+	}
+	for _, round := range fine.Trace {
+		round.Round += coarseSteps
+		stats.Trace = append(stats.Trace, round)
+	}
+	if fine.ConvergedRound >= 0 {
+		stats.ConvergedRound = coarseSteps + fine.ConvergedRound
+	}
+	if fine.StableRound > 0 {
+		stats.StableRound = coarseSteps + fine.StableRound
+	}
+	return stats
+}
+
+// sample sampleNum vertices and connect them by a pruned exact kNN graph of degree m.
+// It returns the sampled ids and the graph over the local ids. The sample and the random fill come from seed
+func BuildCoarseGraph(vectors [][]float32, sampleNum int, m int, seed int64) ([]int, [][]int) {
+	n := len(vectors)
+	sampleNum = min(sampleNum, n)
+	m = min(m, sampleNum-1)
+	start := time.Now()
+
+	r := rand.New(rand.NewSource(seed))
+	ids := r.Perm(n)[:sampleNum]
+	sort.Ints(ids)
+	sample := make([][]float32, sampleNum)
+	for i, id := range ids {
+		sample[i] = vectors[id]
+	}
+
+	alpha := float32(1.2)
+	graph := make([][]int, sampleNum)
+
+	maxThread := graphBuildThreads(16)
+	var wg sync.WaitGroup
+	wg.Add(maxThread)
+	perThreadVertices := (sampleNum + maxThread - 1) / maxThread
+	for t := 0; t < maxThread; t++ {
+		go func(start, end int) {
+			defer wg.Done()
+			candidates := make([]IdWithDist, 0, sampleNum)
+			for u := start; u < end; u++ {
+				candidates = candidates[:0]
+				for v := 0; v < sampleNum; v++ {
+					if v != u {
+						candidates = append(candidates, IdWithDist{id: v, dist: L2Dist(sample[u], sample[v])})
+					}
+				}
+				sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+				nearest := make([]int, 0, 2*m)
+				for i := 0; i < 2*m && i < len(candidates); i++ {
+					nearest = append(nearest, candidates[i].id)
+				}
+				graph[u] = robustPrune(sample, u, nearest, m, alpha)
+			}
+		}(t*perThreadVertices, min((t+1)*perThreadVertices, sampleNum))
+	}
+	wg.Wait()
+
+	// add the reverse edges, prune again, and fill with random neighbors
+	biGraph := make([][]int, sampleNum)
+	for u := 0; u < sampleNum; u++ {
+		for _, v := range graph[u] {
+			biGraph[u] = append(biGraph[u], v)
+			biGraph[v] = append(biGraph[v], u)
+		}
+	}
+	for u := 0; u < sampleNum; u++ {
+		connection := dedup(biGraph[u])
+		if len(connection) > m {
+			connection = robustPrune(sample, u, connection, m, alpha)
+		}
+		for len(connection) < m {
+			v := r.Intn(sampleNum)
+			if v != u && !contains(connection, v) {
+				connection = append(connection, v)
+			}
+		}
+		graph[u] = connection
+	}
+
+	fmt.Println("Coarse graph built, time = ", time.Since(start))
+	return ids, graph
+}
+
+func dedup(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	ret := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+func contains(ids []int, x int) bool {
+	for _, id := range ids {
+		if id == x {
+			return true
+		}
+	}
+	return false
+}
+
+// an in-memory coarse level, the vertices carry their full-graph neighbors as links
+type BasicCoarseGraphInfo struct {
+	BasicGraphInfo
+	Links [][]int
+}
+
+func (g *BasicCoarseGraphInfo) GetVertexInfo(ids []int) ([]Vertex, error) {
+	vertices, err := g.BasicGraphInfo.GetVertexInfo(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		vertices[i].Links = g.Links[id]
+	}
+	return vertices, nil
+}
+
+func (g *BasicCoarseGraphInfo) GetStartVertex() ([]Vertex, error) {
+	targetNum := int(math.Sqrt(float64(g.N)))
+	batch := make([]int, targetNum)
+	for i := 0; i < targetNum; i++ {
+		batch[i] = i
+	}
+	return g.GetVertexInfo(batch)
+}
+
+// the in-memory coarse level of a full graph
+func NewBasicCoarseLevel(vectors [][]float32, graph [][]int, attrs [][]uint32, ids []int, coarseGraph [][]int) *CoarseLevel {
+	info := &BasicCoarseGraphInfo{
+		BasicGraphInfo: BasicGraphInfo{
+			N:       len(ids),
+			Dim:     len(vectors[0]),
+			M:       len(coarseGraph[0]),
+			Graph:   coarseGraph,
+			Vectors: make([][]float32, len(ids)),
+		},
+		Links: make([][]int, len(ids)),
+	}
+	if attrs != nil {
+		info.Attrs = make([][]uint32, len(ids))
+	}
+	for i, id := range ids {
+		info.Vectors[i] = vectors[id]
+		info.Links[i] = graph[id]
+		if attrs != nil {
+			info.Attrs[i] = attrs[id]
+		}
+	}
+	return &CoarseLevel{Ids: ids, Graph: info}
+}
@@ -0,0 +1,74 @@
+package graphann
+
+import (
+	"context"
+	"fmt"
+)
+
+// interleaved batch search
+// SearchKNNBatch runs the queries one after another, so it pays len(queryVectors) * maxStep round trips.
+// SearchKNNInterleaved advances all the queries in lockstep instead: each round, the batches of all
+// the queries are concatenated into one GetVertexInfo call of len(queryVectors) * m * parallel ids
+// (plus the speculative ids), so the whole batch takes maxStep rounds.
+// Every query contributes a full batch in every round, even after it converged.
+// The hierarchical and split modes are not supported, the queries start from StartVertices.
+func (g GraphANNFrontend) SearchKNNInterleaved(queryVectors [][]float32, k int, maxStep int, parallel int, benchmarking bool) ([][]int, [][]int, []SearchStats) {
+	results, stats, err := g.SearchKNNInterleavedContext(context.Background(), queryVectors, k, maxStep, parallel, benchmarking)
+	if err != nil {
+		fmt.Printf("Error when querying vertices: %v\n", err)
+		panic(err)
+	}
+	ret := make([][]int, len(queryVectors))
+	stepRet := make([][]int, len(queryVectors))
+	for i := range results {
+		ret[i], stepRet[i] = padResults(results[i], k)
+	}
+	return ret, stepRet, stats
+}
+
+// the context-aware form of SearchKNNInterleaved, see SearchKNNContext.
+// A failed round fails all the queries, each of them returns the results found before it.
+func (g GraphANNFrontend) SearchKNNInterleavedContext(ctx context.Context, queryVectors [][]float32, k int, maxStep int, parallel int, benchmarking bool) ([][]SearchResult, []SearchStats, error) {
+	searches := make([]*knnSearch, len(queryVectors))
+	for i, queryVector := range queryVectors {
+		searches[i] = g.newKNNSearch(g.StartVertices, queryVector, k, parallel, benchmarking)
+	}
+
+	var err error
+	for step := 0; step < maxStep; step++ {
+		if err = checkRound(ctx, step); err != nil {
+			break
+		}
+		batchQ := make([]int, 0)
+		offsets := make([]int, len(searches)+1)
+		for i, s := range searches {
+			offsets[i] = len(batchQ)
+			if !s.done() {
+				batchQ = append(batchQ, s.nextBatch()...)
+			}
+		}
+		offsets[len(searches)] = len(batchQ)
+		if len(batchQ) == 0 {
+			// all the queries converged and skip their dummy rounds
+			break
+		}
+
+		queryResults, lookupErr := g.Graph.GetVertexInfo(batchQ)
+		if lookupErr != nil {
+			err = &RoundError{Round: step, Err: lookupErr}
+			break
+		}
+		for i, s := range searches {
+			if offsets[i] < offsets[i+1] {
+				s.absorb(step, queryResults[offsets[i]:offsets[i+1]])
+			}
+		}
+	}
+
+	results := make([][]SearchResult, len(queryVectors))
+	stats := make([]SearchStats, len(queryVectors))
+	for i, s := range searches {
+		results[i], stats[i] = s.results()
+	}
+	return results, stats, err
+}
@@ -4,13 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/kshard/fvecs"
-	"github.com/kshedden/gonpy"
 )
 
 func LoadBvecsFile(filename string, n int, dim int) ([][]float32, error) {
@@ -160,43 +160,29 @@ func LoadFloat32MatrixFromTxt(filename string, n int, dim int) ([][]float32, err
 	return LoadTxtFileFloat32(filename, n, dim)
 }
 
+// any dtype and either order of the .npy format, see npy.go
 func LoadFloat32MatrixFromNpy(filename string, n int, dim int) ([][]float32, error) {
-	r, err := gonpy.NewFileReader(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
+	defer file.Close()
 
-	shape := r.Shape
-
-	// check the shape
-	if len(shape) != 2 || shape[0] < n || shape[1] != dim {
-		fmt.Printf("Invalid shape: %v\n", shape)
-		fmt.Printf("Expected shape: (%d, %d)\n", n, dim)
-		return nil, fmt.Errorf("invalid shape: %v", shape)
-	}
-
-	data, err := r.GetFloat64()
+	ret, err := readNpyFloat32Matrix(file, n, dim)
 	if err != nil {
 		fmt.Println(err)
-		return nil, err
-	}
-
-	// we now convert the data to a 2D slice
-	ret := make([][]float32, n)
-	for i := 0; i < n; i++ {
-		ret[i] = make([]float32, dim)
-		for j := 0; j < dim; j++ {
-			ret[i][j] = float32(data[i*dim+j])
-		}
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-
 	return ret, nil
 }
 
 func LoadFloat32Matrix(filename string, n int, dim int) ([][]float32, error) {
 	// first we check the file extension
 	ext := filepath.Ext(filename)
+	if isNpzPath(filename) {
+		return LoadFloat32MatrixFromNpz(filename, n, dim)
+	}
 
 	// write a if case for each extension
 	switch ext {
@@ -208,6 +194,8 @@ func LoadFloat32Matrix(filename string, n int, dim int) ([][]float32, error) {
 		return LoadFloat32MatrixFromTxt(filename, n, dim)
 	case ".npy":
 		return LoadFloat32MatrixFromNpy(filename, n, dim)
+	case ".fbin", ".u8bin", ".i8bin":
+		return LoadFloat32MatrixFromBin(filename, n, dim)
 	default:
 		fmt.Printf("Unknown file extension: %s\n", ext)
 		return nil, fmt.Errorf("unknown file extension: %s", ext)
@@ -215,35 +203,18 @@ func LoadFloat32Matrix(filename string, n int, dim int) ([][]float32, error) {
 }
 
 func LoadGraphFromNpyFile(filename string, n int, m int) ([][]int, error) {
-	r, err := gonpy.NewFileReader(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
+	defer file.Close()
 
-	shape := r.Shape
-
-	// check the shape
-	if len(shape) != 2 || shape[0] < n || shape[1] != m {
-		fmt.Printf("Invalid shape: %v\n", shape)
-		return nil, fmt.Errorf("invalid shape: %v", shape)
-	}
-
-	data, err := r.GetInt32()
+	ret, err := readNpyIntMatrix(file, n, m)
 	if err != nil {
 		fmt.Println(err)
-		return nil, err
-	}
-
-	// we now convert the data to a 2D slice
-	ret := make([][]int, n)
-	for i := 0; i < n; i++ {
-		ret[i] = make([]int, m)
-		for j := 0; j < m; j++ {
-			ret[i][j] = int(data[i*m+j])
-		}
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-
 	return ret, nil
 }
 
@@ -286,6 +257,9 @@ func LoadGraphFromTxtFile(filename string, n int, m int) ([][]int, error) {
 
 func LoadGraphFromFile(filename string, n int, m int) ([][]int, error) {
 	ext := filepath.Ext(filename)
+	if isNpzPath(filename) {
+		return LoadIntMatrixFromNpz(filename, n, m)
+	}
 	switch ext {
 	case ".npy":
 		return LoadGraphFromNpyFile(filename, n, m)
@@ -293,6 +267,10 @@ func LoadGraphFromFile(filename string, n int, m int) ([][]int, error) {
 		return LoadGraphFromTxtFile(filename, n, m)
 	case ".ivecs":
 		return LoadIvecsFile(filename, n, m)
+	case ".ibin":
+		return LoadIbinFile(filename, n, m)
+	case ".graph":
+		return LoadGraphContainer(filename, n, m)
 	default:
 		fmt.Printf("Unknown file extension: %s\n", ext)
 		return nil, fmt.Errorf("unknown file extension: %s", ext)
@@ -303,26 +281,17 @@ func LoadIntMatrixFromFile(filename string, n int, m int) ([][]int, error) {
 	return LoadGraphFromFile(filename, n, m) // same thing
 }
 
+// int32, or uint32 if the ids do not fit
 func SaveGraphToNpyFile(filename string, graph [][]int) error {
-	n := len(graph)
-	m := len(graph[0])
-
-	data := make([]int32, n*m)
-	for i := 0; i < n; i++ {
-		for j := 0; j < m; j++ {
-			data[i*m+j] = int32(graph[i][j])
+	dtype := "int32"
+	for _, row := range graph {
+		for _, v := range row {
+			if v > math.MaxInt32 {
+				dtype = "uint32"
+			}
 		}
 	}
-
-	w, err := gonpy.NewFileWriter(filename)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	w.Shape = []int{n, m}
-	err = w.WriteInt32(data)
-	return err
+	return SaveIntMatrixToNpy(filename, graph, dtype)
 }
 
 func SaveGraphToTxtFile(filename string, graph [][]int) error {
@@ -353,6 +322,13 @@ func SaveGraphToFile(filename string, graph [][]int) error {
 		return SaveGraphToNpyFile(filename, graph)
 	case ".txt":
 		return SaveGraphToTxtFile(filename, graph)
+	case ".ivecs":
+		return SaveIvecsFile(filename, graph)
+	case ".ibin":
+		return SaveIbinFile(filename, graph)
+	case ".graph":
+		// without the vectors, only the shape is recorded. Use SaveGraphWithMeta for the full metadata
+		return SaveGraphWithMeta(filename, graph, GraphMeta{})
 	default:
 		fmt.Printf("Unknown file extension: %s\n", ext)
 		return fmt.Errorf("unknown file extension: %s", ext)
@@ -1,8 +1,13 @@
 package graphann
 
 import (
+	"archive/zip"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -140,3 +145,511 @@ func TestIvecsLoad(t *testing.T) {
 	fmt.Println("Shape of gnd", len(gnd), len(gnd[0]))
 	fmt.Println(gnd[0][0:5])
 }
+
+func TestBinFormats(t *testing.T) {
+	dir := t.TempDir()
+	n, d := 6, 4
+	matrix := make([][]float32, n)
+	for i := range matrix {
+		matrix[i] = make([]float32, d)
+		for j := range matrix[i] {
+			matrix[i][j] = float32(i*d + j - 10) // the .u8bin rows are shifted below
+		}
+	}
+
+	for _, ext := range []string{".fbin", ".u8bin", ".i8bin"} {
+		rows := matrix
+		if ext == ".u8bin" {
+			rows = make([][]float32, n)
+			for i := range rows {
+				rows[i] = make([]float32, d)
+				for j := range rows[i] {
+					rows[i][j] = matrix[i][j] + 10
+				}
+			}
+		}
+		filename := filepath.Join(dir, "base"+ext)
+		if err := SaveBinFile(filename, rows); err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+
+		// a sliced read through the extension dispatch
+		loaded, err := LoadFloat32Matrix(filename, 4, d)
+		if err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		if len(loaded) != 4 {
+			t.Fatalf("%s: expected the first 4 rows, got %d", ext, len(loaded))
+		}
+		for i := range loaded {
+			for j := range loaded[i] {
+				if loaded[i][j] != rows[i][j] {
+					t.Fatalf("%s: row %d is %v, expected %v", ext, i, loaded[i], rows[i])
+				}
+			}
+		}
+		if _, err := LoadFloat32Matrix(filename, n+1, d); err == nil {
+			t.Fatalf("%s: reading more rows than the file holds should fail", ext)
+		}
+		if _, err := LoadFloat32Matrix(filename, n, d+1); err == nil {
+			t.Fatalf("%s: a wrong dimension should fail", ext)
+		}
+	}
+
+	// a kNN ground truth: the ids load as an integer matrix, and with their distances
+	gt := GroundTruth{Ids: [][]int{{3, 1, 2}, {0, 5, 4}}, Dists: [][]float32{{0.5, 1, 2}, {0, 0.25, 3}}}
+	gndFile := filepath.Join(dir, "gnd.ibin")
+	if err := SaveGroundTruth(gndFile, gt); err != nil {
+		t.Fatalf("SaveGroundTruth: %v", err)
+	}
+	ids, err := LoadIntMatrixFromFile(gndFile, 2, 2)
+	if err != nil {
+		t.Fatalf("LoadIntMatrixFromFile: %v", err)
+	}
+	if ComputeRecall(gt.Ids, ids, 3) != 1 {
+		t.Fatalf("the ids are %v, expected %v", ids, gt.Ids)
+	}
+	loaded, err := LoadBinGroundTruth(gndFile)
+	if err != nil {
+		t.Fatalf("LoadBinGroundTruth: %v", err)
+	}
+	for i := range gt.Ids {
+		for j := range gt.Ids[i] {
+			if loaded.Ids[i][j] != gt.Ids[i][j] || loaded.Dists[i][j] != gt.Dists[i][j] {
+				t.Fatalf("query %d is %v %v, expected %v %v", i, loaded.Ids[i], loaded.Dists[i], gt.Ids[i], gt.Dists[i])
+			}
+		}
+	}
+
+	// a range search ground truth, with 2, 0 and 1 results
+	rangeFile := filepath.Join(dir, "range.ibin")
+	file, err := os.Create(rangeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, values := range []interface{}{[]int32{3, 3}, []int32{2, 0, 1}, []int32{7, 8, 9}, []float32{0.1, 0.2, 0.3}} {
+		if err := binary.Write(file, binary.LittleEndian, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+	ranged, err := LoadBinGroundTruth(rangeFile)
+	if err != nil {
+		t.Fatalf("LoadBinGroundTruth (range): %v", err)
+	}
+	if len(ranged.Ids) != 3 || len(ranged.Ids[0]) != 2 || len(ranged.Ids[1]) != 0 || ranged.Ids[2][0] != 9 || ranged.Dists[2][0] != 0.3 {
+		t.Fatalf("unexpected range ground truth: %v %v", ranged.Ids, ranged.Dists)
+	}
+
+	// the ids for the recall: the top-k of the kNN layout, and an error for a query with fewer than k results
+	top, err := LoadGroundTruthIds(gndFile, 0, 2)
+	if err != nil {
+		t.Fatalf("LoadGroundTruthIds: %v", err)
+	}
+	if len(top) != 2 || len(top[0]) != 2 || top[0][0] != 3 || top[1][1] != 5 {
+		t.Fatalf("expected the first 2 ids of every query, got %v", top)
+	}
+	if _, err := LoadGroundTruthIds(rangeFile, 3, 1); err == nil {
+		t.Fatalf("a query without results should not give a top-1")
+	}
+	if top, err := LoadGroundTruthIds(rangeFile, 1, 2); err != nil || top[0][0] != 7 || top[0][1] != 8 {
+		t.Fatalf("the first query has 2 results, got %v, %v", top, err)
+	}
+}
+
+func TestProbeMatrixFile(t *testing.T) {
+	dir := t.TempDir()
+	n, d := 5, 12
+	matrix := make([][]float32, n)
+	ints := make([][]int, n)
+	for i := range matrix {
+		matrix[i] = make([]float32, d)
+		ints[i] = make([]int, d)
+		for j := range matrix[i] {
+			matrix[i][j] = float32(i + j)
+			ints[i][j] = i + j
+		}
+	}
+
+	files := map[string]func(string) error{
+		"base.fvecs": func(f string) error { return SaveFvecsFile(f, matrix) },
+		"base.npy":   func(f string) error { return SaveFloat32MatrixToNpyFile(f, matrix) },
+		"base.fbin":  func(f string) error { return SaveBinFile(f, matrix) },
+		"base.u8bin": func(f string) error { return SaveBinFile(f, matrix) },
+		"gnd.ivecs":  func(f string) error { return SaveIvecsFile(f, ints) },
+		"gnd.ibin":   func(f string) error { return SaveIbinFile(f, ints) },
+		"graph.txt":  func(f string) error { return SaveGraphToTxtFile(f, ints) },
+	}
+	for name, save := range files {
+		filename := filepath.Join(dir, name)
+		if err := save(filename); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		info, err := ProbeMatrixFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if info.Rows != n || info.Dim != d {
+			t.Fatalf("%s: detected shape (%d, %d), expected (%d, %d)", name, info.Rows, info.Dim, n, d)
+		}
+	}
+
+	// the shape is inferred, and the requested one is checked
+	vectors, info, err := LoadFloat32MatrixWithInfo(filepath.Join(dir, "base.fvecs"), 0, 0)
+	if err != nil || len(vectors) != n || info.Dim != d {
+		t.Fatalf("expected all %d vectors, got %d (%v)", n, len(vectors), err)
+	}
+	if vectors, _, err = LoadFloat32MatrixWithInfo(filepath.Join(dir, "base.u8bin"), 3, d); err != nil || len(vectors) != 3 {
+		t.Fatalf("expected the first 3 vectors, got %d (%v)", len(vectors), err)
+	}
+	if _, _, err = LoadFloat32MatrixWithInfo(filepath.Join(dir, "base.fbin"), n+1, 0); err == nil {
+		t.Fatalf("reading more rows than the file holds should fail")
+	}
+	if _, _, err = LoadFloat32MatrixWithInfo(filepath.Join(dir, "base.fbin"), 0, d-1); err == nil {
+		t.Fatalf("a wrong dimension should fail")
+	}
+	gnd, _, err := LoadIntMatrixWithInfo(filepath.Join(dir, "gnd.ivecs"), 0, 10)
+	if err != nil || len(gnd) != n || len(gnd[0]) != d {
+		t.Fatalf("expected the full ground truth, got %d rows (%v)", len(gnd), err)
+	}
+	if _, _, err = LoadIntMatrixWithInfo(filepath.Join(dir, "gnd.ibin"), 0, d+1); err == nil {
+		t.Fatalf("reading more columns than the file holds should fail")
+	}
+}
+
+// a .npy file written by hand, e.g. with a byte order or layout SaveFloat32MatrixToNpy does not write
+func writeTestNpy(t *testing.T, filename string, descr string, shape string, data interface{}) {
+	writeTestNpyOrder(t, filename, descr, false, shape, data)
+}
+
+func writeTestNpyOrder(t *testing.T, filename string, descr string, fortran bool, shape string, data interface{}) {
+	order := "False"
+	if fortran {
+		order = "True"
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': %s, }", descr, order, shape)
+	for (10+len(header)+1)%64 != 0 {
+		header += " "
+	}
+	header += "\n"
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write([]byte("\x93NUMPY\x01\x00"))
+	binary.Write(file, binary.LittleEndian, uint16(len(header)))
+	file.Write([]byte(header))
+	byteOrder := binary.ByteOrder(binary.LittleEndian)
+	if descr[0] == '>' {
+		byteOrder = binary.BigEndian
+	}
+	if err := binary.Write(file, byteOrder, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVectorReader(t *testing.T) {
+	dir := t.TempDir()
+	n, d := 7, 9
+	matrix := make([][]float32, n)
+	for i := range matrix {
+		matrix[i] = make([]float32, d)
+		for j := range matrix[i] {
+			matrix[i][j] = float32(i*d+j) / 2
+		}
+	}
+	if err := SaveFvecsFile(filepath.Join(dir, "base.fvecs"), matrix); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveBinFile(filepath.Join(dir, "base.fbin"), matrix); err != nil {
+		t.Fatal(err)
+	}
+	// 0.5 steps are exact in float16: 0x3800 = 0.5, 0x3c00 = 1, ...
+	half := make([]uint16, n*d)
+	for i := range half {
+		half[i] = float32ToFloat16(float32(i) / 2)
+	}
+	writeTestNpy(t, filepath.Join(dir, "base.npy"), "<f2", fmt.Sprintf("(%d, %d)", n, d), half)
+
+	for _, name := range []string{"base.fvecs", "base.fbin", "base.npy"} {
+		r, err := OpenVectorReader(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if r.Rows() != n || r.Dim() != d {
+			t.Fatalf("%s: shape (%d, %d), expected (%d, %d)", name, r.Rows(), r.Dim(), n, d)
+		}
+		rows, err := r.ReadRows(2, 5, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i := range rows {
+			for j := range rows[i] {
+				if rows[i][j] != matrix[i+2][j] {
+					t.Fatalf("%s: row %d is %v, expected %v", name, i+2, rows[i], matrix[i+2])
+				}
+			}
+		}
+		if _, err := r.ReadRows(5, n+1, nil); err == nil {
+			t.Fatalf("%s: reading past the last row should fail", name)
+		}
+		r.Close()
+
+		// the blocks cover all rows once
+		br, err := OpenBlockReader(filepath.Join(dir, name), 0, d, 3)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		seen := 0
+		for {
+			block, err := br.Next()
+			if err != nil {
+				break
+			}
+			for _, row := range block {
+				if row[0] != matrix[seen][0] {
+					t.Fatalf("%s: block row %d starts with %f, expected %f", name, seen, row[0], matrix[seen][0])
+				}
+				seen++
+			}
+		}
+		br.Close()
+		if seen != n {
+			t.Fatalf("%s: the blocks have %d rows, expected %d", name, seen, n)
+		}
+
+		mapped, mr, err := MapFloat32Matrix(filepath.Join(dir, name), 4, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(mapped) != 4 || mapped[3][d-1] != matrix[3][d-1] {
+			t.Fatalf("%s: unexpected mapped rows %v", name, mapped)
+		}
+		mr.Close()
+	}
+
+	// the float16 special values
+	for bits, want := range map[uint16]float32{0x0000: 0, 0x3c00: 1, 0xc000: -2, 0x7bff: 65504, 0x0001: 1.0 / (1 << 24)} {
+		if got := float16ToFloat32(bits); got != want {
+			t.Fatalf("float16 %#04x is %g, expected %g", bits, got, want)
+		}
+	}
+	if got := float16ToFloat32(0x7c00); !math.IsInf(float64(got), 1) {
+		t.Fatalf("float16 0x7c00 is %g, expected +Inf", got)
+	}
+}
+
+func TestNpyFormats(t *testing.T) {
+	dir := t.TempDir()
+	n, d := 5, 3
+	matrix := make([][]float32, n)
+	for i := range matrix {
+		matrix[i] = make([]float32, d)
+		for j := range matrix[i] {
+			matrix[i][j] = float32(i*d + j)
+		}
+	}
+	equal := func(name string, got [][]float32, rows int) {
+		if len(got) != rows {
+			t.Fatalf("%s: %d rows, expected %d", name, len(got), rows)
+		}
+		for i := range got {
+			for j := range got[i] {
+				if got[i][j] != matrix[i][j] {
+					t.Fatalf("%s: row %d is %v, expected %v", name, i, got[i], matrix[i])
+				}
+			}
+		}
+	}
+
+	// every dtype round trips the small integers
+	for _, dtype := range []string{"float16", "float32", "float64", "uint8", "int8", "int32", "int64", "uint32"} {
+		filename := filepath.Join(dir, dtype+".npy")
+		if err := SaveFloat32MatrixToNpy(filename, matrix, dtype); err != nil {
+			t.Fatalf("%s: %v", dtype, err)
+		}
+		got, info, err := LoadFloat32MatrixWithInfo(filename, 0, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", dtype, err)
+		}
+		if info.Rows != n || info.Dim != d {
+			t.Fatalf("%s: shape (%d, %d), expected (%d, %d)", dtype, info.Rows, info.Dim, n, d)
+		}
+		equal(dtype, got, n)
+		ints, err := LoadIntMatrixFromFile(filename, 2, d)
+		if err != nil || len(ints) != 2 || ints[1][2] != int(matrix[1][2]) {
+			t.Fatalf("%s: unexpected integer rows %v (%v)", dtype, ints, err)
+		}
+	}
+	if err := SaveFloat32MatrixToNpy(filepath.Join(dir, "x.npy"), matrix, "complex64"); err == nil {
+		t.Fatalf("an unknown dtype should fail")
+	}
+
+	// big-endian and Fortran order, only the first rows are returned
+	columns := make([]float64, n*d)
+	for i := range matrix {
+		for j := range matrix[i] {
+			columns[j*n+i] = float64(matrix[i][j])
+		}
+	}
+	writeTestNpyOrder(t, filepath.Join(dir, "fortran.npy"), ">f8", true, fmt.Sprintf("(%d, %d)", n, d), columns)
+	got, err := LoadFloat32Matrix(filepath.Join(dir, "fortran.npy"), 3, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal("fortran.npy", got, 3)
+
+	// a 1-dimensional array is a column
+	writeTestNpy(t, filepath.Join(dir, "ids.npy"), "<i8", fmt.Sprintf("(%d,)", n), []int64{4, 3, 2, 1, 0})
+	ids, err := LoadIntMatrixFromFile(filepath.Join(dir, "ids.npy"), 0, 1)
+	if err != nil || len(ids) != n || ids[0][0] != 4 {
+		t.Fatalf("unexpected ids %v (%v)", ids, err)
+	}
+
+	// the ids beyond int32 are written as uint32
+	graph := [][]int{{0, 1 << 31}, {math.MaxUint32, 2}}
+	if err := SaveGraphToNpyFile(filepath.Join(dir, "graph.npy"), graph); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readNpyFileHeader(filepath.Join(dir, "graph.npy"))
+	if err != nil || h.descr != "<u4" {
+		t.Fatalf("expected a uint32 graph, got %q (%v)", h.descr, err)
+	}
+	loaded, err := LoadGraphFromFile(filepath.Join(dir, "graph.npy"), 2, 2)
+	if err != nil || loaded[0][1] != 1<<31 || loaded[1][0] != math.MaxUint32 {
+		t.Fatalf("unexpected graph %v (%v)", loaded, err)
+	}
+
+	// an archive with a stored and a compressed array, and one with a single array
+	writeNpz := func(filename string, names ...string) {
+		file, err := os.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		z := zip.NewWriter(file)
+		for i, name := range names {
+			method := zip.Store
+			if i%2 == 1 {
+				method = zip.Deflate
+			}
+			w, err := z.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, name+".npy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(data)
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeNpz(filepath.Join(dir, "both.npz"), "float16", "int64")
+	writeNpz(filepath.Join(dir, "single.npz"), "uint8")
+	for _, path := range []string{"both.npz:float16", "both.npz:int64.npy", "single.npz"} {
+		got, info, err := LoadFloat32MatrixWithInfo(filepath.Join(dir, path), 0, d)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if info.Format != ".npz" || info.Rows != n {
+			t.Fatalf("%s: unexpected info %+v", path, info)
+		}
+		equal(path, got, n)
+	}
+	if _, err := LoadGraphFromFile(filepath.Join(dir, "both.npz:int64"), 2, d); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"both.npz", "both.npz:missing"} {
+		if _, err := LoadFloat32Matrix(filepath.Join(dir, path), 0, 0); err == nil || !strings.Contains(err.Error(), "float16, int64") {
+			t.Fatalf("%s: expected an error listing the arrays, got %v", path, err)
+		}
+	}
+
+	// rounding to float16
+	for f, want := range map[float32]uint16{1: 0x3c00, -2: 0xc000, 65504: 0x7bff, 1e6: 0x7c00, 1.0 / (1 << 24): 0x0001, 1 + 1.0/4096: 0x3c00} {
+		if got := float32ToFloat16(f); got != want {
+			t.Fatalf("float16 of %g is %#04x, expected %#04x", f, got, want)
+		}
+	}
+}
+
+func TestGraphContainer(t *testing.T) {
+	dir := t.TempDir()
+	n, d, m := 9, 4, 3
+	vectors := make([][]float32, n)
+	graph := make([][]int, n)
+	for i := range vectors {
+		vectors[i] = make([]float32, d)
+		for j := range vectors[i] {
+			vectors[i][j] = float32(i + j)
+		}
+		graph[i] = []int{(i + 1) % n, (i + 2) % n, (i + 3) % n}
+	}
+
+	filename := filepath.Join(dir, "base.graph")
+	meta := NewGraphMeta(vectors, graph, "ngt")
+	if len(meta.StartVertices) != 3 || meta.M != m || meta.Alpha != DefaultPruneAlpha {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if err := SaveGraphWithMeta(filename, graph, meta); err != nil {
+		t.Fatal(err)
+	}
+	loaded, got, err := LoadGraphWithMeta(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Builder != "ngt" || got.VectorChecksum != meta.VectorChecksum || len(got.StartVertices) != 3 || got.GraphChecksum == "" {
+		t.Fatalf("unexpected metadata %+v", got)
+	}
+	for i := range graph {
+		for j := range graph[i] {
+			if loaded[i][j] != graph[i][j] {
+				t.Fatalf("row %d is %v, expected %v", i, loaded[i], graph[i])
+			}
+		}
+	}
+
+	// the graph is refused for other vectors or another n
+	if err := got.Validate(vectors); err != nil {
+		t.Fatal(err)
+	}
+	other := append([][]float32{{9, 9, 9, 9}}, vectors[1:]...)
+	if err := got.Validate(other); err == nil {
+		t.Fatalf("other vectors should be refused")
+	}
+	if err := got.Validate(vectors[:n-1]); err == nil {
+		t.Fatalf("another n should be refused")
+	}
+	if _, err := LoadGraphFromFile(filename, n-1, m); err == nil {
+		t.Fatalf("loading the graph for another n should fail")
+	}
+	if info, err := ProbeMatrixFile(filename); err != nil || info.Rows != n || info.Dim != m {
+		t.Fatalf("unexpected info %+v (%v)", info, err)
+	}
+
+	// SaveGraphToFile only records the shape
+	plain := filepath.Join(dir, "plain.graph")
+	if err := SaveGraphToFile(plain, graph); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadGraphFromFile(plain, n, m); err != nil || len(loaded) != n {
+		t.Fatalf("unexpected graph %v (%v)", loaded, err)
+	}
+
+	// a flipped bit in the rows is detected
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadGraphWithMeta(filename); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package graphann
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// long-range edges
+// every hop of the private traversal costs a PIR round, so the graph should lead to the top-k in few hops, not only
+// eventually. With GraphBuildOptions.LongRangeFraction, the last slots of every row are reserved for long-range edges:
+// half of them point to cluster hubs (the vertices nearest to the centroids of a k-means over a sample), the others
+// are small-world edges whose distance ranks are spread harmonically, as in Kleinberg's navigable small world.
+// The hubs only point to other hubs, which gives a coarse overlay of the data.
+
+// the largest random sample of the small-world edges. The nearest of s random vertices has rank about n/s, so the
+// edges reach down to rank n/1024, the nearer ranks are left to the local neighbors
+const longRangeMaxSample = 1024
+
+// the k-means behind the hubs runs a few iterations over this many sampled vertices per cluster
+const kmeansIterations = 5
+const kmeansSamplePerCluster = 32
+
+// the vertices of a chunk share one random source, so the edges do not depend on the threads
+const longRangeChunk = 1024
+
+// the number of vertices the tuning searches for
+const longRangeTuneQueries = 200
+
+// the samples of a row that may come back without a new vertex before the row is left short, e.g. when most
+// vertices already are in the row
+const longRangeMaxMisses = 64
+
+type LongRangeStats struct {
+	Hubs            int // the cluster hubs
+	HubEdges        int
+	SmallWorldEdges int
+}
+
+func (s LongRangeStats) String() string {
+	return fmt.Sprintf("%d edges to %d cluster hubs, %d small-world edges", s.HubEdges, s.Hubs, s.SmallWorldEdges)
+}
+
+// the slots of a row of m reserved for long-range edges, at least one local neighbor is kept
+func longRangeSlots(m int, fraction float64) int {
+	return min(max(int(math.Round(fraction*float64(m))), 0), m-1)
+}
+
+// a sample size of 2^k, k uniform in [0, log2(limit)]. The rank of the nearest sampled vertex is then log-uniform,
+// i.e. rank r is drawn with a probability about 1/r
+func harmonicSampleSize(limit int, r *rand.Rand) int {
+	return 1 << r.Intn(bits.Len(uint(limit)))
+}
+
+// the nearest to u of s vertices drawn by pick that are not u and not in row, or -1
+func nearestOfSample(vectors [][]float32, u int, row []int, s int, pick func() int) int {
+	best, bestDist := -1, float32(0)
+	for i := 0; i < s; i++ {
+		v := pick()
+		if v == u || contains(row, v) {
+			continue
+		}
+		if d := L2Dist(vectors[u], vectors[v]); best < 0 || d < bestDist {
+			best, bestDist = v, d
+		}
+	}
+	return best
+}
+
+// the nearest centroid of every sampled vertex, and its distance
+func assignToCentroids(vectors [][]float32, sample []int, centroids [][]float32, assign []IdWithDist) {
+	maxThread := graphBuildThreads(16)
+	perThread := (len(sample) + maxThread - 1) / maxThread
+	var wg sync.WaitGroup
+	wg.Add(maxThread)
+	for t := 0; t < maxThread; t++ {
+		go func(start, end int) {
+			defer wg.Done()
+			for j := start; j < end; j++ {
+				best := IdWithDist{id: -1}
+				for i, c := range centroids {
+					if d := L2Dist(vectors[sample[j]], c); best.id < 0 || d < best.dist {
+						best = IdWithDist{id: i, dist: d}
+					}
+				}
+				assign[j] = best
+			}
+		}(t*perThread, min((t+1)*perThread, len(sample)))
+	}
+	wg.Wait()
+}
+
+// the hubs of a k-means with c clusters over a sample of the vectors: the sampled vertex nearest to every centroid,
+// sorted. An empty cluster has no hub
+func clusterHubs(vectors [][]float32, c int, r *rand.Rand) []int {
+	n := len(vectors)
+	sample := r.Perm(n)[:min(n, c*kmeansSamplePerCluster)]
+	c = max(min(c, len(sample)), 1)
+
+	centroids := make([][]float32, c)
+	for i := range centroids {
+		centroids[i] = append([]float32(nil), vectors[sample[i]]...)
+	}
+	assign := make([]IdWithDist, len(sample))
+	counts := make([]int, c)
+	for iter := 0; ; iter++ {
+		assignToCentroids(vectors, sample, centroids, assign)
+		if iter == kmeansIterations {
+			break
+		}
+
+		// move the centroids to the means of their clusters, an empty cluster keeps its centroid
+		clear(counts)
+		for _, a := range assign {
+			counts[a.id]++
+		}
+		for i := range centroids {
+			if counts[i] > 0 {
+				clear(centroids[i])
+			}
+		}
+		for j, a := range assign {
+			for d, x := range vectors[sample[j]] {
+				centroids[a.id][d] += x
+			}
+		}
+		for i := range centroids {
+			for d := range centroids[i] {
+				if counts[i] > 0 {
+					centroids[i][d] /= float32(counts[i])
+				}
+			}
+		}
+	}
+
+	hubOf := make([]IdWithDist, c)
+	for i := range hubOf {
+		hubOf[i].id = -1
+	}
+	for j, a := range assign {
+		if hubOf[a.id].id < 0 || a.dist < hubOf[a.id].dist {
+			hubOf[a.id] = IdWithDist{id: sample[j], dist: a.dist}
+		}
+	}
+	hubs := make([]int, 0, c)
+	for _, h := range hubOf {
+		if h.id >= 0 {
+			hubs = append(hubs, h.id)
+		}
+	}
+	sort.Ints(hubs)
+	return hubs
+}
+
+// fill every row of the graph up to m with long-range edges, in place. A row is left short when the graph has at
+// most m vertices, or when the samples keep finding vertices the row already has. The hubs are those of sqrt(n) clusters,
+// as many as the start vertices of the search
+func addLongRangeEdges(vectors [][]float32, graph [][]int, m int, seed int64) LongRangeStats {
+	n := len(graph)
+	hubs := clusterHubs(vectors, int(math.Sqrt(float64(n))), rand.New(rand.NewSource(seed)))
+	isHub := make([]bool, n)
+	for _, h := range hubs {
+		isHub[h] = true
+	}
+
+	var hubEdges, smallWorldEdges, next atomic.Int64
+	maxThread := graphBuildThreads(16)
+	var wg sync.WaitGroup
+	wg.Add(maxThread)
+	for t := 0; t < maxThread; t++ {
+		go func() {
+			defer wg.Done()
+			for {
+				start := int(next.Add(longRangeChunk)) - longRangeChunk
+				if start >= n {
+					return
+				}
+				r := rand.New(rand.NewSource(seed + int64(start) + 1))
+				for u := start; u < min(start+longRangeChunk, n); u++ {
+					row := graph[u]
+					toHubs := len(row) + (m-len(row))/2
+					if isHub[u] {
+						toHubs = m
+					}
+					misses := 0
+					for len(row) < min(m, n-1) && misses < longRangeMaxMisses {
+						v := -1
+						if len(row) < toHubs && len(hubs) > 0 {
+							v = nearestOfSample(vectors, u, row, harmonicSampleSize(len(hubs), r), func() int { return hubs[r.Intn(len(hubs))] })
+						}
+						if v >= 0 {
+							hubEdges.Add(1)
+						} else {
+							v = nearestOfSample(vectors, u, row, harmonicSampleSize(min(n, longRangeMaxSample), r), func() int { return r.Intn(n) })
+							if v < 0 {
+								misses++
+								continue
+							}
+							smallWorldEdges.Add(1)
+						}
+						row = append(row, v)
+					}
+					graph[u] = row
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return LongRangeStats{Hubs: len(hubs), HubEdges: int(hubEdges.Load()), SmallWorldEdges: int(smallWorldEdges.Load())}
+}
+
+// the graph quality of one fraction tried by tuneLongRange
+type LongRangeTrial struct {
+	Fraction float64
+	HitRate  float64
+	AvgSteps float64
+}
+
+func (t LongRangeTrial) String() string {
+	return fmt.Sprintf("long-range fraction %g: hit rate %.3f, average steps %.3f", t.Fraction, t.HitRate, t.AvgSteps)
+}
+
+// build the second pass with every fraction of opts.TuneLongRange, and keep the one that reaches sampled vertices in
+// the fewest average steps of MeasureGraphQuality among those whose hit rate is within 0.02 of the best one. On ties,
+// the smaller fraction wins. It returns the graph, its fraction and the trials of all fractions in increasing order
+func tuneLongRange(vectors [][]float32, labels [][]uint32, firstPass [][]int, m int, alpha float32, opts GraphBuildOptions) ([][]int, float64, []LongRangeTrial) {
+	n := len(vectors)
+	fractions := append([]float64(nil), opts.TuneLongRange...)
+	sort.Float64s(fractions)
+	targets := rand.New(rand.NewSource(GraphBuildSeed())).Perm(n)[:min(n, longRangeTuneQueries)]
+
+	build := func(fraction float64) [][]int {
+		o := opts
+		o.LongRangeFraction = fraction
+		o.TuneLongRange = nil
+		return finishGraph(vectors, labels, firstPass, m, alpha, o)
+	}
+
+	trials := make([]LongRangeTrial, len(fractions))
+	var graph [][]int
+	for i, f := range fractions {
+		graph = build(f)
+		hitRate, avgSteps := MeasureGraphQuality(vectors, graph, targets)
+		trials[i] = LongRangeTrial{Fraction: f, HitRate: hitRate, AvgSteps: avgSteps}
+	}
+
+	bestHit := 0.0
+	for _, t := range trials {
+		bestHit = max(bestHit, t.HitRate)
+	}
+	best := -1
+	for i, t := range trials {
+		if t.HitRate >= bestHit-0.02 && (best < 0 || t.AvgSteps < trials[best].AvgSteps) {
+			best = i
+		}
+	}
+
+	// only the last graph is kept, the construction is deterministic so the chosen one is built again
+	if best != len(fractions)-1 {
+		graph = build(fractions[best])
+	}
+	return graph, fractions[best], trials
+}
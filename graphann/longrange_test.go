@@ -0,0 +1,111 @@
+package graphann
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// n vectors around c random centers, the vertices of a cluster have consecutive ids. The start vertices of the
+// search, the first sqrt(n) ids, then all lie in the first cluster
+func genTestClusters(rng *rand.Rand, n int, dim int, c int, spread float32) [][]float32 {
+	centers := genTestVectors(rng, c, dim)
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = make([]float32, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = centers[i*c/n][j] + float32(rng.NormFloat64())*spread
+		}
+	}
+	return vectors
+}
+
+func TestLongRangeEdges(t *testing.T) {
+	if got := longRangeSlots(16, 0.25); got != 4 {
+		t.Fatalf("a quarter of 16 slots should be 4, got %d", got)
+	}
+	if got := longRangeSlots(16, 1); got != 15 {
+		t.Fatalf("one local neighbor should be kept, got %d long-range slots of 16", got)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	n, m := 600, 8
+	vectors := genTestVectors(r, n, 8)
+	firstPass, _ := genTestGraph(r, vectors, m, m)
+
+	// the long-range edges fill the rows after the local neighbors
+	local := make([][]int, n)
+	for u, row := range firstPass {
+		local[u] = append([]int(nil), row[:m-2]...)
+	}
+	s := addLongRangeEdges(vectors, local, m, 0)
+	if s.Hubs == 0 || s.Hubs > 24 || s.HubEdges == 0 || s.SmallWorldEdges == 0 || s.HubEdges+s.SmallWorldEdges != 2*n {
+		t.Fatalf("expected 2 long-range edges per row to at most sqrt(n) hubs, got %v", s)
+	}
+
+	// with fewer vertices than m, the rows stop at the n-1 other vertices
+	small := make([][]int, 5)
+	addLongRangeEdges(vectors[:5], small, m, 0)
+	for u, row := range small {
+		if len(row) != 4 {
+			t.Fatalf("row %d of 5 vertices has %d neighbors, expected 4", u, len(row))
+		}
+	}
+	if hitRate, steps := MeasureGraphQuality(vectors, firstPass, nil); hitRate != 0 || !math.IsInf(steps, 1) {
+		t.Fatalf("no target found should give +Inf steps, got hit rate %g, %g steps", hitRate, steps)
+	}
+
+	// the last 2 slots are long-range edges, new to the row
+	opts := GraphBuildOptions{LongRangeFraction: 0.25}
+	graph := finishGraph(vectors, nil, firstPass, m, DefaultPruneAlpha, opts)
+	for u, row := range graph {
+		if len(row) != m {
+			t.Fatalf("row %d has %d neighbors, expected %d", u, len(row), m)
+		}
+		for j := m - 2; j < m; j++ {
+			if v := row[j]; v == u || v < 0 || v >= n || contains(row[:j], v) {
+				t.Fatalf("row %d has a self, invalid or duplicate long-range edge: %v", u, row)
+			}
+		}
+	}
+	again := finishGraph(vectors, nil, firstPass, m, DefaultPruneAlpha, opts)
+	for u := range graph {
+		for j := range graph[u] {
+			if again[u][j] != graph[u][j] {
+				t.Fatalf("two builds differ at row %d: %v and %v", u, graph[u], again[u])
+			}
+		}
+	}
+
+	// the tuning keeps one of the fractions, and the graph built with it
+	opts.TuneLongRange = []float64{0.25, 0, 0.5}
+	tuned, fraction, trials := tuneLongRange(vectors, nil, firstPass, m, DefaultPruneAlpha, opts)
+	if fraction != 0 && fraction != 0.25 && fraction != 0.5 {
+		t.Fatalf("the tuning chose %g, not one of the fractions", fraction)
+	}
+	if len(trials) != 3 || trials[0].Fraction != 0 || trials[2].Fraction != 0.5 {
+		t.Fatalf("expected the trials of the fractions 0, 0.25 and 0.5, got %v", trials)
+	}
+	expected := finishGraph(vectors, nil, firstPass, m, DefaultPruneAlpha, GraphBuildOptions{LongRangeFraction: fraction})
+	for u := range expected {
+		for j := range expected[u] {
+			if tuned[u][j] != expected[u][j] {
+				t.Fatalf("the tuned graph differs from the graph of the fraction %g at row %d", fraction, u)
+			}
+		}
+	}
+
+	// on clustered data whose start vertices lie in one cluster, the long-range edges reach the other clusters in
+	// fewer steps
+	r = rand.New(rand.NewSource(1))
+	n, m = 1000, 16
+	vectors = genTestClusters(r, n, 16, 20, 0.05)
+	firstPass, _ = genTestGraph(r, vectors, m, m)
+	targets := rand.New(rand.NewSource(2)).Perm(n)[:200]
+	localHit, localSteps := MeasureGraphQuality(vectors, finishGraph(vectors, nil, firstPass, m, DefaultPruneAlpha, GraphBuildOptions{}), targets)
+	longHit, longSteps := MeasureGraphQuality(vectors, finishGraph(vectors, nil, firstPass, m, DefaultPruneAlpha, GraphBuildOptions{LongRangeFraction: 0.25}), targets)
+	if longHit < localHit || longSteps >= localSteps {
+		t.Fatalf("the long-range edges should find the targets in fewer steps, fraction 0: hit rate %.3f, %.3f steps, fraction 0.25: hit rate %.3f, %.3f steps",
+			localHit, localSteps, longHit, longSteps)
+	}
+}
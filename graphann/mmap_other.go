@@ -0,0 +1,17 @@
+//go:build !unix
+
+package graphann
+
+import (
+	"errors"
+	"os"
+)
+
+// without mmap, the vector readers fall back to ReadAt
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
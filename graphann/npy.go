@@ -0,0 +1,516 @@
+package graphann
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// .npy and .npz I/O
+// the arrays are read in their own dtype (float16/32/64, int8/32/64, uint8/32, either byte order) and
+// converted row by row, so a float32 file does not go through a float64 copy. Fortran-ordered arrays are
+// transposed. An .npz archive is addressed as "archive.npz" (if it holds a single array) or "archive.npz:name".
+
+// the header of a .npy file
+type npyHeader struct {
+	descr        string
+	fortranOrder bool
+	shape        []int
+	dataOffset   int64
+}
+
+var (
+	npyDescrRe   = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyFortranRe = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShapeRe   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+func readNpyHeader(r io.Reader) (npyHeader, error) {
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return npyHeader{}, fmt.Errorf("reading the .npy magic: %w", err)
+	}
+	if string(prefix[:6]) != "\x93NUMPY" {
+		return npyHeader{}, fmt.Errorf("not a .npy file (wrong magic number)")
+	}
+
+	var headerLen int64
+	offset := int64(8)
+	switch prefix[6] {
+	case 1:
+		var l uint16
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return npyHeader{}, err
+		}
+		headerLen, offset = int64(l), offset+2
+	case 2, 3:
+		var l uint32
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return npyHeader{}, err
+		}
+		headerLen, offset = int64(l), offset+4
+	default:
+		return npyHeader{}, fmt.Errorf("unknown .npy version %d", prefix[6])
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return npyHeader{}, fmt.Errorf("reading the .npy header: %w", err)
+	}
+
+	h := npyHeader{dataOffset: offset + headerLen}
+	if m := npyDescrRe.FindSubmatch(header); m != nil {
+		h.descr = string(m[1])
+	} else {
+		return npyHeader{}, fmt.Errorf("no descr in the .npy header %q", header)
+	}
+	if m := npyFortranRe.FindSubmatch(header); m != nil {
+		h.fortranOrder = bytes.Equal(m[1], []byte("True"))
+	}
+	m := npyShapeRe.FindSubmatch(header)
+	if m == nil {
+		return npyHeader{}, fmt.Errorf("no shape in the .npy header %q", header)
+	}
+	for _, field := range strings.Split(string(m[1]), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return npyHeader{}, fmt.Errorf("invalid .npy shape %q", m[1])
+		}
+		h.shape = append(h.shape, v)
+	}
+	if len(h.shape) != 1 && len(h.shape) != 2 {
+		return npyHeader{}, fmt.Errorf("expected a 1 or 2-dimensional array, got shape %v", h.shape)
+	}
+	return h, nil
+}
+
+// the rows and columns of the array. A 1-dimensional array is a column
+func (h npyHeader) matrixShape() (int, int) {
+	if len(h.shape) == 1 {
+		return h.shape[0], 1
+	}
+	return h.shape[0], h.shape[1]
+}
+
+// the element type of a .npy descr, e.g. "<f4"
+type npyDtype struct {
+	kind  byte // 'f', 'i' or 'u'
+	size  int
+	order binary.ByteOrder
+}
+
+func parseNpyDtype(descr string) (npyDtype, error) {
+	if len(descr) < 3 {
+		return npyDtype{}, fmt.Errorf("unsupported .npy dtype %q", descr)
+	}
+	d := npyDtype{kind: descr[1], order: binary.LittleEndian}
+	if descr[0] == '>' {
+		d.order = binary.BigEndian
+	}
+	size, err := strconv.Atoi(descr[2:])
+	if err != nil {
+		return npyDtype{}, fmt.Errorf("unsupported .npy dtype %q", descr)
+	}
+	d.size = size
+	switch {
+	case d.kind == 'f' && (size == 2 || size == 4 || size == 8):
+	case (d.kind == 'i' || d.kind == 'u') && (size == 1 || size == 2 || size == 4 || size == 8):
+	default:
+		return npyDtype{}, fmt.Errorf("unsupported .npy dtype %q", descr)
+	}
+	return d, nil
+}
+
+func (d npyDtype) float(b []byte) float64 {
+	if d.kind != 'f' {
+		if d.kind == 'u' {
+			return float64(d.uint(b))
+		}
+		return float64(d.int(b))
+	}
+	switch d.size {
+	case 2:
+		return float64(float16ToFloat32(d.order.Uint16(b)))
+	case 4:
+		return float64(math.Float32frombits(d.order.Uint32(b)))
+	default:
+		return math.Float64frombits(d.order.Uint64(b))
+	}
+}
+
+func (d npyDtype) uint(b []byte) uint64 {
+	switch d.size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(d.order.Uint16(b))
+	case 4:
+		return uint64(d.order.Uint32(b))
+	default:
+		return d.order.Uint64(b)
+	}
+}
+
+func (d npyDtype) int(b []byte) int64 {
+	switch d.kind {
+	case 'f':
+		return int64(d.float(b))
+	case 'u':
+		return int64(d.uint(b))
+	}
+	switch d.size {
+	case 1:
+		return int64(int8(b[0]))
+	case 2:
+		return int64(int16(d.order.Uint16(b)))
+	case 4:
+		return int64(int32(d.order.Uint32(b)))
+	default:
+		return int64(d.order.Uint64(b))
+	}
+}
+
+// read the first n rows (n <= 0: all) of the array after its header, and call set with every element
+func readNpyRows(r io.Reader, h npyHeader, n int, set func(i int, j int, b []byte)) (int, int, error) {
+	d, err := parseNpyDtype(h.descr)
+	if err != nil {
+		return 0, 0, err
+	}
+	rows, cols := h.matrixShape()
+	if n <= 0 || n > rows {
+		n = rows
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+
+	if !h.fortranOrder || cols == 1 {
+		// row-major, only the first n rows are read
+		buf := make([]byte, cols*d.size)
+		for i := 0; i < n; i++ {
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return 0, 0, fmt.Errorf("reading row %d: %w", i, err)
+			}
+			for j := 0; j < cols; j++ {
+				set(i, j, buf[j*d.size:(j+1)*d.size])
+			}
+		}
+		return n, cols, nil
+	}
+
+	// column-major: every column holds all rows, so the first n values of every column are read
+	buf := make([]byte, rows*d.size)
+	for j := 0; j < cols; j++ {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return 0, 0, fmt.Errorf("reading column %d: %w", j, err)
+		}
+		for i := 0; i < n; i++ {
+			set(i, j, buf[i*d.size:(i+1)*d.size])
+		}
+	}
+	return n, cols, nil
+}
+
+// the first n rows of the array as float32, checking the dimension unless dim <= 0
+func readNpyFloat32Matrix(r io.Reader, n int, dim int) ([][]float32, error) {
+	h, err := readNpyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	rows, cols := h.matrixShape()
+	if rows < n || (dim > 0 && cols != dim) {
+		return nil, fmt.Errorf("invalid shape %v, expected at least (%d, %d)", h.shape, n, dim)
+	}
+	if n <= 0 {
+		n = rows
+	}
+	d, err := parseNpyDtype(h.descr)
+	if err != nil {
+		return nil, err
+	}
+
+	memSpace := make([]float32, n*cols)
+	if _, _, err := readNpyRows(r, h, n, func(i int, j int, b []byte) {
+		memSpace[i*cols+j] = float32(d.float(b))
+	}); err != nil {
+		return nil, err
+	}
+	ret := make([][]float32, n)
+	for i := range ret {
+		ret[i] = memSpace[i*cols : (i+1)*cols]
+	}
+	return ret, nil
+}
+
+// the first n rows of an integer array, e.g. a graph, checking the number of columns unless m <= 0
+func readNpyIntMatrix(r io.Reader, n int, m int) ([][]int, error) {
+	h, err := readNpyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	rows, cols := h.matrixShape()
+	if rows < n || (m > 0 && cols != m) {
+		return nil, fmt.Errorf("invalid shape %v, expected at least (%d, %d)", h.shape, n, m)
+	}
+	if n <= 0 {
+		n = rows
+	}
+	d, err := parseNpyDtype(h.descr)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([][]int, n)
+	for i := range ret {
+		ret[i] = make([]int, cols)
+	}
+	if _, _, err := readNpyRows(r, h, n, func(i int, j int, b []byte) {
+		ret[i][j] = int(d.int(b))
+	}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// the .npy descr of a dtype name
+func npyDescr(dtype string) (string, error) {
+	switch dtype {
+	case "float16":
+		return "<f2", nil
+	case "float32":
+		return "<f4", nil
+	case "float64":
+		return "<f8", nil
+	case "uint8":
+		return "|u1", nil
+	case "int8":
+		return "|i1", nil
+	case "int32":
+		return "<i4", nil
+	case "int64":
+		return "<i8", nil
+	case "uint32":
+		return "<u4", nil
+	default:
+		return "", fmt.Errorf("unsupported dtype %q, expected float16, float32, float64, uint8, int8, int32, int64 or uint32", dtype)
+	}
+}
+
+// the header is padded so that the data starts at a multiple of 64 bytes
+func writeNpyHeader(w io.Writer, descr string, rows int, cols int) error {
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%d, %d), }", descr, rows, cols)
+	for (10+len(header)+1)%64 != 0 {
+		header += " "
+	}
+	header += "\n"
+	if _, err := w.Write([]byte("\x93NUMPY\x01\x00")); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(header))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(header))
+	return err
+}
+
+// write the matrix as a C-ordered .npy array of the dtype (float16, float32, float64, uint8, int8, int32,
+// int64 or uint32). The integer dtypes truncate the values
+func SaveFloat32MatrixToNpy(filename string, matrix [][]float32, dtype string) error {
+	return saveNpyMatrix(filename, dtype, len(matrix), func(i int) int { return len(matrix[i]) }, func(i int, j int) (float64, int64) {
+		return float64(matrix[i][j]), int64(matrix[i][j])
+	})
+}
+
+// write the matrix as a C-ordered .npy array of the dtype, e.g. uint32 for the graphs with more than 2^31 vertices
+func SaveIntMatrixToNpy(filename string, matrix [][]int, dtype string) error {
+	return saveNpyMatrix(filename, dtype, len(matrix), func(i int) int { return len(matrix[i]) }, func(i int, j int) (float64, int64) {
+		return float64(matrix[i][j]), int64(matrix[i][j])
+	})
+}
+
+func saveNpyMatrix(filename string, dtype string, rows int, rowLen func(i int) int, value func(i int, j int) (float64, int64)) error {
+	descr, err := npyDescr(dtype)
+	if err != nil {
+		return err
+	}
+	d, _ := parseNpyDtype(descr)
+	cols := 0
+	if rows > 0 {
+		cols = rowLen(0)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+	if err := writeNpyHeader(w, descr, rows, cols); err != nil {
+		return err
+	}
+
+	buf := make([]byte, cols*d.size)
+	for i := 0; i < rows; i++ {
+		if rowLen(i) != cols {
+			return fmt.Errorf("row %d has %d values, expected %d", i, rowLen(i), cols)
+		}
+		for j := 0; j < cols; j++ {
+			f, n := value(i, j)
+			b := buf[j*d.size : (j+1)*d.size]
+			switch {
+			case d.kind == 'f' && d.size == 2:
+				binary.LittleEndian.PutUint16(b, float32ToFloat16(float32(f)))
+			case d.kind == 'f' && d.size == 4:
+				binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f)))
+			case d.kind == 'f':
+				binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+			case d.size == 1:
+				b[0] = byte(n)
+			case d.size == 4:
+				binary.LittleEndian.PutUint32(b, uint32(n))
+			default:
+				binary.LittleEndian.PutUint64(b, uint64(n))
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// IEEE 754 single precision to half precision, rounding to nearest even
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	frac := bits & 0x7fffff
+
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		// infinity or NaN
+		if frac != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		// too large, infinity
+		return sign | 0x7c00
+	case exp <= 0:
+		// subnormal or zero
+		if exp < -10 {
+			return sign
+		}
+		frac |= 0x800000
+		shift := uint32(14 - exp)
+		half := frac >> shift
+		rest := frac & (1<<shift - 1)
+		if rest > 1<<(shift-1) || (rest == 1<<(shift-1) && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exp)<<10 | frac>>13
+	rest := frac & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && half&1 == 1) {
+		// the carry may round up into the exponent, up to infinity
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// whether the file name addresses an .npz archive, "archive.npz" or "archive.npz:name"
+func isNpzPath(filename string) bool {
+	return strings.HasSuffix(filename, ".npz") || strings.Contains(filename, ".npz:")
+}
+
+// open an array of an .npz archive. Without a name, the archive has to hold a single array
+func openNpzArray(path string) (io.ReadCloser, func() error, error) {
+	archive, name := path, ""
+	if i := strings.Index(path, ".npz:"); i >= 0 {
+		archive, name = path[:i+4], path[i+5:]
+	}
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(z.File))
+	var entry *zip.File
+	for _, f := range z.File {
+		key := strings.TrimSuffix(f.Name, ".npy")
+		names = append(names, key)
+		if key == strings.TrimSuffix(name, ".npy") {
+			entry = f
+		}
+	}
+	if name == "" && len(z.File) == 1 {
+		entry = z.File[0]
+	}
+	if entry == nil {
+		z.Close()
+		sort.Strings(names)
+		if name == "" {
+			return nil, nil, fmt.Errorf("%s holds several arrays, choose one with %s:<name> (%s)", archive, archive, strings.Join(names, ", "))
+		}
+		return nil, nil, fmt.Errorf("%s has no array %q (%s)", archive, name, strings.Join(names, ", "))
+	}
+	r, err := entry.Open()
+	if err != nil {
+		z.Close()
+		return nil, nil, err
+	}
+	return r, z.Close, nil
+}
+
+func LoadFloat32MatrixFromNpz(path string, n int, dim int) ([][]float32, error) {
+	r, closeArchive, err := openNpzArray(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+	defer r.Close()
+	return readNpyFloat32Matrix(r, n, dim)
+}
+
+func LoadIntMatrixFromNpz(path string, n int, m int) ([][]int, error) {
+	r, closeArchive, err := openNpzArray(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+	defer r.Close()
+	return readNpyIntMatrix(r, n, m)
+}
+
+// the header of a .npy file or of an array in an .npz archive
+func readNpyFileHeader(path string) (npyHeader, error) {
+	if isNpzPath(path) {
+		r, closeArchive, err := openNpzArray(path)
+		if err != nil {
+			return npyHeader{}, err
+		}
+		defer closeArchive()
+		defer r.Close()
+		return readNpyHeader(r)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return npyHeader{}, err
+	}
+	defer file.Close()
+	return readNpyHeader(file)
+}
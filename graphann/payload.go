@@ -0,0 +1,195 @@
+package graphann
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// document payloads fetched after the search
+// the payloads have variable length, so they are cut into fixed-size chunks stored in their own DB.
+// Every document is fetched with exactly ChunksPerDoc chunk lookups (padded with dummy lookups),
+// so the server learns neither which documents nor how long they are.
+// The layout (offsets and lengths) is public and downloaded by the client once.
+// The batch PIR answers only a few lookups per partition of contiguous ids, so the chunks of a document are striped:
+// the documents take consecutive cells of a grid of Stripes columns, row by row, and the chunks are stored column by
+// column. The chunks of a document are then in distinct columns, i.e. in distinct partitions of a batch PIR with
+// Stripes partitions.
+
+// the first 4 bytes of every chunk store id+1 of its document, so a failed (all zero) lookup is detected
+const chunkHeaderSize = 4
+
+type PayloadLayout struct {
+	ChunkSize    int   // bytes per chunk, including the header
+	ChunksPerDoc int   // number of chunk lookups per document. Longer payloads are truncated
+	ChunkNum     int   // total number of chunks, including the empty cells of the last row
+	Stripes      int   // the number of columns of the grid, see ChunkId
+	Rows         int   // the number of rows of the grid
+	Offsets      []int // the first cell of each document
+	Lengths      []int // the stored (possibly truncated) payload length of each document
+	Truncated    int   // number of truncated documents
+}
+
+// stripes should be the number of partitions of the batch PIR serving the chunks. The chunks of a document are in
+// distinct partitions as long as ChunksPerDoc <= stripes; stripes = 1 stores them next to each other
+func BuildPayloadLayout(lengths []int, chunkSize int, chunksPerDoc int, stripes int) *PayloadLayout {
+	capacity := chunkSize - chunkHeaderSize
+	layout := &PayloadLayout{
+		ChunkSize:    chunkSize,
+		ChunksPerDoc: chunksPerDoc,
+		Stripes:      max(stripes, 1),
+		Offsets:      make([]int, len(lengths)),
+		Lengths:      make([]int, len(lengths)),
+	}
+	cells := 0
+	for i, l := range lengths {
+		if l > capacity*chunksPerDoc {
+			l = capacity * chunksPerDoc
+			layout.Truncated++
+		}
+		layout.Offsets[i] = cells
+		layout.Lengths[i] = l
+		// empty payloads still get one chunk, so every document can be verified
+		cells += max(1, (l+capacity-1)/capacity)
+	}
+	layout.Rows = (cells + layout.Stripes - 1) / layout.Stripes
+	layout.ChunkNum = layout.Rows * layout.Stripes
+	return layout
+}
+
+// the id of chunk c of the document id: the cell in row r and column j of the grid is chunk j*Rows+r
+func (l *PayloadLayout) ChunkId(id int, c int) int {
+	cell := l.Offsets[id] + c
+	return cell%l.Stripes*l.Rows + cell/l.Stripes
+}
+
+func (l *PayloadLayout) chunkCount(id int) int {
+	capacity := l.ChunkSize - chunkHeaderSize
+	return max(1, (l.Lengths[id]+capacity-1)/capacity)
+}
+
+// cut the payloads into chunks following the layout. The empty cells are all zero chunks
+func (l *PayloadLayout) Chunks(payloads [][]byte) [][]byte {
+	capacity := l.ChunkSize - chunkHeaderSize
+	chunks := make([][]byte, l.ChunkNum)
+	for id, payload := range payloads {
+		payload = payload[:l.Lengths[id]]
+		for c := 0; c < l.chunkCount(id); c++ {
+			chunk := make([]byte, l.ChunkSize)
+			binary.LittleEndian.PutUint32(chunk, uint32(id+1))
+			copy(chunk[chunkHeaderSize:], payload[min(c*capacity, len(payload)):min((c+1)*capacity, len(payload))])
+			chunks[l.ChunkId(id, c)] = chunk
+		}
+	}
+	for i := range chunks {
+		if chunks[i] == nil {
+			chunks[i] = make([]byte, l.ChunkSize)
+		}
+	}
+	return chunks
+}
+
+// define an interface that provides the payload chunks, like GetGraphInfo for the graph
+
+type GetPayloadChunks interface {
+	Preprocess() error
+	GetChunks([]int) ([][]byte, error) // given a list of chunk ids, return the chunks (all zero if a lookup failed). -1 is a dummy lookup
+}
+
+type BasicPayloadChunks struct {
+	Data [][]byte
+}
+
+func (p *BasicPayloadChunks) Preprocess() error { return nil }
+
+func (p *BasicPayloadChunks) GetChunks(ids []int) ([][]byte, error) {
+	ret := make([][]byte, len(ids))
+	for i, id := range ids {
+		if id < 0 {
+			ret[i] = make([]byte, len(p.Data[0]))
+			continue
+		}
+		ret[i] = p.Data[id]
+	}
+	return ret, nil
+}
+
+type PayloadFetcher struct {
+	Layout *PayloadLayout
+	Chunks GetPayloadChunks
+
+	// stats
+	FailedDocs int
+}
+
+// fetch the payloads of ids in one round of len(ids) * ChunksPerDoc lookups.
+// ids equal to -1 and the short documents are padded with dummy lookups, which take no partition slot of the batch PIR.
+// A payload is nil if one of its chunks failed.
+func (f *PayloadFetcher) FetchPayloads(ids []int) ([][]byte, error) {
+	l := f.Layout
+	batch := make([]int, 0, len(ids)*l.ChunksPerDoc)
+	for _, id := range ids {
+		cnt := 0
+		if id >= 0 {
+			cnt = l.chunkCount(id)
+			for c := 0; c < cnt; c++ {
+				batch = append(batch, l.ChunkId(id, c))
+			}
+		}
+		for c := cnt; c < l.ChunksPerDoc; c++ {
+			batch = append(batch, -1)
+		}
+	}
+
+	chunks, err := f.Chunks.GetChunks(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([][]byte, len(ids))
+	for i, id := range ids {
+		if id < 0 {
+			continue
+		}
+		payload := make([]byte, 0, l.Lengths[id])
+		ok := true
+		for c := 0; c < l.chunkCount(id); c++ {
+			chunk := chunks[i*l.ChunksPerDoc+c]
+			if binary.LittleEndian.Uint32(chunk) != uint32(id+1) {
+				ok = false
+				break
+			}
+			payload = append(payload, chunk[chunkHeaderSize:]...)
+		}
+		if !ok {
+			f.FailedDocs++
+			continue
+		}
+		payloads[i] = payload[:l.Lengths[id]]
+	}
+	return payloads, nil
+}
+
+// one payload per line, e.g. the collection file of MS-MARCO (only the first n lines are read)
+func LoadPayloadsFromTxt(filename string, n int) ([][]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := make([][]byte, 0, n)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	for i := 0; i < n && scanner.Scan(); i++ {
+		ret = append(ret, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) < n {
+		return nil, fmt.Errorf("expected %d payloads in %s, got %d", n, filename, len(ret))
+	}
+	return ret, nil
+}
@@ -0,0 +1,215 @@
+package graphann
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// PIR-aware relabeling
+// the batch PIR splits the ids into partitionNum contiguous ranges and answers only perPartition queries of every
+// range per row of a batch, the other queries of the range come back as zero entries. Neighbors that share a range
+// therefore collide and get dropped. RelabelForPartitions assigns the vertices to the ranges so the neighbors of
+// every vertex spread over as many ranges as possible, then numbers the vertices range by range.
+
+type Relabeling struct {
+	NewId []int // original id -> new id
+	OldId []int // new id -> original id
+}
+
+// the size of the ranges of the batch PIR over n entries, all but the last one are full
+func partitionSize(n int, partitionNum int) int {
+	return (n + partitionNum - 1) / partitionNum
+}
+
+// the neighbors of the rows that share their range with more than perPartition other neighbors of the row,
+// i.e. that the batch PIR drops when it fetches the row, and the number of neighbors
+func PartitionCollisions(graph [][]int, partitionNum int, perPartition int) (int, int) {
+	size := partitionSize(len(graph), partitionNum)
+	dropped, total := 0, 0
+	counts := make([]int, partitionNum)
+	for _, row := range graph {
+		clear(counts)
+		for _, v := range row {
+			if v < 0 || v >= len(graph) {
+				continue
+			}
+			c := v / size
+			counts[c]++
+			if counts[c] > perPartition {
+				dropped++
+			}
+		}
+		total += len(row)
+	}
+	return dropped, total
+}
+
+// the number of neighbors of a row in one range
+type rangeCount struct {
+	partition int32
+	count     int32
+}
+
+func addRangeCount(counts []rangeCount, partition int) []rangeCount {
+	for i := range counts {
+		if int(counts[i].partition) == partition {
+			counts[i].count++
+			return counts
+		}
+	}
+	return append(counts, rangeCount{partition: int32(partition), count: 1})
+}
+
+// assign the vertices greedily, the vertices with the most in-neighbors first: a vertex goes to the range with space
+// left that causes the fewest new collisions in the rows pointing to it, then the one that the fewest neighbors of
+// these rows are in, then the emptiest one. Ties between vertices are broken by seed
+func RelabelForPartitions(graph [][]int, partitionNum int, perPartition int, seed int64) Relabeling {
+	n := len(graph)
+	partitionNum = max(min(partitionNum, n), 1)
+	size := partitionSize(n, partitionNum)
+
+	// the rows pointing to every vertex
+	rows, _, _, _ := cleanRows(graph)
+	inbound := make([][]int, n)
+	for u, row := range rows {
+		for _, v := range row {
+			inbound[v] = append(inbound[v], u)
+		}
+	}
+
+	order := rand.New(rand.NewSource(seed)).Perm(n)
+	sort.SliceStable(order, func(i, j int) bool { return len(inbound[order[i]]) > len(inbound[order[j]]) })
+
+	space := make([]int, partitionNum)
+	for c := range space {
+		space[c] = min(size, n-c*size)
+	}
+	// assigned[u]: the ranges of the neighbors of u assigned so far, with their counts. A row has at most m
+	// ranges, so this takes memory in the edges rather than in n*partitionNum
+	assigned := make([][]rangeCount, n)
+	// per range, the rows pointing to v that are full in it, and the neighbors of these rows in it
+	newCollisions := make([]int, partitionNum)
+	shared := make([]int, partitionNum)
+	partition := make([]int, n)
+	for _, v := range order {
+		clear(newCollisions)
+		clear(shared)
+		for _, u := range inbound[v] {
+			for _, rc := range assigned[u] {
+				if int(rc.count) >= perPartition {
+					newCollisions[rc.partition]++
+				}
+				shared[rc.partition] += int(rc.count)
+			}
+		}
+		best := -1
+		for c := 0; c < partitionNum; c++ {
+			if space[c] == 0 {
+				continue
+			}
+			if best < 0 || newCollisions[c] < newCollisions[best] || (newCollisions[c] == newCollisions[best] && (shared[c] < shared[best] ||
+				(shared[c] == shared[best] && space[c] > space[best]))) {
+				best = c
+			}
+		}
+		partition[v] = best
+		space[best]--
+		for _, u := range inbound[v] {
+			assigned[u] = addRangeCount(assigned[u], best)
+		}
+	}
+
+	// number the vertices range by range, in their original order within a range
+	r := Relabeling{NewId: make([]int, n), OldId: make([]int, n)}
+	next := make([]int, partitionNum)
+	for c := range next {
+		next[c] = c * size
+	}
+	for v := 0; v < n; v++ {
+		c := partition[v]
+		r.NewId[v] = next[c]
+		r.OldId[next[c]] = v
+		next[c]++
+	}
+	return r
+}
+
+// the graph in the new ids. Row i of the result is the row of OldId[i]
+func (r Relabeling) ApplyGraph(graph [][]int) [][]int {
+	ret := make([][]int, len(graph))
+	for i := range ret {
+		row := graph[r.OldId[i]]
+		ret[i] = make([]int, len(row))
+		for j, v := range row {
+			ret[i][j] = r.NewId[v]
+		}
+	}
+	return ret
+}
+
+// the per-vertex rows (vectors, attributes, ...) in the new order
+func PermuteRows[T any](r Relabeling, rows []T) []T {
+	ret := make([]T, len(rows))
+	for i := range ret {
+		ret[i] = rows[r.OldId[i]]
+	}
+	return ret
+}
+
+// original ids to new ids, e.g. for a ground truth. Negative ids (no result) are kept
+func (r Relabeling) MapIds(ids [][]int) [][]int {
+	return mapIds(ids, r.NewId)
+}
+
+// new ids back to original ids, e.g. for search results. Negative ids (no result) are kept
+func (r Relabeling) RestoreIds(ids [][]int) [][]int {
+	return mapIds(ids, r.OldId)
+}
+
+func mapIds(ids [][]int, to []int) [][]int {
+	ret := make([][]int, len(ids))
+	for i, row := range ids {
+		ret[i] = make([]int, len(row))
+		for j, v := range row {
+			ret[i][j] = v
+			if v >= 0 && v < len(to) {
+				ret[i][j] = to[v]
+			}
+		}
+	}
+	return ret
+}
+
+// write the permutation as one column of original ids, in the order of the new ids
+func SaveRelabeling(filename string, r Relabeling) error {
+	column := make([][]int, len(r.OldId))
+	for i, v := range r.OldId {
+		column[i] = []int{v}
+	}
+	return SaveIntMatrixToFile(filename, column)
+}
+
+// read a permutation of n ids written by SaveRelabeling
+func LoadRelabeling(filename string, n int) (Relabeling, error) {
+	column, info, err := LoadIntMatrixWithInfo(filename, 0, 1)
+	if err != nil {
+		return Relabeling{}, err
+	}
+	if info.Rows != n {
+		return Relabeling{}, fmt.Errorf("%s: a permutation of %d ids, expected %d", filename, info.Rows, n)
+	}
+	r := Relabeling{NewId: make([]int, n), OldId: make([]int, n)}
+	for i := range r.NewId {
+		r.NewId[i] = -1
+	}
+	for i, row := range column {
+		v := row[0]
+		if v < 0 || v >= n || r.NewId[v] >= 0 {
+			return Relabeling{}, fmt.Errorf("%s: row %d: %d is not part of a permutation of %d ids", filename, i, v, n)
+		}
+		r.OldId[i] = v
+		r.NewId[v] = i
+	}
+	return r, nil
+}
@@ -0,0 +1,126 @@
+package graphann
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelabelForPartitions(t *testing.T) {
+	// the neighbors of a vertex are the next m ids, so they mostly share a partition
+	n, m := 400, 8
+	graph := make([][]int, n)
+	for i := range graph {
+		graph[i] = make([]int, m)
+		for j := range graph[i] {
+			graph[i][j] = (i + j + 1) % n
+		}
+	}
+	partitionNum, perPartition := m/2, 2
+
+	before, total := PartitionCollisions(graph, partitionNum, perPartition)
+	r := RelabelForPartitions(graph, partitionNum, perPartition, 0)
+	relabeled := r.ApplyGraph(graph)
+	after, _ := PartitionCollisions(relabeled, partitionNum, perPartition)
+	if total != n*m || after >= before/2 {
+		t.Fatalf("the relabeling should halve the collisions, got %d -> %d of %d", before, after, total)
+	}
+
+	// a permutation that keeps the edges
+	for v := 0; v < n; v++ {
+		if r.OldId[r.NewId[v]] != v {
+			t.Fatalf("not a permutation at %d", v)
+		}
+	}
+	for u := range graph {
+		for j, v := range graph[u] {
+			if relabeled[r.NewId[u]][j] != r.NewId[v] {
+				t.Fatalf("the edge %d -> %d was not kept", u, v)
+			}
+		}
+	}
+	ids := [][]int{{0, 5, -1}}
+	if back := r.RestoreIds(r.MapIds(ids)); back[0][0] != 0 || back[0][1] != 5 || back[0][2] != -1 {
+		t.Fatalf("the ids did not survive the round trip: %v", back)
+	}
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = []float32{float32(i)}
+	}
+	if permuted := PermuteRows(r, vectors); permuted[r.NewId[7]][0] != 7 {
+		t.Fatalf("vector 7 was not moved to %d", r.NewId[7])
+	}
+
+	filename := filepath.Join(t.TempDir(), "perm.npy")
+	if err := SaveRelabeling(filename, r); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRelabeling(filename, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v := range r.NewId {
+		if loaded.NewId[v] != r.NewId[v] {
+			t.Fatalf("the loaded permutation differs at %d", v)
+		}
+	}
+	if _, err := LoadRelabeling(filename, n+1); err == nil {
+		t.Fatalf("a permutation of another n should be refused")
+	}
+	column := make([][]int, n)
+	for i := range column {
+		column[i] = []int{i / 2}
+	}
+	if err := SaveIntMatrixToFile(filename, column); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRelabeling(filename, n); err == nil {
+		t.Fatalf("repeated ids should be refused")
+	}
+}
+
+func TestRelabelForPartitionsKNN(t *testing.T) {
+	// a kNN graph: the neighbor lists spread over the original ids like the data does
+	rng := rand.New(rand.NewSource(5))
+	vectors := genTestVectors(rng, 1500, 8)
+	graph, _ := genTestGraph(rng, vectors, 16, 12)
+	partitionNum, perPartition := 8, 2
+
+	before, total := PartitionCollisions(graph, partitionNum, perPartition)
+	r := RelabelForPartitions(graph, partitionNum, perPartition, 3)
+	relabeled := r.ApplyGraph(graph)
+	after, _ := PartitionCollisions(relabeled, partitionNum, perPartition)
+	if after >= before*3/4 {
+		t.Fatalf("the relabeling should cut the collisions by a quarter, got %d -> %d of %d", before, after, total)
+	}
+
+	// per neighbor list: the rows lose collisions far more often than they gain some
+	size := partitionSize(len(graph), partitionNum)
+	fewer, more := 0, 0
+	for u := range graph {
+		old := rowCollisions(graph[u], size, perPartition)
+		now := rowCollisions(relabeled[r.NewId[u]], size, perPartition)
+		if now < old {
+			fewer++
+		} else if now > old {
+			more++
+		}
+	}
+	t.Logf("collisions %d -> %d of %d neighbors, %d rows with fewer, %d with more", before, after, total, fewer, more)
+	if fewer <= 2*more {
+		t.Fatalf("%d rows with fewer collisions, %d with more", fewer, more)
+	}
+}
+
+// the neighbors of one row beyond perPartition in their range
+func rowCollisions(row []int, size int, perPartition int) int {
+	counts := map[int]int{}
+	dropped := 0
+	for _, v := range row {
+		counts[v/size]++
+		if counts[v/size] > perPartition {
+			dropped++
+		}
+	}
+	return dropped
+}
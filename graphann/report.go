@@ -0,0 +1,232 @@
+package graphann
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// machine-readable benchmark reports
+// private-search writes one Report per run as JSON next to its text report, so runs can be compared
+// with DiffReports (or graphann/cmd/reportdiff) instead of scraping the text.
+
+type ReportSettings struct {
+	VectorNum         int     `json:"vector_num"`
+	Dim               int     `json:"dim"`
+	M                 int     `json:"m"`
+	DBSizeMB          float64 `json:"db_size_mb"`
+	TopK              int     `json:"top_k"`
+	Rounds            int     `json:"rounds"`
+	Parallel          int     `json:"parallel"`
+	BeamWidth         int     `json:"beam_width"`
+	Split             bool    `json:"split"`
+	SpecDepth         int     `json:"spec_depth"`
+	SpecWidth         int     `json:"spec_width"`
+	Interleave        int     `json:"interleave"`
+	Radius            float64 `json:"radius"`
+	Timeout           string  `json:"timeout"`
+	CoarseVertices    int     `json:"coarse_vertices"`
+	CoarseDegree      int     `json:"coarse_degree"`
+	CoarseRounds      int     `json:"coarse_rounds"`
+	AttrNum           int     `json:"attr_num"`
+	Filter            string  `json:"filter"`
+	LabelAttr         int     `json:"label_attr"`
+	Hybrid            bool    `json:"hybrid"`
+	Payloads          bool    `json:"payloads"`
+	EarlyStop         bool    `json:"early_stop"`
+	Patience          int     `json:"patience"`
+	NonPrivate        bool    `json:"non_private"`
+	RTTms             int     `json:"rtt_ms"`
+	Seed              int64   `json:"seed"`
+	WindowSize        uint64  `json:"window_size"`
+	Relabeled         bool    `json:"relabeled"`
+	MinInDegree       int     `json:"min_in_degree"`       // the in-degree balancing of the graph, 0 if none
+	LongRangeFraction float64 `json:"long_range_fraction"` // the row fraction of long-range edges, -1 if tuned but not recorded
+}
+
+// the costs of the main graph DB. The other DBs (adjacency, coarse, sparse, payloads) are in Extra
+type ReportPreprocessing struct {
+	StorageMB        float64 `json:"storage_mb"`
+	PrepTime         float64 `json:"prep_time_s"`
+	OfflineCommKB    float64 `json:"offline_comm_kb"` // per query, amortized
+	MaintenanceTime  float64 `json:"maintenance_time_s"`
+	ExtraStorageMB   float64 `json:"extra_storage_mb"`
+	ExtraPrepTime    float64 `json:"extra_prep_time_s"`
+	ExtraOfflineComm float64 `json:"extra_offline_comm_kb"`
+}
+
+type ReportOnline struct {
+	ComputeTime     float64 `json:"compute_time_s"` // per query
+	TotalTime       float64 `json:"total_time_s"`   // computation plus one RTT per issued round
+	OnlineCommKB    float64 `json:"online_comm_kb"`
+	ExtraOnlineComm float64 `json:"extra_online_comm_kb"`
+	SuccessRate     float64 `json:"success_rate"` // fraction of the lookups that did not fail
+	TimedOut        int     `json:"timed_out"`
+}
+
+type ReportQuality struct {
+	Recall       float32 `json:"recall"` // -1 without ground truth
+	MRR          float32 `json:"mrr"`
+	DenseRecall  float32 `json:"dense_recall"` // -1 outside hybrid mode
+	AvgStable    float64 `json:"avg_stable_round"`
+	P90Stable    int     `json:"p90_stable_round"`
+	ConvergedNum int     `json:"converged_queries"`
+	AvgReal      float64 `json:"avg_real_rounds"`
+	AvgIssued    float64 `json:"avg_issued_rounds"`
+}
+
+type ReportEnvironment struct {
+	Time        string   `json:"time"`
+	GoVersion   string   `json:"go_version"`
+	OS          string   `json:"os"`
+	Arch        string   `json:"arch"`
+	CPUs        int      `json:"cpus"`
+	Hostname    string   `json:"hostname"`
+	GitRevision string   `json:"git_revision"`
+	Args        []string `json:"args"`
+}
+
+type Report struct {
+	Settings      ReportSettings      `json:"settings"`
+	Preprocessing ReportPreprocessing `json:"preprocessing"`
+	Online        ReportOnline        `json:"online"`
+	Quality       ReportQuality       `json:"quality"`
+	Environment   ReportEnvironment   `json:"environment"`
+}
+
+// the environment of the current process
+func CollectEnvironment() ReportEnvironment {
+	hostname, _ := os.Hostname()
+	return ReportEnvironment{
+		Time:        time.Now().Format(time.RFC3339),
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		CPUs:        runtime.NumCPU(),
+		Hostname:    hostname,
+		GitRevision: gitRevision(),
+		Args:        os.Args,
+	}
+}
+
+// the revision stamped into the binary, or the one of the working directory (go run does not stamp it).
+// A "+dirty" suffix marks uncommitted changes
+func gitRevision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		revision, dirty := "", false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if revision != "" {
+			if dirty {
+				revision += "+dirty"
+			}
+			return revision
+		}
+	}
+
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+	revision := strings.TrimSpace(string(out))
+	if status, err := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output(); err == nil && len(status) > 0 {
+		revision += "+dirty"
+	}
+	return revision
+}
+
+func WriteReport(w io.Writer, report Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func ReadReport(r io.Reader) (Report, error) {
+	var report Report
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return Report{}, fmt.Errorf("invalid report: %w", err)
+	}
+	return report, nil
+}
+
+// the regression thresholds of DiffReports. The recall is compared in absolute terms,
+// the times and the communication relative to the base run
+type DiffTolerance struct {
+	Recall  float64 // e.g. 0.01 = one point of recall
+	Latency float64 // e.g. 0.1 = 10% slower
+	Comm    float64 // e.g. 0.05 = 5% more bytes
+}
+
+// one compared metric of two reports
+type ReportChange struct {
+	Metric     string
+	Base       float64
+	New        float64
+	Regression bool
+}
+
+// compare the quality and the costs of two runs. The settings that differ are returned separately,
+// since a changed setting usually explains a changed metric
+func DiffReports(base Report, current Report, tol DiffTolerance) ([]ReportChange, []string) {
+	changes := make([]ReportChange, 0)
+
+	// higher is better, absolute threshold
+	higher := func(metric string, b float64, c float64) {
+		if b < 0 || c < 0 {
+			// no ground truth in one of the runs
+			return
+		}
+		changes = append(changes, ReportChange{Metric: metric, Base: b, New: c, Regression: b-c > tol.Recall})
+	}
+	// lower is better, relative threshold
+	lower := func(metric string, b float64, c float64, rel float64) {
+		changes = append(changes, ReportChange{Metric: metric, Base: b, New: c, Regression: c > b*(1+rel)})
+	}
+
+	higher("recall", float64(base.Quality.Recall), float64(current.Quality.Recall))
+	higher("mrr", float64(base.Quality.MRR), float64(current.Quality.MRR))
+	higher("dense_recall", float64(base.Quality.DenseRecall), float64(current.Quality.DenseRecall))
+	lower("compute_time_s", base.Online.ComputeTime, current.Online.ComputeTime, tol.Latency)
+	lower("total_time_s", base.Online.TotalTime, current.Online.TotalTime, tol.Latency)
+	lower("online_comm_kb", base.Online.OnlineCommKB, current.Online.OnlineCommKB, tol.Comm)
+	lower("extra_online_comm_kb", base.Online.ExtraOnlineComm, current.Online.ExtraOnlineComm, tol.Comm)
+	lower("offline_comm_kb", base.Preprocessing.OfflineCommKB, current.Preprocessing.OfflineCommKB, tol.Comm)
+	lower("storage_mb", base.Preprocessing.StorageMB, current.Preprocessing.StorageMB, tol.Comm)
+	lower("prep_time_s", base.Preprocessing.PrepTime, current.Preprocessing.PrepTime, tol.Latency)
+
+	// the settings are flat, so we compare them field by field through their JSON form
+	var baseSettings, currentSettings map[string]interface{}
+	b, _ := json.Marshal(base.Settings)
+	c, _ := json.Marshal(current.Settings)
+	_ = json.Unmarshal(b, &baseSettings)
+	_ = json.Unmarshal(c, &currentSettings)
+	// over the keys of both runs, so a setting missing from one of them is reported too
+	keys := make(map[string]bool, len(baseSettings)+len(currentSettings))
+	for key := range baseSettings {
+		keys[key] = true
+	}
+	for key := range currentSettings {
+		keys[key] = true
+	}
+	settings := make([]string, 0)
+	for key := range keys {
+		if fmt.Sprint(baseSettings[key]) != fmt.Sprint(currentSettings[key]) {
+			settings = append(settings, fmt.Sprintf("%s: %v -> %v", key, baseSettings[key], currentSettings[key]))
+		}
+	}
+	sort.Strings(settings)
+	return changes, settings
+}
@@ -0,0 +1,64 @@
+package graphann
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReportDiff(t *testing.T) {
+	base := Report{
+		Settings:      ReportSettings{VectorNum: 1000, M: 16, Rounds: 12, Parallel: 2},
+		Preprocessing: ReportPreprocessing{StorageMB: 2, PrepTime: 1, OfflineCommKB: 100},
+		Online:        ReportOnline{ComputeTime: 0.1, TotalTime: 0.7, OnlineCommKB: 90},
+		Quality:       ReportQuality{Recall: 0.9, MRR: 0.8, DenseRecall: -1},
+		Environment:   CollectEnvironment(),
+	}
+
+	// the reports survive the JSON round trip
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, base); err != nil {
+		t.Fatalf("WriteReport: %v", err)
+	}
+	read, err := ReadReport(&buf)
+	if err != nil {
+		t.Fatalf("ReadReport: %v", err)
+	}
+	if read.Settings != base.Settings || read.Online != base.Online || read.Quality != base.Quality {
+		t.Fatalf("the report changed in the round trip: %+v", read)
+	}
+
+	tol := DiffTolerance{Recall: 0.01, Latency: 0.1, Comm: 0.05}
+	changes, settings := DiffReports(base, base, tol)
+	for _, c := range changes {
+		if c.Regression {
+			t.Fatalf("a run cannot regress against itself, but %s did", c.Metric)
+		}
+		if c.Metric == "dense_recall" {
+			t.Fatalf("the dense recall is -1 and should not be compared")
+		}
+	}
+	if len(settings) != 0 {
+		t.Fatalf("expected no changed settings, got %v", settings)
+	}
+
+	current := base
+	current.Settings.Parallel = 3
+	current.Quality.Recall = 0.85        // 5 points lower
+	current.Quality.MRR = 0.795          // within the tolerance
+	current.Online.TotalTime = 0.75      // 7% slower, within the tolerance
+	current.Online.OnlineCommKB = 135    // 50% more
+	current.Preprocessing.PrepTime = 0.5 // faster
+	changes, settings = DiffReports(base, current, tol)
+	regressed := map[string]bool{}
+	for _, c := range changes {
+		if c.Regression {
+			regressed[c.Metric] = true
+		}
+	}
+	if len(regressed) != 2 || !regressed["recall"] || !regressed["online_comm_kb"] {
+		t.Fatalf("expected regressions in recall and online_comm_kb, got %v", regressed)
+	}
+	if len(settings) != 1 || settings[0] != "parallel: 2 -> 3" {
+		t.Fatalf("expected the changed parallel setting, got %v", settings)
+	}
+}
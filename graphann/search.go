@@ -2,6 +2,8 @@ package graphann
 
 import (
 	"container/heap"
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -13,12 +15,14 @@ type Vertex struct {
 	Id        int
 	Neighbors []int
 	Vector    []float32
+	Attrs     []uint32 // optional attributes for filtered search
+	Links     []int    // coarse level only: the neighbors of the vertex in the full graph
 }
 
 // define an interface that provides GeVertexInfo and GetStartVertex methods
 
 type GetGraphInfo interface {
-	Preprocess()
+	Preprocess() error                     // set up the access to the graph, e.g. the PIR hints
 	GetMetadata() (int, int, int)          // n, dim, m
 	GetVertexInfo([]int) ([]Vertex, error) // given a list of vertex ids, return the corresponding vertices
 	GetStartVertex() ([]Vertex, error)     // return the start vertices (could be more than one)
@@ -32,9 +36,10 @@ type BasicGraphInfo struct {
 	M       int
 	Graph   [][]int
 	Vectors [][]float32
+	Attrs   [][]uint32 // optional, nil if the vertices have no attributes
 }
 
-func (g *BasicGraphInfo) Preprocess() {}
+func (g *BasicGraphInfo) Preprocess() error { return nil }
 
 func (g *BasicGraphInfo) GetMetadata() (int, int, int) {
 	return g.N, g.Dim, g.M
@@ -44,6 +49,9 @@ func (g *BasicGraphInfo) GetVertexInfo(ids []int) ([]Vertex, error) {
 	vertices := make([]Vertex, len(ids))
 	for i, id := range ids {
 		vertices[i] = Vertex{Id: id, Neighbors: g.Graph[id], Vector: g.Vectors[id]}
+		if g.Attrs != nil {
+			vertices[i].Attrs = g.Attrs[id]
+		}
 	}
 	return vertices, nil
 }
@@ -69,15 +77,125 @@ func (g *BasicGraphInfo) GetStartVertex() ([]Vertex, error) {
 type GraphANNFrontend struct {
 	Graph         GetGraphInfo
 	StartVertices []Vertex
+
+	// early termination knobs.
+	// the convergence test runs on the client only. After convergence we keep sending
+	// batches of random ids with the same shape, so the server cannot tell when we stopped.
+	EarlyStop       bool // declare convergence once the frontier cannot improve the top-k
+	Patience        int  // also declare convergence after this many rounds without top-k change (0 = off)
+	SkipDummyRounds bool // stop issuing the dummy batches after convergence. Only use it in non-private mode
+
+	// fetch the vectors of all candidates but the neighbors of the expanded vertices only.
+	// Ignored if the graph does not implement GetSplitGraphInfo
+	SplitFetch bool
+
+	// speculative prefetch, only used by SearchKNN.
+	// Each round also expands the parallel * SpecDepth candidates that would be expanded in the next
+	// SpecDepth rounds, fetching their first SpecWidth neighbors (0 = all m).
+	// If they are still the best candidates later, their rounds are saved
+	SpecDepth int
+	SpecWidth int
+
+	// hierarchical search, only used by SearchKNN.
+	// The first CoarseSteps rounds search the (cheaper) coarse level, whose best vertices start the full search
+	Coarse      *CoarseLevel
+	CoarseSteps int
+
+	// if set, the results carry the fetched vectors
+	ReturnVectors bool
+
+	// if set, SearchStats.RoundTopK records the top-k after every round, e.g. to plot recall against rounds
+	TrackRounds bool
+	// if set, SearchStats.Trace records what every round fetched. Only SearchKNN (with or without the
+	// coarse level, and interleaved) and SearchKNNBeam record it
+	Trace bool
+
+	// range search, set by SearchRange
+	rangeSearch bool
+	radius      float32
+
+	// if set, SearchWithPayloads also fetches the documents of the results
+	Payloads *PayloadFetcher
+
+	// if set, only the vertices matching the filter are returned.
+	// The other vertices are still explored, since they may lead to matching ones.
+	Filter VertexFilter
+}
+
+func (f *GraphANNFrontend) matches(v Vertex) bool {
+	return f.Filter == nil || f.Filter(v.Attrs)
+}
+
+// per-query statistics of a traversal
+type SearchStats struct {
+	IssuedRounds   int // number of batches sent to the graph
+	DummyRounds    int // batches sent after convergence, only containing random ids
+	ConvergedRound int // number of real rounds before convergence was declared, -1 if it never was
+	StableRound    int // number of rounds after which the top-k did not change anymore
+	SpecHits       int // expansions beyond parallel per round, thanks to prefetched neighbors. About SpecHits / parallel rounds were saved
+
+	// with TrackRounds, the ids of the top-k (closest first) after each issued round.
+	// The search stopped after the last one, so later rounds have the same top-k
+	RoundTopK [][]int
+	// with Trace, the record of each issued round
+	Trace []RoundTrace
+}
+
+// the error of a failed search round. Err is the error of the graph (e.g. of the PIR),
+// or the context error if the search was canceled before the round. Check it with errors.Is
+type RoundError struct {
+	Round int
+	Err   error
+}
+
+func (e *RoundError) Error() string {
+	return fmt.Sprintf("graphann: round %d: %v", e.Round, e.Err)
+}
+
+func (e *RoundError) Unwrap() error {
+	return e.Err
+}
+
+// the context is checked before every round, so a search stops at the next round boundary
+func checkRound(ctx context.Context, round int) error {
+	if err := ctx.Err(); err != nil {
+		return &RoundError{Round: round, Err: err}
+	}
+	return nil
+}
+
+// the panicking form of the context-aware searches, used by the legacy methods
+func mustSearch(results []SearchResult, stats SearchStats, err error) ([]SearchResult, SearchStats) {
+	if err != nil {
+		fmt.Printf("Error when querying vertices: %v\n", err)
+		panic(err)
+	}
+	return results, stats
 }
 
 func (f *GraphANNFrontend) Preprocess() {
-	f.Graph.Preprocess()
+	if err := f.PreprocessContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// same as Preprocess, but return the error of the graph instead of panicking
+func (f *GraphANNFrontend) PreprocessContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := f.Graph.Preprocess(); err != nil {
+		return fmt.Errorf("graphann: preprocessing the graph: %w", err)
+	}
 	v, err := f.Graph.GetStartVertex()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("graphann: fetching the start vertices: %w", err)
 	}
 	f.StartVertices = v
+	if f.Coarse != nil {
+		return f.Coarse.PreprocessContext(ctx)
+	}
+	return nil
 }
 
 func (f *GraphANNFrontend) GetMetadata() (int, int, int) {
@@ -110,127 +228,425 @@ func (pq *exploreQueue) Pop() interface{} {
 	return item
 }
 
+// topKList keeps the k closest vertices seen so far, sorted by ascending distance
+type topKList struct {
+	k     int
+	items []*VertexWithDist
+}
+
+// insert v into the list, return true if the list has changed
+func (l *topKList) insert(v *VertexWithDist) bool {
+	if l.k <= 0 {
+		return false
+	}
+	if len(l.items) == l.k && v.dist >= l.items[l.k-1].dist {
+		return false
+	}
+	pos := sort.Search(len(l.items), func(i int) bool { return l.items[i].dist > v.dist })
+	if len(l.items) < l.k {
+		l.items = append(l.items, nil)
+	}
+	copy(l.items[pos+1:], l.items[pos:len(l.items)-1])
+	l.items[pos] = v
+	return true
+}
+
+// with TrackRounds, append the top-k after the current round to the stats
+func (g GraphANNFrontend) recordRound(stats *SearchStats, ids []int) {
+	if g.TrackRounds {
+		stats.RoundTopK = append(stats.RoundTopK, ids)
+	}
+}
+
+// the ids of the current top-k, closest first
+func (l *topKList) ids(g GraphANNFrontend) []int {
+	ids := make([]int, 0, len(l.items))
+	for _, item := range l.items {
+		if g.inRange(item.dist) {
+			ids = append(ids, item.vertex.Id)
+		}
+	}
+	return ids
+}
+
+// the frontier has converged if the closest unexplored vertex is already farther than the k-th result,
+// or if the top-k has not changed for Patience rounds
+func (g GraphANNFrontend) frontierConverged(frontier exploreQueue, topK *topKList, unchangedRounds int) bool {
+	if g.Patience > 0 && unchangedRounds >= g.Patience {
+		return true
+	}
+	if len(frontier) == 0 {
+		return true
+	}
+	if len(topK.items) < topK.k {
+		return false
+	}
+	return frontier[0].dist > topK.items[topK.k-1].dist
+}
+
 // return the found k nearest neighbors and the step to reach them
 func (g GraphANNFrontend) SearchKNN(queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]int, []int) {
-	n, _, m := g.GetMetadata()
+	ret, stepRet, _ := g.SearchKNNWithStats(queryVector, k, maxStep, parallel, benchmarking)
+	return ret, stepRet
+}
+
+// same as SearchKNN, but also report when the traversal converged and stabilized
+func (g GraphANNFrontend) SearchKNNWithStats(queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]int, []int, SearchStats) {
+	results, stats := mustSearch(g.searchKNN(context.Background(), queryVector, k, maxStep, parallel, benchmarking))
+	ret, stepRet := padResults(results, k)
+	return ret, stepRet, stats
+}
+
+// same as SearchKNNWithStats, but return the found results with their distances instead of padded ids
+func (g GraphANNFrontend) SearchKNNResults(queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats) {
+	return mustSearch(g.searchKNN(context.Background(), queryVector, k, maxStep, parallel, benchmarking))
+}
+
+// same as SearchKNNResults, but return the errors of the graph as a *RoundError instead of panicking.
+// The context is checked between rounds. On error, the results found in the previous rounds are returned with it.
+func (g GraphANNFrontend) SearchKNNContext(ctx context.Context, queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	return g.searchKNN(ctx, queryVector, k, maxStep, parallel, benchmarking)
+}
+
+// range search: return all the found vertices within squared L2 distance radius of the query, at most maxResults.
+// The traversal is the one of SearchKNN with k = maxResults. With EarlyStop, it also converges
+// once some results are found and the frontier has left the ball.
+func (g GraphANNFrontend) SearchRange(queryVector []float32, radius float32, maxResults int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats) {
+	return mustSearch(g.SearchRangeContext(context.Background(), queryVector, radius, maxResults, maxStep, parallel, benchmarking))
+}
+
+// the context-aware form of SearchRange, see SearchKNNContext
+func (g GraphANNFrontend) SearchRangeContext(ctx context.Context, queryVector []float32, radius float32, maxResults int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	g.rangeSearch = true
+	g.radius = radius
+	return g.searchKNN(ctx, queryVector, maxResults, maxStep, parallel, benchmarking)
+}
+
+// the legacy form of the results: k ids and reach steps, padded with -1
+func padResults(results []SearchResult, k int) ([]int, []int) {
+	ret := make([]int, k)
+	stepRet := make([]int, k)
+	for i := 0; i < k; i++ {
+		if i < len(results) {
+			ret[i] = results[i].Id
+			stepRet[i] = results[i].Step
+		} else {
+			ret[i] = -1
+			stepRet[i] = -1
+		}
+	}
+	return ret, stepRet
+}
+
+func (g GraphANNFrontend) inRange(dist float32) bool {
+	return !g.rangeSearch || dist <= g.radius
+}
+
+func (g GraphANNFrontend) newResult(v Vertex, dist float32, step int) SearchResult {
+	r := SearchResult{Id: v.Id, Dist: dist, Step: step}
+	if g.ReturnVectors {
+		r.Vector = v.Vector
+	}
+	return r
+}
+
+// the traversal behind SearchKNN. It returns the ids, distances and reach steps of the top k
+func (g GraphANNFrontend) searchKNN(ctx context.Context, queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	if split, ok := g.Graph.(GetSplitGraphInfo); ok && g.SplitFetch {
+		return g.searchKNNSplit(ctx, split, queryVector, k, maxStep, parallel, benchmarking)
+	}
+
+	if g.Coarse == nil || g.CoarseSteps <= 0 {
+		return g.searchKNNFrom(ctx, g.StartVertices, queryVector, k, maxStep, parallel, benchmarking)
+	}
+
+	// the first CoarseSteps rounds navigate the coarse graph, the others the full graph
+	start, coarseStats, err := g.searchCoarse(ctx, queryVector, parallel, benchmarking)
+	if err != nil {
+		return nil, coarseStats, err
+	}
+	for i, ids := range coarseStats.RoundTopK {
+		coarseStats.RoundTopK[i] = ids[:min(k, len(ids))]
+	}
+	results, stats, err := g.searchKNNFrom(ctx, start, queryVector, k, maxStep-g.CoarseSteps, parallel, benchmarking)
+	for i := range results {
+		results[i].Step += g.CoarseSteps
+	}
+	var roundErr *RoundError
+	if errors.As(err, &roundErr) {
+		roundErr.Round += g.CoarseSteps
+	}
+	return results, mergeLevelStats(coarseStats, stats, g.CoarseSteps), err
+}
 
-	reachStep := map[int]int{}
-	knownVertices := map[int]Vertex{}
+// the traversal of the full graph, starting from the best parallel vertices of start
+func (g GraphANNFrontend) searchKNNFrom(ctx context.Context, start []Vertex, queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	s := g.newKNNSearch(start, queryVector, k, parallel, benchmarking)
+	for step := 0; step < maxStep && !s.done(); step++ {
+		if err := checkRound(ctx, step); err != nil {
+			results, stats := s.results()
+			return results, stats, err
+		}
+		batchQ := s.nextBatch()
+
+		//fmt.Println("Querying vertices, batch = ", batchQ[:5])
+		queryResults, err := g.Graph.GetVertexInfo(batchQ)
+		//fmt.Println("Querying vertices done")
+
+		if err != nil {
+			results, stats := s.results()
+			return results, stats, &RoundError{Round: step, Err: err}
+		}
+		s.absorb(step, queryResults)
+	}
+	results, stats := s.results()
+	return results, stats, nil
+}
+
+// the per-round records of TrackRounds and Trace, after the round was absorbed
+func (s *knnSearch) recordRound(queryResults []Vertex) {
+	s.g.recordRound(&s.stats, s.topK.ids(s.g))
+	if !s.g.Trace {
+		return
+	}
+	if !s.round.Dummy && !s.benchmarking {
+		fetched := make(map[int]bool, len(s.round.Fetched))
+		for _, id := range s.round.Fetched {
+			fetched[id] = true
+		}
+		for _, v := range queryResults {
+			if fetched[v.Id] && lookupFailed(v) {
+				s.round.Failed = append(s.round.Failed, v.Id)
+				// only reported once
+				fetched[v.Id] = false
+			}
+		}
+	}
+	s.round.setDists(s.topK)
+	s.stats.Trace = append(s.stats.Trace, s.round)
+}
+
+// the state of one SearchKNN traversal. Each round, nextBatch gives the ids to fetch,
+// and absorb takes the fetched vertices. This lets several queries share the rounds.
+type knnSearch struct {
+	g            GraphANNFrontend
+	queryVector  []float32
+	k            int
+	parallel     int
+	benchmarking bool
+	n            int
+	m            int
+
+	stats           SearchStats
+	topK            *topKList
+	converged       bool
+	unchangedRounds int
+
+	reachStep     map[int]int
+	knownVertices map[int]Vertex
 	// define a priority queue
 	// the priority queue is a min heap, ranked by the distance to the query vector
 	// each element is a tuple (*potential distance, vertex index)
-	// we first push the first parallel * m vertices into the heap
-	toBeExploredVertices := make(exploreQueue, 0)
-	heap.Init(&toBeExploredVertices)
+	toBeExploredVertices exploreQueue
+	// the vertices whose neighbors were (partially) prefetched
+	speculated map[int]bool
+	// with Trace, the record of the current round
+	round RoundTrace
+}
+
+func (g GraphANNFrontend) newKNNSearch(start []Vertex, queryVector []float32, k int, parallel int, benchmarking bool) *knnSearch {
+	n, _, m := g.GetMetadata()
+	s := &knnSearch{
+		g:                    g,
+		queryVector:          queryVector,
+		k:                    k,
+		parallel:             parallel,
+		benchmarking:         benchmarking,
+		n:                    n,
+		m:                    m,
+		stats:                SearchStats{ConvergedRound: -1},
+		topK:                 &topKList{k: k},
+		reachStep:            map[int]int{},
+		knownVertices:        map[int]Vertex{},
+		toBeExploredVertices: make(exploreQueue, 0),
+		speculated:           map[int]bool{},
+	}
+	heap.Init(&s.toBeExploredVertices)
 
 	//fmt.Println("Start vertices: ", g.startVertices)
 
 	// we first find the top parallel vertices from fastStartVertices by their distance to the query vector
 	if !benchmarking {
 		fastStartQueue := make(exploreQueue, 0)
-		for _, v := range g.StartVertices {
+		for _, v := range start {
 			dist := L2Dist(v.Vector, queryVector)
 			fastStartQueue.Push(&VertexWithDist{dist: dist, vertex: v})
 		}
 		sort.Sort(fastStartQueue)
-		for i := 0; len(toBeExploredVertices) < parallel && i < len(fastStartQueue); i++ {
+		if g.Filter != nil {
+			// start from the closest matching vertices
+			sort.SliceStable(fastStartQueue, func(i, j int) bool {
+				return g.matches(fastStartQueue[i].vertex) && !g.matches(fastStartQueue[j].vertex)
+			})
+		}
+		for i := 0; len(s.toBeExploredVertices) < parallel && i < len(fastStartQueue); i++ {
 			v := fastStartQueue[i]
 			id := v.vertex.Id
-			if _, ok := knownVertices[id]; ok {
+			if _, ok := s.knownVertices[id]; ok {
 				// we have already known this vertex
 				continue
 			}
-			knownVertices[id] = v.vertex
-			heap.Push(&toBeExploredVertices, v)
-			reachStep[id] = 0
+			s.knownVertices[id] = v.vertex
+			heap.Push(&s.toBeExploredVertices, v)
+			if g.matches(v.vertex) {
+				s.topK.insert(v)
+			}
+			s.reachStep[id] = 0
 			//toBeExploredItems = append(toBeExploredItems, v)
 		}
 	}
+	return s
+}
 
-	for step := 0; step < maxStep; step++ {
+// no more batches are needed
+func (s *knnSearch) done() bool {
+	return s.converged && s.g.SkipDummyRounds
+}
 
-		// each time we issue parallel batches, each exploring one vertex's neighbors
-		batchQ := make([]int, 0, m)
-		for rept := 0; rept < parallel; rept++ {
-			if len(toBeExploredVertices) == 0 || benchmarking {
-				// in this case we simply make random queries
-				for i := 0; i < m; i++ {
-					batchQ = append(batchQ, rand.Intn(n))
-				}
-			} else {
-				item := heap.Pop(&toBeExploredVertices).(*VertexWithDist)
-				v := item.vertex.Id
-				//log.Print("Exploring vertex ", v, " at step ", step, " with distance ", item.dist)
-				// copy the neighbors of v to the batchQ
-				batchQ = append(batchQ, knownVertices[v].Neighbors...)
-			}
+// the number of ids in each batch
+func (s *knnSearch) batchSize() int {
+	return s.m*s.parallel + s.g.specBatchSize(s.m, s.parallel)
+}
 
-			//log.Printf("Exploring %d vertices at step %d", len(batchQ), step)
-			//log.Printf("The first 5 vertices are %v", batchQ[:5])
+func (s *knnSearch) nextBatch() []int {
+	n, m, parallel := s.n, s.m, s.parallel
+	active := !s.converged && !s.benchmarking
+
+	// each time we issue parallel batches, each exploring one vertex's neighbors.
+	// Prefetched neighbors are not fetched again, so more vertices may fit in the batches
+	batchQ := make([]int, 0, s.batchSize())
+	expanded := 0
+	if s.g.Trace {
+		s.round = newRoundTrace(s.stats.IssuedRounds)
+		s.round.Dummy = s.converged
+	}
+	for active && len(s.toBeExploredVertices) > 0 {
+		item := s.toBeExploredVertices[0]
+		if len(batchQ)+len(item.vertex.Neighbors) > m*parallel {
+			break
+		}
+		heap.Pop(&s.toBeExploredVertices)
+		//log.Print("Exploring vertex ", v, " at step ", step, " with distance ", item.dist)
+		// copy the neighbors of v to the batchQ
+		batchQ = append(batchQ, item.vertex.Neighbors...)
+		expanded++
+		if s.g.Trace {
+			s.round.Expanded = append(s.round.Expanded, item.vertex.Id)
+		}
+	}
+	s.stats.SpecHits += max(0, expanded-parallel)
+	if s.g.Trace {
+		s.round.Fetched = append(s.round.Fetched, batchQ...)
+	}
+	// otherwise we simply make random queries
+	for len(batchQ) < m*parallel {
+		batchQ = append(batchQ, rand.Intn(n))
+	}
 
+	if s.g.SpecDepth > 0 && active {
+		batchQ = s.g.speculate(&s.toBeExploredVertices, s.speculated, batchQ, m, parallel)
+		if s.g.Trace {
+			s.round.Fetched = append(s.round.Fetched, batchQ[m*parallel:]...)
 		}
+	}
+	for len(batchQ) < s.batchSize() {
+		batchQ = append(batchQ, rand.Intn(n))
+	}
+	return batchQ
+}
 
-		//fmt.Println("Querying vertices, batch = ", batchQ[:5])
-		queryResults, err := g.Graph.GetVertexInfo(batchQ)
-		//fmt.Println("Querying vertices done")
+// take the vertices fetched in this step
+func (s *knnSearch) absorb(step int, queryResults []Vertex) {
+	s.stats.IssuedRounds++
+	if s.g.TrackRounds || s.g.Trace {
+		defer s.recordRound(queryResults)
+	}
 
-		if err != nil {
-			fmt.Printf("Error when querying vertices: %v\n", err)
-			panic(err)
-		}
+	if s.converged {
+		// a dummy round that keeps the access pattern fixed-shape
+		s.stats.DummyRounds++
+		return
+	}
+
+	if s.benchmarking {
+		// if we are just benchmarking, we don't care about the return
+		return
+	}
 
-		if benchmarking {
-			// if we are just benchmarking, we don't care about the return
+	changed := false
+	for _, v := range queryResults {
+		if _, ok := s.knownVertices[v.Id]; ok {
+			// we have already known this vertex
 			continue
 		}
-
-		for _, v := range queryResults {
-			if _, ok := knownVertices[v.Id]; ok {
-				// we have already known this vertex
-				continue
-			}
-			// if the neighbor list is all zeroes, we skip this vertex
-			ok := false
-			for _, neighbor := range v.Neighbors {
-				if neighbor != 0 {
-					ok = true
-					break
-				}
-			}
-			if ok {
-				knownVertices[v.Id] = v
-				reachStep[v.Id] = step
-				// calculate the distance to the query vector
-				dist := L2Dist(v.Vector, queryVector)
-				heap.Push(&toBeExploredVertices, &VertexWithDist{dist: dist, vertex: v})
+		// if the neighbor list is all zeroes, we skip this vertex
+		if !lookupFailed(v) {
+			s.knownVertices[v.Id] = v
+			s.reachStep[v.Id] = step
+			// calculate the distance to the query vector
+			dist := L2Dist(v.Vector, s.queryVector)
+			item := &VertexWithDist{dist: dist, vertex: v}
+			heap.Push(&s.toBeExploredVertices, item)
+			if s.g.matches(v) && s.topK.insert(item) {
+				changed = true
 			}
 		}
 	}
 
+	if changed {
+		s.stats.StableRound = step + 1
+		s.unchangedRounds = 0
+	} else {
+		s.unchangedRounds++
+	}
+
+	if s.g.EarlyStop && (s.g.frontierConverged(s.toBeExploredVertices, s.topK, s.unchangedRounds) || s.rangeConverged()) {
+		s.converged = true
+		s.stats.ConvergedRound = step + 1
+	}
+}
+
+// range search: we reached the ball around the query, and the frontier has left it
+func (s *knnSearch) rangeConverged() bool {
+	if !s.g.rangeSearch || len(s.topK.items) == 0 || len(s.toBeExploredVertices) == 0 {
+		return false
+	}
+	return s.topK.items[0].dist <= s.g.radius && s.toBeExploredVertices[0].dist > s.g.radius
+}
+
+// the (at most) k closest found vertices, sorted by distance
+func (s *knnSearch) results() ([]SearchResult, SearchStats) {
 	// extract all known vertices and sort them by distance by ascending order
-	allKnownVertices := make([]VertexWithDist, 0, len(knownVertices))
-	for _, v := range knownVertices {
+	allKnownVertices := make([]VertexWithDist, 0, len(s.knownVertices))
+	for _, v := range s.knownVertices {
+		if !s.g.matches(v) {
+			continue
+		}
 		allKnownVertices = append(allKnownVertices,
 			VertexWithDist{
-				dist:   L2Dist(v.Vector, queryVector),
+				dist:   L2Dist(v.Vector, s.queryVector),
 				vertex: v,
 			})
 	}
 	sort.Slice(allKnownVertices, func(i, j int) bool {
 		return allKnownVertices[i].dist < allKnownVertices[j].dist
 	})
-	ret := make([]int, k)
-	stepRet := make([]int, k)
-	for i := 0; i < k; i++ {
-		if i >= len(allKnownVertices) {
-			ret[i] = -1
-			stepRet[i] = -1
-		} else {
-			ret[i] = allKnownVertices[i].vertex.Id
-			stepRet[i] = reachStep[ret[i]]
-		}
+	results := make([]SearchResult, 0, s.k)
+	for i := 0; i < s.k && i < len(allKnownVertices) && s.g.inRange(allKnownVertices[i].dist); i++ {
+		v := allKnownVertices[i]
+		results = append(results, s.g.newResult(v.vertex, v.dist, s.reachStep[v.vertex.Id]))
 	}
-	return ret, stepRet
+	return results, s.stats
 }
 
 func (g *GraphANNFrontend) SearchKNNBatch(queryVectors [][]float32, k int, maxStep int, parallel int, benchmarking bool) ([][]int, [][]int) {
@@ -243,3 +659,49 @@ func (g *GraphANNFrontend) SearchKNNBatch(queryVectors [][]float32, k int, maxSt
 	}
 	return ret, stepRet
 }
+
+// a search result
+type SearchResult struct {
+	Id      int
+	Dist    float32   // squared L2 distance to the query
+	Step    int       // the round in which the vertex was fetched
+	Vector  []float32 // only set with ReturnVectors
+	Payload []byte    // nil if no payload was fetched, or if the fetch failed
+}
+
+// search the k nearest neighbors (with beam search if L > 0), then fetch their payloads
+// in one more round of fixed size. Only the found results are returned.
+func (g GraphANNFrontend) SearchWithPayloads(queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	return g.SearchWithPayloadsContext(context.Background(), queryVector, k, L, maxStep, parallel, benchmarking)
+}
+
+// the context-aware form of SearchWithPayloads. The context is also checked before the payload round
+func (g GraphANNFrontend) SearchWithPayloadsContext(ctx context.Context, queryVector []float32, k int, L int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	var results []SearchResult
+	var stats SearchStats
+	var err error
+	if L > 0 {
+		results, stats, err = g.searchKNNBeam(ctx, queryVector, k, L, maxStep, parallel, benchmarking)
+	} else {
+		results, stats, err = g.searchKNN(ctx, queryVector, k, maxStep, parallel, benchmarking)
+	}
+	if err != nil {
+		return results, stats, err
+	}
+
+	if g.Payloads != nil {
+		if err := checkRound(ctx, stats.IssuedRounds); err != nil {
+			return results, stats, err
+		}
+		// always k documents, so the payload round has a fixed size
+		ids, _ := padResults(results, k)
+		payloads, err := g.Payloads.FetchPayloads(ids)
+		if err != nil {
+			return results, stats, &RoundError{Round: stats.IssuedRounds, Err: err}
+		}
+		for i := range results {
+			results[i].Payload = payloads[i]
+		}
+	}
+	return results, stats, nil
+}
@@ -0,0 +1,1050 @@
+package graphann
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"example.com/pianopir"
+)
+
+// a small random dataset with a brute-force graph, so that the search tests do not need NGT or the SIFT files
+func genTestVectors(rng *rand.Rand, n int, dim int) [][]float32 {
+	vectors := make([][]float32, n)
+	for i := 0; i < n; i++ {
+		vectors[i] = make([]float32, dim)
+		for j := 0; j < dim; j++ {
+			vectors[i][j] = rng.Float32()
+		}
+	}
+	return vectors
+}
+
+// the 2m nearest vertices of every vertex pruned to local neighbors, the rest of the row up to m filled with random
+// vertices. It also returns the number of random fill edges at the end of every row, as in finishGraph
+func genTestGraph(rng *rand.Rand, vectors [][]float32, m int, local int) ([][]int, []int) {
+	n := len(vectors)
+	graph := make([][]int, n)
+	fill := make([]int, n)
+	for u := 0; u < n; u++ {
+		candidates := make([]IdWithDist, 0, n-1)
+		for v := 0; v < n; v++ {
+			if v != u {
+				candidates = append(candidates, IdWithDist{id: v, dist: L2Dist(vectors[u], vectors[v])})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+		ids := make([]int, 0, 2*m)
+		for i := 0; i < 2*m && i < len(candidates); i++ {
+			ids = append(ids, candidates[i].id)
+		}
+		graph[u] = robustPrune(vectors, u, ids, local, 1.2)
+		// the other edges are long-range ones, like the random fill in CreateGraphBasedOnNGT
+		fill[u] = m - len(graph[u])
+		for len(graph[u]) < m {
+			v := rng.Intn(n)
+			ok := v != u
+			for _, w := range graph[u] {
+				if w == v {
+					ok = false
+				}
+			}
+			if ok {
+				graph[u] = append(graph[u], v)
+			}
+		}
+	}
+	return graph, fill
+}
+
+func genTestFrontend(seed int64, n int, dim int, m int) (GraphANNFrontend, [][]float32) {
+	rng := rand.New(rand.NewSource(seed))
+	vectors := genTestVectors(rng, n, dim)
+	graph, _ := genTestGraph(rng, vectors, m, m/2)
+	frontend := GraphANNFrontend{
+		Graph: &BasicGraphInfo{
+			N:       n,
+			Dim:     dim,
+			M:       m,
+			Graph:   graph,
+			Vectors: vectors,
+		},
+	}
+	frontend.Preprocess()
+	return frontend, vectors
+}
+
+// counts the number of GetVertexInfo calls and the ids in each call
+type countingGraphInfo struct {
+	BasicGraphInfo
+	batchSizes []int
+}
+
+func (g *countingGraphInfo) GetVertexInfo(ids []int) ([]Vertex, error) {
+	g.batchSizes = append(g.batchSizes, len(ids))
+	return g.BasicGraphInfo.GetVertexInfo(ids)
+}
+
+// counts the ids in each vector and adjacency lookup
+type countingSplitGraphInfo struct {
+	BasicSplitGraphInfo
+	vectorSizes []int
+	rowSizes    []int
+}
+
+func (g *countingSplitGraphInfo) GetVectors(ids []int) ([]Vertex, error) {
+	g.vectorSizes = append(g.vectorSizes, len(ids))
+	return g.BasicSplitGraphInfo.GetVectors(ids)
+}
+
+func (g *countingSplitGraphInfo) GetNeighbors(ids []int) ([][]int, error) {
+	g.rowSizes = append(g.rowSizes, len(ids))
+	return g.BasicSplitGraphInfo.GetNeighbors(ids)
+}
+
+func TestEarlyStop(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	counting := &countingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo)}
+	frontend.Graph = counting
+	frontend.EarlyStop = true
+
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		query := genTestVectors(rng, 1, dim)[0]
+
+		frontend.EarlyStop = false
+		baseline, _, baseStats := frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+		if baseStats.ConvergedRound != -1 || baseStats.DummyRounds != 0 {
+			t.Fatalf("early stop is off, but got stats %+v", baseStats)
+		}
+
+		// with dummy rounds, the shape of the access pattern must not change
+		frontend.EarlyStop = true
+		counting.batchSizes = nil
+		knn, _, stats := frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+		if stats.IssuedRounds != maxStep || len(counting.batchSizes) != maxStep {
+			t.Fatalf("expected %d rounds, got %d (%d calls)", maxStep, stats.IssuedRounds, len(counting.batchSizes))
+		}
+		for _, size := range counting.batchSizes {
+			if size != m*parallel {
+				t.Fatalf("expected fixed batch size %d, got %v", m*parallel, counting.batchSizes)
+			}
+		}
+		if stats.ConvergedRound >= 0 && stats.DummyRounds != maxStep-stats.ConvergedRound {
+			t.Fatalf("inconsistent stats %+v", stats)
+		}
+		if stats.StableRound > baseStats.StableRound {
+			t.Fatalf("stable round %d is later than without early stop %d", stats.StableRound, baseStats.StableRound)
+		}
+
+		// stopping early can never find something closer than the full traversal
+		if L2Dist(vectors[knn[0]], query) < L2Dist(vectors[baseline[0]], query) {
+			t.Fatalf("early stop found a closer vertex %v than the full traversal %v", knn[0], baseline[0])
+		}
+
+		// skipping the dummy rounds only changes the number of rounds
+		frontend.SkipDummyRounds = true
+		skipped, _, skipStats := frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+		frontend.SkipDummyRounds = false
+		if skipStats.DummyRounds != 0 {
+			t.Fatalf("dummy rounds should be skipped, got %+v", skipStats)
+		}
+		if skipStats.ConvergedRound >= 0 && skipStats.IssuedRounds != skipStats.ConvergedRound {
+			t.Fatalf("inconsistent stats %+v", skipStats)
+		}
+		if len(skipped) != k {
+			t.Fatalf("expected %d results, got %d", k, len(skipped))
+		}
+	}
+}
+
+func TestTopKList(t *testing.T) {
+	l := &topKList{k: 3}
+	dists := []float32{5, 3, 4, 1, 6, 2}
+	changed := []bool{true, true, true, true, false, true}
+	for i, d := range dists {
+		if got := l.insert(&VertexWithDist{dist: d, vertex: Vertex{Id: i}}); got != changed[i] {
+			t.Fatalf("insert %v: expected changed = %v", d, changed[i])
+		}
+	}
+	want := []float32{1, 2, 3}
+	for i, v := range l.items {
+		if v.dist != want[i] {
+			t.Fatalf("expected %v at %d, got %v", want[i], i, v.dist)
+		}
+	}
+}
+
+func bruteForceKNN(vectors [][]float32, query []float32, k int) []int {
+	candidates := make([]IdWithDist, len(vectors))
+	for i, v := range vectors {
+		candidates[i] = IdWithDist{id: i, dist: L2Dist(v, query)}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+	ret := make([]int, k)
+	for i := 0; i < k; i++ {
+		ret[i] = candidates[i].id
+	}
+	return ret
+}
+
+func TestBeamSearch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	counting := &countingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo)}
+	frontend.Graph = counting
+
+	rng := rand.New(rand.NewSource(3))
+	q := 50
+	queries := genTestVectors(rng, q, dim)
+	gnd := make([][]int, q)
+	for i := 0; i < q; i++ {
+		gnd[i] = bruteForceKNN(vectors, queries[i], k)
+	}
+
+	answers, _ := frontend.SearchKNNBatch(queries, k, maxStep, parallel, false)
+	recall := ComputeRecall(gnd, answers, k)
+
+	counting.batchSizes = nil
+	beamAnswers, steps := frontend.SearchKNNBeamBatch(queries, k, 64, maxStep, parallel, false)
+	beamRecall := ComputeRecall(gnd, beamAnswers, k)
+	t.Logf("recall: SearchKNN %v, SearchKNNBeam %v", recall, beamRecall)
+
+	if len(counting.batchSizes) != q*maxStep {
+		t.Fatalf("expected %d batches, got %d", q*maxStep, len(counting.batchSizes))
+	}
+	for _, size := range counting.batchSizes {
+		if size != m*parallel {
+			t.Fatalf("expected fixed batch size %d, got %d", m*parallel, size)
+		}
+	}
+	if beamRecall < 0.9 {
+		t.Fatalf("beam search recall %v is too low", beamRecall)
+	}
+	for i := 0; i < q; i++ {
+		for j := 0; j < k; j++ {
+			if steps[i][j] < 0 || steps[i][j] >= maxStep {
+				t.Fatalf("invalid reach step %d", steps[i][j])
+			}
+		}
+	}
+
+	// early stop: the beam converges once all candidates are expanded
+	frontend.EarlyStop = true
+	frontend.SkipDummyRounds = true
+	_, _, stats := frontend.SearchKNNBeam(queries[0], k, 16, 100, parallel, false)
+	if stats.ConvergedRound < 0 || stats.IssuedRounds != stats.ConvergedRound {
+		t.Fatalf("expected the beam to converge within 100 rounds, got %+v", stats)
+	}
+}
+
+func TestBeamList(t *testing.T) {
+	l := newBeamList(3)
+	for i, d := range []float32{5, 3, 4, 1, 6} {
+		l.insert(beamCandidate{id: i, dist: d})
+	}
+	want := []int{3, 1, 2}
+	for i := 0; i < l.size; i++ {
+		if l.items[i].id != want[i] {
+			t.Fatalf("expected id %d at %d, got %d", want[i], i, l.items[i].id)
+		}
+	}
+	l.items[0].expanded = true
+	if next := l.nextToExpand(1); len(next) != 1 || next[0] != 1 {
+		t.Fatalf("expected position 1 to be expanded next, got %v", next)
+	}
+
+	b := newBitset(130)
+	b.set(129)
+	if !b.get(129) || b.get(1) {
+		t.Fatalf("bitset is broken")
+	}
+}
+
+func TestFilteredSearch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	rng := rand.New(rand.NewSource(4))
+	attrs := make([][]uint32, n)
+	for i := 0; i < n; i++ {
+		attrs[i] = []uint32{uint32(rng.Intn(4)), uint32(rng.Intn(100))}
+	}
+	frontend.Graph.(*BasicGraphInfo).Attrs = attrs
+	frontend.Preprocess()
+
+	filter, err := ParseFilter("0=2, 1>=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontend.Filter = filter
+
+	for i := 0; i < 10; i++ {
+		query := genTestVectors(rng, 1, dim)[0]
+		knn, _ := frontend.SearchKNN(query, k, maxStep, parallel, false)
+		beam, _, _ := frontend.SearchKNNBeam(query, k, 64, maxStep, parallel, false)
+		for _, answer := range [][]int{knn, beam} {
+			for _, id := range answer {
+				if id >= 0 && !filter(attrs[id]) {
+					t.Fatalf("vertex %d with attributes %v does not match the filter", id, attrs[id])
+				}
+			}
+			if answer[0] < 0 {
+				t.Fatalf("no matching vertex found")
+			}
+		}
+		// results are sorted by distance
+		for j := 1; j < k && beam[j] >= 0; j++ {
+			if L2Dist(vectors[beam[j]], query) < L2Dist(vectors[beam[j-1]], query) {
+				t.Fatalf("results are not sorted")
+			}
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter("0=3,1>10,2<=5,3!=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter([]uint32{3, 11, 5, 0}) || filter([]uint32{3, 10, 5, 0}) || filter([]uint32{3, 11, 6, 0}) || filter([]uint32{3, 11, 5, 1}) {
+		t.Fatalf("wrong filter evaluation")
+	}
+	// a missing column never matches
+	if filter([]uint32{3}) {
+		t.Fatalf("a vertex without the attribute should not match")
+	}
+	for _, bad := range []string{"", "a=1", "0~1", "0=-1"} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRobustPruneWithLabels(t *testing.T) {
+	// u = 0 at the origin, 1 and 2 lie on the same ray, so 1 occludes 2 in the plain prune rule
+	// (L2Dist needs at least 8 dimensions)
+	vectors := [][]float32{{0, 0, 0, 0, 0, 0, 0, 0}, {1, 0, 0, 0, 0, 0, 0, 0}, {2, 0, 0, 0, 0, 0, 0, 0}, {0, 5, 0, 0, 0, 0, 0, 0}}
+	pruned := robustPrune(vectors, 0, []int{1, 2, 3}, 2, 1.2)
+	for _, v := range pruned {
+		if v == 2 {
+			t.Fatalf("expected 2 to be pruned, got %v", pruned)
+		}
+	}
+
+	// if 0 and 2 share a label that 1 does not have, the edge to 2 must be kept
+	labels := [][]uint32{{7}, {1}, {7}, {1}}
+	pruned = robustPruneWithLabels(vectors, labels, 0, []int{1, 2, 3}, 2, 1.2)
+	if len(pruned) != 2 || pruned[0] != 1 || pruned[1] != 2 {
+		t.Fatalf("expected [1 2], got %v", pruned)
+	}
+}
+
+// records the batch sizes, and fails the lookups of the chunks in failing
+type testPayloadChunks struct {
+	BasicPayloadChunks
+	batchSizes []int
+	failing    map[int]bool
+}
+
+func (p *testPayloadChunks) GetChunks(ids []int) ([][]byte, error) {
+	p.batchSizes = append(p.batchSizes, len(ids))
+	ret, _ := p.BasicPayloadChunks.GetChunks(ids)
+	for i, id := range ids {
+		if p.failing[id] {
+			ret[i] = make([]byte, len(ret[i]))
+		}
+	}
+	return ret, nil
+}
+
+func TestSearchWithPayloads(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	// payloads of 0 to 300 bytes, with 64-byte chunks and at most 4 chunks per document
+	rng := rand.New(rand.NewSource(5))
+	payloads := make([][]byte, n)
+	lengths := make([]int, n)
+	for i := 0; i < n; i++ {
+		payloads[i] = make([]byte, rng.Intn(300))
+		rng.Read(payloads[i])
+		lengths[i] = len(payloads[i])
+	}
+	layout := BuildPayloadLayout(lengths, 64, 4, k*4/2)
+	if layout.Truncated == 0 {
+		t.Fatalf("expected some truncated payloads")
+	}
+	chunks := &testPayloadChunks{BasicPayloadChunks: BasicPayloadChunks{Data: layout.Chunks(payloads)}}
+	frontend.Payloads = &PayloadFetcher{Layout: layout, Chunks: chunks}
+
+	query := genTestVectors(rng, 1, dim)[0]
+	results, _, err := frontend.SearchWithPayloads(query, k, 0, 20, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != k {
+		t.Fatalf("expected %d results, got %d", k, len(results))
+	}
+	if len(chunks.batchSizes) != 1 || chunks.batchSizes[0] != k*4 {
+		t.Fatalf("expected one batch of %d chunks, got %v", k*4, chunks.batchSizes)
+	}
+	for i, r := range results {
+		if r.Dist != L2Dist(vectors[r.Id], query) || (i > 0 && r.Dist < results[i-1].Dist) {
+			t.Fatalf("wrong distance for result %d", i)
+		}
+		want := payloads[r.Id][:layout.Lengths[r.Id]]
+		if string(r.Payload) != string(want) {
+			t.Fatalf("wrong payload for %d: got %d bytes, want %d", r.Id, len(r.Payload), len(want))
+		}
+	}
+
+	// a failed chunk invalidates the payload of its document only
+	failed := results[0].Id
+	chunks.failing = map[int]bool{layout.ChunkId(failed, 0): true}
+	results, _, _ = frontend.SearchWithPayloads(query, k, 32, 20, 2, false)
+	for _, r := range results {
+		if (r.Payload == nil) != (r.Id == failed) {
+			t.Fatalf("unexpected payload state for %d", r.Id)
+		}
+	}
+	if frontend.Payloads.FailedDocs != 1 {
+		t.Fatalf("expected 1 failed document, got %d", frontend.Payloads.FailedDocs)
+	}
+}
+
+// serves the chunks through the batch PIR, like PIRPayloadChunks in private-search.go
+type batchPIRPayloadChunks struct {
+	pir       *pianopir.SimpleBatchPianoPIR
+	chunkSize int
+	batchSize int
+}
+
+func (p *batchPIRPayloadChunks) Preprocess() error { return nil }
+
+func (p *batchPIRPayloadChunks) GetChunks(ids []int) ([][]byte, error) {
+	indices := make([]uint64, p.batchSize)
+	for i := range indices {
+		indices[i] = pianopir.DummyIndex
+		if i < len(ids) && ids[i] >= 0 {
+			indices[i] = uint64(ids[i])
+		}
+	}
+	responses, err := p.pir.Query(indices)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, len(ids))
+	for i := range ids {
+		ret[i] = make([]byte, p.chunkSize)
+		for j, word := range responses[i] {
+			binary.LittleEndian.PutUint64(ret[i][j*8:], word)
+		}
+	}
+	return ret, nil
+}
+
+func TestPayloadsThroughBatchPIR(t *testing.T) {
+	n, chunkSize, chunksPerDoc, k := 20000, 256, 8, 10
+	batchSize := k * chunksPerDoc
+	partitionNum := batchSize / pianopir.RealQueryPerPartition
+
+	// payloads of 1 to 4 chunks
+	rng := rand.New(rand.NewSource(7))
+	capacity := chunkSize - chunkHeaderSize
+	payloads := make([][]byte, n)
+	lengths := make([]int, n)
+	for i := range payloads {
+		payloads[i] = make([]byte, 1+rng.Intn(4*capacity))
+		rng.Read(payloads[i])
+		lengths[i] = len(payloads[i])
+	}
+	layout := BuildPayloadLayout(lengths, chunkSize, chunksPerDoc, partitionNum)
+	for id := 0; id < n; id++ {
+		seen := make(map[int]bool)
+		for c := 0; c < layout.chunkCount(id); c++ {
+			partition := layout.ChunkId(id, c) / layout.Rows
+			if seen[partition] {
+				t.Fatalf("two chunks of document %d are in partition %d", id, partition)
+			}
+			seen[partition] = true
+		}
+	}
+
+	chunks := layout.Chunks(payloads)
+	rawDB := make([]uint64, len(chunks)*chunkSize/8)
+	for i, chunk := range chunks {
+		for j := 0; j < chunkSize/8; j++ {
+			rawDB[i*chunkSize/8+j] = binary.LittleEndian.Uint64(chunk[j*8:])
+		}
+	}
+	pir, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(len(chunks)), uint64(chunkSize), uint64(batchSize), rawDB, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pir.Config().PartitionSize != uint64(layout.Rows) {
+		t.Fatalf("the partitions of the PIR (%d entries) are not the columns of the layout (%d rows)", pir.Config().PartitionSize, layout.Rows)
+	}
+	pir.Preprocessing()
+	fetcher := &PayloadFetcher{Layout: layout, Chunks: &batchPIRPayloadChunks{pir: pir, chunkSize: chunkSize, batchSize: batchSize}}
+
+	// the documents of 1 to 4 chunks, and how many of them failed
+	fetched := make([]int, 5)
+	failed := make([]int, 5)
+	for round := 0; round < 200; round++ {
+		ids := rng.Perm(n)[:k]
+		got, err := fetcher.FetchPayloads(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range ids {
+			cnt := layout.chunkCount(id)
+			fetched[cnt]++
+			if got[i] == nil {
+				failed[cnt]++
+			} else if !bytes.Equal(got[i], payloads[id]) {
+				t.Fatalf("wrong payload for document %d", id)
+			}
+		}
+	}
+	t.Logf("failed documents by chunk count: %v of %v", failed[1:], fetched[1:])
+	if failed[1]*10 > fetched[1] || failed[4]*4 > fetched[4] {
+		t.Fatalf("too many failed documents: %v of %v", failed[1:], fetched[1:])
+	}
+}
+
+func TestSplitSearch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	counting := &countingSplitGraphInfo{BasicSplitGraphInfo: BasicSplitGraphInfo{*frontend.Graph.(*BasicGraphInfo)}}
+	frontend.Graph = counting
+
+	rng := rand.New(rand.NewSource(3))
+	q := 50
+	queries := genTestVectors(rng, q, dim)
+	gnd := make([][]int, q)
+	for i := 0; i < q; i++ {
+		gnd[i] = bruteForceKNN(vectors, queries[i], k)
+	}
+
+	answers, _ := frontend.SearchKNNBatch(queries, k, maxStep, parallel, false)
+	if len(counting.vectorSizes) != 0 {
+		t.Fatalf("split lookups used without SplitFetch")
+	}
+
+	frontend.SplitFetch = true
+	// a hop takes two rounds in split mode
+	splitAnswers, steps := frontend.SearchKNNBatch(queries, k, 2*maxStep, parallel, false)
+	recall := ComputeRecall(gnd, answers, k)
+	splitRecall := ComputeRecall(gnd, splitAnswers, k)
+	t.Logf("recall: SearchKNN %v, split %v", recall, splitRecall)
+
+	if len(counting.vectorSizes) != q*2*maxStep || len(counting.rowSizes) != q*2*maxStep {
+		t.Fatalf("expected %d rounds, got %d vector and %d row lookups", q*2*maxStep, len(counting.vectorSizes), len(counting.rowSizes))
+	}
+	for i := range counting.vectorSizes {
+		if counting.vectorSizes[i] != m*parallel || counting.rowSizes[i] != parallel {
+			t.Fatalf("expected fixed lookup sizes %d/%d, got %d/%d", m*parallel, parallel, counting.vectorSizes[i], counting.rowSizes[i])
+		}
+	}
+	if splitRecall < 0.9 {
+		t.Fatalf("split search recall %v is too low", splitRecall)
+	}
+	for i := 0; i < q; i++ {
+		for j := 0; j < k; j++ {
+			if steps[i][j] < 0 || steps[i][j] >= 2*maxStep {
+				t.Fatalf("invalid reach step %d", steps[i][j])
+			}
+		}
+	}
+
+	frontend.EarlyStop = true
+	frontend.SkipDummyRounds = true
+	_, _, stats := frontend.SearchKNNWithStats(queries[0], k, 200, parallel, false)
+	if stats.ConvergedRound < 0 || stats.IssuedRounds != stats.ConvergedRound {
+		t.Fatalf("expected the split search to converge within 200 rounds, got %+v", stats)
+	}
+}
+
+func TestSpeculativePrefetch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	parallel := 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	counting := &countingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo)}
+	frontend.Graph = counting
+	frontend.EarlyStop = true
+
+	rng := rand.New(rand.NewSource(3))
+	q := 50
+	queries := genTestVectors(rng, q, dim)
+	gnd := make([][]int, q)
+	for i := 0; i < q; i++ {
+		gnd[i] = bruteForceKNN(vectors, queries[i], k)
+	}
+
+	run := func(maxStep int) ([][]int, float64) {
+		answers := make([][]int, q)
+		stable := 0
+		for i := 0; i < q; i++ {
+			var stats SearchStats
+			answers[i], _, stats = frontend.SearchKNNWithStats(queries[i], k, maxStep, parallel, false)
+			stable += stats.StableRound
+		}
+		return answers, float64(stable) / float64(q)
+	}
+
+	answers, baseStable := run(20)
+	baseRecall := ComputeRecall(gnd, answers, k)
+
+	frontend.SpecDepth = 2
+	frontend.SpecWidth = m / 2
+	counting.batchSizes = nil
+	answers, specStable := run(20)
+	specRecall := ComputeRecall(gnd, answers, k)
+	t.Logf("recall %v -> %v, average stable round %v -> %v", baseRecall, specRecall, baseStable, specStable)
+
+	batchSize := m*parallel + frontend.specBatchSize(m, parallel)
+	if batchSize != m*parallel+m*parallel {
+		t.Fatalf("unexpected speculative batch size %d", batchSize)
+	}
+	for _, size := range counting.batchSizes {
+		if size != batchSize {
+			t.Fatalf("expected fixed batch size %d, got %d", batchSize, size)
+		}
+	}
+	if specStable >= baseStable {
+		t.Fatalf("speculation did not save rounds: %v vs %v", specStable, baseStable)
+	}
+	if specRecall < baseRecall-0.02 {
+		t.Fatalf("speculation lost recall: %v vs %v", specRecall, baseRecall)
+	}
+
+	_, _, stats := frontend.SearchKNNWithStats(queries[0], k, 20, parallel, false)
+	if stats.SpecHits == 0 {
+		t.Fatalf("expected speculative hits, got %+v", stats)
+	}
+}
+
+func TestHierarchicalSearch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	coarseM, coarseSteps := 8, 4
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+	graph := frontend.Graph.(*BasicGraphInfo).Graph
+
+	counting := &countingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo)}
+	frontend.Graph = counting
+
+	ids, coarseGraph := BuildCoarseGraph(vectors, 200, coarseM, 1)
+	if len(ids) != 200 || len(coarseGraph) != 200 {
+		t.Fatalf("expected 200 coarse vertices, got %d", len(ids))
+	}
+	for u, neighbors := range coarseGraph {
+		if len(neighbors) != coarseM {
+			t.Fatalf("coarse vertex %d has %d neighbors", u, len(neighbors))
+		}
+		for _, v := range neighbors {
+			if v == u || v < 0 || v >= len(ids) {
+				t.Fatalf("invalid coarse edge %d -> %d", u, v)
+			}
+		}
+	}
+
+	coarse := NewBasicCoarseLevel(vectors, graph, nil, ids, coarseGraph)
+	frontend.Coarse = coarse
+	frontend.CoarseSteps = coarseSteps
+	frontend.Preprocess()
+
+	rng := rand.New(rand.NewSource(3))
+	q := 50
+	queries := genTestVectors(rng, q, dim)
+	gnd := make([][]int, q)
+	for i := 0; i < q; i++ {
+		gnd[i] = bruteForceKNN(vectors, queries[i], k)
+	}
+
+	counting.batchSizes = nil
+	answers, steps := frontend.SearchKNNBatch(queries, k, maxStep, parallel, false)
+	recall := ComputeRecall(gnd, answers, k)
+	t.Logf("hierarchical recall %v", recall)
+
+	if len(counting.batchSizes) != q*(maxStep-coarseSteps) {
+		t.Fatalf("expected %d full-graph rounds, got %d", q*(maxStep-coarseSteps), len(counting.batchSizes))
+	}
+	if recall < 0.9 {
+		t.Fatalf("hierarchical recall %v is too low", recall)
+	}
+	for i := 0; i < q; i++ {
+		for j := 0; j < k; j++ {
+			if steps[i][j] < coarseSteps || steps[i][j] >= maxStep {
+				t.Fatalf("invalid reach step %d", steps[i][j])
+			}
+		}
+	}
+
+	_, _, stats := frontend.SearchKNNWithStats(queries[0], k, maxStep, parallel, false)
+	if stats.IssuedRounds != maxStep {
+		t.Fatalf("expected %d rounds in total, got %+v", maxStep, stats)
+	}
+}
+
+func TestInterleavedSearch(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+
+	counting := &countingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo)}
+	frontend.Graph = counting
+
+	rng := rand.New(rand.NewSource(3))
+	q := 10
+	queries := genTestVectors(rng, q, dim)
+	gnd := make([][]int, q)
+	for i := 0; i < q; i++ {
+		gnd[i] = bruteForceKNN(vectors, queries[i], k)
+	}
+
+	answers, _ := frontend.SearchKNNBatch(queries, k, maxStep, parallel, false)
+	recall := ComputeRecall(gnd, answers, k)
+
+	counting.batchSizes = nil
+	interleaved, steps, stats := frontend.SearchKNNInterleaved(queries, k, maxStep, parallel, false)
+	interleavedRecall := ComputeRecall(gnd, interleaved, k)
+	t.Logf("recall: sequential %v, interleaved %v", recall, interleavedRecall)
+
+	if len(counting.batchSizes) != maxStep {
+		t.Fatalf("expected %d rounds for %d queries, got %d", maxStep, q, len(counting.batchSizes))
+	}
+	for _, size := range counting.batchSizes {
+		if size != q*m*parallel {
+			t.Fatalf("expected fixed batch size %d, got %d", q*m*parallel, size)
+		}
+	}
+	if interleavedRecall < recall-0.05 {
+		t.Fatalf("interleaved recall %v is lower than sequential %v", interleavedRecall, recall)
+	}
+	for i := 0; i < q; i++ {
+		if stats[i].IssuedRounds != maxStep {
+			t.Fatalf("query %d: expected %d rounds, got %+v", i, maxStep, stats[i])
+		}
+		for j := 0; j < k; j++ {
+			if steps[i][j] < 0 || steps[i][j] >= maxStep {
+				t.Fatalf("invalid reach step %d", steps[i][j])
+			}
+		}
+	}
+
+	// converged queries keep sending dummy batches
+	frontend.EarlyStop = true
+	counting.batchSizes = nil
+	_, _, stats = frontend.SearchKNNInterleaved(queries, k, maxStep, parallel, false)
+	for _, size := range counting.batchSizes {
+		if size != q*m*parallel {
+			t.Fatalf("expected fixed batch size %d with early stop, got %d", q*m*parallel, size)
+		}
+	}
+	if len(counting.batchSizes) != maxStep || stats[0].ConvergedRound < 0 {
+		t.Fatalf("expected %d rounds and a converged query, got %d rounds and %+v", maxStep, len(counting.batchSizes), stats[0])
+	}
+}
+
+func TestSearchResultsAndRange(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+	frontend.ReturnVectors = true
+
+	rng := rand.New(rand.NewSource(3))
+	query := genTestVectors(rng, 1, dim)[0]
+
+	results, _ := frontend.SearchKNNResults(query, k, maxStep, parallel, false)
+	ids, steps := frontend.SearchKNN(query, k, maxStep, parallel, false)
+	if len(results) != k {
+		t.Fatalf("expected %d results, got %d", k, len(results))
+	}
+	for i, r := range results {
+		if r.Id != ids[i] || r.Step != steps[i] {
+			t.Fatalf("result %d is %+v, but SearchKNN returned id %d step %d", i, r, ids[i], steps[i])
+		}
+		if r.Dist != L2Dist(vectors[r.Id], query) || len(r.Vector) != dim || r.Vector[0] != vectors[r.Id][0] {
+			t.Fatalf("result %d has a wrong distance or vector", i)
+		}
+		if i > 0 && r.Dist < results[i-1].Dist {
+			t.Fatalf("results are not sorted by distance")
+		}
+	}
+
+	beamResults, _ := frontend.SearchKNNBeamResults(query, k, 64, maxStep, parallel, false)
+	if len(beamResults) != k || beamResults[0].Vector == nil {
+		t.Fatalf("expected %d beam results with vectors, got %d", k, len(beamResults))
+	}
+
+	// the radius of the 5th neighbor: the range search should return (about) the 5 closest vertices
+	gnd := bruteForceKNN(vectors, query, k)
+	radius := L2Dist(vectors[gnd[4]], query)
+	inRange, _ := frontend.SearchRange(query, radius, 100, maxStep, parallel, false)
+	if len(inRange) == 0 || len(inRange) > 5 {
+		t.Fatalf("expected at most 5 results within the radius, got %d", len(inRange))
+	}
+	for _, r := range inRange {
+		if r.Dist > radius {
+			t.Fatalf("result %d at distance %v is out of the radius %v", r.Id, r.Dist, radius)
+		}
+	}
+	capped, _ := frontend.SearchRange(query, radius, 2, maxStep, parallel, false)
+	if len(capped) > 2 {
+		t.Fatalf("expected at most 2 results, got %d", len(capped))
+	}
+
+	frontend.EarlyStop = true
+	frontend.SkipDummyRounds = true
+	_, stats := frontend.SearchRange(query, radius, 100, 100, parallel, false)
+	if stats.ConvergedRound < 0 {
+		t.Fatalf("expected the range search to converge, got %+v", stats)
+	}
+}
+
+var errTestLookup = errors.New("test lookup failed")
+
+// fails every lookup from the failAt-th one, and calls onLookup before each lookup
+type failingGraphInfo struct {
+	BasicGraphInfo
+	failAt   int
+	lookups  int
+	onLookup func()
+}
+
+func (g *failingGraphInfo) GetVertexInfo(ids []int) ([]Vertex, error) {
+	g.lookups++
+	if g.onLookup != nil {
+		g.onLookup()
+	}
+	if g.lookups > g.failAt {
+		return nil, errTestLookup
+	}
+	return g.BasicGraphInfo.GetVertexInfo(ids)
+}
+
+func TestSearchContextErrors(t *testing.T) {
+	n, dim, m, k := 1000, 16, 8, 10
+	maxStep, parallel := 10, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+	query := genTestVectors(rand.New(rand.NewSource(3)), 1, dim)[0]
+	basic := frontend.Graph.(*BasicGraphInfo)
+
+	// a failing lookup is returned as a *RoundError wrapping the error of the graph, with the results found so far
+	failing := &failingGraphInfo{BasicGraphInfo: *basic, failAt: 3}
+	frontend.Graph = failing
+	results, stats, err := frontend.SearchKNNContext(context.Background(), query, k, maxStep, parallel, false)
+	var roundErr *RoundError
+	if !errors.Is(err, errTestLookup) || !errors.As(err, &roundErr) || roundErr.Round != 3 {
+		t.Fatalf("expected a round 3 lookup error, got %v", err)
+	}
+	if len(results) == 0 || stats.IssuedRounds != 3 {
+		t.Fatalf("expected the results of 3 rounds, got %d results after %d rounds", len(results), stats.IssuedRounds)
+	}
+
+	failing.lookups = 0
+	if _, _, err := frontend.SearchKNNBeamContext(context.Background(), query, k, 32, maxStep, parallel, false); !errors.Is(err, errTestLookup) {
+		t.Fatalf("expected the beam search to fail, got %v", err)
+	}
+	failing.lookups = 0
+	if _, _, err := frontend.SearchKNNInterleavedContext(context.Background(), [][]float32{query, vectors[0]}, k, maxStep, parallel, false); !errors.Is(err, errTestLookup) {
+		t.Fatalf("expected the interleaved search to fail, got %v", err)
+	}
+
+	// the legacy methods still panic
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected SearchKNN to panic")
+			}
+		}()
+		failing.lookups = 0
+		frontend.SearchKNN(query, k, maxStep, parallel, false)
+	}()
+
+	// a canceled context stops the search before the next round
+	ctx, cancel := context.WithCancel(context.Background())
+	working := &failingGraphInfo{BasicGraphInfo: *basic, failAt: maxStep}
+	working.onLookup = func() {
+		if working.lookups == 2 {
+			cancel()
+		}
+	}
+	frontend.Graph = working
+	results, stats, err = frontend.SearchKNNContext(ctx, query, k, maxStep, parallel, false)
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &roundErr) || roundErr.Round != 2 {
+		t.Fatalf("expected the search to be canceled before round 2, got %v", err)
+	}
+	if len(results) == 0 || stats.IssuedRounds != 2 || working.lookups != 2 {
+		t.Fatalf("expected the results of 2 rounds, got %d results after %d rounds", len(results), stats.IssuedRounds)
+	}
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	working.lookups = 0
+	if _, _, err := frontend.SearchRangeContext(expired, query, 1, k, maxStep, parallel, false); !errors.Is(err, context.DeadlineExceeded) || working.lookups != 0 {
+		t.Fatalf("expected the expired search to stop before any lookup, got %v after %d lookups", err, working.lookups)
+	}
+	if err := frontend.PreprocessContext(expired); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected PreprocessContext to fail, got %v", err)
+	}
+}
+
+func TestRoundTopK(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 20, 2
+	frontend, vectors := genTestFrontend(1, n, dim, m)
+	frontend.TrackRounds = true
+	query := genTestVectors(rand.New(rand.NewSource(3)), 1, dim)[0]
+
+	// the top-k only improves, and the last snapshot is the result
+	checkRounds := func(name string, ids []int, stats SearchStats) {
+		if len(stats.RoundTopK) != stats.IssuedRounds {
+			t.Fatalf("%s: expected %d snapshots, got %d", name, stats.IssuedRounds, len(stats.RoundTopK))
+		}
+		last := stats.RoundTopK[len(stats.RoundTopK)-1]
+		for i, id := range last {
+			if id != ids[i] {
+				t.Fatalf("%s: the last snapshot %v differs from the results %v", name, last, ids)
+			}
+		}
+		for r := 1; r < len(stats.RoundTopK); r++ {
+			prev, cur := stats.RoundTopK[r-1], stats.RoundTopK[r]
+			if len(cur) < len(prev) || (len(prev) == k && L2Dist(vectors[cur[k-1]], query) > L2Dist(vectors[prev[k-1]], query)) {
+				t.Fatalf("%s: the top-k got worse in round %d", name, r)
+			}
+		}
+	}
+
+	ids, _, stats := frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+	checkRounds("SearchKNN", ids, stats)
+	ids, _, stats = frontend.SearchKNNBeam(query, k, 32, maxStep, parallel, false)
+	checkRounds("SearchKNNBeam", ids, stats)
+
+	graph := frontend.Graph.(*BasicGraphInfo).Graph
+	coarseIds, coarseGraph := BuildCoarseGraph(vectors, 200, 8, 1)
+	frontend.Coarse = NewBasicCoarseLevel(vectors, graph, nil, coarseIds, coarseGraph)
+	frontend.CoarseSteps = 4
+	frontend.Preprocess()
+	ids, _, stats = frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+	if len(stats.RoundTopK) != stats.IssuedRounds {
+		t.Fatalf("hierarchical: expected %d snapshots, got %d", stats.IssuedRounds, len(stats.RoundTopK))
+	}
+	for _, id := range stats.RoundTopK[0] {
+		if !contains(coarseIds, id) {
+			t.Fatalf("hierarchical: the coarse snapshot has the non-sampled id %d", id)
+		}
+	}
+	if stats.RoundTopK[maxStep-1][0] != ids[0] {
+		t.Fatalf("hierarchical: the last snapshot differs from the results")
+	}
+
+	gnd := [][]int{{1, 2}, {3, 4}}
+	if mrr := ComputeMRR(gnd, [][]int{{1, 5}, {5, 3}}); mrr != 0.75 {
+		t.Fatalf("expected an MRR of 0.75, got %v", mrr)
+	}
+}
+
+// returns an all zero row for the ids in zero, like a failed PIR lookup
+type zeroingGraphInfo struct {
+	BasicGraphInfo
+	zero map[int]bool
+}
+
+func (g *zeroingGraphInfo) GetVertexInfo(ids []int) ([]Vertex, error) {
+	vertices, err := g.BasicGraphInfo.GetVertexInfo(ids)
+	for i := range vertices {
+		if g.zero[vertices[i].Id] {
+			vertices[i] = Vertex{Id: vertices[i].Id, Neighbors: make([]int, g.M), Vector: make([]float32, g.Dim)}
+		}
+	}
+	return vertices, err
+}
+
+func TestSearchTrace(t *testing.T) {
+	n, dim, m, k := 2000, 16, 16, 10
+	maxStep, parallel := 12, 2
+	frontend, _ := genTestFrontend(1, n, dim, m)
+	zero := map[int]bool{}
+	for id := 0; id < n; id += 7 {
+		zero[id] = true
+	}
+	frontend.Graph = &zeroingGraphInfo{BasicGraphInfo: *frontend.Graph.(*BasicGraphInfo), zero: zero}
+	frontend.Trace = true
+	frontend.EarlyStop = true
+	query := genTestVectors(rand.New(rand.NewSource(3)), 1, dim)[0]
+
+	check := func(name string, stats SearchStats) {
+		if len(stats.Trace) != stats.IssuedRounds {
+			t.Fatalf("%s: expected %d traced rounds, got %d", name, stats.IssuedRounds, len(stats.Trace))
+		}
+		failed := 0
+		for i, r := range stats.Trace {
+			if r.Round != i {
+				t.Fatalf("%s: round %d is numbered %d", name, i, r.Round)
+			}
+			if r.Dummy != (stats.ConvergedRound >= 0 && i >= stats.ConvergedRound) {
+				t.Fatalf("%s: round %d has dummy = %v, but the search converged after %d rounds", name, i, r.Dummy, stats.ConvergedRound)
+			}
+			if r.Dummy {
+				if len(r.Fetched) != 0 || len(r.Expanded) != 0 {
+					t.Fatalf("%s: the dummy round %d fetched real ids", name, i)
+				}
+				continue
+			}
+			if len(r.Expanded) == 0 || len(r.Fetched) > m*parallel {
+				t.Fatalf("%s: round %d expanded %d vertices and fetched %d ids", name, i, len(r.Expanded), len(r.Fetched))
+			}
+			for _, id := range r.Failed {
+				if !zero[id] {
+					t.Fatalf("%s: vertex %d is reported as failed", name, id)
+				}
+			}
+			failed += len(r.Failed)
+			if i > 0 && r.BestDist > stats.Trace[i-1].BestDist {
+				t.Fatalf("%s: the best distance got worse in round %d", name, i)
+			}
+		}
+		if failed == 0 {
+			t.Fatalf("%s: expected some failed lookups", name)
+		}
+	}
+
+	_, _, stats := frontend.SearchKNNWithStats(query, k, maxStep, parallel, false)
+	check("SearchKNN", stats)
+	_, _, beamStats := frontend.SearchKNNBeam(query, k, 32, maxStep, parallel, false)
+	check("SearchKNNBeam", beamStats)
+
+	// the JSON lines round trip
+	var buf bytes.Buffer
+	traces := []QueryTrace{{Query: 0, Recall: -1, Rounds: stats.Trace}, {Query: 1, Recall: 0.5, Rounds: beamStats.Trace}}
+	if err := WriteQueryTraces(&buf, traces); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Fatalf("expected 2 lines, got %d", lines)
+	}
+	read, err := ReadQueryTraces(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[1].Recall != 0.5 || len(read[0].Rounds) != len(stats.Trace) || read[0].Rounds[0].Fetched[0] != stats.Trace[0].Fetched[0] {
+		t.Fatalf("the traces differ after the round trip")
+	}
+}
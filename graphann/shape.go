@@ -0,0 +1,157 @@
+package graphann
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shape inference
+// the vector and ground truth files carry their shape (.fvecs/.ivecs/.bvecs in every row, .npy, the arrays
+// of an .npz and .fbin/.u8bin/.i8bin/.ibin in a header), so the callers do not have to know n and dim in advance.
+
+// the shape of a matrix file
+type MatrixInfo struct {
+	Rows   int
+	Dim    int
+	Format string // the file extension, e.g. ".fvecs"
+}
+
+// read the shape of the file from its header. The .txt files are scanned once
+func ProbeMatrixFile(filename string) (MatrixInfo, error) {
+	info := MatrixInfo{Format: filepath.Ext(filename)}
+	if isNpzPath(filename) {
+		// the array of the archive, see npy.go
+		info.Format = ".npz"
+		h, err := readNpyFileHeader(filename)
+		if err != nil {
+			return info, fmt.Errorf("%s: %w", filename, err)
+		}
+		info.Rows, info.Dim = h.matrixShape()
+		return info, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+	size := stat.Size()
+
+	switch info.Format {
+	case ".fvecs", ".ivecs", ".bvecs":
+		// every row starts with its dimension
+		var dim uint32
+		if err := binary.Read(file, binary.LittleEndian, &dim); err != nil {
+			return info, fmt.Errorf("%s: reading the dimension: %w", filename, err)
+		}
+		elemSize := int64(4)
+		if info.Format == ".bvecs" {
+			elemSize = 1
+		}
+		rowSize := 4 + elemSize*int64(dim)
+		if dim == 0 || size%rowSize != 0 {
+			return info, fmt.Errorf("%s: the size %d is not a multiple of the row size %d", filename, size, rowSize)
+		}
+		info.Rows, info.Dim = int(size/rowSize), int(dim)
+	case ".npy":
+		h, err := readNpyHeader(file)
+		if err != nil {
+			return info, fmt.Errorf("%s: %w", filename, err)
+		}
+		info.Rows, info.Dim = h.matrixShape()
+	case ".graph":
+		meta, err := readGraphMeta(bufio.NewReader(file))
+		if err != nil {
+			return info, fmt.Errorf("%s: %w", filename, err)
+		}
+		info.Rows, info.Dim = meta.N, meta.M
+	case ".fbin", ".u8bin", ".i8bin", ".ibin":
+		info.Rows, info.Dim, err = readBinHeader(file)
+		if err != nil {
+			return info, fmt.Errorf("%s: %w", filename, err)
+		}
+	case ".txt":
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1<<20), 1<<26)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				break
+			}
+			if info.Rows == 0 {
+				info.Dim = len(strings.Fields(line))
+			}
+			info.Rows++
+		}
+		if err := scanner.Err(); err != nil {
+			return info, fmt.Errorf("%s: %w", filename, err)
+		}
+	default:
+		return info, fmt.Errorf("unknown file extension: %s", info.Format)
+	}
+	return info, nil
+}
+
+// check the requested number of rows and dimension against the file.
+// n <= 0 means all rows and dim <= 0 the dimension of the file
+func (info MatrixInfo) Resolve(n int, dim int) (int, int, error) {
+	if n <= 0 {
+		n = info.Rows
+	}
+	if dim <= 0 {
+		dim = info.Dim
+	}
+	if n > info.Rows {
+		return 0, 0, fmt.Errorf("%d rows requested, the file only has %d", n, info.Rows)
+	}
+	if dim != info.Dim {
+		return 0, 0, fmt.Errorf("dimension %d requested, the file has dimension %d", dim, info.Dim)
+	}
+	return n, dim, nil
+}
+
+// load the first n rows (n <= 0: all) of a vector file whose dimension has to be dim (dim <= 0: any),
+// and return them with the shape of the file
+func LoadFloat32MatrixWithInfo(filename string, n int, dim int) ([][]float32, MatrixInfo, error) {
+	info, err := ProbeMatrixFile(filename)
+	if err != nil {
+		return nil, info, err
+	}
+	n, dim, err = info.Resolve(n, dim)
+	if err != nil {
+		return nil, info, fmt.Errorf("%s: %w", filename, err)
+	}
+	matrix, err := LoadFloat32Matrix(filename, n, dim)
+	return matrix, info, err
+}
+
+// load the first n rows (n <= 0: all) of an integer matrix, e.g. a graph or a ground truth file, with at least
+// m columns (m <= 0: all). As with LoadIntMatrixFromFile, the .ivecs and .ibin files return all their columns
+func LoadIntMatrixWithInfo(filename string, n int, m int) ([][]int, MatrixInfo, error) {
+	info, err := ProbeMatrixFile(filename)
+	if err != nil {
+		return nil, info, err
+	}
+	if n <= 0 {
+		n = info.Rows
+	}
+	if m <= 0 || info.Format == ".ivecs" || info.Format == ".ibin" {
+		if m > info.Dim {
+			return nil, info, fmt.Errorf("%s: %d columns requested, the file has %d", filename, m, info.Dim)
+		}
+		m = info.Dim
+	}
+	if n > info.Rows {
+		return nil, info, fmt.Errorf("%s: %d rows requested, the file only has %d", filename, n, info.Rows)
+	}
+	matrix, err := LoadIntMatrixFromFile(filename, n, m)
+	return matrix, info, err
+}
@@ -0,0 +1,300 @@
+package graphann
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the keyword (sparse) component of the hybrid search
+// the terms are hashed into BucketNum buckets. Each bucket stores a fixed-size block of
+// the BlockSize highest-weighted postings among all the terms hashed into it.
+// A query fetches one block per query term, so the blocks can be served by a PIR database.
+
+type Posting struct {
+	Id    int
+	Term  uint32  // the fingerprint of the term, to tell apart the terms sharing a bucket
+	Score float32 // tf-idf weight. 0 means an empty slot
+}
+
+type InvertedIndex struct {
+	BucketNum int
+	BlockSize int
+	Blocks    [][]Posting // BucketNum blocks, each of at most BlockSize postings
+}
+
+// return the bucket and the fingerprint of a term
+func TermHash(term string, bucketNum int) (int, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(term))
+	x := h.Sum64()
+	return int(x % uint64(bucketNum)), uint32(x >> 32)
+}
+
+// a min heap of postings, used to keep the top BlockSize postings of a bucket
+type postingHeap []Posting
+
+func (h postingHeap) Len() int            { return len(h) }
+func (h postingHeap) Less(i, j int) bool  { return h[i].Score < h[j].Score }
+func (h postingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *postingHeap) Push(x interface{}) { *h = append(*h, x.(Posting)) }
+func (h *postingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+// build the index from an iterator over the documents. forEachDoc is called twice:
+// once to count the document frequencies, and once to compute the weights.
+func buildInvertedIndex(forEachDoc func(func(id int, terms []string)) error, bucketNum int, blockSize int) (*InvertedIndex, error) {
+	df := make(map[string]int)
+	docNum := 0
+	err := forEachDoc(func(id int, terms []string) {
+		docNum++
+		seen := make(map[string]bool)
+		for _, t := range terms {
+			if !seen[t] {
+				seen[t] = true
+				df[t]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	heaps := make([]postingHeap, bucketNum)
+	err = forEachDoc(func(id int, terms []string) {
+		tf := make(map[string]int)
+		for _, t := range terms {
+			tf[t]++
+		}
+		for t, cnt := range tf {
+			score := float32((1 + math.Log(float64(cnt))) * math.Log(1+float64(docNum)/float64(df[t])))
+			bucket, fp := TermHash(t, bucketNum)
+			p := Posting{Id: id, Term: fp, Score: score}
+			if len(heaps[bucket]) < blockSize {
+				heap.Push(&heaps[bucket], p)
+			} else if heaps[bucket][0].Score < score {
+				heaps[bucket][0] = p
+				heap.Fix(&heaps[bucket], 0)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]Posting, bucketNum)
+	for i := range heaps {
+		blocks[i] = []Posting(heaps[i])
+		sort.Slice(blocks[i], func(a, b int) bool { return blocks[i][a].Score > blocks[i][b].Score })
+	}
+
+	return &InvertedIndex{
+		BucketNum: bucketNum,
+		BlockSize: blockSize,
+		Blocks:    blocks,
+	}, nil
+}
+
+func BuildInvertedIndex(docTerms [][]string, bucketNum int, blockSize int) *InvertedIndex {
+	index, _ := buildInvertedIndex(func(f func(int, []string)) error {
+		for i, terms := range docTerms {
+			f(i, terms)
+		}
+		return nil
+	}, bucketNum, blockSize)
+	return index
+}
+
+// the file has one line per document (the first n lines are used), with whitespace separated terms.
+// The file is streamed twice instead of being kept in memory.
+func BuildInvertedIndexFromTxt(filename string, n int, bucketNum int, blockSize int) (*InvertedIndex, error) {
+	return buildInvertedIndex(func(f func(int, []string)) error {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		for i := 0; i < n && scanner.Scan(); i++ {
+			f(i, strings.Fields(strings.ToLower(scanner.Text())))
+		}
+		return scanner.Err()
+	}, bucketNum, blockSize)
+}
+
+// one line per query, with whitespace separated terms
+func LoadTermsFromTxt(filename string, n int) ([][]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := make([][]string, 0, n)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for i := 0; i < n && scanner.Scan(); i++ {
+		ret = append(ret, strings.Fields(strings.ToLower(scanner.Text())))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ret) < n {
+		return nil, fmt.Errorf("expected %d lines in %s, got %d", n, filename, len(ret))
+	}
+	return ret, nil
+}
+
+// define an interface that provides the posting blocks, like GetGraphInfo for the graph
+
+type GetPostingInfo interface {
+	Preprocess() error
+	GetMetadata() (int, int)                     // bucket number, block size
+	GetPostingBlocks([]int) ([][]Posting, error) // given a list of buckets, return the corresponding blocks
+}
+
+type BasicPostingInfo struct {
+	Index *InvertedIndex
+}
+
+func (p *BasicPostingInfo) Preprocess() error { return nil }
+
+func (p *BasicPostingInfo) GetMetadata() (int, int) {
+	return p.Index.BucketNum, p.Index.BlockSize
+}
+
+func (p *BasicPostingInfo) GetPostingBlocks(buckets []int) ([][]Posting, error) {
+	ret := make([][]Posting, len(buckets))
+	for i, b := range buckets {
+		ret[i] = p.Index.Blocks[b]
+	}
+	return ret, nil
+}
+
+type SparseFrontend struct {
+	Postings      GetPostingInfo
+	TermsPerQuery int // the number of blocks fetched per query. Longer queries are truncated
+}
+
+// return the top k documents by the sum of the matched term weights.
+// Exactly TermsPerQuery blocks are fetched, padded with random buckets.
+func (f *SparseFrontend) SearchSparse(terms []string, k int) []int {
+	ret, err := f.SearchSparseContext(context.Background(), terms, k)
+	if err != nil {
+		fmt.Printf("Error when querying posting blocks: %v\n", err)
+		panic(err)
+	}
+	return ret
+}
+
+// same as SearchSparse, but return the error of the postings as a *RoundError instead of panicking
+func (f *SparseFrontend) SearchSparseContext(ctx context.Context, terms []string, k int) ([]int, error) {
+	if err := checkRound(ctx, 0); err != nil {
+		return nil, err
+	}
+	bucketNum, _ := f.Postings.GetMetadata()
+
+	buckets := make([]int, 0, f.TermsPerQuery)
+	fingerprints := make([]uint32, 0, f.TermsPerQuery)
+	seen := make(map[string]bool)
+	for _, t := range terms {
+		if len(buckets) == f.TermsPerQuery {
+			break
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		b, fp := TermHash(t, bucketNum)
+		buckets = append(buckets, b)
+		fingerprints = append(fingerprints, fp)
+	}
+	realNum := len(buckets)
+	for len(buckets) < f.TermsPerQuery {
+		buckets = append(buckets, rand.Intn(bucketNum))
+	}
+
+	blocks, err := f.Postings.GetPostingBlocks(buckets)
+	if err != nil {
+		return nil, &RoundError{Round: 0, Err: err}
+	}
+
+	scores := make(map[int]float32)
+	for i := 0; i < realNum; i++ {
+		for _, p := range blocks[i] {
+			if p.Score > 0 && p.Term == fingerprints[i] {
+				scores[p.Id] += p.Score
+			}
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for id := range scores {
+		docs = append(docs, id)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+
+	ret := make([]int, k)
+	for i := 0; i < k; i++ {
+		if i < len(docs) {
+			ret[i] = docs[i]
+		} else {
+			ret[i] = -1
+		}
+	}
+	return ret, nil
+}
+
+// merge ranked lists by reciprocal-rank fusion: score(d) = sum over lists of 1 / (c + rank(d)).
+// Ranks start at 1, and -1 entries are ignored. c = 60 is the usual choice.
+func ReciprocalRankFusion(lists [][]int, k int, c float64) []int {
+	scores := make(map[int]float64)
+	for _, list := range lists {
+		for rank, id := range list {
+			if id < 0 {
+				continue
+			}
+			scores[id] += 1.0 / (c + float64(rank+1))
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for id := range scores {
+		docs = append(docs, id)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if scores[docs[i]] != scores[docs[j]] {
+			return scores[docs[i]] > scores[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+
+	ret := make([]int, k)
+	for i := 0; i < k; i++ {
+		if i < len(docs) {
+			ret[i] = docs[i]
+		} else {
+			ret[i] = -1
+		}
+	}
+	return ret
+}
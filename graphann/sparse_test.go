@@ -0,0 +1,76 @@
+package graphann
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSparseSearch(t *testing.T) {
+	docs := [][]string{
+		{"private", "search", "graph"},
+		{"private", "information", "retrieval"},
+		{"graph", "neighbor", "search", "search"},
+		{"cooking", "recipes"},
+	}
+	index := BuildInvertedIndex(docs, 16, 4)
+
+	frontend := SparseFrontend{
+		Postings:      &BasicPostingInfo{Index: index},
+		TermsPerQuery: 4,
+	}
+
+	// "search" appears twice in doc 2
+	ret := frontend.SearchSparse([]string{"search"}, 3)
+	if ret[0] != 2 || ret[1] != 0 || ret[2] != -1 {
+		t.Fatalf("expected [2 0 -1], got %v", ret)
+	}
+
+	ret = frontend.SearchSparse([]string{"private", "retrieval"}, 1)
+	if ret[0] != 1 {
+		t.Fatalf("expected [1], got %v", ret)
+	}
+
+	// terms which are not in the index find nothing, even if they share a bucket with others
+	ret = frontend.SearchSparse([]string{"unknown"}, 2)
+	if ret[0] != -1 {
+		t.Fatalf("expected no result, got %v", ret)
+	}
+
+	// the index can also be streamed from a file
+	filename := "test_terms.txt"
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		for _, term := range d {
+			file.WriteString(term + " ")
+		}
+		file.WriteString("\n")
+	}
+	file.Close()
+	defer os.Remove(filename)
+
+	fromFile, err := BuildInvertedIndexFromTxt(filename, len(docs), 16, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := range index.Blocks {
+		if len(index.Blocks[b]) != len(fromFile.Blocks[b]) {
+			t.Fatalf("bucket %d differs: %v vs %v", b, index.Blocks[b], fromFile.Blocks[b])
+		}
+	}
+}
+
+func TestReciprocalRankFusion(t *testing.T) {
+	dense := []int{1, 2, 3, -1}
+	sparse := []int{3, 4, -1, -1}
+	fused := ReciprocalRankFusion([][]int{dense, sparse}, 5, 60)
+	// 3 is in both lists, then 1 and the tie between 2 and 4 is broken by the id
+	want := []int{3, 1, 2, 4, -1}
+	for i := range want {
+		if fused[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, fused)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package graphann
+
+import "container/heap"
+
+// speculative prefetch
+// the greedy search expands the best parallel candidates per round, and every hop costs one round trip.
+// With SpecDepth > 0, each round also expands the candidates that come next in the frontier,
+// i.e. the ones the search would expand in the next SpecDepth rounds if no better vertex shows up.
+// Only their first SpecWidth neighbors are fetched (the pruned lists are sorted by distance,
+// so those are the most promising ones), and the rest is fetched if the vertex is popped later.
+// The extra ids have a fixed count per round, so the batches keep the same shape.
+
+func (g GraphANNFrontend) specWidth(m int) int {
+	if g.SpecWidth <= 0 || g.SpecWidth > m {
+		return m
+	}
+	return g.SpecWidth
+}
+
+// the number of speculative ids per round, rounded up to whole batches of m
+func (g GraphANNFrontend) specBatchSize(m int, parallel int) int {
+	if g.SpecDepth <= 0 {
+		return 0
+	}
+	return (parallel*g.SpecDepth*g.specWidth(m) + m - 1) / m * m
+}
+
+// append the prefetched neighbors of the next candidates to batchQ.
+// The candidates stay in the frontier with their remaining neighbors.
+func (g GraphANNFrontend) speculate(frontier *exploreQueue, speculated map[int]bool, batchQ []int, m int, parallel int) []int {
+	width := g.specWidth(m)
+	want := parallel * g.SpecDepth
+
+	// the candidates prefetched in earlier rounds are skipped
+	skipped := make([]*VertexWithDist, 0)
+	for tries := 0; want > 0 && frontier.Len() > 0 && tries < 2*parallel*g.SpecDepth; tries++ {
+		item := heap.Pop(frontier).(*VertexWithDist)
+		if speculated[item.vertex.Id] {
+			skipped = append(skipped, item)
+			continue
+		}
+		speculated[item.vertex.Id] = true
+		w := min(width, len(item.vertex.Neighbors))
+		batchQ = append(batchQ, item.vertex.Neighbors[:w]...)
+		rest := &VertexWithDist{dist: item.dist, vertex: item.vertex}
+		rest.vertex.Neighbors = item.vertex.Neighbors[w:]
+		skipped = append(skipped, rest)
+		want--
+	}
+	for _, item := range skipped {
+		heap.Push(frontier, item)
+	}
+	return batchQ
+}
@@ -0,0 +1,216 @@
+package graphann
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// split fetching
+// the vectors and the adjacency rows are served by two databases. Every candidate needs its vector
+// to be ranked, but only the expanded vertices need their neighbors. So each round fetches
+// m * parallel vectors and only parallel adjacency rows, instead of m * parallel full entries.
+// Both lookups are issued in the same round and always have the same size:
+// the rows fetched in one round are expanded (their vectors fetched) in the next one.
+
+type GetSplitGraphInfo interface {
+	GetGraphInfo
+	GetVectors([]int) ([]Vertex, error)  // only Id, Vector and Attrs are set. Vector is nil if the lookup failed
+	GetNeighbors([]int) ([][]int, error) // the adjacency rows, nil if the lookup failed
+}
+
+// the traversal behind SearchKNN when SplitFetch is set.
+// A hop takes two rounds (row, then vectors), but the two lookups of consecutive hops are pipelined.
+func (g GraphANNFrontend) searchKNNSplit(ctx context.Context, split GetSplitGraphInfo, queryVector []float32, k int, maxStep int, parallel int, benchmarking bool) ([]SearchResult, SearchStats, error) {
+	n, _, m := g.GetMetadata()
+
+	stats := SearchStats{ConvergedRound: -1}
+	topK := &topKList{k: k}
+	converged := false
+	unchangedRounds := 0
+
+	reachStep := map[int]int{}
+	knownVertices := map[int]*VertexWithDist{}
+	// the vertices with known vectors whose rows have not been requested yet
+	frontier := make(exploreQueue, 0)
+	heap.Init(&frontier)
+	// the vertices whose rows were received in the last round, their neighbors' vectors are fetched in the next round
+	pendingRows := make(exploreQueue, 0, parallel)
+
+	if !benchmarking {
+		fastStartQueue := make(exploreQueue, 0)
+		for _, v := range g.StartVertices {
+			dist := L2Dist(v.Vector, queryVector)
+			fastStartQueue.Push(&VertexWithDist{dist: dist, vertex: v})
+		}
+		sort.Sort(fastStartQueue)
+		if g.Filter != nil {
+			sort.SliceStable(fastStartQueue, func(i, j int) bool {
+				return g.matches(fastStartQueue[i].vertex) && !g.matches(fastStartQueue[j].vertex)
+			})
+		}
+		// the start vertices come with their neighbors, so they are expanded right away
+		for i := 0; len(pendingRows) < parallel && i < len(fastStartQueue); i++ {
+			v := fastStartQueue[i]
+			if _, ok := knownVertices[v.vertex.Id]; ok {
+				continue
+			}
+			knownVertices[v.vertex.Id] = v
+			reachStep[v.vertex.Id] = 0
+			pendingRows = append(pendingRows, v)
+			if g.matches(v.vertex) {
+				topK.insert(v)
+			}
+		}
+	}
+
+	for step := 0; step < maxStep; step++ {
+
+		if converged && g.SkipDummyRounds {
+			break
+		}
+		if err := checkRound(ctx, step); err != nil {
+			return g.splitResults(knownVertices, reachStep, k), stats, err
+		}
+
+		vectorQ := make([]int, 0, m*parallel)
+		rowQ := make([]int, 0, parallel)
+		if !converged && !benchmarking {
+			requested := map[int]bool{}
+			for _, row := range pendingRows {
+				for _, v := range row.vertex.Neighbors {
+					if _, ok := knownVertices[v]; ok || requested[v] || len(vectorQ) == m*parallel {
+						continue
+					}
+					requested[v] = true
+					vectorQ = append(vectorQ, v)
+				}
+			}
+			for len(rowQ) < parallel && len(frontier) > 0 {
+				item := heap.Pop(&frontier).(*VertexWithDist)
+				rowQ = append(rowQ, item.vertex.Id)
+			}
+		}
+		realRows := len(rowQ)
+		// both batches always have the same size, so we fill them with random vertices
+		for len(vectorQ) < m*parallel {
+			vectorQ = append(vectorQ, rand.Intn(n))
+		}
+		for len(rowQ) < parallel {
+			rowQ = append(rowQ, rand.Intn(n))
+		}
+
+		vectors, err := split.GetVectors(vectorQ)
+		if err != nil {
+			return g.splitResults(knownVertices, reachStep, k), stats, &RoundError{Round: step, Err: fmt.Errorf("querying vectors: %w", err)}
+		}
+		rows, err := split.GetNeighbors(rowQ)
+		if err != nil {
+			return g.splitResults(knownVertices, reachStep, k), stats, &RoundError{Round: step, Err: fmt.Errorf("querying neighbors: %w", err)}
+		}
+		stats.IssuedRounds++
+		pendingRows = pendingRows[:0]
+
+		if converged || benchmarking {
+			if converged {
+				stats.DummyRounds++
+			}
+			g.recordRound(&stats, topK.ids(g))
+			continue
+		}
+
+		for i := 0; i < realRows; i++ {
+			if rows[i] == nil {
+				// the PIR failed, so we retry this vertex later
+				heap.Push(&frontier, knownVertices[rowQ[i]])
+				continue
+			}
+			item := knownVertices[rowQ[i]]
+			pendingRows = append(pendingRows, &VertexWithDist{dist: item.dist, vertex: Vertex{Id: item.vertex.Id, Neighbors: rows[i]}})
+		}
+
+		changed := false
+		for _, v := range vectors {
+			if _, ok := knownVertices[v.Id]; ok || v.Vector == nil {
+				continue
+			}
+			item := &VertexWithDist{dist: L2Dist(v.Vector, queryVector), vertex: v}
+			knownVertices[v.Id] = item
+			reachStep[v.Id] = step
+			heap.Push(&frontier, item)
+			if g.matches(v) && topK.insert(item) {
+				changed = true
+			}
+		}
+
+		if changed {
+			stats.StableRound = step + 1
+			unchangedRounds = 0
+		} else {
+			unchangedRounds++
+		}
+
+		// the pending rows are part of the frontier, since their neighbors are not fetched yet
+		pendingConverged := g.Patience > 0 && unchangedRounds >= g.Patience
+		if len(pendingRows) == 0 || len(topK.items) == topK.k {
+			pendingConverged = true
+			for _, row := range pendingRows {
+				if row.dist <= topK.items[topK.k-1].dist {
+					pendingConverged = false
+				}
+			}
+		}
+		if g.EarlyStop && pendingConverged && g.frontierConverged(frontier, topK, unchangedRounds) {
+			converged = true
+			stats.ConvergedRound = step + 1
+		}
+		g.recordRound(&stats, topK.ids(g))
+	}
+
+	return g.splitResults(knownVertices, reachStep, k), stats, nil
+}
+
+// the (at most) k closest matching vertices found so far
+func (g GraphANNFrontend) splitResults(knownVertices map[int]*VertexWithDist, reachStep map[int]int, k int) []SearchResult {
+	allKnownVertices := make([]*VertexWithDist, 0, len(knownVertices))
+	for _, v := range knownVertices {
+		if g.matches(v.vertex) {
+			allKnownVertices = append(allKnownVertices, v)
+		}
+	}
+	sort.Slice(allKnownVertices, func(i, j int) bool {
+		return allKnownVertices[i].dist < allKnownVertices[j].dist
+	})
+	results := make([]SearchResult, 0, k)
+	for i := 0; i < k && i < len(allKnownVertices) && g.inRange(allKnownVertices[i].dist); i++ {
+		v := allKnownVertices[i]
+		results = append(results, g.newResult(v.vertex, v.dist, reachStep[v.vertex.Id]))
+	}
+	return results
+}
+
+// an in-memory graph served as two databases
+type BasicSplitGraphInfo struct {
+	BasicGraphInfo
+}
+
+func (g *BasicSplitGraphInfo) GetVectors(ids []int) ([]Vertex, error) {
+	vertices := make([]Vertex, len(ids))
+	for i, id := range ids {
+		vertices[i] = Vertex{Id: id, Vector: g.Vectors[id]}
+		if g.Attrs != nil {
+			vertices[i].Attrs = g.Attrs[id]
+		}
+	}
+	return vertices, nil
+}
+
+func (g *BasicSplitGraphInfo) GetNeighbors(ids []int) ([][]int, error) {
+	rows := make([][]int, len(ids))
+	for i, id := range ids {
+		rows[i] = g.Graph[id]
+	}
+	return rows, nil
+}
@@ -0,0 +1,85 @@
+package graphann
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// traversal traces
+// with Trace set, the searches record every round in SearchStats.Trace, so a query with a poor recall
+// can be inspected afterwards: which vertices were expanded, which lookups failed, and whether
+// the best distance was still improving when the rounds ran out.
+
+type RoundTrace struct {
+	Round    int     `json:"round"`
+	Expanded []int   `json:"expanded"`  // the vertices whose neighbors were requested in this round
+	Fetched  []int   `json:"fetched"`   // the requested ids, without the random padding
+	Failed   []int   `json:"failed"`    // the requested ids whose lookup failed (an all zero row)
+	BestDist float32 `json:"best_dist"` // the distance of the closest result so far, -1 if none
+	KthDist  float32 `json:"kth_dist"`  // the distance of the k-th result so far, -1 if there are less than k
+	Dummy    bool    `json:"dummy"`     // sent after convergence, only random ids
+}
+
+// the trace of one query, one JSON line in a trace file
+type QueryTrace struct {
+	Query          int          `json:"query"`
+	Results        []int        `json:"results"`
+	Recall         float32      `json:"recall"` // -1 without ground truth
+	StableRound    int          `json:"stable_round"`
+	ConvergedRound int          `json:"converged_round"`
+	IssuedRounds   int          `json:"issued_rounds"`
+	Rounds         []RoundTrace `json:"rounds"`
+}
+
+// the trace of the current round, filled by nextBatch and completed by absorb
+func newRoundTrace(round int) RoundTrace {
+	return RoundTrace{Round: round, Expanded: []int{}, Fetched: []int{}, Failed: []int{}, BestDist: -1, KthDist: -1}
+}
+
+// the best and k-th distances of the top-k list
+func (t *RoundTrace) setDists(topK *topKList) {
+	if len(topK.items) > 0 {
+		t.BestDist = topK.items[0].dist
+	}
+	if len(topK.items) == topK.k {
+		t.KthDist = topK.items[topK.k-1].dist
+	}
+}
+
+// a vertex whose neighbor list is all zeroes was not fetched
+func lookupFailed(v Vertex) bool {
+	for _, neighbor := range v.Neighbors {
+		if neighbor != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func WriteQueryTraces(w io.Writer, traces []QueryTrace) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, t := range traces {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func ReadQueryTraces(r io.Reader) ([]QueryTrace, error) {
+	dec := json.NewDecoder(r)
+	traces := make([]QueryTrace, 0)
+	for {
+		var t QueryTrace
+		err := dec.Decode(&t)
+		if err == io.EOF {
+			return traces, nil
+		}
+		if err != nil {
+			return traces, err
+		}
+		traces = append(traces, t)
+	}
+}
@@ -0,0 +1,357 @@
+package graphann
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// vector readers
+// random access to the rows of a vector file in its own element type. The file is memory-mapped where the
+// platform supports it (and read with ReadAt otherwise), so a billion-scale base set can be scanned in row
+// ranges, or used as a [][]float32 without copying it when it is stored as float32.
+
+// the element type of a vector file
+type Dtype int
+
+const (
+	DtypeUint8 Dtype = iota
+	DtypeInt8
+	DtypeFloat16
+	DtypeFloat32
+)
+
+func (d Dtype) Size() int {
+	switch d {
+	case DtypeFloat16:
+		return 2
+	case DtypeFloat32:
+		return 4
+	default:
+		return 1
+	}
+}
+
+func (d Dtype) String() string {
+	switch d {
+	case DtypeUint8:
+		return "uint8"
+	case DtypeInt8:
+		return "int8"
+	case DtypeFloat16:
+		return "float16"
+	default:
+		return "float32"
+	}
+}
+
+var ErrUnsupportedFormat = errors.New("unsupported vector file format")
+
+type VectorReader interface {
+	Rows() int
+	Dim() int
+	Dtype() Dtype
+	// the little-endian bytes of row i in the element type of the file. The slice may point into the mapping,
+	// so it must not be modified, and it is only valid until Close
+	RawRow(i int) ([]byte, error)
+	// rows [start, end) converted to float32, using dst as the storage if it has room for them
+	ReadRows(start int, end int, dst []float32) ([][]float32, error)
+	Close() error
+}
+
+// the layout of a file with fixed-size rows
+type vectorLayout struct {
+	rows      int
+	dim       int
+	dtype     Dtype
+	offset    int64 // the start of the first row
+	rowStride int64 // the bytes from one row to the next
+	rowSkip   int64 // the bytes before the values of every row, e.g. the dimension in .fvecs
+}
+
+type fileVectorReader struct {
+	layout vectorLayout
+	file   *os.File
+	data   []byte // the mapped file, nil if it is read with ReadAt
+}
+
+// open a .fvecs, .bvecs, .fbin, .u8bin, .i8bin or .npy (C order, float32/float16/uint8/int8) vector file
+func OpenVectorReader(filename string) (VectorReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := readVectorLayout(file, filepath.Ext(filename))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if end := layout.offset + int64(layout.rows)*layout.rowStride; end > stat.Size() {
+		file.Close()
+		return nil, fmt.Errorf("%s: the file is truncated, %d rows need %d bytes but it has %d", filename, layout.rows, end, stat.Size())
+	}
+
+	r := &fileVectorReader{layout: layout, file: file}
+	if data, err := mmapFile(file, stat.Size()); err == nil {
+		r.data = data
+	}
+	return r, nil
+}
+
+func readVectorLayout(file *os.File, ext string) (vectorLayout, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return vectorLayout{}, err
+	}
+	size := stat.Size()
+
+	switch ext {
+	case ".fvecs", ".bvecs":
+		var dim uint32
+		if err := binary.Read(file, binary.LittleEndian, &dim); err != nil {
+			return vectorLayout{}, fmt.Errorf("reading the dimension: %w", err)
+		}
+		l := vectorLayout{dim: int(dim), dtype: DtypeFloat32, rowSkip: 4}
+		if ext == ".bvecs" {
+			l.dtype = DtypeUint8
+		}
+		l.rowStride = 4 + int64(l.dim*l.dtype.Size())
+		if dim == 0 || size%l.rowStride != 0 {
+			return vectorLayout{}, fmt.Errorf("the size %d is not a multiple of the row size %d", size, l.rowStride)
+		}
+		l.rows = int(size / l.rowStride)
+		return l, nil
+	case ".fbin", ".u8bin", ".i8bin":
+		rows, dim, err := readBinHeader(file)
+		if err != nil {
+			return vectorLayout{}, err
+		}
+		l := vectorLayout{rows: rows, dim: dim, dtype: DtypeFloat32, offset: 8}
+		if ext == ".u8bin" {
+			l.dtype = DtypeUint8
+		} else if ext == ".i8bin" {
+			l.dtype = DtypeInt8
+		}
+		l.rowStride = int64(dim * l.dtype.Size())
+		return l, nil
+	case ".npy":
+		h, err := readNpyHeader(file)
+		if err != nil {
+			return vectorLayout{}, err
+		}
+		if h.fortranOrder {
+			return vectorLayout{}, fmt.Errorf("%w: Fortran-ordered .npy", ErrUnsupportedFormat)
+		}
+		l := vectorLayout{rows: h.shape[0], dim: 1, offset: h.dataOffset}
+		if len(h.shape) == 2 {
+			l.dim = h.shape[1]
+		}
+		switch h.descr {
+		case "<f4":
+			l.dtype = DtypeFloat32
+		case "<f2":
+			l.dtype = DtypeFloat16
+		case "|u1", "<u1":
+			l.dtype = DtypeUint8
+		case "|i1", "<i1":
+			l.dtype = DtypeInt8
+		default:
+			return vectorLayout{}, fmt.Errorf("%w: .npy dtype %s", ErrUnsupportedFormat, h.descr)
+		}
+		l.rowStride = int64(l.dim * l.dtype.Size())
+		return l, nil
+	default:
+		return vectorLayout{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, ext)
+	}
+}
+
+func (r *fileVectorReader) Rows() int    { return r.layout.rows }
+func (r *fileVectorReader) Dim() int     { return r.layout.dim }
+func (r *fileVectorReader) Dtype() Dtype { return r.layout.dtype }
+
+func (r *fileVectorReader) RawRow(i int) ([]byte, error) {
+	if i < 0 || i >= r.layout.rows {
+		return nil, fmt.Errorf("row %d out of range [0, %d)", i, r.layout.rows)
+	}
+	start := r.layout.offset + int64(i)*r.layout.rowStride + r.layout.rowSkip
+	size := int64(r.layout.dim * r.layout.dtype.Size())
+	if r.data != nil {
+		return r.data[start : start+size], nil
+	}
+	buf := make([]byte, size)
+	if _, err := r.file.ReadAt(buf, start); err != nil {
+		return nil, fmt.Errorf("reading row %d: %w", i, err)
+	}
+	return buf, nil
+}
+
+func (r *fileVectorReader) ReadRows(start int, end int, dst []float32) ([][]float32, error) {
+	if start < 0 || end > r.layout.rows || start > end {
+		return nil, fmt.Errorf("rows [%d, %d) out of range [0, %d)", start, end, r.layout.rows)
+	}
+	dim := r.layout.dim
+	if len(dst) < (end-start)*dim {
+		dst = make([]float32, (end-start)*dim)
+	}
+	rows := make([][]float32, end-start)
+	for i := start; i < end; i++ {
+		raw, err := r.RawRow(i)
+		if err != nil {
+			return nil, err
+		}
+		rows[i-start] = dst[(i-start)*dim : (i-start+1)*dim]
+		decodeRow(raw, r.layout.dtype, rows[i-start])
+	}
+	return rows, nil
+}
+
+// views of the float32 rows into the mapping, without copying them.
+// Only available for mapped float32 files on a little-endian machine
+func (r *fileVectorReader) float32View(n int) ([][]float32, bool) {
+	if r.data == nil || r.layout.dtype != DtypeFloat32 || !littleEndian() || r.layout.dim == 0 {
+		return nil, false
+	}
+	rows := make([][]float32, n)
+	for i := range rows {
+		start := r.layout.offset + int64(i)*r.layout.rowStride + r.layout.rowSkip
+		if start%4 != 0 {
+			return nil, false
+		}
+		rows[i] = unsafe.Slice((*float32)(unsafe.Pointer(&r.data[start])), r.layout.dim)
+	}
+	return rows, true
+}
+
+func (r *fileVectorReader) Close() error {
+	if r.data != nil {
+		if err := munmapFile(r.data); err != nil {
+			return err
+		}
+		r.data = nil
+	}
+	return r.file.Close()
+}
+
+func littleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
+
+func decodeRow(raw []byte, dtype Dtype, row []float32) {
+	switch dtype {
+	case DtypeUint8:
+		for j := range row {
+			row[j] = float32(raw[j])
+		}
+	case DtypeInt8:
+		for j := range row {
+			row[j] = float32(int8(raw[j]))
+		}
+	case DtypeFloat16:
+		for j := range row {
+			row[j] = float16ToFloat32(binary.LittleEndian.Uint16(raw[2*j:]))
+		}
+	default:
+		for j := range row {
+			row[j] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*j:]))
+		}
+	}
+}
+
+// IEEE 754 half precision to single precision
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch {
+	case exp == 0 && frac == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// subnormal, normalize it
+		for frac&0x400 == 0 {
+			frac <<= 1
+			exp--
+		}
+		exp++
+		frac &= 0x3ff
+	case exp == 0x1f:
+		// infinity or NaN
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
+
+// the first n rows of the reader in blocks of blockSize, converted to float32.
+// The blocks reuse one buffer, so a block is only valid until the next call of Next
+type vectorBlockReader struct {
+	r         VectorReader
+	n         int
+	blockSize int
+	pos       int
+	buf       []float32
+}
+
+func NewVectorBlockReader(r VectorReader, n int, blockSize int) BlockReader {
+	if n <= 0 || n > r.Rows() {
+		n = r.Rows()
+	}
+	return &vectorBlockReader{r: r, n: n, blockSize: max(blockSize, 1)}
+}
+
+func (b *vectorBlockReader) Next() ([][]float32, error) {
+	if b.pos >= b.n {
+		return nil, io.EOF
+	}
+	end := min(b.pos+b.blockSize, b.n)
+	block, err := b.r.ReadRows(b.pos, end, b.buf)
+	if err != nil {
+		return nil, err
+	}
+	if b.buf == nil {
+		b.buf = block[0][:cap(block[0])]
+	}
+	b.pos = end
+	return block, nil
+}
+
+func (b *vectorBlockReader) Close() error {
+	return b.r.Close()
+}
+
+// the first n rows (n <= 0: all) of a vector file as float32, checking the dimension unless dim <= 0.
+// A mapped float32 file is returned as views into the mapping, without copying it; the other element types
+// are converted in one pass into a single buffer, which takes as much memory as loading the file. The returned
+// reader has to stay open while the rows are used
+func MapFloat32Matrix(filename string, n int, dim int) ([][]float32, VectorReader, error) {
+	r, err := OpenVectorReader(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := MatrixInfo{Rows: r.Rows(), Dim: r.Dim(), Format: filepath.Ext(filename)}
+	n, dim, err = info.Resolve(n, dim)
+	if err != nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if fr, ok := r.(*fileVectorReader); ok {
+		if rows, ok := fr.float32View(n); ok {
+			return rows, r, nil
+		}
+	}
+	rows, err := r.ReadRows(0, n, nil)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return rows, r, nil
+}
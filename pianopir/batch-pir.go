@@ -1,6 +1,7 @@
 package pianopir
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -14,6 +15,9 @@ const (
 	QueryPerPartition     = 2
 	DefaultValue          = 0xdeadbeef
 	ThreadNum             = 1
+
+	// a lookup that only pads a batch: it takes no query of its partition and is answered with zeros
+	DummyIndex = ^uint64(0)
 )
 
 type SimpleBatchPianoPIRConfig struct {
@@ -53,15 +57,31 @@ type SimpleBatchPianoPIR struct {
 }
 
 func NewSimpleBatchPianoPIR(DBSize uint64, DBEntryByteNum uint64, BatchSize uint64, rawDB []uint64, FailureProbLog2 uint64) *SimpleBatchPianoPIR {
+	p, err := NewSimpleBatchPianoPIRChecked(DBSize, DBEntryByteNum, BatchSize, rawDB, FailureProbLog2)
+	if err != nil {
+		log.Fatalf("BatchPIR: %v", err)
+	}
+	return p
+}
+
+// same as NewSimpleBatchPianoPIR, but return an error instead of exiting on bad sizes
+func NewSimpleBatchPianoPIRChecked(DBSize uint64, DBEntryByteNum uint64, BatchSize uint64, rawDB []uint64, FailureProbLog2 uint64) (*SimpleBatchPianoPIR, error) {
 	DBEntrySize := DBEntryByteNum / 8
 	if len(rawDB) != int(DBSize*DBEntrySize) {
-		log.Fatalf("BatchPIR: len(rawDB) = %v; want %v", len(rawDB), DBSize*DBEntrySize)
+		return nil, fmt.Errorf("%w: len(rawDB) = %v; want %v", ErrInvalidDBSize, len(rawDB), DBSize*DBEntrySize)
 	}
 
 	// create the sub PIR classes
 	PartitionNum := BatchSize / RealQueryPerPartition
+	if PartitionNum == 0 {
+		return nil, fmt.Errorf("%w: BatchSize = %v, want at least %v", ErrInvalidBatchSize, BatchSize, RealQueryPerPartition)
+	}
 	//PartitionSize := DBSize / PartitionNum and round up
 	PartitionSize := (DBSize + PartitionNum - 1) / PartitionNum
+	// every partition needs at least one entry
+	if (PartitionNum-1)*PartitionSize >= DBSize {
+		return nil, fmt.Errorf("%w: %v partitions of size %v for a DB of size %v", ErrInvalidBatchSize, PartitionNum, PartitionSize, DBSize)
+	}
 
 	config := &SimpleBatchPianoPIRConfig{
 		DBEntryByteNum:  DBEntryByteNum,
@@ -81,7 +101,11 @@ func NewSimpleBatchPianoPIR(DBSize uint64, DBEntryByteNum uint64, BatchSize uint
 		end := min((i+1)*PartitionSize, DBSize)
 		// print start and end
 		//fmt.Printf("start: %v, end: %v\n", start, end)
-		subPIR[i] = NewPianoPIR(end-start, DBEntryByteNum, rawDB[start*DBEntrySize:end*DBEntrySize], FailureProbLog2)
+		sub, err := NewPianoPIRChecked(end-start, DBEntryByteNum, rawDB[start*DBEntrySize:end*DBEntrySize], FailureProbLog2)
+		if err != nil {
+			return nil, fmt.Errorf("partition %v: %w", i, err)
+		}
+		subPIR[i] = sub
 	}
 
 	return &SimpleBatchPianoPIR{
@@ -89,7 +113,7 @@ func NewSimpleBatchPianoPIR(DBSize uint64, DBEntryByteNum uint64, BatchSize uint
 		subPIR:                 subPIR,
 		FinishedBatchNum:       0,
 		QueriesMadeInPartition: 0,
-	}
+	}, nil
 }
 
 func (p *SimpleBatchPianoPIR) PrintInfo() {
@@ -174,9 +198,29 @@ func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
 	// this is different from the default
 	queryNumToMake := len(idx) / int(p.config.PartitionNum)
 
+	for i := 0; i < len(idx); i++ {
+		if idx[i] >= p.config.DBSize && idx[i] != DummyIndex {
+			return nil, fmt.Errorf("%w: idx[%v] = %v, DB size %v", ErrIndexOutOfRange, i, idx[i], p.config.DBSize)
+		}
+	}
+
+	// redo the preprocessing before the batch if it would use up the hints of a partition, so every
+	// partition can make all its queries
+	maxQueryNum := p.subPIR[0].client.MaxQueryNum
+	if uint64(queryNumToMake) > maxQueryNum {
+		return nil, fmt.Errorf("%w: %v queries per partition in a batch, at most %v", ErrTooManyQueries, queryNumToMake, maxQueryNum)
+	}
+	if p.QueriesMadeInPartition+uint64(queryNumToMake) > maxQueryNum {
+		fmt.Printf("Redo preprocessing. Made %v batches (%v queries in a partition), redo the preprocessing\n", p.FinishedBatchNum, p.QueriesMadeInPartition)
+		p.Preprocessing()
+	}
+
 	// first arrange the queries into the partitions
 	partitionQueries := make([][]uint64, p.config.PartitionNum)
 	for i := 0; i < len(idx); i++ {
+		if idx[i] == DummyIndex {
+			continue
+		}
 		partitionIdx := idx[i] / p.config.PartitionSize
 		partitionQueries[partitionIdx] = append(partitionQueries[partitionIdx], idx[i])
 	}
@@ -185,6 +229,8 @@ func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
 
 	// we make a map from index to their responses
 	responses := make(map[uint64][]uint64)
+	// the errors are returned once the whole batch is sent, so the server always sees batches of the same shape
+	var batchErr error
 
 	for i := uint64(0); i < p.config.PartitionNum; i++ {
 		//start := i * p.config.PartitionSize
@@ -198,19 +244,22 @@ func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
 		}
 
 		// now we make queryNumToMake queries to the sub PIR
+		// a lookup that fails before reaching the server (no hint, or too many queries in its chunk) is
+		// replaced by a dummy query and gets a zero response, like the dropped queries
 		for j := uint64(0); j < uint64(queryNumToMake); j++ {
-			if partitionQueries[i][j] == DefaultValue {
-				_, _ = p.subPIR[i].Query(0, false) // just make a dummy query
-			} else {
-				query, _ := p.subPIR[i].Query(partitionQueries[i][j]-i*p.config.PartitionSize, true)
-				//if err != nil {
-
-				//log.Printf("the queries to this sub pir is: %v, the offset is %v\n", partitionQueries[i], partitionQueries[i][j]-i*p.config.PartitionSize)
-				//log.Printf("All the queries are %v\n", partitionQueries)
-				//log.Printf("SimpleBatchPianoPIR.Query: subPIR[%v].Query(%v) failed: %v\n", i, partitionQueries[i][j], err)
-				//	return nil, err
-				//	}
-				responses[partitionQueries[i][j]] = query
+			if partitionQueries[i][j] != DefaultValue {
+				query, err := p.subPIR[i].Query(partitionQueries[i][j]-i*p.config.PartitionSize, true)
+				if err == nil {
+					responses[partitionQueries[i][j]] = query
+					continue
+				}
+				if !errors.Is(err, ErrNoHint) && !errors.Is(err, ErrTooManyQueries) {
+					batchErr = errors.Join(batchErr, fmt.Errorf("partition %v: query %v: %w", i, partitionQueries[i][j], err))
+					continue
+				}
+			}
+			if _, err := p.subPIR[i].Query(0, false); err != nil { // just make a dummy query
+				batchErr = errors.Join(batchErr, fmt.Errorf("partition %v: dummy query: %w", i, err))
 			}
 		}
 	}
@@ -234,17 +283,10 @@ func (p *SimpleBatchPianoPIR) Query(idx []uint64) ([][]uint64, error) {
 		}
 	}
 
-	// now test if the subPIR has reached the max query num, redo the preprocessing
-	// -2 means we want to do the preprocessing before the last query
-	if p.QueriesMadeInPartition >= p.subPIR[0].client.MaxQueryNum-2 {
-		fmt.Printf("Redo preprocessing. Made %v batches (%v queries in a partition), redo the preprocessing\n", p.FinishedBatchNum, p.QueriesMadeInPartition)
-		p.Preprocessing()
-	} else {
-		p.FinishedBatchNum += uint64(len(idx) / int(p.config.BatchSize))
-		p.QueriesMadeInPartition += uint64(queryNumToMake)
-	}
+	p.FinishedBatchNum += uint64(len(idx) / int(p.config.BatchSize))
+	p.QueriesMadeInPartition += uint64(queryNumToMake)
 
-	return ret, nil
+	return ret, batchErr
 }
 
 func (p *SimpleBatchPianoPIR) LocalStorageSize() float64 {
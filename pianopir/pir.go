@@ -1,6 +1,7 @@
 package pianopir
 
 import (
+	"errors"
 	"fmt"
 	//"encoding/binary"
 
@@ -15,6 +16,15 @@ const (
 	DefaultProgramPoint = 0x7fffffff
 )
 
+// the errors returned by the PIR, wrapped with the details. Check them with errors.Is
+var (
+	ErrInvalidDBSize    = errors.New("pianopir: invalid DB size")
+	ErrIndexOutOfRange  = errors.New("pianopir: index out of range")
+	ErrTooManyQueries   = errors.New("pianopir: too many queries") // the hints are used up, or the chunk got too many queries
+	ErrNoHint           = errors.New("pianopir: no hint for the index")
+	ErrInvalidBatchSize = errors.New("pianopir: invalid batch size")
+)
+
 type PianoPIRConfig struct {
 	DBEntryByteNum  uint64 // the number of bytes in a DB entry
 	DBEntrySize     uint64 // the number of uint64 in a DB entry
@@ -52,7 +62,7 @@ func (s *PianoPIRServer) NonePrivateQuery(idx uint64) ([]uint64, error) {
 			return ret, nil
 		} else {
 			// return an empty entry and an error
-			return ret, fmt.Errorf("idx %v is out of range", idx)
+			return ret, fmt.Errorf("%w: idx %v", ErrIndexOutOfRange, idx)
 		}
 	}
 
@@ -371,10 +381,8 @@ func (c *PianoPIRClient) Query(idx uint64, server *PianoPIRServer, realQuery boo
 	}
 
 	if idx >= c.config.DBSize {
-		log.Fatalf("idx %v is out of range", idx)
-
 		// return an empty entry and an error
-		return ret, fmt.Errorf("idx %v is out of range", idx)
+		return ret, fmt.Errorf("%w: idx %v, DB size %v", ErrIndexOutOfRange, idx, c.config.DBSize)
 	}
 
 	// if the idx is in the local cache, then return the result from the local cache
@@ -387,7 +395,7 @@ func (c *PianoPIRClient) Query(idx uint64, server *PianoPIRServer, realQuery boo
 		log.Printf("fnished query = %v", c.FinishedQueryNum)
 		log.Printf("max query num = %v", c.MaxQueryNum)
 		log.Printf("exceed the maximum number of queries")
-		return ret, fmt.Errorf("exceed the maximum number of queries")
+		return ret, fmt.Errorf("%w: exceed the maximum number of queries %v", ErrTooManyQueries, c.MaxQueryNum)
 	}
 
 	chunkId := idx / c.config.ChunkSize
@@ -396,7 +404,7 @@ func (c *PianoPIRClient) Query(idx uint64, server *PianoPIRServer, realQuery boo
 	if c.QueryHistogram[chunkId] >= c.maxQueryPerChunk {
 		log.Printf("Too many queries in chunk %v", chunkId)
 		log.Printf("Max query per chunk = %v", c.maxQueryPerChunk)
-		return ret, fmt.Errorf("too many queries in chunk %v", chunkId)
+		return ret, fmt.Errorf("%w: in chunk %v", ErrTooManyQueries, chunkId)
 	}
 
 	// now we find the hit hint in the primary hint table
@@ -415,7 +423,7 @@ func (c *PianoPIRClient) Query(idx uint64, server *PianoPIRServer, realQuery boo
 
 	if hitId == DefaultProgramPoint {
 		//log.Printf("No hit hint in the primary hint table, current idx = %v", idx)
-		return ret, fmt.Errorf("no hit hint in the primary hint table")
+		return ret, fmt.Errorf("%w: no hit hint in the primary hint table", ErrNoHint)
 	}
 
 	// now we expand this hit hint to a full set
@@ -477,11 +485,23 @@ type PianoPIR struct {
 }
 
 func NewPianoPIR(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailureProbLog2 uint64) *PianoPIR {
+	p, err := NewPianoPIRChecked(DBSize, DBEntryByteNum, rawDB, FailureProbLog2)
+	if err != nil {
+		log.Fatalf("Piano PIR: %v", err)
+	}
+	return p
+}
+
+// same as NewPianoPIR, but return an error instead of exiting on bad sizes
+func NewPianoPIRChecked(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailureProbLog2 uint64) (*PianoPIR, error) {
 	DBEntrySize := DBEntryByteNum / 8
 
 	// assert that the rawDB is of the correct size
+	if DBSize == 0 || DBEntrySize == 0 || DBEntryByteNum%8 != 0 {
+		return nil, fmt.Errorf("%w: DBSize = %v, DBEntryByteNum = %v", ErrInvalidDBSize, DBSize, DBEntryByteNum)
+	}
 	if uint64(len(rawDB)) != DBSize*DBEntrySize {
-		log.Fatalf("Piano PIR len(rawDB) = %v; want %v", len(rawDB), DBSize*DBEntrySize)
+		return nil, fmt.Errorf("%w: len(rawDB) = %v; want %v", ErrInvalidDBSize, len(rawDB), DBSize*DBEntrySize)
 	}
 
 	targetChunkSize := uint64(2 * math.Sqrt(float64(DBSize)))
@@ -510,7 +530,7 @@ func NewPianoPIR(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailurePr
 		config: config,
 		client: client,
 		server: server,
-	}
+	}, nil
 }
 
 func (p *PianoPIR) Preprocessing() {
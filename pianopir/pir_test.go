@@ -1,6 +1,7 @@
 package pianopir
 
 import (
+	"errors"
 	"math/rand"
 	"testing"
 	"time"
@@ -57,6 +58,59 @@ func TestPIRBasic(t *testing.T) {
 	}
 }
 
+func TestPIRErrors(t *testing.T) {
+	DBSize := uint64(1024)
+	DBEntrySize := uint64(4)
+	rawDB := make([]uint64, DBEntrySize*DBSize)
+
+	if _, err := NewPianoPIRChecked(DBSize, DBEntrySize*8, rawDB[:10], 40); !errors.Is(err, ErrInvalidDBSize) {
+		t.Errorf("NewPianoPIRChecked with a short DB: got %v; want ErrInvalidDBSize", err)
+	}
+	if _, err := NewSimpleBatchPianoPIRChecked(DBSize, DBEntrySize*8, 1, rawDB, 8); !errors.Is(err, ErrInvalidBatchSize) {
+		t.Errorf("NewSimpleBatchPianoPIRChecked with BatchSize 1: got %v; want ErrInvalidBatchSize", err)
+	}
+
+	PIR, err := NewPianoPIRChecked(DBSize, DBEntrySize*8, rawDB, 40)
+	if err != nil {
+		t.Fatalf("NewPianoPIRChecked failed: %v", err)
+	}
+	PIR.Preprocessing()
+	if _, err := PIR.Query(DBSize, true); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Errorf("PIR.Query(%v): got %v; want ErrIndexOutOfRange", DBSize, err)
+	}
+
+	batchPIR, err := NewSimpleBatchPianoPIRChecked(DBSize, DBEntrySize*8, 4, rawDB, 8)
+	if err != nil {
+		t.Fatalf("NewSimpleBatchPianoPIRChecked failed: %v", err)
+	}
+	batchPIR.Preprocessing()
+	if _, err := batchPIR.Query([]uint64{0, 1, 2, DBSize + 5}); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Errorf("batchPIR.Query: got %v; want ErrIndexOutOfRange", err)
+	}
+	if ret, err := batchPIR.Query([]uint64{0, DummyIndex, DummyIndex, DBSize - 1}); err != nil || ret[1][0] != 0 || ret[2][0] != 0 {
+		t.Errorf("batchPIR.Query with dummy lookups: got %v, %v; want zero responses", ret, err)
+	}
+
+	// batches of 4 queries per partition, past the hints of a preprocessing: the preprocessing is redone
+	// before a batch would use them up, and the failed lookups are zero responses, not errors
+	maxQueryNum := batchPIR.subPIR[0].client.MaxQueryNum
+	config := batchPIR.Config()
+	for b := uint64(0); b < maxQueryNum; b++ {
+		batch := make([]uint64, 0, 4*config.PartitionNum)
+		for i := uint64(0); i < config.PartitionNum; i++ {
+			for j := uint64(0); j < 4; j++ {
+				batch = append(batch, i*config.PartitionSize+(b*4+j)%config.PartitionSize)
+			}
+		}
+		if _, err := batchPIR.Query(batch); err != nil {
+			t.Fatalf("batch %v: %v", b, err)
+		}
+		if batchPIR.QueriesMadeInPartition > maxQueryNum {
+			t.Fatalf("batch %v: %v queries in a partition, the hints support %v", b, batchPIR.QueriesMadeInPartition, maxQueryNum)
+		}
+	}
+}
+
 func TestBatchPIRBasic(t *testing.T) {
 	// Arrange
 	// Set up any necessary data or arguments
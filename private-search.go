@@ -3,7 +3,10 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +14,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,6 +30,7 @@ var syntheticTest bool
 var nonPrivateMode bool
 var vectors [][]float32
 var graph [][]int
+var attrs [][]uint32
 var queries [][]float32
 var n int
 var dim int
@@ -51,6 +58,122 @@ func genRandomMatrix(n int, dim int) [][]float32 {
 	return ret
 }
 
+// load the graph of max degree m from graphFileName. Without a file name, the default name of the dataset is used,
+// and the graph is built and saved there if the file does not exist yet
+// a .graph file (see graphann/graphfile.go) also records the vectors the graph was built for, its start vertices
+// and its build options, which are returned with the graph. The other formats return no start vertices, and the
+// requested build options
+func loadOrBuildGraph(graphFileName string, m int, labels [][]uint32, labelAttr int, opts graphann.GraphBuildOptions, workingDir string, dataset string) ([][]int, []int, graphann.GraphBuildOptions) {
+	if syntheticTest {
+		log.Print("Generated synthetic graph...")
+		return genRandomGraph(n, m), nil, graphann.GraphBuildOptions{}
+	}
+
+	if graphFileName == "" {
+		// we will use the default name
+		suffix := ""
+		if labels != nil {
+			suffix += fmt.Sprintf("_label%d", labelAttr)
+		}
+		if opts.MinInDegree > 0 {
+			suffix += fmt.Sprintf("_in%d", opts.MinInDegree)
+		}
+		if len(opts.TuneLongRange) > 0 {
+			// the name is chosen before the tuning, so it has the tuned fractions, e.g. _lrtune0-0.125-0.25
+			fractions := append([]float64(nil), opts.TuneLongRange...)
+			sort.Float64s(fractions)
+			values := make([]string, len(fractions))
+			for i, f := range fractions {
+				values[i] = fmt.Sprintf("%g", f)
+			}
+			suffix += "_lrtune" + strings.Join(values, "-")
+		} else if opts.LongRangeFraction > 0 {
+			suffix += fmt.Sprintf("_lr%g", opts.LongRangeFraction)
+		}
+		graphFileName = filepath.Join(workingDir, dataset+suffix+"_graph.npy")
+	}
+	container := filepath.Ext(graphFileName) == ".graph"
+
+	if _, err := os.Stat(graphFileName); os.IsNotExist(err) {
+		// in this case we need to generate the graph
+		log.Printf("Graph file %s does not exist. Generating the graph...\n", graphFileName)
+		start := time.Now()
+		graph, applied := graphann.BuildGraphWithOptions(n, dim, m, vectors, labels, workingDir, dataset, opts)
+		end := time.Now()
+		var startIds []int
+		if container {
+			meta := graphann.NewGraphMeta(vectors, graph, "ngt")
+			meta.VectorFile = dataset
+			meta.MinInDegree = applied.MinInDegree
+			meta.LongRangeFraction = applied.LongRangeFraction
+			startIds = meta.StartVertices
+			err = graphann.SaveGraphWithMeta(graphFileName, graph, meta)
+		} else {
+			err = graphann.SaveGraphToFile(graphFileName, graph)
+		}
+		if err != nil {
+			log.Printf("Error saving the graph file: %v", err)
+		}
+		log.Printf("Graph generation time: %v\n", end.Sub(start))
+
+		// we write the graph generation time to an auxiliary file
+
+		auxFileName := filepath.Join(workingDir, dataset+"_graph_aux.txt")
+		auxFile, _ := os.Create(auxFileName)
+		fmt.Fprintf(auxFile, "Dataset: %s\n", dataset)
+		fmt.Fprintf(auxFile, "Graph generation time: %v\n", end.Sub(start))
+		return graph, startIds, applied
+	}
+
+	log.Printf("Loading graph from file %s\n", graphFileName)
+	if container {
+		graph, meta, err := graphann.LoadGraphWithMeta(graphFileName)
+		if err != nil {
+			log.Fatalf("Error reading the graph file: %v", err)
+		}
+		if err := meta.Validate(vectors); err != nil {
+			log.Fatalf("%s does not match the input: %v", graphFileName, err)
+		}
+		if meta.M != m {
+			log.Fatalf("%s has degree %d, -m is %d", graphFileName, meta.M, m)
+		}
+		log.Printf("Graph built by %q (alpha %.2f, seed %d), %d start vertices\n", meta.Builder, meta.Alpha, meta.Seed, len(meta.StartVertices))
+		return graph, meta.StartVertices, graphann.GraphBuildOptions{MinInDegree: meta.MinInDegree, LongRangeFraction: meta.LongRangeFraction}
+	}
+	graph, err := graphann.LoadIntMatrixFromFile(graphFileName, n, m)
+	if err != nil {
+		log.Fatalf("Error reading the graph file: %v", err)
+	}
+	if len(opts.TuneLongRange) > 0 {
+		// the file does not record which fraction the tuning chose
+		opts.LongRangeFraction = -1
+	}
+	return graph, nil, opts
+}
+
+// the relabeling of the file, or a new one saved to the file. The batch PIR of the graph splits the ids into
+// m / RealQueryPerPartition partitions (a batch of m queries)
+func relabelForPIR(relabelFileName string, m int) *graphann.Relabeling {
+	partitionNum := m / pianopir.RealQueryPerPartition
+	var relabeling graphann.Relabeling
+	if _, err := os.Stat(relabelFileName); os.IsNotExist(err) {
+		log.Printf("Relabeling the vertices for %d PIR partitions...\n", partitionNum)
+		start := time.Now()
+		relabeling = graphann.RelabelForPartitions(graph, partitionNum, pianopir.RealQueryPerPartition, 0)
+		log.Printf("Relabeling time: %v\n", time.Since(start))
+		if err := graphann.SaveRelabeling(relabelFileName, relabeling); err != nil {
+			log.Printf("Error saving the permutation file: %v", err)
+		}
+	} else {
+		log.Printf("Loading the permutation from file %s\n", relabelFileName)
+		relabeling, err = graphann.LoadRelabeling(relabelFileName, n)
+		if err != nil {
+			log.Fatalf("Error reading the permutation file: %v", err)
+		}
+	}
+	return &relabeling
+}
+
 func genRandomGraph(n int, m int) [][]int {
 	ret := make([][]int, n)
 	for i := 0; i < n; i++ {
@@ -68,127 +191,674 @@ func genRandomGraph(n int, m int) [][]int {
 	return ret
 }
 
-func main() {
-	numVectors := flag.Int("n", 100000, "number of vectors")
-	dimVectors := flag.Int("d", 128, "dimension of the vectors")
-	neighborNum := flag.Int("m", 32, "number of neighbors")
-	outputNum := flag.Int("k", 100, "top K output")
-	queryNum := flag.Int("q", 100, "number of queries")
-	inputFile := flag.String("input", "", "input file name")
-	graphFile := flag.String("graph", "", "graph file name")
-	queryFile := flag.String("query", "", "file name")
-	outputFile := flag.String("output", "", "output file name")
-	gndFile := flag.String("gnd", "", "ground truth file name")
-	reportFile := flag.String("report", "", "report file name")
-	stepN := flag.Int("step", 15, "searching max depth")
-	parallelN := flag.Int("parallel", 2, "how many parallel vertices are accessed in the same round")
-	benchmarking := flag.Bool("benchmark", false, "benchmarking mode")
-	rtt := flag.Int("rtt", 0, "round trip time in milliseconds")
-	nonPrivate := flag.Bool("nonprivate", false, "non-private mode")
-	randomSeed := flag.Int64("seed", 1, "seed for reproducible graph-search randomness")
+// each attribute is a category in [0, 10)
+func genRandomAttrs(n int, a int) [][]uint32 {
+	ret := make([][]uint32, n)
+	for i := 0; i < n; i++ {
+		ret[i] = make([]uint32, a)
+		for j := 0; j < a; j++ {
+			ret[i][j] = uint32(rand.Intn(10))
+		}
+	}
+	return ret
+}
+
+// each document is a list of terms drawn from a vocabulary of 1000 terms
+func genRandomTerms(n int, termNum int) [][]string {
+	ret := make([][]string, n)
+	for i := 0; i < n; i++ {
+		ret[i] = make([]string, termNum)
+		for j := 0; j < termNum; j++ {
+			ret[i][j] = fmt.Sprintf("t%d", rand.Intn(1000))
+		}
+	}
+	return ret
+}
+
+// random printable payloads of up to maxLen bytes
+func genRandomPayloads(n int, maxLen int) [][]byte {
+	ret := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		ret[i] = make([]byte, rand.Intn(maxLen))
+		for j := range ret[i] {
+			ret[i][j] = byte('a' + rand.Intn(26))
+		}
+	}
+	return ret
+}
 
+// one line per result: query, rank, id, payload
+func writePayloads(filename string, answers [][]int, payloads [][][]byte) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i := range answers {
+		for j, id := range answers[i] {
+			if id < 0 {
+				continue
+			}
+			fmt.Fprintf(file, "%d\t%d\t%d\t%s\n", i, j, id, payloads[i][j])
+		}
+	}
+	return nil
+}
+
+// the command line options. The options that do not apply to the chosen mode are reset when they are checked
+type options struct {
+	numVectors        int
+	dimVectors        int
+	neighborNum       int
+	outputNum         int
+	queryNum          int
+	inputFile         string
+	mmapInput         bool
+	graphFile         string
+	minInDegree       int
+	longRange         string
+	relabelFile       string
+	queryFile         string
+	outputFile        string
+	gndFile           string
+	reportFile        string
+	jsonReportFile    string
+	stepN             int
+	parallelN         int
+	beamL             int
+	specDepth         int
+	specWidth         int
+	coarseNum         int
+	coarseM           int
+	coarseStepN       int
+	radius            float64
+	timeout           time.Duration
+	interleaveN       int
+	splitDB           bool
+	benchmarking      bool
+	rtt               int
+	nonPrivate        bool
+	randomSeed        int64
+	earlyStop         bool
+	patience          int
+	skipDummy         bool
+	roundStatsFile    string
+	traceFile         string
+	curveFile         string
+	attrNum           int
+	attrFile          string
+	filterExpr        string
+	labelAttr         int
+	termFile          string
+	queryTermFile     string
+	bucketNum         int
+	blockSize         int
+	termsPerQuery     int
+	rrfConstant       float64
+	payloadFile       string
+	chunkSize         int
+	chunksPerDoc      int
+	payloadOutputFile string
+	sweepPrefix       string
+	sweepM            string
+	sweepStep         string
+	sweepParallel     string
+	sweepBatch        string
+	sweepFail         string
+}
+
+func parseOptions() *options {
+	o := &options{}
+	flag.IntVar(&o.numVectors, "n", 0, "number of vectors (0 = all rows of -input, 100000 for synthetic data)")
+	flag.IntVar(&o.dimVectors, "d", 0, "dimension of the vectors (0 = the dimension of -input, 128 for synthetic data)")
+	flag.IntVar(&o.neighborNum, "m", 32, "number of neighbors")
+	flag.IntVar(&o.outputNum, "k", 100, "top K output")
+	flag.IntVar(&o.queryNum, "q", 100, "number of queries (0 = all rows of -query)")
+	flag.StringVar(&o.inputFile, "input", "", "input file name")
+	flag.BoolVar(&o.mmapInput, "mmap", false, "memory-map the input file instead of loading it (only float32 files are used in place, the others are still converted into memory)")
+	flag.StringVar(&o.graphFile, "graph", "", "graph file name")
+	flag.IntVar(&o.minInDegree, "minindegree", 0, "repair the in-degree of every vertex of a new graph up to this target (0 = no balancing)")
+	flag.StringVar(&o.longRange, "longrange", "", "fraction of every row of a new graph reserved for long-range edges, or a comma-separated list of fractions to tune on the average steps")
+	flag.StringVar(&o.relabelFile, "relabel", "", "permutation file of the PIR-aware relabeling (computed and saved if missing)")
+	flag.StringVar(&o.queryFile, "query", "", "file name")
+	flag.StringVar(&o.outputFile, "output", "", "output file name")
+	flag.StringVar(&o.gndFile, "gnd", "", "ground truth file name")
+	flag.StringVar(&o.reportFile, "report", "", "report file name")
+	flag.StringVar(&o.jsonReportFile, "jsonreport", "", "JSON report file name (default: the report file name with a .json extension)")
+	flag.IntVar(&o.stepN, "step", 15, "searching max depth")
+	flag.IntVar(&o.parallelN, "parallel", 2, "how many parallel vertices are accessed in the same round")
+	flag.IntVar(&o.beamL, "L", 0, "size of the candidate list in beam search (0 = unbounded search)")
+	flag.IntVar(&o.specDepth, "specdepth", 0, "also prefetch the candidates of the next specdepth rounds in each round (0 = off)")
+	flag.IntVar(&o.specWidth, "specwidth", 0, "neighbors prefetched per speculative candidate (0 = all m)")
+	flag.IntVar(&o.coarseNum, "coarse", 0, "number of sampled vertices in the coarse level of the hierarchical search (0 = off)")
+	flag.IntVar(&o.coarseM, "coarsem", 0, "max degree of the coarse graph (0 = m/2)")
+	flag.IntVar(&o.coarseStepN, "coarsestep", 4, "number of rounds (out of -step) spent on the coarse level")
+	flag.Float64Var(&o.radius, "radius", 0, "range search: only return the results within this squared L2 distance, at most k (0 = off)")
+	flag.DurationVar(&o.timeout, "timeout", 0, "deadline of each search, the results found before it are kept (0 = none)")
+	flag.IntVar(&o.interleaveN, "interleave", 1, "number of queries advanced in lockstep, sharing the PIR rounds")
+	flag.BoolVar(&o.splitDB, "split", false, "serve the vectors and the adjacency rows from two PIR DBs, and only fetch the rows of the expanded vertices")
+	flag.BoolVar(&o.benchmarking, "benchmark", false, "benchmarking mode")
+	flag.IntVar(&o.rtt, "rtt", 0, "round trip time in milliseconds")
+	flag.BoolVar(&o.nonPrivate, "nonprivate", false, "non-private mode")
+	flag.Int64Var(&o.randomSeed, "seed", 1, "seed for reproducible graph-search randomness")
+	flag.BoolVar(&o.earlyStop, "earlystop", false, "stop the traversal once the frontier has converged (dummy rounds are still issued)")
+	flag.IntVar(&o.patience, "patience", 0, "also treat the search as converged after this many rounds without top-k change (0 = off)")
+	flag.BoolVar(&o.skipDummy, "skipdummy", false, "skip the dummy rounds after convergence (only allowed with -nonprivate)")
+	flag.StringVar(&o.roundStatsFile, "roundstats", "", "file to write the per-query round statistics to")
+	flag.StringVar(&o.traceFile, "trace", "", "file to write the per-query traversal traces to (JSON lines, see graphann/cmd/tracesum)")
+	flag.StringVar(&o.curveFile, "curve", "", "file to write the recall@k, MRR and communication after every round to (needs -gnd)")
+	flag.IntVar(&o.attrNum, "a", 0, "number of attribute columns per vector (0 = no attributes)")
+	flag.StringVar(&o.attrFile, "attrs", "", "attribute file name (n rows, -a integer columns)")
+	flag.StringVar(&o.filterExpr, "filter", "", "only return vectors whose attributes match, e.g. \"0=3\" or \"0=3,1>100\"")
+	flag.IntVar(&o.labelAttr, "labelattr", -1, "use this attribute column as the label for filter-aware graph construction (-1 = off)")
+	flag.StringVar(&o.termFile, "terms", "", "document terms file for hybrid search (one line of terms per vector)")
+	flag.StringVar(&o.queryTermFile, "queryterms", "", "query terms file for hybrid search (one line of terms per query, \"synthetic\" with -input synthetic)")
+	flag.IntVar(&o.bucketNum, "buckets", 65536, "number of hashed term buckets in the sparse index")
+	flag.IntVar(&o.blockSize, "blocksize", 32, "number of postings kept per bucket in the sparse index")
+	flag.IntVar(&o.termsPerQuery, "qterms", 8, "number of term blocks fetched per query in hybrid search")
+	flag.Float64Var(&o.rrfConstant, "rrf", 60, "constant of the reciprocal-rank fusion in hybrid search")
+	flag.StringVar(&o.payloadFile, "payloads", "", "document payload file (one document per line) fetched privately after the search")
+	flag.IntVar(&o.chunkSize, "chunksize", 256, "bytes per payload chunk (multiple of 32)")
+	flag.IntVar(&o.chunksPerDoc, "chunksperdoc", 8, "chunks fetched per document. Longer documents are truncated")
+	flag.StringVar(&o.payloadOutputFile, "payloadoutput", "", "file to write the fetched payloads to")
+	flag.StringVar(&o.sweepPrefix, "sweep", "", "run a parameter sweep and write <prefix>.csv, <prefix>.json and the Pareto frontier to <prefix>_pareto.csv")
+	flag.StringVar(&o.sweepM, "sweepm", "", "comma-separated values of m in the sweep (default: -m)")
+	flag.StringVar(&o.sweepStep, "sweepstep", "", "comma-separated numbers of rounds in the sweep (default: -step)")
+	flag.StringVar(&o.sweepParallel, "sweepparallel", "", "comma-separated parallel explorations in the sweep (default: -parallel)")
+	flag.StringVar(&o.sweepBatch, "sweepbatch", "", "comma-separated PIR batch sizes in the sweep (default: m)")
+	flag.StringVar(&o.sweepFail, "sweepfail", "", "comma-separated PIR failure probabilities in the sweep, as -log2 (default: 8)")
 	flag.Parse()
-	rand.Seed(*randomSeed)
-
-	n = *numVectors
-	dim = *dimVectors
-	m = *neighborNum
-	k = *outputNum
-	q = *queryNum
-	nonPrivateMode = *nonPrivate
-	workingDir := filepath.Dir(*inputFile)
+	return o
+}
+
+func (o *options) hybridMode() bool {
+	return o.termFile != "" || (syntheticTest && o.queryTermFile == "synthetic")
+}
+
+func (o *options) payloadMode() bool {
+	return o.payloadFile != ""
+}
+
+func main() {
+	o := parseOptions()
+	rand.Seed(o.randomSeed)
+
+	n = o.numVectors
+	dim = o.dimVectors
+	m = o.neighborNum
+	k = o.outputNum
+	q = o.queryNum
+	nonPrivateMode = o.nonPrivate
+	workingDir := filepath.Dir(o.inputFile)
 	fmt.Println("Working directory: ", workingDir)
-	dataName := filepath.Base(*inputFile)
+	dataName := filepath.Base(o.inputFile)
 	dataName = strings.TrimSuffix(dataName, filepath.Ext(dataName))
 	fmt.Println("Data name: ", dataName)
-	dataset := dataName + fmt.Sprintf("_%d_%d_%d", n, dim, m)
-	fmt.Println("Dataset name: ", dataset)
 
 	// step 1: load vector
 
-	if *inputFile == "" {
+	if o.inputFile == "" {
 		log.Printf("No input file specified. If you want to use synthetic data, use -input synthetic instead.")
 		return
 	}
+	if reader := loadVectors(o); reader != nil {
+		// the vectors may point into the mapping, so it stays open until the end
+		defer reader.Close()
+	}
+
+	dataset := dataName + fmt.Sprintf("_%d_%d_%d", n, dim, m)
+	fmt.Println("Dataset name: ", dataset)
+
+	// step 1b: load the attributes for filtered search
+
+	filter, labels := loadAttributes(o)
+
+	if o.skipDummy && !nonPrivateMode {
+		log.Printf("-skipdummy would leak the number of rounds to the server. Ignored in private mode.")
+		o.skipDummy = false
+	}
+	buildOpts := parseBuildOptions(o)
+
+	// the parameter sweep runs its own configurations and stops here
+
+	if o.sweepPrefix != "" {
+		sweep(o, filter, labels, buildOpts, workingDir, dataName)
+		return
+	}
+
+	// step 2: load graph. If not exists, generate the graph
+
+	var startIds []int
+	var graphOpts graphann.GraphBuildOptions // the options the graph was built with
+	graph, startIds, graphOpts = loadOrBuildGraph(o.graphFile, m, labels, o.labelAttr, buildOpts, workingDir, dataset)
+
+	// step 2a: relabel the vertices, so the neighbors of a vertex spread over the partitions of the batch PIR.
+	// The ground truth is mapped to the new ids and the answers back to the original ids
+
+	relabeling := relabelVertices(o, startIds)
+
+	// step 2b: build the coarse level for the hierarchical search
+
+	coarseIds, coarseGraph, coarseSteps := buildCoarseLevel(o)
+
+	// step 3: load queries
+
+	loadQueries(o)
+
+	// step 3b: build the sparse index for hybrid search
+
+	sparseIndex, queryTerms := loadSparseIndex(o)
+
+	// step 3c: load the document payloads
+
+	payloadData := loadPayloads(o)
+
+	// step 4: build PIR instace
+
+	s := newSearchSetup(o, filter, startIds, coarseIds, coarseGraph, coarseSteps)
+	s.relabeling = relabeling
+	s.graphOpts = graphOpts
+	if s.hybrid {
+		s.setupSparse(o, sparseIndex, queryTerms)
+	}
+	if s.payloads {
+		s.setupPayloads(o, payloadData)
+	}
+
+	// we now make queries
 
-	if *inputFile == "synthetic" {
+	run := runQueries(&s.frontend, queries, s.queryOptions(o))
+	log.Println("Total Online time: ", run.searchTime)
+	log.Println("Average search time: ", run.avgTime(), " seconds per query")
+	log.Println("Average maintainence time: ", run.maintenanceTime.Seconds()/float64(q), " seconds per query")
+
+	// some stats
+	log.Println("Total query number: ", s.queryEngine.totalQueryNum)
+	log.Println("Successful query number: ", s.queryEngine.succQueryNum)
+	log.Println("Success rate: ", float32(s.queryEngine.succQueryNum)/float32(s.queryEngine.totalQueryNum))
+
+	roundStats := summarizeRoundStats(run.stats)
+	log.Printf("Top-k stabilized after %.2f rounds on average (p50 %d, p90 %d, p99 %d, max %d)\n",
+		roundStats.avgStable, roundStats.p50Stable, roundStats.p90Stable, roundStats.p99Stable, roundStats.maxStable)
+	if o.earlyStop {
+		log.Printf("Converged queries: %d / %d, average real rounds: %.2f, average issued rounds: %.2f\n",
+			roundStats.convergedNum, q, roundStats.avgReal, roundStats.avgIssued)
+	}
+
+	if o.roundStatsFile != "" {
+		log.Println("Writing the per-query round statistics to: ", o.roundStatsFile)
+		if err := writeRoundStats(o.roundStatsFile, run.stats); err != nil {
+			log.Printf("Error writing the round statistics: %v", err)
+		}
+	}
+
+	if o.outputFile == "" {
+		// we use the default output file name
+		o.outputFile = filepath.Join(workingDir, dataset+"_output.txt")
+	}
+	writeAnswers(o, s, run)
+
+	// finally we evaluate the recall
+	quality := evaluateAnswers(o, s, run)
+
+	if o.traceFile != "" {
+		log.Println("Writing the traversal traces to: ", o.traceFile)
+		if err := writeTraces(o.traceFile, run.stats, run.denseAnswers, quality.gnd, k, relabeling); err != nil {
+			log.Printf("Error writing the traces: %v", err)
+		}
+	}
+
+	// we finally write the report
+
+	if o.reportFile == "" {
+		// use a default report file name
+		o.reportFile = filepath.Join(workingDir, dataset+"_report.txt")
+		log.Printf("Using the default report file name: %s\n", o.reportFile)
+	}
+	writeReports(o, s, run, roundStats, quality)
+}
+
+// load or generate the vectors. The reader of a mapped input file is returned, it has to stay open while the
+// vectors are used
+func loadVectors(o *options) graphann.VectorReader {
+	if o.inputFile == "synthetic" {
 		syntheticTest = true
+		if n <= 0 {
+			n = 100000
+		}
+		if dim <= 0 {
+			dim = 128
+		}
 		vectors = genRandomMatrix(n, dim)
 		log.Printf("Generated synthetic data with n=%d, dim=%d\n", n, dim)
+		return nil
+	}
+
+	// it means we need to read the file. The shape comes from the file unless -n and -d are given
+	log.Print("Loading vectors from file: ", o.inputFile)
+	var info graphann.MatrixInfo
+	var reader graphann.VectorReader
+	var err error
+	if o.mmapInput {
+		vectors, reader, err = graphann.MapFloat32Matrix(o.inputFile, n, dim)
+		if err != nil {
+			log.Fatalf("Error mapping the input file: %v", err)
+		}
+		info = graphann.MatrixInfo{Rows: reader.Rows(), Dim: reader.Dim()}
+		log.Printf("Mapped the input file (%s)\n", reader.Dtype())
+		if reader.Dtype() != graphann.DtypeFloat32 {
+			// the DB packing and the graph construction take the full float32 matrix
+			log.Printf("-mmap only avoids the copy of float32 files, the %s rows were converted into memory as without -mmap.", reader.Dtype())
+		}
 	} else {
-		// it means we need to read the file
-		log.Print("Loading vectors from file: ", *inputFile)
-		var err error
-		vectors, err = graphann.LoadFloat32Matrix(*inputFile, n, dim)
+		vectors, info, err = graphann.LoadFloat32MatrixWithInfo(o.inputFile, n, dim)
 		if err != nil {
 			log.Fatalf("Error reading the input file: %v", err)
 		}
 	}
+	n, dim = len(vectors), info.Dim
+	log.Printf("Loaded %d of %d vectors with dim=%d\n", n, info.Rows, dim)
+	return reader
+}
 
-	// step 2: load graph. If not exists, generate the graph
-
-	graph = make([][]int, n)
-	graphFileName := *graphFile
-	if syntheticTest {
-		graph = genRandomGraph(n, m)
-		log.Print("Generated synthetic graph...")
-	} else {
-		if *graphFile == "" {
-			// we will use the default name
-			graphFileName = filepath.Join(workingDir, dataset+"_graph.npy")
-		}
-
-		if _, err := os.Stat(graphFileName); os.IsNotExist(err) {
-			// in this case we need to generate the graph
-			log.Printf("Graph file %s does not exist. Generating the graph...\n", graphFileName)
-			start := time.Now()
-			graph = graphann.BuildGraph(n, dim, m, vectors, workingDir, dataset)
-			end := time.Now()
-			graphann.SaveGraphToFile(graphFileName, graph)
-			log.Printf("Graph generation time: %v\n", end.Sub(start))
-
-			// we write the graph generation time to an auxiliary file
-
-			auxFileName := filepath.Join(workingDir, dataset+"_graph_aux.txt")
-			auxFile, _ := os.Create(auxFileName)
-			fmt.Fprintf(auxFile, "Dataset: %s\n", dataset)
-			fmt.Fprintf(auxFile, "Graph generation time: %v\n", end.Sub(start))
+// load or generate the attributes, and return the filter of -filter and the labels of -labelattr
+func loadAttributes(o *options) (graphann.VertexFilter, [][]uint32) {
+	if o.attrNum > 0 {
+		if syntheticTest {
+			attrs = genRandomAttrs(n, o.attrNum)
+			log.Printf("Generated synthetic attributes with %d columns\n", o.attrNum)
 		} else {
-			log.Printf("Loading graph from file %s\n", graphFileName)
-			graph, err = graphann.LoadIntMatrixFromFile(graphFileName, n, m)
+			if o.attrFile == "" {
+				log.Fatalf("No attribute file specified. Please specify the attribute file with -attrs.")
+			}
+			log.Print("Loading attributes from file: ", o.attrFile)
+			intAttrs, err := graphann.LoadIntMatrixFromFile(o.attrFile, n, o.attrNum)
 			if err != nil {
-				log.Fatalf("Error reading the graph file: %v", err)
+				log.Fatalf("Error reading the attribute file: %v", err)
+			}
+			attrs = make([][]uint32, n)
+			for i := 0; i < n; i++ {
+				attrs[i] = make([]uint32, o.attrNum)
+				for j := 0; j < o.attrNum; j++ {
+					attrs[i][j] = uint32(intAttrs[i][j])
+				}
 			}
 		}
 	}
 
-	// step 3: load queries
+	var filter graphann.VertexFilter
+	if o.filterExpr != "" {
+		if attrs == nil {
+			log.Fatalf("-filter needs attributes. Please specify -a and -attrs.")
+		}
+		var err error
+		filter, err = graphann.ParseFilter(o.filterExpr)
+		if err != nil {
+			log.Fatalf("Error parsing the filter: %v", err)
+		}
+	}
 
-	queries = make([][]float32, q)
+	var labels [][]uint32
+	if o.labelAttr >= 0 {
+		if o.labelAttr >= o.attrNum {
+			log.Fatalf("-labelattr %d is out of range, there are only %d attribute columns", o.labelAttr, o.attrNum)
+		}
+		labels = graphann.LabelsFromAttrs(attrs, o.labelAttr)
+	}
+	return filter, labels
+}
+
+// the options of a new graph
+func parseBuildOptions(o *options) graphann.GraphBuildOptions {
+	buildOpts := graphann.GraphBuildOptions{MinInDegree: o.minInDegree}
+	if o.longRange != "" {
+		fractions, err := parseFloatList(o.longRange)
+		if err != nil {
+			log.Fatalf("Error parsing -longrange: %v", err)
+		}
+		for _, f := range fractions {
+			if f < 0 || f >= 1 {
+				log.Fatalf("-longrange fractions must be in [0, 1), got %g", f)
+			}
+		}
+		if len(fractions) == 1 {
+			buildOpts.LongRangeFraction = fractions[0]
+		} else {
+			buildOpts.TuneLongRange = fractions
+		}
+	}
+	return buildOpts
+}
+
+// the relabeling of -relabel applied to the graph, the vectors, the attributes and the start vertices, or nil
+func relabelVertices(o *options, startIds []int) *graphann.Relabeling {
+	if o.relabelFile == "" {
+		return nil
+	}
+	if syntheticTest || o.termFile != "" || o.payloadFile != "" {
+		log.Printf("-relabel is not supported with -sweep, synthetic data, -terms or -payloads. Ignored.")
+		return nil
+	}
+	relabeling := relabelForPIR(o.relabelFile, m)
+	partitionNum := m / pianopir.RealQueryPerPartition
+	before, total := graphann.PartitionCollisions(graph, partitionNum, pianopir.RealQueryPerPartition)
+	graph = relabeling.ApplyGraph(graph)
+	after, _ := graphann.PartitionCollisions(graph, partitionNum, pianopir.RealQueryPerPartition)
+	log.Printf("Neighbors colliding in a PIR partition: %d -> %d of %d (%.2f%% -> %.2f%%)\n",
+		before, after, total, float64(before)/float64(max(total, 1))*100, float64(after)/float64(max(total, 1))*100)
+	vectors = graphann.PermuteRows(*relabeling, vectors)
+	if attrs != nil {
+		attrs = graphann.PermuteRows(*relabeling, attrs)
+	}
+	for i, id := range startIds {
+		startIds[i] = relabeling.NewId[id]
+	}
+	return relabeling
+}
+
+// the sampled vertices and the graph of the coarse level, and the rounds spent on it
+func buildCoarseLevel(o *options) ([]int, [][]int, int) {
+	if o.coarseNum <= 0 {
+		return nil, nil, 0
+	}
+	if o.beamL > 0 || o.splitDB {
+		log.Printf("-coarse is only supported by the unbounded search with a joint DB. Ignored.")
+		return nil, nil, 0
+	}
+	if o.coarseM <= 0 {
+		o.coarseM = m / 2
+	}
+	log.Printf("Building the coarse graph over %d sampled vertices...\n", o.coarseNum)
+	coarseIds, coarseGraph := graphann.BuildCoarseGraph(vectors, o.coarseNum, o.coarseM, o.randomSeed)
+	o.coarseM = len(coarseGraph[0])
+	return coarseIds, coarseGraph, min(o.coarseStepN, o.stepN)
+}
+
+// load or generate the queries
+func loadQueries(o *options) {
 	if syntheticTest {
+		q = max(q, 1)
 		queries = genRandomMatrix(q, dim)
 		log.Print("Generated synthetic queries...")
+		return
+	}
+	if o.queryFile == "" {
+		log.Fatalf("No query file specified. Please specify the query file.")
+	}
+	log.Print("Loading queries from file: ", o.queryFile)
+	var info graphann.MatrixInfo
+	var err error
+	queries, info, err = graphann.LoadFloat32MatrixWithInfo(o.queryFile, q, 0)
+	if err != nil {
+		log.Fatalf("Error reading the query file: %v", err)
+	}
+	if info.Dim != dim {
+		log.Fatalf("The queries have dimension %d, but the vectors have dimension %d", info.Dim, dim)
+	}
+	q = len(queries)
+}
+
+// the ground truth of -gnd, nil without it
+func loadGroundTruth(o *options) [][]int {
+	if o.gndFile == "" {
+		return nil
+	}
+	gnd, err := graphann.LoadGroundTruthIds(o.gndFile, q, k)
+	if err != nil {
+		log.Fatalf("Error reading the ground truth file: %v", err)
+	}
+	return gnd
+}
+
+// run the parameter sweep of the -sweep options and write its results
+func sweep(o *options, filter graphann.VertexFilter, labels [][]uint32, buildOpts graphann.GraphBuildOptions, workingDir string, dataName string) {
+	var grid sweepGrid
+	var err error
+	if grid.ms, err = parseIntList(o.sweepM, m); err != nil {
+		log.Fatalf("Error parsing -sweepm: %v", err)
+	}
+	if grid.steps, err = parseIntList(o.sweepStep, o.stepN); err != nil {
+		log.Fatalf("Error parsing -sweepstep: %v", err)
+	}
+	if grid.parallels, err = parseIntList(o.sweepParallel, o.parallelN); err != nil {
+		log.Fatalf("Error parsing -sweepparallel: %v", err)
+	}
+	if grid.batches, err = parseIntList(o.sweepBatch, 0); err != nil {
+		log.Fatalf("Error parsing -sweepbatch: %v", err)
+	}
+	if grid.failProbs, err = parseIntList(o.sweepFail, 8); err != nil {
+		log.Fatalf("Error parsing -sweepfail: %v", err)
+	}
+	if o.graphFile != "" && len(grid.ms) > 1 {
+		log.Fatalf("-graph only holds the graph of one m, the sweep over %d values of m needs the default graph files.", len(grid.ms))
+	}
+	if o.coarseNum > 0 || o.splitDB || o.beamL > 0 || o.interleaveN > 1 || o.radius > 0 || o.termFile != "" || o.payloadFile != "" {
+		log.Printf("-sweep only runs the unbounded search with a joint DB. -coarse, -split, -L, -interleave, -radius, -terms and -payloads are ignored.")
+	}
+	if o.relabelFile != "" {
+		log.Printf("-relabel is not supported with -sweep, synthetic data, -terms or -payloads. Ignored.")
+	}
+
+	loadQueries(o)
+	gnd := loadGroundTruth(o)
+	template := graphann.GraphANNFrontend{
+		EarlyStop:       o.earlyStop,
+		Patience:        o.patience,
+		SkipDummyRounds: o.skipDummy,
+		Filter:          filter,
+	}
+	results := runSweep(grid, template, gnd, o.rtt, o.graphFile, labels, o.labelAttr, buildOpts, workingDir, dataName, o.benchmarking)
+	log.Println("Writing the sweep results to: ", o.sweepPrefix+".csv")
+	if err := writeSweep(o.sweepPrefix, results); err != nil {
+		log.Fatalf("Error writing the sweep results: %v", err)
+	}
+	log.Println("Pareto frontier (recall, latency, online communication):")
+	for _, r := range results {
+		if r.Pareto {
+			log.Printf("  m=%d step=%d parallel=%d batch=%d fail=2^-%d: %f, %fs, %fKB\n",
+				r.M, r.Step, r.Parallel, r.BatchSize, r.FailureProbLog2, r.Recall, r.Latency, r.OnlineCommKB)
+		}
+	}
+}
+
+// the sparse index and the query terms of hybrid search, nil without it
+func loadSparseIndex(o *options) (*graphann.InvertedIndex, [][]string) {
+	if !o.hybridMode() {
+		return nil, nil
+	}
+	// the batch PIR serves two queries per partition, so we fetch an even number of blocks
+	o.termsPerQuery = max(2, (o.termsPerQuery+1)/2*2)
+
+	start := time.Now()
+	var sparseIndex *graphann.InvertedIndex
+	var queryTerms [][]string
+	if syntheticTest {
+		sparseIndex = graphann.BuildInvertedIndex(genRandomTerms(n, 10), o.bucketNum, o.blockSize)
+		queryTerms = genRandomTerms(q, 3)
+		log.Print("Generated synthetic terms...")
 	} else {
-		if *queryFile == "" {
-			log.Fatalf("No query file specified. Please specify the query file.")
+		if o.queryTermFile == "" {
+			log.Fatalf("No query terms file specified. Please specify it with -queryterms.")
 		}
-		log.Print("Loading queries from file: ", *queryFile)
 		var err error
-		queries, err = graphann.LoadFloat32Matrix(*queryFile, q, dim)
+		log.Print("Building the sparse index from file: ", o.termFile)
+		sparseIndex, err = graphann.BuildInvertedIndexFromTxt(o.termFile, n, o.bucketNum, o.blockSize)
 		if err != nil {
-			log.Fatalf("Error reading the query file: %v", err)
+			log.Fatalf("Error reading the terms file: %v", err)
 		}
+		queryTerms, err = graphann.LoadTermsFromTxt(o.queryTermFile, q)
+		if err != nil {
+			log.Fatalf("Error reading the query terms file: %v", err)
+		}
+	}
+	log.Printf("Sparse index built, time = %v\n", time.Since(start))
+	return sparseIndex, queryTerms
+}
+
+// the document payloads, nil without -payloads
+func loadPayloads(o *options) [][]byte {
+	if !o.payloadMode() {
+		return nil
+	}
+	if o.chunkSize%32 != 0 {
+		log.Fatalf("-chunksize has to be a multiple of 32, got %d", o.chunkSize)
+	}
+	if syntheticTest {
+		log.Print("Generated synthetic payloads...")
+		return genRandomPayloads(n, o.chunkSize*o.chunksPerDoc)
+	}
+	log.Print("Loading payloads from file: ", o.payloadFile)
+	payloadData, err := graphann.LoadPayloadsFromTxt(o.payloadFile, n)
+	if err != nil {
+		log.Fatalf("Error reading the payload file: %v", err)
 	}
+	return payloadData
+}
 
-	// step 4: build PIR instace
+// the PIR DBs and the frontend of a run, and what the report needs to know about them
+type searchSetup struct {
+	frontend       graphann.GraphANNFrontend
+	queryEngine    *PIRGraphInfo
+	coarseEngine   *PIRGraphInfo // nil without a coarse level
+	sparseEngine   *PIRPostingInfo
+	sparseFrontend graphann.SparseFrontend
+	queryTerms     [][]string
+	payloadEngine  *PIRPayloadChunks
+
+	coarseIds       []int
+	coarseSteps     int // the rounds on the coarse level
+	fineSteps       int // the rounds on the full graph
+	batchesPerRound int // the PIR batches of a round on the full graph
+	hybrid          bool
+	payloads        bool
+	relabeling      *graphann.Relabeling
+	graphOpts       graphann.GraphBuildOptions // the options the graph was built with
+}
 
-	queryEngine := PIRGraphInfo{
+// set up the PIR of the graph (and of its coarse level) and the frontend. The options that the chosen search
+// does not support are reset
+func newSearchSetup(o *options, filter graphann.VertexFilter, startIds []int, coarseIds []int, coarseGraph [][]int, coarseSteps int) *searchSetup {
+	s := &searchSetup{
+		coarseIds:   coarseIds,
+		coarseSteps: coarseSteps,
+		// the rounds on the full graph
+		fineSteps: o.stepN - coarseSteps,
+		hybrid:    o.hybridMode(),
+		payloads:  o.payloadMode(),
+	}
+	s.queryEngine = &PIRGraphInfo{
 		N:              n,
 		Dim:            dim,
 		M:              m,
+		A:              o.attrNum,
+		Split:          o.splitDB,
+		Parallel:       o.parallelN,
 		graph:          graph,
 		vectors:        vectors,
-		skipPrep:       *benchmarking, // if benchmarking, we will skip PIR prep
+		attrs:          attrs,
+		startIds:       startIds,
+		skipPrep:       o.benchmarking, // if benchmarking, we will skip PIR prep
 		NonPrivateMode: nonPrivateMode,
 
 		// the following will be set during prep
@@ -198,137 +868,1107 @@ func main() {
 		PIR:            nil,
 	}
 
-	frontend := graphann.GraphANNFrontend{
-		Graph: &queryEngine,
+	var coarseLevel *graphann.CoarseLevel
+	if coarseSteps > 0 {
+		// every coarse entry also links into the full graph
+		s.coarseEngine = &PIRGraphInfo{
+			N:              len(coarseIds),
+			Dim:            dim,
+			M:              o.coarseM,
+			A:              o.attrNum,
+			LinkNum:        m,
+			graph:          coarseGraph,
+			vectors:        make([][]float32, len(coarseIds)),
+			links:          make([][]int, len(coarseIds)),
+			skipPrep:       o.benchmarking,
+			NonPrivateMode: nonPrivateMode,
+		}
+		if attrs != nil {
+			s.coarseEngine.attrs = make([][]uint32, len(coarseIds))
+		}
+		for i, id := range coarseIds {
+			s.coarseEngine.vectors[i] = vectors[id]
+			s.coarseEngine.links[i] = graph[id]
+			if attrs != nil {
+				s.coarseEngine.attrs[i] = attrs[id]
+			}
+		}
+		coarseLevel = &graphann.CoarseLevel{Ids: coarseIds, Graph: s.coarseEngine}
+	}
+
+	if o.curveFile != "" && o.gndFile == "" {
+		log.Printf("-curve needs the ground truth of -gnd. Ignored.")
+		o.curveFile = ""
+	}
+
+	s.frontend = graphann.GraphANNFrontend{
+		Graph:           s.queryEngine,
+		EarlyStop:       o.earlyStop,
+		Patience:        o.patience,
+		SkipDummyRounds: o.skipDummy,
+		SplitFetch:      o.splitDB,
+		SpecDepth:       o.specDepth,
+		SpecWidth:       o.specWidth,
+		Coarse:          coarseLevel,
+		CoarseSteps:     coarseSteps,
+		Filter:          filter,
+		TrackRounds:     o.curveFile != "",
+		Trace:           o.traceFile != "",
+	}
+
+	// the speculative ids are sent as extra batches of m, so the rounds use more PIR batches
+	s.batchesPerRound = o.parallelN
+	if o.specDepth > 0 && o.beamL == 0 && !o.splitDB {
+		width := o.specWidth
+		if width <= 0 || width > m {
+			width = m
+		}
+		s.batchesPerRound += (o.parallelN*o.specDepth*width + m - 1) / m
+	} else if o.specDepth > 0 {
+		log.Printf("-specdepth is only supported by the unbounded search with a joint DB. Ignored.")
+	}
+
+	if o.radius > 0 && (o.beamL > 0 || o.interleaveN > 1 || s.payloads) {
+		log.Printf("-radius is only supported by the unbounded search without -interleave and -payloads. Ignored.")
+		o.radius = 0
+	}
+
+	if o.interleaveN > 1 && (o.beamL > 0 || o.splitDB || coarseSteps > 0) {
+		log.Printf("-interleave is only supported by the unbounded search with a joint DB and no coarse level. Ignored.")
+		o.interleaveN = 1
+	}
+	o.interleaveN = max(o.interleaveN, 1)
+
+	if o.splitDB && o.beamL > 0 {
+		log.Printf("-split is only supported by the unbounded search, beam search fetches the full entries.")
+	}
+
+	start := time.Now()
+	if err := s.frontend.PreprocessContext(context.Background()); err != nil {
+		log.Fatalf("Preprocessing failed: %v", err)
+	}
+	log.Println("Preprocessing time: ", time.Since(start))
+	return s
+}
+
+// set up the PIR of the sparse index for hybrid search
+func (s *searchSetup) setupSparse(o *options, sparseIndex *graphann.InvertedIndex, queryTerms [][]string) {
+	s.sparseEngine = &PIRPostingInfo{
+		index:          sparseIndex,
+		batchSize:      uint64(o.termsPerQuery),
+		skipPrep:       o.benchmarking,
+		NonPrivateMode: nonPrivateMode,
+	}
+	s.sparseFrontend = graphann.SparseFrontend{
+		Postings:      s.sparseEngine,
+		TermsPerQuery: o.termsPerQuery,
+	}
+	s.queryTerms = queryTerms
+	start := time.Now()
+	if err := s.sparseEngine.Preprocess(); err != nil {
+		log.Fatalf("Sparse preprocessing failed: %v", err)
+	}
+	log.Println("Sparse preprocessing time: ", time.Since(start))
+}
+
+// set up the PIR of the payload chunks, the frontend fetches the payloads through it
+func (s *searchSetup) setupPayloads(o *options, payloadData [][]byte) {
+	lengths := make([]int, n)
+	for i := 0; i < n; i++ {
+		lengths[i] = len(payloadData[i])
+	}
+	// the batch PIR serves two queries per partition, so we fetch an even number of chunks,
+	// and the chunks of a document are striped over its partitions
+	payloadBatch := (k*o.chunksPerDoc + 1) / 2 * 2
+	layout := graphann.BuildPayloadLayout(lengths, o.chunkSize, o.chunksPerDoc, payloadBatch/pianopir.RealQueryPerPartition)
+	log.Printf("Payload layout: %d chunks, %d truncated documents\n", layout.ChunkNum, layout.Truncated)
+
+	s.payloadEngine = &PIRPayloadChunks{
+		chunkSize:      o.chunkSize,
+		chunks:         layout.Chunks(payloadData),
+		batchSize:      uint64(payloadBatch),
+		skipPrep:       o.benchmarking,
+		NonPrivateMode: nonPrivateMode,
+	}
+
+	start := time.Now()
+	if err := s.payloadEngine.Preprocess(); err != nil {
+		log.Fatalf("Payload preprocessing failed: %v", err)
+	}
+	log.Println("Payload preprocessing time: ", time.Since(start))
+	s.frontend.Payloads = &graphann.PayloadFetcher{
+		Layout: layout,
+		Chunks: s.payloadEngine,
+	}
+}
+
+// the queries of the set-up search, see runQueries
+func (s *searchSetup) queryOptions(o *options) queryOptions {
+	qo := queryOptions{
+		k:            k,
+		steps:        o.stepN,
+		parallel:     o.parallelN,
+		beamL:        o.beamL,
+		radius:       float32(o.radius),
+		interleave:   o.interleaveN,
+		timeout:      o.timeout,
+		benchmarking: o.benchmarking,
+		payloads:     s.payloads,
+	}
+	if s.hybrid {
+		qo.sparse = &s.sparseFrontend
+		qo.queryTerms = s.queryTerms
+		qo.rrfConstant = o.rrfConstant
+		qo.refresh = append(qo.refresh, pirRefresh{pir: s.sparseEngine.PIR})
+	}
+	if s.payloads {
+		qo.refresh = append(qo.refresh, pirRefresh{pir: s.payloadEngine.PIR})
+	}
+	if o.splitDB {
+		qo.refresh = append(qo.refresh, pirRefresh{pir: s.queryEngine.AdjPIR, batches: uint64(o.stepN)})
+	}
+	if s.coarseSteps > 0 {
+		qo.refresh = append(qo.refresh, pirRefresh{pir: s.coarseEngine.PIR, batches: uint64(s.coarseSteps) * uint64(o.parallelN)})
+	}
+	qo.refresh = append(qo.refresh, pirRefresh{pir: s.queryEngine.PIR, batches: uint64(s.fineSteps) * uint64(s.batchesPerRound) * uint64(o.interleaveN)})
+	return qo
+}
+
+// the options of a run of the queries
+type queryOptions struct {
+	k            int
+	steps        int // the rounds per query, the coarse ones included
+	parallel     int
+	beamL        int     // beam search if > 0
+	radius       float32 // range search if > 0
+	interleave   int     // the queries advanced in lockstep
+	timeout      time.Duration
+	benchmarking bool
+	payloads     bool // also fetch the payloads of the answers, see GraphANNFrontend.Payloads
+
+	// hybrid search: the sparse answers of the query terms are fused with the dense answers
+	sparse      *graphann.SparseFrontend
+	queryTerms  [][]string
+	rrfConstant float64
+
+	// the PIR DBs whose hints are refreshed between the queries
+	refresh []pirRefresh
+}
+
+// a PIR DB whose preprocessing is redone before the next query could run out of hints
+type pirRefresh struct {
+	pir     *pianopir.SimpleBatchPianoPIR
+	batches uint64 // the batches of the next query, besides a margin of 10
+}
+
+// the answers and the statistics of a run of the queries
+type queryRun struct {
+	answers         [][]int // the top-k ids of every query, padded with -1
+	denseAnswers    [][]int // the answers of the graph search, before the fusion of hybrid search
+	payloads        [][][]byte
+	stats           []graphann.SearchStats
+	timedOut        int
+	searchTime      time.Duration // without the maintenance
+	maintenanceTime time.Duration // the preprocessing redone between the queries
+}
+
+// the average search time per query, in seconds
+func (r queryRun) avgTime() float64 {
+	return r.searchTime.Seconds() / float64(len(r.answers))
+}
+
+// the top-k ids of the results, padded with -1
+func resultIds(results []graphann.SearchResult, k int) []int {
+	ids := make([]int, k)
+	for j := range ids {
+		ids[j] = -1
+		if j < len(results) {
+			ids[j] = results[j].Id
+		}
+	}
+	return ids
+}
+
+// search for every query with the frontend
+func runQueries(frontend *graphann.GraphANNFrontend, queries [][]float32, opts queryOptions) queryRun {
+	q := len(queries)
+	k := opts.k
+	run := queryRun{
+		answers:      make([][]int, q),
+		denseAnswers: make([][]int, q),
+		payloads:     make([][][]byte, q),
+		stats:        make([]graphann.SearchStats, q),
+	}
+
+	// the results of the current group of interleaved queries
+	var groupAnswers [][]int
+	var groupStats []graphann.SearchStats
+
+	start := time.Now()
+	for i := 0; i < q; i++ {
+		if i%100 == 0 {
+			log.Printf("Processing query %d\n", i)
+		}
+		if opts.interleave > 1 {
+			if i%opts.interleave == 0 {
+				// the last group is padded with repeated queries, so the rounds keep their shape
+				group := make([][]float32, opts.interleave)
+				for j := range group {
+					group[j] = queries[min(i+j, q-1)]
+				}
+				ctx, cancel := queryContext(opts.timeout)
+				var groupResults [][]graphann.SearchResult
+				var err error
+				groupResults, groupStats, err = frontend.SearchKNNInterleavedContext(ctx, group, k, opts.steps, opts.parallel, opts.benchmarking)
+				cancel()
+				if errors.Is(err, context.DeadlineExceeded) {
+					run.timedOut += min(opts.interleave, q-i)
+				} else if err != nil {
+					log.Fatalf("Error searching queries %d-%d: %v", i, i+opts.interleave-1, err)
+				}
+				groupAnswers = make([][]int, len(groupResults))
+				for j, results := range groupResults {
+					groupAnswers[j] = resultIds(results, k)
+				}
+			}
+			run.answers[i] = groupAnswers[i%opts.interleave]
+			run.stats[i] = groupStats[i%opts.interleave]
+			if opts.payloads && opts.sparse == nil {
+				var err error
+				run.payloads[i], err = frontend.Payloads.FetchPayloads(run.answers[i])
+				if err != nil {
+					log.Fatalf("Error fetching the payloads of query %d: %v", i, err)
+				}
+			}
+		} else if opts.payloads && opts.sparse == nil {
+			// one call returns the ids, the distances and the payloads
+			ctx, cancel := queryContext(opts.timeout)
+			results, stats, err := frontend.SearchWithPayloadsContext(ctx, queries[i], k, opts.beamL, opts.steps, opts.parallel, opts.benchmarking)
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				run.timedOut++
+			} else if err != nil {
+				log.Fatalf("Error searching query %d: %v", i, err)
+			}
+			run.stats[i] = stats
+			run.answers[i] = resultIds(results, k)
+			run.payloads[i] = make([][]byte, k)
+			for j := 0; j < k && j < len(results); j++ {
+				run.payloads[i][j] = results[j].Payload
+			}
+		} else {
+			ctx, cancel := queryContext(opts.timeout)
+			var results []graphann.SearchResult
+			var err error
+			if opts.radius > 0 {
+				results, run.stats[i], err = frontend.SearchRangeContext(ctx, queries[i], opts.radius, k, opts.steps, opts.parallel, opts.benchmarking)
+			} else if opts.beamL > 0 {
+				results, run.stats[i], err = frontend.SearchKNNBeamContext(ctx, queries[i], k, opts.beamL, opts.steps, opts.parallel, opts.benchmarking)
+			} else {
+				results, run.stats[i], err = frontend.SearchKNNContext(ctx, queries[i], k, opts.steps, opts.parallel, opts.benchmarking)
+			}
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				// the search was cut short, the results found so far are kept
+				run.timedOut++
+			} else if err != nil {
+				log.Fatalf("Error searching query %d: %v", i, err)
+			}
+			run.answers[i] = resultIds(results, k)
+		}
+		run.denseAnswers[i] = run.answers[i]
+
+		if opts.sparse != nil {
+			// the sparse lookup goes to its own PIR DB, so it can be sent together with the first traversal round
+			sparseAnswer := opts.sparse.SearchSparse(opts.queryTerms[i], k)
+			run.answers[i] = graphann.ReciprocalRankFusion([][]int{run.denseAnswers[i], sparseAnswer}, k, opts.rrfConstant)
+
+			if opts.payloads {
+				// the payloads of the fused results
+				var err error
+				run.payloads[i], err = frontend.Payloads.FetchPayloads(run.answers[i])
+				if err != nil {
+					log.Fatalf("Error fetching the payloads of query %d: %v", i, err)
+				}
+			}
+		}
+
+		for _, r := range opts.refresh {
+			if r.pir.FinishedBatchNum+r.batches+10 >= r.pir.SupportBatchNum {
+				// in this case we need to re-run the preprocessing
+				start := time.Now()
+				r.pir.Preprocessing()
+				run.maintenanceTime += time.Since(start)
+			}
+		}
+	}
+	run.searchTime = time.Since(start) - run.maintenanceTime
+	return run
+}
+
+// write the answers, in the original ids, and the fetched payloads
+func writeAnswers(o *options, s *searchSetup, run queryRun) {
+	log.Println("Writing answers to the output file: ", o.outputFile)
+	answers := run.answers
+	if s.relabeling != nil {
+		answers = s.relabeling.RestoreIds(answers)
+	}
+	if err := graphann.SaveIntMatrixToFile(o.outputFile, answers); err != nil {
+		log.Printf("Error writing the output file: %v", err)
+	}
+
+	if s.payloads {
+		log.Printf("Payload fetch failures: %d documents\n", s.frontend.Payloads.FailedDocs)
+		if o.payloadOutputFile != "" {
+			log.Println("Writing the payloads to the file: ", o.payloadOutputFile)
+			if err := writePayloads(o.payloadOutputFile, run.answers, run.payloads); err != nil {
+				log.Printf("Error writing the payloads: %v", err)
+			}
+		}
+	}
+}
+
+// the quality of the answers against the ground truth. The numbers are -1 without it
+type answerQuality struct {
+	gnd         [][]int // in the ids of the graph
+	recall      float32
+	mrr         float32
+	denseRecall float32 // hybrid search only
+	curve       []curvePoint
+}
+
+// evaluate the answers against -gnd, and write the recall curve of -curve
+func evaluateAnswers(o *options, s *searchSetup, run queryRun) answerQuality {
+	quality := answerQuality{recall: -1, mrr: -1, denseRecall: -1}
+	if o.gndFile == "" {
+		return quality
+	}
+	log.Println("Evaluating recall...")
+	gnd := loadGroundTruth(o)
+	if s.relabeling != nil {
+		gnd = s.relabeling.MapIds(gnd)
+	}
+	quality.gnd = gnd
+	quality.recall = graphann.ComputeRecall(gnd, run.answers, k)
+	quality.mrr = graphann.ComputeMRR(gnd, run.answers)
+	log.Println("Recall: ", quality.recall)
+	log.Println("MRR: ", quality.mrr)
+	if s.hybrid {
+		quality.denseRecall = graphann.ComputeRecall(gnd, run.denseAnswers, k)
+		log.Println("Dense-only recall: ", quality.denseRecall)
+	}
+
+	if o.curveFile != "" {
+		// the online communication of one query in the first step rounds, over all the PIR DBs
+		commKB := func(step int) float64 {
+			coarse := min(step, s.coarseSteps)
+			comm := float64(s.queryEngine.PIR.CommCostPerBatchOnline()) * float64(step-coarse) * float64(s.batchesPerRound)
+			if o.splitDB {
+				comm += float64(s.queryEngine.AdjPIR.CommCostPerBatchOnline()) * float64(step)
+			}
+			if s.coarseSteps > 0 {
+				comm += float64(s.coarseEngine.PIR.CommCostPerBatchOnline()) * float64(coarse) * float64(o.parallelN)
+			}
+			return comm / 1024.0
+		}
+		for step := 1; step <= o.stepN; step++ {
+			stepAnswers := answersAfter(run.stats, step, k)
+			quality.curve = append(quality.curve, curvePoint{
+				step:   step,
+				recall: graphann.ComputeRecall(gnd, stepAnswers, k),
+				mrr:    graphann.ComputeMRR(gnd, stepAnswers),
+				commKB: commKB(step),
+			})
+		}
+		log.Println("Writing the recall curve to: ", o.curveFile)
+		if err := writeCurve(o.curveFile, quality.curve); err != nil {
+			log.Printf("Error writing the recall curve: %v", err)
+		}
+	}
+	return quality
+}
+
+// append the text report to -report and write the JSON report of the run
+func writeReports(o *options, s *searchSetup, run queryRun, roundStats roundStatsSummary, quality answerQuality) {
+	log.Printf("Writing the report to the file: %s\n", o.reportFile)
+
+	file, err := os.OpenFile(o.reportFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error creating the report file: %v", err)
+		return
+	}
+	costs := newGraphCosts(o, s, run, roundStats)
+	jsonReport := newJSONReport(o, s, run, roundStats, quality, costs)
+	writeTextReport(file, o, s, run, roundStats, quality, costs, &jsonReport)
+	file.Close()
+
+	// one run per JSON report, so two runs can be compared with graphann/cmd/reportdiff
+	if o.jsonReportFile == "" {
+		o.jsonReportFile = strings.TrimSuffix(o.reportFile, filepath.Ext(o.reportFile)) + ".json"
+	}
+	log.Printf("Writing the JSON report to the file: %s\n", o.jsonReportFile)
+	jsonFile, err := os.Create(o.jsonReportFile)
+	if err != nil {
+		log.Printf("Error creating the JSON report file: %v", err)
+		return
+	}
+	defer jsonFile.Close()
+	if err := graphann.WriteReport(jsonFile, jsonReport); err != nil {
+		log.Printf("Error writing the JSON report: %v", err)
+	}
+}
+
+// the costs per query of the DB of the graph (the vector DB in split mode)
+type graphCosts struct {
+	dbSize      uint64 // in bytes
+	prepTime    float64
+	maintenance float64 // amortized, in seconds
+	storage     float64
+	offlineComm float64 // amortized, in bytes
+	onlineComm  float64
+	windowSize  uint64 // the queries between two preprocessings
+	totalTime   float64
+	successRate float64
+}
+
+func newGraphCosts(o *options, s *searchSetup, run queryRun, roundStats roundStatsSummary) graphCosts {
+	instance := s.queryEngine.PIR
+	config := instance.Config()
+	batches := float64(s.fineSteps) * float64(s.batchesPerRound)
+	// the rounds each query actually sent, dummy rounds included. Interleaved queries share their rounds
+	totalRounds := roundStats.avgIssued / float64(o.interleaveN)
+	if s.payloads {
+		// the payloads are fetched in one more round
+		totalRounds++
+	}
+	return graphCosts{
+		dbSize:      config.DBSize * config.DBEntryByteNum,
+		prepTime:    instance.PreprocessingTime(),
+		maintenance: instance.PreprocessingTime() / float64(instance.SupportBatchNum) * batches,
+		storage:     instance.LocalStorageSize(),
+		offlineComm: float64(instance.CommCostPerBatchOffline()) * batches,
+		onlineComm:  float64(instance.CommCostPerBatchOnline()) * batches,
+		windowSize:  instance.SupportBatchNum / (uint64(max(s.fineSteps, 1)) * uint64(s.batchesPerRound)),
+		totalTime:   run.avgTime() + float64(o.rtt)/1000.0*totalRounds,
+		successRate: float64(s.queryEngine.succQueryNum) / float64(max(s.queryEngine.totalQueryNum, 1)),
+	}
+}
+
+// the JSON report of the run. The costs of the other DBs are added by writeTextReport
+func newJSONReport(o *options, s *searchSetup, run queryRun, roundStats roundStatsSummary, quality answerQuality, costs graphCosts) graphann.Report {
+	return graphann.Report{
+		Settings: graphann.ReportSettings{
+			VectorNum:         n,
+			Dim:               dim,
+			M:                 m,
+			DBSizeMB:          float64(costs.dbSize) / 1024.0 / 1024.0,
+			TopK:              k,
+			Rounds:            o.stepN,
+			Parallel:          o.parallelN,
+			BeamWidth:         o.beamL,
+			Split:             o.splitDB,
+			SpecDepth:         o.specDepth,
+			SpecWidth:         o.specWidth,
+			Interleave:        o.interleaveN,
+			Radius:            o.radius,
+			Timeout:           o.timeout.String(),
+			CoarseVertices:    len(s.coarseIds),
+			CoarseDegree:      o.coarseM,
+			CoarseRounds:      s.coarseSteps,
+			AttrNum:           o.attrNum,
+			Filter:            o.filterExpr,
+			LabelAttr:         o.labelAttr,
+			Hybrid:            s.hybrid,
+			Payloads:          s.payloads,
+			EarlyStop:         o.earlyStop,
+			Patience:          o.patience,
+			NonPrivate:        nonPrivateMode,
+			RTTms:             o.rtt,
+			Seed:              o.randomSeed,
+			WindowSize:        costs.windowSize,
+			Relabeled:         s.relabeling != nil,
+			MinInDegree:       s.graphOpts.MinInDegree,
+			LongRangeFraction: s.graphOpts.LongRangeFraction,
+		},
+		Preprocessing: graphann.ReportPreprocessing{
+			StorageMB:       costs.storage / 1024.0 / 1024.0,
+			PrepTime:        costs.prepTime,
+			OfflineCommKB:   costs.offlineComm / 1024.0,
+			MaintenanceTime: costs.maintenance,
+		},
+		Online: graphann.ReportOnline{
+			ComputeTime:  run.avgTime(),
+			TotalTime:    costs.totalTime,
+			OnlineCommKB: costs.onlineComm / 1024.0,
+			SuccessRate:  costs.successRate,
+			TimedOut:     run.timedOut,
+		},
+		Quality: graphann.ReportQuality{
+			Recall:       quality.recall,
+			MRR:          quality.mrr,
+			DenseRecall:  quality.denseRecall,
+			AvgStable:    roundStats.avgStable,
+			P90Stable:    roundStats.p90Stable,
+			ConvergedNum: roundStats.convergedNum,
+			AvgReal:      roundStats.avgReal,
+			AvgIssued:    roundStats.avgIssued,
+		},
+		Environment: graphann.CollectEnvironment(),
+	}
+}
+
+// write the text report of the run, and add the costs of the DBs besides the graph to the JSON report
+func writeTextReport(file *os.File, o *options, s *searchSetup, run queryRun, roundStats roundStatsSummary, quality answerQuality, costs graphCosts, jsonReport *graphann.Report) {
+	addExtra := func(storage float64, prepTime float64, offlineComm float64, onlineComm float64) {
+		jsonReport.Preprocessing.ExtraStorageMB += storage / 1024.0 / 1024.0
+		jsonReport.Preprocessing.ExtraPrepTime += prepTime
+		jsonReport.Preprocessing.ExtraOfflineComm += offlineComm / 1024.0
+		jsonReport.Online.ExtraOnlineComm += onlineComm / 1024.0
+	}
+
+	fmt.Fprintf(file, "-------------------------\n")
+	fmt.Fprintf(file, "Private ANN Benchmarking w/ Go Frontend\n")
+	fmt.Fprintf(file, "Settings:\n")
+	fmt.Fprintf(file, "** Vector Num: %d\n", n)
+	fmt.Fprintf(file, "** DB Size (MB): %f\n", float64(costs.dbSize)/1024.0/1024.0)
+	fmt.Fprintf(file, "** Top K: %d\n", k)
+	fmt.Fprintf(file, "** Rounds: %d\n", o.stepN)
+	fmt.Fprintf(file, "** Parallel Exploration: %d\n", o.parallelN)
+	fmt.Fprintf(file, "** Beam Width L: %d\n", o.beamL)
+	fmt.Fprintf(file, "** Split Vector/Adjacency DBs: %v\n", o.splitDB)
+	fmt.Fprintf(file, "** Speculative Depth/Width: %d/%d\n", o.specDepth, o.specWidth)
+	fmt.Fprintf(file, "** Interleaved Queries: %d\n", o.interleaveN)
+	fmt.Fprintf(file, "** Range Search Radius: %f\n", o.radius)
+	fmt.Fprintf(file, "** Search Timeout: %v\n", o.timeout)
+	fmt.Fprintf(file, "** Coarse Vertices/Degree/Rounds: %d/%d/%d\n", len(s.coarseIds), o.coarseM, s.coarseSteps)
+	fmt.Fprintf(file, "** Attribute Columns: %d\n", o.attrNum)
+	fmt.Fprintf(file, "** Filter: %q\n", o.filterExpr)
+	fmt.Fprintf(file, "** Label Attribute: %d\n", o.labelAttr)
+	fmt.Fprintf(file, "** RTT (ms): %d\n", o.rtt)
+	fmt.Fprintf(file, "** Random Seed: %d\n", o.randomSeed)
+	fmt.Fprintf(file, "** Window Size: %d\n", costs.windowSize)
+	fmt.Fprintf(file, "** Relabeled for the PIR Partitions: %v\n", s.relabeling != nil)
+	fmt.Fprintf(file, "** Min In-Degree of the Graph: %d\n", s.graphOpts.MinInDegree)
+	fmt.Fprintf(file, "** Long-Range Fraction of the Graph: %g\n", s.graphOpts.LongRangeFraction)
+	fmt.Fprintf(file, "\n")
+	fmt.Fprintf(file, "Preprocessing Cost:\n")
+	fmt.Fprintf(file, "** Storage (MB): %f\n", costs.storage/1024.0/1024.0)
+	fmt.Fprintf(file, "** Preparation Time (s): %f\n", costs.prepTime)
+	fmt.Fprintf(file, "** Offline Communication Cost Per Q (KB, amt.): %f\n", costs.offlineComm/1024.0)
+	fmt.Fprintf(file, "** Amortized Maintainence Time Per Q (s): %f\n", costs.maintenance)
+	fmt.Fprintf(file, "\n")
+	fmt.Fprintf(file, "Online Cost:\n")
+	fmt.Fprintf(file, "** Average Computation Time Per Query (s): %f\n", run.avgTime())
+	fmt.Fprintf(file, "** Average Total Time Per Q (s): %f\n", costs.totalTime)
+	fmt.Fprintf(file, "** Online Communication Per Q (KB): %f\n", costs.onlineComm/1024.0)
+	fmt.Fprintf(file, "\n")
+	if o.splitDB {
+		adj := s.queryEngine.AdjPIR
+		adjConfig := adj.Config()
+		fmt.Fprintf(file, "Adjacency DB (the numbers above are for the vector DB):\n")
+		fmt.Fprintf(file, "** Vector Entry Size (B): %d\n", s.queryEngine.DBEntryByteNum)
+		fmt.Fprintf(file, "** Adjacency Entry Size (B): %d\n", adjConfig.DBEntryByteNum)
+		fmt.Fprintf(file, "** Adjacency DB Size (MB): %f\n", float64(adjConfig.DBSize*adjConfig.DBEntryByteNum)/1024.0/1024.0)
+		fmt.Fprintf(file, "** Adjacency Storage (MB): %f\n", adj.LocalStorageSize()/1024.0/1024.0)
+		fmt.Fprintf(file, "** Adjacency Preparation Time (s): %f\n", adj.PreprocessingTime())
+		fmt.Fprintf(file, "** Adjacency Offline Communication Cost Per Q (KB, amt.): %f\n", float64(adj.CommCostPerBatchOffline())*float64(o.stepN)/1024.0)
+		fmt.Fprintf(file, "** Adjacency Online Communication Per Q (KB): %f\n", float64(adj.CommCostPerBatchOnline())*float64(o.stepN)/1024.0)
+		fmt.Fprintf(file, "\n")
+		addExtra(adj.LocalStorageSize(), adj.PreprocessingTime(), float64(adj.CommCostPerBatchOffline())*float64(o.stepN), float64(adj.CommCostPerBatchOnline())*float64(o.stepN))
+	}
+	if s.coarseSteps > 0 {
+		coarsePIR := s.coarseEngine.PIR
+		coarseConfig := coarsePIR.Config()
+		coarseBatches := float64(s.coarseSteps) * float64(o.parallelN)
+		fmt.Fprintf(file, "Coarse Level (the numbers above are for the %d full-graph rounds):\n", s.fineSteps)
+		fmt.Fprintf(file, "** Coarse Entry Size (B): %d\n", coarseConfig.DBEntryByteNum)
+		fmt.Fprintf(file, "** Coarse DB Size (MB): %f\n", float64(coarseConfig.DBSize*coarseConfig.DBEntryByteNum)/1024.0/1024.0)
+		fmt.Fprintf(file, "** Coarse Storage (MB): %f\n", coarsePIR.LocalStorageSize()/1024.0/1024.0)
+		fmt.Fprintf(file, "** Coarse Preparation Time (s): %f\n", coarsePIR.PreprocessingTime())
+		fmt.Fprintf(file, "** Coarse Offline Communication Cost Per Q (KB, amt.): %f\n", float64(coarsePIR.CommCostPerBatchOffline())*coarseBatches/1024.0)
+		fmt.Fprintf(file, "** Coarse Online Communication Per Q (KB): %f\n", float64(coarsePIR.CommCostPerBatchOnline())*coarseBatches/1024.0)
+		fmt.Fprintf(file, "\n")
+		addExtra(coarsePIR.LocalStorageSize(), coarsePIR.PreprocessingTime(), float64(coarsePIR.CommCostPerBatchOffline())*coarseBatches, float64(coarsePIR.CommCostPerBatchOnline())*coarseBatches)
+	}
+	fmt.Fprintf(file, "Traversal:\n")
+	fmt.Fprintf(file, "** Early Stop: %v (patience %d, skip dummy rounds %v)\n", o.earlyStop, o.patience, o.skipDummy)
+	fmt.Fprintf(file, "** Average Stable Round: %f\n", roundStats.avgStable)
+	fmt.Fprintf(file, "** Stable Round p50/p90/p99/max: %d/%d/%d/%d\n", roundStats.p50Stable, roundStats.p90Stable, roundStats.p99Stable, roundStats.maxStable)
+	fmt.Fprintf(file, "** Converged Queries: %d\n", roundStats.convergedNum)
+	fmt.Fprintf(file, "** Average Real Rounds: %f\n", roundStats.avgReal)
+	fmt.Fprintf(file, "** Average Issued Rounds: %f\n", roundStats.avgIssued)
+	if o.timeout > 0 {
+		fmt.Fprintf(file, "** Timed Out Queries: %d\n", run.timedOut)
+	}
+	if o.specDepth > 0 {
+		fmt.Fprintf(file, "** Average Speculative Hits: %f\n", roundStats.avgSpecHits)
+		fmt.Fprintf(file, "** Estimated Rounds Saved Per Q: %f\n", roundStats.avgSpecHits/float64(o.parallelN))
+	}
+	fmt.Fprintf(file, "\n")
+	if s.hybrid {
+		sparsePIR := s.sparseEngine.PIR
+		sparseConfig := sparsePIR.Config()
+		fmt.Fprintf(file, "Hybrid (Sparse) Component:\n")
+		fmt.Fprintf(file, "** Buckets: %d\n", o.bucketNum)
+		fmt.Fprintf(file, "** Postings Per Block: %d\n", o.blockSize)
+		fmt.Fprintf(file, "** Terms Per Query: %d\n", o.termsPerQuery)
+		fmt.Fprintf(file, "** RRF Constant: %f\n", o.rrfConstant)
+		fmt.Fprintf(file, "** Sparse DB Size (MB): %f\n", float64(sparseConfig.DBSize*sparseConfig.DBEntryByteNum)/1024.0/1024.0)
+		fmt.Fprintf(file, "** Sparse Storage (MB): %f\n", sparsePIR.LocalStorageSize()/1024.0/1024.0)
+		fmt.Fprintf(file, "** Sparse Preparation Time (s): %f\n", sparsePIR.PreprocessingTime())
+		fmt.Fprintf(file, "** Sparse Offline Communication Cost Per Q (KB, amt.): %f\n", float64(sparsePIR.CommCostPerBatchOffline())/1024.0)
+		fmt.Fprintf(file, "** Sparse Online Communication Per Q (KB): %f\n", float64(sparsePIR.CommCostPerBatchOnline())/1024.0)
+		fmt.Fprintf(file, "\n")
+		addExtra(sparsePIR.LocalStorageSize(), sparsePIR.PreprocessingTime(), float64(sparsePIR.CommCostPerBatchOffline()), float64(sparsePIR.CommCostPerBatchOnline()))
+	}
+	if s.payloads {
+		payloadPIR := s.payloadEngine.PIR
+		payloadConfig := payloadPIR.Config()
+		layout := s.frontend.Payloads.Layout
+		fmt.Fprintf(file, "Payloads:\n")
+		fmt.Fprintf(file, "** Chunk Size (B): %d\n", o.chunkSize)
+		fmt.Fprintf(file, "** Chunks Per Document: %d\n", o.chunksPerDoc)
+		fmt.Fprintf(file, "** Chunk Num: %d\n", layout.ChunkNum)
+		fmt.Fprintf(file, "** Truncated Documents: %d\n", layout.Truncated)
+		fmt.Fprintf(file, "** Failed Document Fetches: %d\n", s.frontend.Payloads.FailedDocs)
+		fmt.Fprintf(file, "** Payload DB Size (MB): %f\n", float64(payloadConfig.DBSize*payloadConfig.DBEntryByteNum)/1024.0/1024.0)
+		fmt.Fprintf(file, "** Payload Storage (MB): %f\n", payloadPIR.LocalStorageSize()/1024.0/1024.0)
+		fmt.Fprintf(file, "** Payload Preparation Time (s): %f\n", payloadPIR.PreprocessingTime())
+		fmt.Fprintf(file, "** Payload Offline Communication Cost Per Q (KB, amt.): %f\n", float64(payloadPIR.CommCostPerBatchOffline())/1024.0)
+		fmt.Fprintf(file, "** Payload Online Communication Per Q (KB): %f\n", float64(payloadPIR.CommCostPerBatchOnline())/1024.0)
+		fmt.Fprintf(file, "\n")
+		addExtra(payloadPIR.LocalStorageSize(), payloadPIR.PreprocessingTime(), float64(payloadPIR.CommCostPerBatchOffline()), float64(payloadPIR.CommCostPerBatchOnline()))
+	}
+	fmt.Fprintf(file, "Quality:\n")
+	fmt.Fprintf(file, "** Recall: %f\n", quality.recall)
+	fmt.Fprintf(file, "** MRR: %f\n", quality.mrr)
+	if s.hybrid {
+		fmt.Fprintf(file, "** Dense-only Recall: %f\n", quality.denseRecall)
+	}
+	if len(quality.curve) > 0 {
+		// in hybrid mode, the curve is the one of the dense search
+		fmt.Fprintf(file, "** Recall/MRR/Online Communication (KB) After Each Round:\n")
+		for _, p := range quality.curve {
+			fmt.Fprintf(file, "**   %d: %f/%f/%f\n", p.step, p.recall, p.mrr, p.commKB)
+		}
+	}
+	fmt.Fprintf(file, "-----------------------\n")
+}
+
+// aggregated round statistics over all queries
+
+type roundStatsSummary struct {
+	avgStable    float64
+	p50Stable    int
+	p90Stable    int
+	p99Stable    int
+	maxStable    int
+	convergedNum int
+	avgReal      float64 // rounds before convergence (or all issued rounds if never converged)
+	avgIssued    float64
+	avgSpecHits  float64 // extra expansions served by the speculative prefetch
+}
+
+// the average rounds the queries sent within the first step rounds
+func issuedBefore(stats []graphann.SearchStats, step int) float64 {
+	total := 0
+	for _, s := range stats {
+		total += min(s.IssuedRounds, step)
+	}
+	return float64(total) / float64(max(len(stats), 1))
+}
+
+func summarizeRoundStats(stats []graphann.SearchStats) roundStatsSummary {
+	ret := roundStatsSummary{}
+	if len(stats) == 0 {
+		return ret
+	}
+
+	stable := make([]int, len(stats))
+	for i, s := range stats {
+		stable[i] = s.StableRound
+		ret.avgStable += float64(s.StableRound)
+		ret.avgIssued += float64(s.IssuedRounds)
+		ret.avgSpecHits += float64(s.SpecHits)
+		if s.ConvergedRound >= 0 {
+			ret.convergedNum++
+			ret.avgReal += float64(s.ConvergedRound)
+		} else {
+			ret.avgReal += float64(s.IssuedRounds)
+		}
+	}
+	sort.Ints(stable)
+
+	percentile := func(p float64) int {
+		idx := int(math.Ceil(p*float64(len(stable)))) - 1
+		return stable[max(idx, 0)]
+	}
+
+	ret.avgStable /= float64(len(stats))
+	ret.avgReal /= float64(len(stats))
+	ret.avgIssued /= float64(len(stats))
+	ret.avgSpecHits /= float64(len(stats))
+	ret.p50Stable = percentile(0.5)
+	ret.p90Stable = percentile(0.9)
+	ret.p99Stable = percentile(0.99)
+	ret.maxStable = stable[len(stable)-1]
+	return ret
+}
+
+// the context of one search, with the -timeout deadline if set
+func queryContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// one point of the recall-versus-rounds curve
+type curvePoint struct {
+	step   int
+	recall float32
+	mrr    float32
+	commKB float64 // online communication per query in the first step rounds
+}
+
+// the answers of all queries after step rounds, padded with -1.
+// A search that stopped issuing rounds earlier keeps its last top-k
+func answersAfter(stats []graphann.SearchStats, step int, k int) [][]int {
+	answers := make([][]int, len(stats))
+	for i, s := range stats {
+		answers[i] = make([]int, k)
+		for j := range answers[i] {
+			answers[i][j] = -1
+		}
+		if len(s.RoundTopK) > 0 {
+			copy(answers[i], s.RoundTopK[min(step, len(s.RoundTopK))-1])
+		}
+	}
+	return answers
+}
+
+func writeCurve(filename string, curve []curvePoint) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "# step recall mrr online_comm_kb\n")
+	for _, p := range curve {
+		fmt.Fprintf(file, "%d %f %f %f\n", p.step, p.recall, p.mrr, p.commKB)
+	}
+	return nil
+}
+
+// one JSON line per query. In hybrid mode, the traces are the ones of the dense search.
+// The answers, the ground truth and the rounds are in the ids of the searched graph, the written ids are mapped back
+// to the original ones if the graph was relabeled
+func writeTraces(filename string, stats []graphann.SearchStats, answers [][]int, gnd [][]int, k int, relabeling *graphann.Relabeling) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	results := answers
+	if relabeling != nil {
+		results = relabeling.RestoreIds(answers)
+	}
+	traces := make([]graphann.QueryTrace, len(stats))
+	for i, s := range stats {
+		traces[i] = graphann.QueryTrace{
+			Query:          i,
+			Results:        results[i],
+			Recall:         -1,
+			StableRound:    s.StableRound,
+			ConvergedRound: s.ConvergedRound,
+			IssuedRounds:   s.IssuedRounds,
+			Rounds:         s.Trace,
+		}
+		if relabeling != nil {
+			traces[i].Rounds = restoreRoundIds(*relabeling, s.Trace)
+		}
+		if gnd != nil {
+			traces[i].Recall = graphann.ComputeRecall(gnd[i:i+1], answers[i:i+1], k)
+		}
+	}
+	return graphann.WriteQueryTraces(file, traces)
+}
+
+// a copy of the rounds with the expanded, fetched and failed ids mapped back to the original ids
+func restoreRoundIds(relabeling graphann.Relabeling, rounds []graphann.RoundTrace) []graphann.RoundTrace {
+	if rounds == nil {
+		return nil
+	}
+	restore := func(ids []int) []int {
+		if ids == nil {
+			return nil
+		}
+		return relabeling.RestoreIds([][]int{ids})[0]
+	}
+	ret := make([]graphann.RoundTrace, len(rounds))
+	for i, r := range rounds {
+		ret[i] = r
+		ret[i].Expanded = restore(r.Expanded)
+		ret[i].Fetched = restore(r.Fetched)
+		ret[i].Failed = restore(r.Failed)
+	}
+	return ret
+}
+
+// one line per query: stable round, converged round, issued rounds, dummy rounds
+func writeRoundStats(filename string, stats []graphann.SearchStats) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	start := time.Now()
-	frontend.Preprocess()
-	end := time.Now()
-	prepTime := end.Sub(start)
-	log.Println("Preprocessing time: ", prepTime)
+	fmt.Fprintf(file, "# query stable_round converged_round issued_rounds dummy_rounds\n")
+	for i, s := range stats {
+		fmt.Fprintf(file, "%d %d %d %d %d\n", i, s.StableRound, s.ConvergedRound, s.IssuedRounds, s.DummyRounds)
+	}
+	return nil
+}
 
-	windowSize := queryEngine.PIR.SupportBatchNum / (uint64(*stepN) * uint64(*parallelN))
-	//expectedMaintainenceTime := prepTime.Seconds() / float64(windowSize)
+// parse a comma-separated list of integers. An empty list is the single default value
+func parseIntList(s string, def int) ([]int, error) {
+	if s == "" {
+		return []int{def}, nil
+	}
+	values := make([]int, 0)
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid list %q: %w", s, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
 
-	// we now make queries
+// parse a comma-separated list of numbers
+func parseFloatList(s string) ([]float64, error) {
+	values := make([]float64, 0)
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid list %q: %w", s, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
 
-	start = time.Now()
-	answers := make([][]int, q)
+// the grid of a parameter sweep, every combination is run
+type sweepGrid struct {
+	ms        []int
+	steps     []int
+	parallels []int
+	batches   []int // PIR batch sizes, 0 = m
+	failProbs []int // log2 of the PIR failure probability
+}
 
-	maintainenceTime := time.Duration(0)
-	for i := 0; i < q; i++ {
-		if i%100 == 0 {
-			log.Printf("Processing query %d\n", i)
+// one configuration of a sweep and its costs per query
+type sweepResult struct {
+	M               int     `json:"m"`
+	Step            int     `json:"step"`
+	Parallel        int     `json:"parallel"`
+	BatchSize       int     `json:"batch_size"`
+	FailureProbLog2 int     `json:"failure_prob_log2"`
+	Recall          float32 `json:"recall"` // -1 without ground truth
+	MRR             float32 `json:"mrr"`
+	SuccessRate     float32 `json:"success_rate"` // fraction of the lookups that did not fail
+	ComputeTime     float64 `json:"compute_time_s"`
+	Latency         float64 `json:"latency_s"` // computation plus one RTT per issued round
+	OnlineCommKB    float64 `json:"online_comm_kb"`
+	OfflineCommKB   float64 `json:"offline_comm_kb"` // amortized
+	MaintenanceTime float64 `json:"maintenance_time_s"`
+	StorageMB       float64 `json:"storage_mb"`
+	PrepTime        float64 `json:"prep_time_s"`
+	Pareto          bool    `json:"pareto"` // no other configuration has a higher recall, a lower latency and less online communication
+}
+
+// run every configuration of the grid on the loaded queries.
+// The graph of each m is built (or loaded) once, and its PIR DB is reused across the batch sizes and failure
+// probabilities. The queries of each parallelism run once for the largest step, and the smaller steps are
+// derived from the top-k after every round. Their computation time is scaled by the number of rounds
+func runSweep(grid sweepGrid, template graphann.GraphANNFrontend, gnd [][]int, rtt int, graphFileName string,
+	labels [][]uint32, labelAttr int, buildOpts graphann.GraphBuildOptions, workingDir string, dataName string, benchmarking bool) []sweepResult {
+	maxStep := slices.Max(grid.steps)
+	results := make([]sweepResult, 0)
+
+	for _, degree := range grid.ms {
+		dataset := dataName + fmt.Sprintf("_%d_%d_%d", n, dim, degree)
+		graph, startIds, _ := loadOrBuildGraph(graphFileName, degree, labels, labelAttr, buildOpts, workingDir, dataset)
+		degree = len(graph[0])
+		attrNum := 0
+		if attrs != nil {
+			attrNum = len(attrs[0])
+		}
+		engine := PIRGraphInfo{
+			N:              n,
+			Dim:            dim,
+			M:              degree,
+			A:              attrNum,
+			graph:          graph,
+			vectors:        vectors,
+			attrs:          attrs,
+			startIds:       startIds,
+			skipPrep:       benchmarking,
+			NonPrivateMode: nonPrivateMode,
 		}
-		answers[i], _ = frontend.SearchKNN(queries[i], k, *stepN, *parallelN, *benchmarking)
 
-		if queryEngine.PIR.FinishedBatchNum+uint64(*stepN)*uint64(*parallelN)+10 >= queryEngine.PIR.SupportBatchNum {
-			// in this case we need to re-run the preprocessing
-			start := time.Now()
-			queryEngine.PIR.Preprocessing()
-			end := time.Now()
-			maintainenceTime += end.Sub(start)
+		for _, batch := range grid.batches {
+			if batch <= 0 {
+				batch = degree
+			}
+			if batch%2 != 0 || batch/2 > n {
+				log.Printf("Sweep: batch size %d has to be even and at most 2n. Skipped.", batch)
+				continue
+			}
+			for _, failProb := range grid.failProbs {
+				engine.BatchSize = batch
+				engine.FailureProbLog2 = failProb
+				frontend := template
+				frontend.Graph = &engine
+				frontend.TrackRounds = true
+
+				log.Printf("Sweep: m=%d, batch size=%d, failure probability=2^-%d\n", degree, batch, engine.failureProbLog2())
+				start := time.Now()
+				if err := frontend.PreprocessContext(context.Background()); err != nil {
+					log.Printf("Sweep: preprocessing failed: %v. Skipped.", err)
+					continue
+				}
+				prepTime := time.Since(start)
+
+				instance := engine.PIR
+				for _, parallel := range grid.parallels {
+					// every partition of the batch has to get the same number of ids in each round
+					if degree*parallel%(batch/2) != 0 || degree*parallel < batch {
+						log.Printf("Sweep: m*parallel = %d is not a multiple of the %d partitions of the batch size %d. Skipped.", degree*parallel, batch/2, batch)
+						continue
+					}
+					// a round can be a fraction of batches more, e.g. 1.5 batches of 64 for m=32 and parallel=3
+					batchesPerRound := float64(degree*parallel) / float64(batch)
+
+					engine.totalQueryNum, engine.succQueryNum = 0, 0
+					run := runQueries(&frontend, queries, queryOptions{
+						k:            k,
+						steps:        maxStep,
+						parallel:     parallel,
+						interleave:   1,
+						benchmarking: benchmarking,
+						refresh:      []pirRefresh{{pir: instance, batches: uint64(math.Ceil(float64(maxStep) * batchesPerRound))}},
+					})
+					stats := run.stats
+					avgTime := run.avgTime()
+					successRate := float32(1)
+					if engine.totalQueryNum > 0 {
+						successRate = float32(engine.succQueryNum) / float32(engine.totalQueryNum)
+					}
+
+					for _, step := range grid.steps {
+						batches := float64(step) * batchesPerRound
+						result := sweepResult{
+							M:               degree,
+							Step:            step,
+							Parallel:        parallel,
+							BatchSize:       batch,
+							FailureProbLog2: int(engine.failureProbLog2()),
+							Recall:          -1,
+							MRR:             -1,
+							SuccessRate:     successRate,
+							ComputeTime:     avgTime * float64(step) / float64(maxStep),
+							OnlineCommKB:    float64(instance.CommCostPerBatchOnline()) * batches / 1024.0,
+							OfflineCommKB:   float64(instance.CommCostPerBatchOffline()) * batches / 1024.0,
+							MaintenanceTime: instance.PreprocessingTime() / float64(instance.SupportBatchNum) * batches,
+							StorageMB:       instance.LocalStorageSize() / 1024.0 / 1024.0,
+							PrepTime:        prepTime.Seconds(),
+						}
+						result.Latency = result.ComputeTime + float64(rtt)/1000.0*issuedBefore(stats, step)
+						if gnd != nil {
+							answers := answersAfter(stats, step, k)
+							result.Recall = graphann.ComputeRecall(gnd, answers, k)
+							result.MRR = graphann.ComputeMRR(gnd, answers)
+						}
+						log.Printf("Sweep: m=%d step=%d parallel=%d batch=%d fail=2^-%d: recall %f, latency %fs, online comm %fKB\n",
+							degree, step, parallel, batch, result.FailureProbLog2, result.Recall, result.Latency, result.OnlineCommKB)
+						results = append(results, result)
+					}
+				}
+				// the next configuration sets up its own PIR on the same DB
+				engine.PIR = nil
+			}
 		}
 	}
-	end = time.Now()
-	searchTime := end.Sub(start) - maintainenceTime
-	avgTime := searchTime.Seconds() / float64(q)
-	avgMaintainenceTime := maintainenceTime.Seconds() / float64(q)
-	log.Println("Total Online time: ", searchTime)
-	log.Println("Average search time: ", avgTime, " seconds per query")
-	log.Println("Average maintainence time: ", avgMaintainenceTime, " seconds per query")
 
-	// some stats
-	log.Println("Total query number: ", queryEngine.totalQueryNum)
-	log.Println("Successful query number: ", queryEngine.succQueryNum)
-	log.Println("Success rate: ", float32(queryEngine.succQueryNum)/float32(queryEngine.totalQueryNum))
+	markPareto(results)
+	return results
+}
 
-	if *outputFile == "" {
-		// we use the default output file name
-		*outputFile = filepath.Join(workingDir, dataset+"_output.txt")
+// mark the configurations on the recall-latency-bandwidth Pareto frontier
+func markPareto(results []sweepResult) {
+	for i := range results {
+		a := &results[i]
+		a.Pareto = true
+		for _, b := range results {
+			noWorse := b.Recall >= a.Recall && b.Latency <= a.Latency && b.OnlineCommKB <= a.OnlineCommKB
+			better := b.Recall > a.Recall || b.Latency < a.Latency || b.OnlineCommKB < a.OnlineCommKB
+			if noWorse && better {
+				a.Pareto = false
+				break
+			}
+		}
 	}
+}
 
-	// write the answers to the output file
-	log.Println("Writing answers to the output file: ", *outputFile)
-
-	file, err := os.Create(*outputFile)
+func writeSweepCSV(filename string, results []sweepResult) error {
+	file, err := os.Create(filename)
 	if err != nil {
-		log.Printf("Error creating the output file: %v", err)
-	} else {
-		_ = graphann.SaveIntMatrixToFile(*outputFile, answers)
+		return err
 	}
-	file.Close()
+	defer file.Close()
 
-	// finally we evaluate the recall
-	recall := float32(-1.0) // if -1, it means we don't have ground truth
-	if *gndFile != "" {
-		log.Println("Evaluating recall...")
-		gnd, err := graphann.LoadIntMatrixFromFile(*gndFile, q, k)
-		if err != nil {
-			log.Fatalf("Error reading the ground truth file: %v", err)
-		}
-		recall = graphann.ComputeRecall(gnd, answers, k)
-		log.Println("Recall: ", recall)
+	fmt.Fprintf(file, "m,step,parallel,batch_size,failure_prob_log2,recall,mrr,success_rate,compute_time_s,latency_s,online_comm_kb,offline_comm_kb,maintenance_time_s,storage_mb,prep_time_s,pareto\n")
+	for _, r := range results {
+		fmt.Fprintf(file, "%d,%d,%d,%d,%d,%f,%f,%f,%f,%f,%f,%f,%f,%f,%f,%v\n",
+			r.M, r.Step, r.Parallel, r.BatchSize, r.FailureProbLog2, r.Recall, r.MRR, r.SuccessRate,
+			r.ComputeTime, r.Latency, r.OnlineCommKB, r.OfflineCommKB, r.MaintenanceTime, r.StorageMB, r.PrepTime, r.Pareto)
 	}
+	return nil
+}
 
-	// we finally write the report
-
-	if *reportFile == "" {
-		// use a default report file name
-		reportFileName := filepath.Join(workingDir, dataset+"_report.txt")
-		reportFile = &reportFileName
-		log.Printf("Using the default report file name: %s\n", *reportFile)
+func writeSweepJSON(filename string, results []sweepResult) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	if *reportFile != "" {
-
-		log.Printf("Writing the report to the file: %s\n", *reportFile)
-
-		file, err := os.OpenFile(*reportFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Printf("Error creating the report file: %v", err)
-			return
-		}
-
-		instance := queryEngine.PIR
-		config := instance.Config()
-		DBSize := config.DBSize * config.DBEntryByteNum // in bytes
-		PrepTime := instance.PreprocessingTime()
-		MainTimePerQ := PrepTime / float64(instance.SupportBatchNum) * float64(*stepN) * float64(*parallelN)
-		Storage := instance.LocalStorageSize()
-		OnlineComm := instance.CommCostPerBatchOnline()
-		OfflineComm := instance.CommCostPerBatchOffline()
-
-		fmt.Fprintf(file, "-------------------------\n")
-		fmt.Fprintf(file, "Private ANN Benchmarking w/ Go Frontend\n")
-		fmt.Fprintf(file, "Settings:\n")
-		fmt.Fprintf(file, "** Vector Num: %d\n", n)
-		fmt.Fprintf(file, "** DB Size (MB): %f\n", float64(DBSize)/1024.0/1024.0)
-		fmt.Fprintf(file, "** Top K: %d\n", k)
-		fmt.Fprintf(file, "** Rounds: %d\n", *stepN)
-		fmt.Fprintf(file, "** Parallel Exploration: %d\n", *parallelN)
-		fmt.Fprintf(file, "** RTT (ms): %d\n", *rtt)
-		fmt.Fprintf(file, "** Random Seed: %d\n", *randomSeed)
-		fmt.Fprintf(file, "** Window Size: %d\n", windowSize)
-		fmt.Fprintf(file, "\n")
-		fmt.Fprintf(file, "Preprocessing Cost:\n")
-		fmt.Fprintf(file, "** Storage (MB): %f\n", float64(Storage)/1024.0/1024.0)
-		fmt.Fprintf(file, "** Preparation Time (s): %f\n", PrepTime)
-		fmt.Fprintf(file, "** Offline Communication Cost Per Q (KB, amt.): %f\n", float64(OfflineComm)*float64(*stepN)*float64(*parallelN)/1024.0)
-		fmt.Fprintf(file, "** Amortized Maintainence Time Per Q (s): %f\n", MainTimePerQ)
-		fmt.Fprintf(file, "\n")
-		fmt.Fprintf(file, "Online Cost:\n")
-		fmt.Fprintf(file, "** Average Computation Time Per Query (s): %f\n", avgTime)
-		fmt.Fprintf(file, "** Average Total Time Per Q (s): %f\n", avgTime+float64(*rtt)/1000.0*float64(*stepN))
-		//fmt.Fprintf(file, "** Average Maintainence Time Per Q (s): %f\n", avgMaintainenceTime)
-		fmt.Fprintf(file, "** Online Communication Per Q (KB): %f\n", float64(OnlineComm)*float64(*stepN)*float64(*parallelN)/1024.0)
-		fmt.Fprintf(file, "\n")
-		fmt.Fprintf(file, "Quality:\n")
-		fmt.Fprintf(file, "** Recall: %f\n", recall)
-		fmt.Fprintf(file, "-----------------------\n")
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
 
+// write <prefix>.csv and <prefix>.json with all configurations, and <prefix>_pareto.csv with the frontier
+// sorted by latency
+func writeSweep(prefix string, results []sweepResult) error {
+	if err := writeSweepCSV(prefix+".csv", results); err != nil {
+		return err
+	}
+	if err := writeSweepJSON(prefix+".json", results); err != nil {
+		return err
+	}
+	frontier := make([]sweepResult, 0)
+	for _, r := range results {
+		if r.Pareto {
+			frontier = append(frontier, r)
+		}
 	}
+	sort.SliceStable(frontier, func(i, j int) bool { return frontier[i].Latency < frontier[j].Latency })
+	return writeSweepCSV(prefix+"_pareto.csv", frontier)
 }
 
 // define a basic graph info struct that implements the GetGraphInfo interface
@@ -337,8 +1977,24 @@ type PIRGraphInfo struct {
 	N       int
 	Dim     int
 	M       int
+	A       int // number of attributes per vertex, packed after the neighbors
+	LinkNum int // coarse level only: number of full-graph neighbors per vertex, packed after the attributes
 	graph   [][]int
 	vectors [][]float32
+	attrs   [][]uint32
+	links   [][]int
+
+	// the start vertices recorded with the graph, random ones if nil
+	startIds []int
+
+	// split mode: PIR only serves the vectors (and attributes), and AdjPIR the adjacency rows.
+	// Parallel rows are fetched per round
+	Split    bool
+	Parallel int
+
+	// the batch PIR parameters (0 = defaults: a batch of M entries, failure probability 2^-8)
+	BatchSize       int
+	FailureProbLog2 int
 
 	skipPrep       bool
 	NonPrivateMode bool
@@ -346,13 +2002,23 @@ type PIRGraphInfo struct {
 	DBTotalSize    uint64 // in bytes
 	rawDB          []uint64
 	PIR            *pianopir.SimpleBatchPianoPIR
+	AdjPIR         *pianopir.SimpleBatchPianoPIR
+	adjRawDB       []uint64
 
 	// some stats
 	totalQueryNum int
 	succQueryNum  int
 }
 
-func (g *PIRGraphInfo) Preprocess() {
+func (g *PIRGraphInfo) Preprocess() error {
+	if g.Split {
+		return g.preprocessSplit()
+	}
+	if g.rawDB != nil {
+		// the DB was already built, e.g. for another configuration of a sweep. Only the PIR is set up again
+		return g.setupPIR()
+	}
+
 	// now we set up the PIR
 
 	// first step, we need to convert the matrix and graph into a rawDB
@@ -360,7 +2026,10 @@ func (g *PIRGraphInfo) Preprocess() {
 	N := g.N
 	Dim := g.Dim
 	M := g.M
-	DBEntryByteNum := uint64(Dim*4 + M*4)
+	A := g.A
+	L := g.LinkNum
+	// the entry is padded to a multiple of 32 bytes, since the PIR xors 4 uint64 at a time
+	DBEntryByteNum := uint64((Dim*4 + M*4 + A*4 + L*4 + 31) / 32 * 32)
 
 	fmt.Println("DBEntryByteNum: ", DBEntryByteNum)
 	fmt.Println("DB Entry Number: ", N)
@@ -383,8 +2052,18 @@ func (g *PIRGraphInfo) Preprocess() {
 			binary.LittleEndian.PutUint32(neighborsBytes[j*4:], uint32(neighbors[j]))
 		}
 
-		// then we concatenate the two byte slices
+		// and the attributes and the links
+		attrsBytes := make([]byte, DBEntryByteNum-uint64(Dim*4+M*4))
+		for j := 0; j < A; j++ {
+			binary.LittleEndian.PutUint32(attrsBytes[j*4:], g.attrs[i][j])
+		}
+		for j := 0; j < L; j++ {
+			binary.LittleEndian.PutUint32(attrsBytes[(A+j)*4:], uint32(g.links[i][j]))
+		}
+
+		// then we concatenate the byte slices
 		entryBytes := append(vectorBytes, neighborsBytes...)
+		entryBytes = append(entryBytes, attrsBytes...)
 
 		// then we convert the byte slice to a uint64 slice
 		entry := make([]uint64, DBEntryByteNum/8)
@@ -402,13 +2081,36 @@ func (g *PIRGraphInfo) Preprocess() {
 	g.DBTotalSize = uint64(N) * DBEntryByteNum
 
 	// now we set up the PIR
-	g.PIR = pianopir.NewSimpleBatchPianoPIR(uint64(g.N), g.DBEntryByteNum, uint64(len(g.graph[0])), g.rawDB, 8)
+	return g.setupPIR()
+}
+
+func (g *PIRGraphInfo) batchSize() uint64 {
+	if g.BatchSize > 0 {
+		return uint64(g.BatchSize)
+	}
+	return uint64(len(g.graph[0]))
+}
+
+func (g *PIRGraphInfo) failureProbLog2() uint64 {
+	if g.FailureProbLog2 > 0 {
+		return uint64(g.FailureProbLog2)
+	}
+	return 8
+}
+
+func (g *PIRGraphInfo) setupPIR() error {
+	PIR, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(g.N), g.DBEntryByteNum, g.batchSize(), g.rawDB, g.failureProbLog2())
+	if err != nil {
+		return fmt.Errorf("graph PIR: %w", err)
+	}
+	g.PIR = PIR
 
 	if g.skipPrep {
 		g.PIR.DummyPreprocessing()
 	} else {
 		g.PIR.Preprocessing()
 	}
+	return nil
 }
 
 func (g *PIRGraphInfo) GetMetadata() (int, int, int) {
@@ -438,8 +2140,39 @@ func Entry2VectorAndNeighbors(dim int, m int, entry []uint64) ([]float32, []int)
 	return vector, neighbors
 }
 
+// the l links are stored right after the attributes
+func Entry2Links(dim int, m int, a int, l int, entry []uint64) []int {
+	if l == 0 {
+		return nil
+	}
+	links := make([]int, l)
+	for i := 0; i < l; i++ {
+		word := entry[(dim+m+a+i)/2]
+		links[i] = int(uint32(word >> (32 * uint((dim+m+a+i)%2))))
+	}
+	return links
+}
+
+// the a attributes are stored right after the neighbors
+func Entry2Attrs(dim int, m int, a int, entry []uint64) []uint32 {
+	if a == 0 {
+		return nil
+	}
+	attrs := make([]uint32, a)
+	for i := 0; i < a; i++ {
+		word := entry[(dim+m+i)/2]
+		attrs[i] = uint32(word >> (32 * uint((dim+m+i)%2)))
+	}
+	return attrs
+}
+
 func (g *PIRGraphInfo) GetVertexInfo(vertexIds []int) ([]graphann.Vertex, error) {
 
+	if g.Split && !g.NonPrivateMode {
+		// fetch both halves of every entry, e.g. for beam search
+		return g.getVertexInfoSplit(vertexIds)
+	}
+
 	g.totalQueryNum += len(vertexIds)
 
 	if g.NonPrivateMode {
@@ -450,6 +2183,12 @@ func (g *PIRGraphInfo) GetVertexInfo(vertexIds []int) ([]graphann.Vertex, error)
 				Vector:    g.vectors[vertexIds[i]],
 				Neighbors: g.graph[vertexIds[i]],
 			}
+			if g.attrs != nil {
+				vertices[i].Attrs = g.attrs[vertexIds[i]]
+			}
+			if g.links != nil {
+				vertices[i].Links = g.links[vertexIds[i]]
+			}
 		}
 		return vertices, nil
 	}
@@ -462,7 +2201,7 @@ func (g *PIRGraphInfo) GetVertexInfo(vertexIds []int) ([]graphann.Vertex, error)
 
 	responses, err := g.PIR.Query(indices)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("graph PIR: %w", err)
 	}
 
 	/*
@@ -484,6 +2223,8 @@ func (g *PIRGraphInfo) GetVertexInfo(vertexIds []int) ([]graphann.Vertex, error)
 			Id:        vertexIds[i],
 			Vector:    vector,
 			Neighbors: neighbors,
+			Attrs:     Entry2Attrs(g.Dim, g.M, g.A, response),
+			Links:     Entry2Links(g.Dim, g.M, g.A, g.LinkNum, response),
 		}
 
 		// if the neighbors are not the same as the ground truth, we will record it as a failed query
@@ -511,10 +2252,16 @@ func (g *PIRGraphInfo) GetStartVertex() ([]graphann.Vertex, error) {
 	added := make(map[int]bool)
 	// we randomly select sqrt(n) vertices as the starting vertices
 	targetNum := int(math.Sqrt(float64(n)))
+	if g.startIds != nil {
+		targetNum = len(g.startIds)
+	}
 	batch := make([]int, targetNum)
 	ret := make([]graphann.Vertex, targetNum)
 	for i := 0; i < targetNum; i++ {
 		x := rand.Intn(n)
+		if g.startIds != nil {
+			x = g.startIds[i]
+		}
 		for added[x] {
 			x = rand.Intn(n)
 		}
@@ -525,7 +2272,355 @@ func (g *PIRGraphInfo) GetStartVertex() ([]graphann.Vertex, error) {
 			Vector:    g.vectors[x],
 			Neighbors: g.graph[x],
 		}
+		if g.attrs != nil {
+			ret[i].Attrs = g.attrs[x]
+		}
+		if g.links != nil {
+			ret[i].Links = g.links[x]
+		}
+	}
+
+	return ret, nil
+}
+
+// the PIR transport of the sparse component: one PIR entry per term bucket
+
+type PIRPostingInfo struct {
+	index     *graphann.InvertedIndex
+	batchSize uint64 // the number of blocks fetched per query
+
+	skipPrep       bool
+	NonPrivateMode bool
+	DBEntryByteNum uint64 // per entry bytes
+	rawDB          []uint64
+	PIR            *pianopir.SimpleBatchPianoPIR
+}
+
+func (p *PIRPostingInfo) Preprocess() error {
+	// each posting is stored as (id, term fingerprint, score), 3 * 4 bytes.
+	// Empty slots are left as zeros, which is also what a failed PIR query returns.
+	BucketNum := p.index.BucketNum
+	BlockSize := p.index.BlockSize
+	DBEntryByteNum := uint64((BlockSize*12 + 31) / 32 * 32)
+
+	fmt.Println("Sparse DBEntryByteNum: ", DBEntryByteNum)
+	fmt.Println("Sparse DB Entry Number: ", BucketNum)
+
+	rawDB := make([]uint64, BucketNum*int(DBEntryByteNum)/8)
+	entryBytes := make([]byte, DBEntryByteNum)
+	for i := 0; i < BucketNum; i++ {
+		for j := range entryBytes {
+			entryBytes[j] = 0
+		}
+		for j, posting := range p.index.Blocks[i] {
+			binary.LittleEndian.PutUint32(entryBytes[j*12:], uint32(posting.Id))
+			binary.LittleEndian.PutUint32(entryBytes[j*12+4:], posting.Term)
+			binary.LittleEndian.PutUint32(entryBytes[j*12+8:], math.Float32bits(posting.Score))
+		}
+		for j := uint64(0); j < DBEntryByteNum/8; j++ {
+			rawDB[uint64(i)*DBEntryByteNum/8+j] = binary.LittleEndian.Uint64(entryBytes[j*8:])
+		}
+	}
+
+	p.rawDB = rawDB
+	p.DBEntryByteNum = DBEntryByteNum
+	PIR, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(BucketNum), DBEntryByteNum, p.batchSize, p.rawDB, 8)
+	if err != nil {
+		return fmt.Errorf("sparse PIR: %w", err)
+	}
+	p.PIR = PIR
+
+	if p.skipPrep {
+		p.PIR.DummyPreprocessing()
+	} else {
+		p.PIR.Preprocessing()
+	}
+	return nil
+}
+
+func (p *PIRPostingInfo) GetMetadata() (int, int) {
+	return p.index.BucketNum, p.index.BlockSize
+}
+
+func Entry2Postings(blockSize int, entry []uint64) []graphann.Posting {
+	entryBytes := make([]byte, len(entry)*8)
+	for i := 0; i < len(entry); i++ {
+		binary.LittleEndian.PutUint64(entryBytes[i*8:], entry[i])
+	}
+
+	postings := make([]graphann.Posting, blockSize)
+	for i := 0; i < blockSize; i++ {
+		postings[i] = graphann.Posting{
+			Id:    int(binary.LittleEndian.Uint32(entryBytes[i*12:])),
+			Term:  binary.LittleEndian.Uint32(entryBytes[i*12+4:]),
+			Score: math.Float32frombits(binary.LittleEndian.Uint32(entryBytes[i*12+8:])),
+		}
+	}
+	return postings
+}
+
+func (p *PIRPostingInfo) GetPostingBlocks(buckets []int) ([][]graphann.Posting, error) {
+	if p.NonPrivateMode {
+		blocks := make([][]graphann.Posting, len(buckets))
+		for i, b := range buckets {
+			blocks[i] = p.index.Blocks[b]
+		}
+		return blocks, nil
+	}
+
+	indices := make([]uint64, len(buckets))
+	for i := 0; i < len(buckets); i++ {
+		indices[i] = uint64(buckets[i])
+	}
+
+	responses, err := p.PIR.Query(indices)
+	if err != nil {
+		return nil, fmt.Errorf("sparse PIR: %w", err)
+	}
+
+	blocks := make([][]graphann.Posting, len(buckets))
+	for i, response := range responses {
+		blocks[i] = Entry2Postings(p.index.BlockSize, response)
+	}
+	return blocks, nil
+}
+
+// the PIR transport of the document payloads: one PIR entry per chunk
+
+type PIRPayloadChunks struct {
+	chunkSize int
+	chunks    [][]byte
+	batchSize uint64 // the number of chunks fetched per query
+
+	skipPrep       bool
+	NonPrivateMode bool
+	rawDB          []uint64
+	PIR            *pianopir.SimpleBatchPianoPIR
+}
+
+func (p *PIRPayloadChunks) Preprocess() error {
+	N := len(p.chunks)
+	DBEntryByteNum := uint64(p.chunkSize)
+
+	fmt.Println("Payload DBEntryByteNum: ", DBEntryByteNum)
+	fmt.Println("Payload DB Entry Number: ", N)
+
+	rawDB := make([]uint64, N*int(DBEntryByteNum)/8)
+	for i := 0; i < N; i++ {
+		for j := uint64(0); j < DBEntryByteNum/8; j++ {
+			rawDB[uint64(i)*DBEntryByteNum/8+j] = binary.LittleEndian.Uint64(p.chunks[i][j*8:])
+		}
+	}
+
+	p.rawDB = rawDB
+	PIR, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(N), DBEntryByteNum, p.batchSize, p.rawDB, 8)
+	if err != nil {
+		return fmt.Errorf("payload PIR: %w", err)
+	}
+	p.PIR = PIR
+
+	if p.skipPrep {
+		p.PIR.DummyPreprocessing()
+	} else {
+		p.PIR.Preprocessing()
+	}
+	return nil
+}
+
+func (p *PIRPayloadChunks) GetChunks(ids []int) ([][]byte, error) {
+	if p.NonPrivateMode {
+		ret := make([][]byte, len(ids))
+		for i, id := range ids {
+			if id < 0 {
+				ret[i] = make([]byte, p.chunkSize)
+				continue
+			}
+			ret[i] = p.chunks[id]
+		}
+		return ret, nil
+	}
+
+	// the batch size is rounded up to an even number, so we may need one more dummy index
+	indices := make([]uint64, p.batchSize)
+	for i := 0; i < len(indices); i++ {
+		indices[i] = pianopir.DummyIndex
+		if i < len(ids) && ids[i] >= 0 {
+			indices[i] = uint64(ids[i])
+		}
+	}
+
+	responses, err := p.PIR.Query(indices)
+	if err != nil {
+		return nil, fmt.Errorf("payload PIR: %w", err)
 	}
 
+	ret := make([][]byte, len(ids))
+	for i := range ids {
+		ret[i] = make([]byte, p.chunkSize)
+		for j, word := range responses[i] {
+			binary.LittleEndian.PutUint64(ret[i][j*8:], word)
+		}
+	}
 	return ret, nil
 }
+
+// split mode: the vector DB stores the vector, the attributes and id+1 (to detect failed lookups),
+// and the adjacency DB stores the neighbors
+
+func (g *PIRGraphInfo) preprocessSplit() error {
+	N := g.N
+	Dim := g.Dim
+	M := g.M
+	A := g.A
+
+	vectorEntryByteNum := uint64((Dim*4 + A*4 + 4 + 31) / 32 * 32)
+	adjEntryByteNum := uint64((M*4 + 31) / 32 * 32)
+	fmt.Println("Vector DBEntryByteNum: ", vectorEntryByteNum)
+	fmt.Println("Adjacency DBEntryByteNum: ", adjEntryByteNum)
+
+	rawDB := make([]uint64, N*int(vectorEntryByteNum)/8)
+	adjRawDB := make([]uint64, N*int(adjEntryByteNum)/8)
+	for i := 0; i < N; i++ {
+		entryBytes := make([]byte, vectorEntryByteNum)
+		for j := 0; j < Dim; j++ {
+			binary.LittleEndian.PutUint32(entryBytes[j*4:], math.Float32bits(g.vectors[i][j]))
+		}
+		for j := 0; j < A; j++ {
+			binary.LittleEndian.PutUint32(entryBytes[(Dim+j)*4:], g.attrs[i][j])
+		}
+		binary.LittleEndian.PutUint32(entryBytes[(Dim+A)*4:], uint32(i+1))
+		for j := uint64(0); j < vectorEntryByteNum/8; j++ {
+			rawDB[uint64(i)*vectorEntryByteNum/8+j] = binary.LittleEndian.Uint64(entryBytes[j*8:])
+		}
+
+		adjBytes := make([]byte, adjEntryByteNum)
+		for j := 0; j < M; j++ {
+			binary.LittleEndian.PutUint32(adjBytes[j*4:], uint32(g.graph[i][j]))
+		}
+		for j := uint64(0); j < adjEntryByteNum/8; j++ {
+			adjRawDB[uint64(i)*adjEntryByteNum/8+j] = binary.LittleEndian.Uint64(adjBytes[j*8:])
+		}
+	}
+
+	g.rawDB = rawDB
+	g.adjRawDB = adjRawDB
+	g.DBEntryByteNum = vectorEntryByteNum
+	g.DBTotalSize = uint64(N) * (vectorEntryByteNum + adjEntryByteNum)
+
+	// the batch PIR serves two queries per partition, so the row batch is rounded up to an even number
+	adjBatchSize := uint64((g.Parallel + 1) / 2 * 2)
+	PIR, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(N), vectorEntryByteNum, uint64(M), g.rawDB, 8)
+	if err != nil {
+		return fmt.Errorf("vector PIR: %w", err)
+	}
+	AdjPIR, err := pianopir.NewSimpleBatchPianoPIRChecked(uint64(N), adjEntryByteNum, adjBatchSize, g.adjRawDB, 8)
+	if err != nil {
+		return fmt.Errorf("adjacency PIR: %w", err)
+	}
+	g.PIR, g.AdjPIR = PIR, AdjPIR
+
+	if g.skipPrep {
+		g.PIR.DummyPreprocessing()
+		g.AdjPIR.DummyPreprocessing()
+	} else {
+		g.PIR.Preprocessing()
+		g.AdjPIR.Preprocessing()
+	}
+	return nil
+}
+
+func (g *PIRGraphInfo) GetVectors(vertexIds []int) ([]graphann.Vertex, error) {
+	g.totalQueryNum += len(vertexIds)
+
+	vertices := make([]graphann.Vertex, len(vertexIds))
+	if g.NonPrivateMode {
+		for i, id := range vertexIds {
+			vertices[i] = graphann.Vertex{Id: id, Vector: g.vectors[id]}
+			if g.attrs != nil {
+				vertices[i].Attrs = g.attrs[id]
+			}
+		}
+		g.succQueryNum += len(vertexIds)
+		return vertices, nil
+	}
+
+	indices := make([]uint64, len(vertexIds))
+	for i := 0; i < len(vertexIds); i++ {
+		indices[i] = uint64(vertexIds[i])
+	}
+	responses, err := g.PIR.Query(indices)
+	if err != nil {
+		return nil, fmt.Errorf("vector PIR: %w", err)
+	}
+
+	for i, response := range responses {
+		vertices[i] = graphann.Vertex{Id: vertexIds[i]}
+		// the id is stored right after the attributes, a failed lookup returns zeroes
+		word := response[(g.Dim+g.A)/2]
+		if uint32(word>>(32*uint((g.Dim+g.A)%2))) != uint32(vertexIds[i]+1) {
+			continue
+		}
+		vertices[i].Vector, _ = Entry2VectorAndNeighbors(g.Dim, 0, response)
+		vertices[i].Attrs = Entry2Attrs(g.Dim, 0, g.A, response)
+		g.succQueryNum++
+	}
+	return vertices, nil
+}
+
+func (g *PIRGraphInfo) GetNeighbors(vertexIds []int) ([][]int, error) {
+	rows := make([][]int, len(vertexIds))
+	if g.NonPrivateMode {
+		for i, id := range vertexIds {
+			rows[i] = g.graph[id]
+		}
+		return rows, nil
+	}
+
+	// pad to whole batches with random rows
+	batchSize := int(g.AdjPIR.Config().BatchSize)
+	indices := make([]uint64, (len(vertexIds)+batchSize-1)/batchSize*batchSize)
+	for i := range indices {
+		if i < len(vertexIds) {
+			indices[i] = uint64(vertexIds[i])
+		} else {
+			indices[i] = uint64(rand.Intn(g.N))
+		}
+	}
+	responses, err := g.AdjPIR.Query(indices)
+	if err != nil {
+		return nil, fmt.Errorf("adjacency PIR: %w", err)
+	}
+
+	for i := range vertexIds {
+		_, neighbors := Entry2VectorAndNeighbors(0, g.M, responses[i])
+		// if the neighbor list is all zeroes, the lookup failed
+		for _, v := range neighbors {
+			if v != 0 {
+				rows[i] = neighbors
+				break
+			}
+		}
+	}
+	return rows, nil
+}
+
+// a failed half makes the whole vertex look failed (all zero neighbors), as in the joint DB
+func (g *PIRGraphInfo) getVertexInfoSplit(vertexIds []int) ([]graphann.Vertex, error) {
+	vertices, err := g.GetVectors(vertexIds)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := g.GetNeighbors(vertexIds)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vertices {
+		if vertices[i].Vector == nil || rows[i] == nil {
+			vertices[i].Vector = make([]float32, g.Dim)
+			vertices[i].Neighbors = make([]int, g.M)
+			continue
+		}
+		vertices[i].Neighbors = rows[i]
+	}
+	return vertices, nil
+}
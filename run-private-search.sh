@@ -1,16 +1,69 @@
-# -n 1000000: The number of data points in the dataset.
-# -d 128: The dimensionality of the data points.
+# -n 1000000: The number of data points in the dataset. Optional, all rows of the input file are loaded by default.
+# -d 128: The dimensionality of the data points. Optional, the dimension is read from the input file by default.
 # -m 32: The number of clusters in the hierarchical k-means tree.
 # -k 10: The number of nearest neighbors to search for.
 # -q 1000: The number of queries to run.
 # -input ./SIFT-dataset/bigann_base.bvecs: The path to the dataset file.
+#   Supported: .bvecs, .fvecs, .npy, .txt and the big-ann-benchmarks .fbin/.u8bin/.i8bin (only the first -n rows are read).
+#   .npy arrays of any float or integer dtype, in C or Fortran order, and the arrays of an .npz archive (archive.npz:name) work too.
+#   With -mmap, the file is memory-mapped instead. This only saves memory for float32 files (.fvecs, .fbin, float32 .npy), which are
+#   used in place: the other types are still converted into a full float32 matrix, since the PIR DB and the graph are built from it.
 # -query ./SIFT-dataset/bigann_query.bvecs: The path to the query file.
 # -output ./private-search-result.txt: The path to the output file where the search results will be saved.
 # -report ./private-search-report.txt: The path to the report file where the search performance metrics will be saved.
+#   The same metrics are written as JSON to ./private-search-report.json (or -jsonreport), one run per file.
+#   Compare two runs with: cd graphann/cmd/reportdiff && go run . -base old.json -new new.json
 # -gnd ./SIFT-dataset/gnd/idx_1M.ivecs: The path to the ground truth file. Change "1M" to other values if needed.
+#   A big-ann-benchmarks .ibin ground truth works too, a range search one only if every query has at least k results.
+#   An .ibin ground truth of big-ann-benchmarks works too. Missing ground truth can be computed with graphann/cmd/groundtruth.
+# -graph ./SIFT-dataset/sift.graph (optional): The graph file, <input>_<n>_<d>_<m>_graph.npy by default (built if missing).
+#   A .graph file also records how the graph was built (seed: PACMANN_GRAPH_SEED), a checksum of the vectors and the start vertices,
+#   and is refused for another input file or -n.
+#   Check the connectivity of a graph with: cd graphann/cmd/graphdiag && go run . -graph graph.npy -input base.fvecs (exit status 1 if disconnected)
+# -minindegree 4 (optional): When the graph is built, repair every vertex to at least 4 in-edges from its nearest vertices,
+#   in place of random fill edges, so fewer vertices are hard to reach. The default graph name gets an _in4 suffix.
+# -longrange 0.25 (optional): When the graph is built, reserve a quarter of every row for long-range edges (to cluster hubs and
+#   small-world samples) so the traversal needs fewer rounds. With a list such as 0,0.125,0.25, the graph is built with each fraction
+#   and the one with the fewest average steps is kept. Small datasets, where the start vertices already cover the space, often keep 0.
+#   The default graph name gets an _lr0.25 suffix, or _lrtune0-0.125-0.25 for a list.
+# -relabel ./SIFT-dataset/sift_perm.npy (optional): Renumber the vertices so the neighbors of a vertex spread over the batch PIR partitions,
+#   which drops fewer neighbors (see the success rate). The permutation (new id -> original id) is computed and saved if the file is missing.
+#   The answers are written with the original ids.
 # -step 20: The maximum steps in the private graph traverse algorithm.
 # -parallel 3: The number of parallel vertices to be explored in one step.
+# -L 100 (optional): Use beam search with a candidate list of 100 vertices instead of the unbounded search.
+# -split (optional): Serve the vectors and the adjacency rows from two PIR DBs. Only the rows of the expanded vertices are fetched,
+#   which cuts the bandwidth per round, but a hop takes two rounds, so double -step.
+# -specdepth 2 -specwidth 8 (optional): Each round also prefetches 8 neighbors of the candidates of the next 2 rounds,
+#   trading bandwidth for fewer rounds. The report shows the estimated rounds saved.
+# -coarse 10000 -coarsestep 4 (optional): Hierarchical search. The first 4 of the -step rounds navigate a coarse graph over
+#   10000 sampled vertices, served by its own small PIR DB. See also -coarsem.
+# -interleave 10 (optional): Advance 10 queries in lockstep. Their lookups share one PIR call per round,
+#   so a group of 10 queries takes -step rounds in total.
+# -radius 0.5 (optional): Range search. Only return the results within squared L2 distance 0.5, at most k.
+# -curve ./curve.txt (optional, needs -gnd): Record the top-k after every round and write recall@k, MRR and
+#   the online communication for every step from 1 to -step, so one run gives the whole curve.
+# -trace ./trace.jsonl (optional): Record every round of every query (expanded vertices, fetched ids, failed lookups,
+#   best distance so far) as JSON lines. Summarize them with graphann/cmd/tracesum -input ./trace.jsonl.
+# -timeout 500ms (optional): Deadline of each search. A search stops at the next round boundary and keeps
+#   the results found so far. The report counts the timed out queries.
+# -a 1 -attrs ./attrs.txt -filter "0=3" (optional): Only return vectors whose attribute column 0 equals 3.
+#   The attributes are packed into the PIR entries, the filter itself is never sent to the server.
+# -labelattr 0 (optional): Build the graph with label-aware (Filtered-Vamana style) pruning on attribute column 0.
+# -terms ./doc-terms.txt -queryterms ./query-terms.txt (optional): Hybrid search. A keyword index over the document terms is
+#   served by a second PIR DB, and its results are merged with the graph search by reciprocal-rank fusion.
+#   See also -buckets, -blocksize, -qterms and -rrf.
+# -payloads ./collection.txt (optional): Privately fetch the text of the top-k documents (one line per document) in one more round.
+#   Payloads are cut into -chunksize 256 byte chunks, and every document costs -chunksperdoc 8 lookups, hiding its length.
+#   See also -payloadoutput.
 # -rtt 50: The round-trip time (RTT) in milliseconds between the client and the server.
+# -earlystop (optional): Stop the traversal once the frontier has converged. Fixed-shape dummy rounds are still issued.
+# -patience 3 (optional): Also treat a query as converged after 3 rounds without top-k change.
+# -roundstats ./private-search-rounds.txt (optional): Per-query round at which the top-k stabilized, useful to tune -step.
+# -sweep ./sweep (optional): Run every combination of -sweepm 16,32, -sweepstep 10,20, -sweepparallel 1,2,
+#   -sweepbatch 32,64 (PIR batch size) and -sweepfail 8,12 (PIR failure probability 2^-x) instead of one search,
+#   and write ./sweep.csv, ./sweep.json and the recall/latency/bandwidth Pareto frontier to ./sweep_pareto.csv.
+#   Each graph and PIR DB is built once, and each parallelism runs once for the largest step.
 
 
 go run private-search.go -n 1000000 -d 128 -m 32 -k 10 -q 100 -input ./SIFT-dataset/bigann_base.bvecs -query ./SIFT-dataset/bigann_query.bvecs \